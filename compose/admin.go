@@ -22,8 +22,12 @@ import (
 
 // AdminHandler is the main handler for all other admin URLs. Because the admin
 // pages use Angular routing, just return the index page and let the JS side
-// determine what content to show.
+// determine what content to show. The CSRF cookie is sent again in case it
+// went missing.
 func AdminHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+    if session, err := RequestSession(r); err == nil {
+        SetCsrfCookie(w, r, session)
+    }
     err := AdminTemplates.ExecuteTemplate(w, "index.html", nil)
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -41,16 +41,37 @@ func DecodeJsonPayload(r *http.Request, obj interface{}) (error) {
     return err
 }
 
-// ApiListPosts is a handler to list posts.
+// ApiListPosts is a handler to list posts. If the tag query parameter is set,
+// only posts with that tag are listed.
 func ApiListPosts(c web.C, w http.ResponseWriter, r *http.Request) {
-    posts, err := ListPostHeaders(0, 0, true)
+    var posts []PostHeader
+    var err error
+    if tag := r.URL.Query().Get("tag"); tag != "" {
+        posts, err = ListPostHeadersByTag(tag, 0, 0, true)
+    } else {
+        posts, err = ListPostHeaders(0, 0, true)
+    }
     if err != nil {
         panic(err)
     }
+    for i := range posts {
+        posts[i].Status = posts[i].CurrentStatus()
+    }
 
     WriteJson(w, posts)
 }
 
+// ApiListTags is a handler to list every tag with the number of posts, drafts
+// included, that have it.
+func ApiListTags(c web.C, w http.ResponseWriter, r *http.Request) {
+    tags, err := CountTags(true)
+    if err != nil {
+        panic(err)
+    }
+
+    WriteJson(w, tags)
+}
+
 // ApiGetPost is a handler to get a post given an id.
 func ApiGetPost(c web.C, w http.ResponseWriter, r *http.Request) {
     post, err := FindPostById(bson.ObjectIdHex(c.URLParams["id"]))
@@ -58,6 +79,7 @@ func ApiGetPost(c web.C, w http.ResponseWriter, r *http.Request) {
         http.NotFound(w, r)
         return
     }
+    post.Status = post.CurrentStatus()
     WriteJson(w, post)
 }
 
@@ -69,7 +91,13 @@ func ApiCreatePost(c web.C, w http.ResponseWriter, r *http.Request) {
     }
 
     post.Title = "New Post"
-    post.Save()
+    post.Slug, err = UniqueSlug(NormalizeSlug(post.Title), post.Id, false)
+    if err != nil {
+        panic(err)
+    }
+    user, _ := RequestUser(r)
+    post.SaveBy(user)
+    post.Status = post.CurrentStatus()
 
     WriteJson(w, post)
 }
@@ -84,7 +112,9 @@ func ApiDeletePost(c web.C, w http.ResponseWriter, r *http.Request) {
     post.Delete()
 }
 
-// ApiUpdatePost is a handler to update an existing post.
+// ApiUpdatePost is a handler to update an existing post. The slug is
+// normalized, or made from the title if there isn't one, and the saved post is
+// sent back. A SlugError is sent if the slug can't be used.
 func ApiUpdatePost(c web.C, w http.ResponseWriter, r *http.Request) {
     post, err := FindPostById(bson.ObjectIdHex((c.URLParams["id"])))
     if err != nil {
@@ -92,15 +122,44 @@ func ApiUpdatePost(c web.C, w http.ResponseWriter, r *http.Request) {
         return
     }
 
+    // The post in the URL is the one updated, whatever id the payload has. A
+    // post can't be turned into a page, or the other way around.
+    id, kind := post.Id, post.Kind
     post = &Post{}
     err = DecodeJsonPayload(r, post)
     if err != nil {
         panic(err)
     }
-    post, err = post.Save()
+    post.Id = id
+    post.Kind = kind
+    post.Tags = NormalizeTags(post.Tags)
+    post.Slug = normalizeSlugFor(post.Slug, post.IsPage())
+    if post.Slug == "" {
+        post.Slug, err = UniqueSlug(NormalizeSlug(post.Title), post.Id, post.IsPage())
+        if err != nil {
+            panic(err)
+        }
+    }
+    err = CheckSlug(post.Slug, post.Id, post.IsPage())
+    if slugErr, ok := err.(*SlugError); ok {
+        WriteSlugError(w, slugErr)
+        return
+    }
     if err != nil {
         panic(err)
     }
+
+    user, _ := RequestUser(r)
+    post, err = post.SaveBy(user)
+    if err == ErrDuplicate {
+        WriteSlugError(w, slugTakenError(post.Slug))
+        return
+    }
+    if err != nil {
+        panic(err)
+    }
+    post.Status = post.CurrentStatus()
+    WriteJson(w, post)
 }
 
 // ApiGetFileInfo is a handler to get info for a single file, given a file id.
@@ -149,28 +208,40 @@ func ApiDeleteFile(c web.C, w http.ResponseWriter, r *http.Request) {
     file.DeleteFile()
 }
 
-// ApiUpdateSettings is a handler to update the settings.
+// ApiUpdateSettings is a handler to update the settings. Changing the e-mail
+// address or password needs the current password, so a stolen session can't
+// take over the account.
 func ApiUpdateSettings(c web.C, w http.ResponseWriter, r *http.Request) {
     updates := &struct{
-        Email    string `json:"email"`
-        Password string `json:"password"`
+        Email           string `json:"email"`
+        Password        string `json:"password"`
+        CurrentPassword string `json:"current_password"`
     }{}
 
-    // Get session
-    cookie, err := r.Cookie(CookieName)
-    session, err := FindSessionByToken(cookie.Value)
-
     // Get User
-    user, err := FindUserById(session.User)
+    user, err := RequestUser(r)
+    if err != nil {
+        panic(err)
+    }
 
     err = DecodeJsonPayload(r, updates)
     if err != nil {
         panic(err)
     }
 
+    if (updates.Email != "" && updates.Email != user.Email) || updates.Password != "" {
+        if !checkRequestPassword(w, r, user, updates.CurrentPassword) {
+            return
+        }
+    }
+
     if updates.Email != "" {
         user.Email = updates.Email
-        user.Save()
+        _, err = user.Save()
+        if err == ErrDuplicate {
+            http.Error(w, "Another user already uses that e-mail address", http.StatusConflict)
+            return
+        }
     }
 
     if updates.Password != "" {
@@ -182,20 +253,20 @@ func ApiUpdateSettings(c web.C, w http.ResponseWriter, r *http.Request) {
 // ApiGetSettings is a handler to get the current settings.
 func ApiGetSettings(c web.C, w http.ResponseWriter, r *http.Request) {
     settings := &struct{
-        Email    string `json:"email"`
+        Email             string `json:"email"`
+        TotpEnabled       bool   `json:"totp_enabled"`
+        RecoveryCodesLeft int    `json:"recovery_codes_left"`
     }{}
 
-    // Get session
-    cookie, err := r.Cookie(CookieName)
-    session, err := FindSessionByToken(cookie.Value)
-
     // Get User
-    user, err := FindUserById(session.User)
+    user, err := RequestUser(r)
     if err != nil {
         panic(err)
     }
 
     settings.Email = user.Email
+    settings.TotpEnabled = user.TotpEnabled
+    settings.RecoveryCodesLeft = len(user.RecoveryCodes)
 
     WriteJson(w, settings)
 }
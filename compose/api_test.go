@@ -0,0 +1,185 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestApiCreateGetUpdateDeletePost(t *testing.T) {
+    m := setupTestServer(t)
+    cookie := loginTestUser(t)
+
+    // Create
+    w := doRequest(m, "POST", "/api/posts", nil, cookie)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Create: expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    created := &Post{}
+    err := json.Unmarshal(w.Body.Bytes(), created)
+    if err != nil {
+        t.Fatal("Create: bad response:", err)
+    }
+    if created.Title != "New Post" || !created.Draft {
+        t.Errorf("Create: unexpected post %+v", created)
+    }
+
+    // Get
+    w = doRequest(m, "GET", "/api/post/" + created.Id.Hex(), nil, cookie)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Get: expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    fetched := &Post{}
+    json.Unmarshal(w.Body.Bytes(), fetched)
+    if fetched.Id != created.Id {
+        t.Errorf("Get: expected id %s, got %s", created.Id.Hex(), fetched.Id.Hex())
+    }
+
+    // Update
+    fetched.Title = "Updated"
+    fetched.Slug = "updated"
+    fetched.Body = "Some *markdown*"
+    fetched.Draft = false
+    payload, _ := json.Marshal(fetched)
+    w = doRequest(m, "PUT", "/api/post/" + created.Id.Hex(), bytes.NewReader(payload), cookie)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Update: expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    post, err := FindPostById(created.Id)
+    if err != nil {
+        t.Fatal("Update: post is gone:", err)
+    }
+    if post.Title != "Updated" || post.Slug != "updated" || post.Draft {
+        t.Errorf("Update: unexpected post %+v", post)
+    }
+
+    // The post is now public
+    w = doRequest(m, "GET", "/updated", nil, nil)
+    if w.Code != http.StatusOK {
+        t.Errorf("View: expected status %d, got %d", http.StatusOK, w.Code)
+    }
+
+    // Delete
+    w = doRequest(m, "DELETE", "/api/post/" + created.Id.Hex(), nil, cookie)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Delete: expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    if _, err := FindPostById(created.Id); err != ErrNotFound {
+        t.Errorf("Delete: expected ErrNotFound, got %v", err)
+    }
+    w = doRequest(m, "GET", "/api/post/" + created.Id.Hex(), nil, cookie)
+    if w.Code != http.StatusNotFound {
+        t.Errorf("Get after delete: expected status %d, got %d", http.StatusNotFound, w.Code)
+    }
+}
+
+func TestApiUpdateMissingPost(t *testing.T) {
+    m := setupTestServer(t)
+    cookie := loginTestUser(t)
+    post, _ := CreatePost()
+    payload, _ := json.Marshal(post)
+    w := doRequest(m, "PUT", "/api/post/" + post.Id.Hex(), bytes.NewReader(payload), cookie)
+    if w.Code != http.StatusNotFound {
+        t.Fatalf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+    }
+}
+
+func TestApiUpdatePostDuplicateSlug(t *testing.T) {
+    m := setupTestServer(t)
+    cookie := loginTestUser(t)
+    createTestPost(t, "taken", false, time.Hour)
+    post := createTestPost(t, "mine", false, time.Hour)
+
+    post.Slug = "taken"
+    payload, _ := json.Marshal(post)
+    w := doRequest(m, "PUT", "/api/post/" + post.Id.Hex(), bytes.NewReader(payload), cookie)
+    if w.Code != http.StatusConflict {
+        t.Fatalf("Expected status %d, got %d", http.StatusConflict, w.Code)
+    }
+    if saved, _ := FindPostById(post.Id); saved.Slug != "mine" {
+        t.Errorf("Expected slug to be unchanged, got %q", saved.Slug)
+    }
+}
+
+func TestApiListPosts(t *testing.T) {
+    m := setupTestServer(t)
+    cookie := loginTestUser(t)
+    createTestPost(t, "older", false, 2 * time.Hour)
+    createTestPost(t, "newer", false, time.Hour)
+    createTestPost(t, "draft", true, 0)
+
+    w := doRequest(m, "GET", "/api/posts", nil, cookie)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    var headers []PostHeader
+    err := json.Unmarshal(w.Body.Bytes(), &headers)
+    if err != nil {
+        t.Fatal("Bad response:", err)
+    }
+
+    // Drafts are listed too, newest first
+    expected := []string{"draft", "newer", "older"}
+    if len(headers) != len(expected) {
+        t.Fatalf("Expected %d posts, got %d", len(expected), len(headers))
+    }
+    for i, slug := range expected {
+        if headers[i].Slug != slug {
+            t.Errorf("Expected post %d to be %q, got %q", i, slug, headers[i].Slug)
+        }
+    }
+}
+
+func TestApiSettings(t *testing.T) {
+    m := setupTestServer(t)
+    cookie := loginTestUser(t)
+
+    for _, payload := range []string{
+        `{"email": "new@example.com"}`,
+        `{"password": "hunter2", "current_password": "wrong"}`,
+    } {
+        w := doRequest(m, "POST", "/api/settings", strings.NewReader(payload), cookie)
+        if w.Code != http.StatusForbidden {
+            t.Errorf("%s: expected status %d, got %d", payload, http.StatusForbidden, w.Code)
+        }
+    }
+    if _, err := Login("admin@example.com", "secret"); err != nil {
+        t.Fatal("Expected the credentials to be unchanged:", err)
+    }
+
+    payload := []byte(`{"email": "new@example.com", "password": "hunter2", "current_password": "secret"}`)
+    w := doRequest(m, "POST", "/api/settings", bytes.NewReader(payload), cookie)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Update: expected status %d, got %d", http.StatusOK, w.Code)
+    }
+
+    w = doRequest(m, "GET", "/api/settings", nil, cookie)
+    settings := map[string]string{}
+    json.Unmarshal(w.Body.Bytes(), &settings)
+    if settings["email"] != "new@example.com" {
+        t.Errorf("Expected email to be updated, got %q", settings["email"])
+    }
+
+    if _, err := Login("new@example.com", "hunter2"); err != nil {
+        t.Error("Expected to login with the new credentials:", err)
+    }
+}
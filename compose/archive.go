@@ -0,0 +1,513 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "archive/tar"
+    "bytes"
+    "compress/gzip"
+    "encoding/json"
+    "errors"
+    "flag"
+    "fmt"
+    "gopkg.in/mgo.v2/bson"
+    "io"
+    "io/ioutil"
+    "os"
+    "path"
+    "strings"
+    "time"
+)
+
+// ArchiveFormatVersion is the version of the layout of export archives.
+const ArchiveFormatVersion = 1
+
+// ArchiveManifest describes an export archive. It is always the first entry.
+type ArchiveManifest struct {
+    FormatVersion int       `json:"format_version"`
+    SchemaVersion int       `json:"schema_version"`
+    Created       time.Time `json:"created"`
+    Posts         int       `json:"posts"`
+    Files         int       `json:"files"`
+    Users         int       `json:"users"`
+}
+
+// ArchiveUser is a user as stored in an export archive. Only the password
+// hash is exported, never any other secrets.
+type ArchiveUser struct {
+    Id           bson.ObjectId `json:"_id"`
+    FirstName    string        `json:"firstName"`
+    LastName     string        `json:"lastName"`
+    Email        string        `json:"email"`
+    PasswordHash string        `json:"password"`
+}
+
+// ImportOptions control how an archive is imported.
+type ImportOptions struct {
+    // Replace deletes all existing posts, files and users first. Otherwise,
+    // the archive is merged with the existing content.
+    Replace bool
+
+    // Remap gives every imported post and user a new id instead of keeping
+    // the id from the archive.
+    Remap bool
+
+    // Settings restores the settings from the archive to the config file.
+    Settings bool
+}
+
+// archiveWriter writes entries to a tar archive.
+type archiveWriter struct {
+    tw *tar.Writer
+}
+
+// WriteFile writes a complete entry from a byte slice.
+func (a *archiveWriter) WriteFile(name string, data []byte) error {
+    return a.WriteStream(name, int64(len(data)), time.Now(), bytes.NewReader(data))
+}
+
+// WriteJson writes an entry with the JSON encoding of obj.
+func (a *archiveWriter) WriteJson(name string, obj interface{}) error {
+    data, err := json.MarshalIndent(obj, "", "  ")
+    if err != nil {
+        return err
+    }
+    return a.WriteFile(name, data)
+}
+
+// WriteStream writes an entry with size bytes read from r.
+func (a *archiveWriter) WriteStream(name string, size int64, modified time.Time, r io.Reader) error {
+    err := a.tw.WriteHeader(&tar.Header{
+        Name:    name,
+        Mode:    0644,
+        Size:    size,
+        ModTime: modified,
+    })
+    if err != nil {
+        return err
+    }
+    _, err = io.CopyN(a.tw, r, size)
+    return err
+}
+
+// ExportSite writes every post, every file attached to a post, all users and
+// the settings to a gzipped tar archive.
+func ExportSite(w io.Writer) (*ArchiveManifest, error) {
+    s := GetStore()
+
+    posts, err := s.ListPosts(0, 0, true)
+    if err != nil {
+        return nil, err
+    }
+    pages, err := s.ListPages(true)
+    if err != nil {
+        return nil, err
+    }
+    posts = append(posts, pages...)
+    users, err := s.ListUsers()
+    if err != nil {
+        return nil, err
+    }
+    version, err := s.SchemaVersion()
+    if err != nil {
+        return nil, err
+    }
+
+    manifest := &ArchiveManifest{
+        FormatVersion: ArchiveFormatVersion,
+        SchemaVersion: version,
+        Created:       time.Now().UTC(),
+        Posts:         len(posts),
+        Users:         len(users),
+    }
+
+    // Find the files for each post up front so the manifest is accurate
+    files := make(map[bson.ObjectId][]*FileInfo)
+    for _, post := range posts {
+        for _, id := range post.Files {
+            info, err := s.FindFileInfoById(id)
+            if err == ErrNotFound {
+                fmt.Printf("Warning: post '%s' refers to missing file %s\n", post.Title, id.Hex())
+                continue
+            }
+            if err != nil {
+                return nil, err
+            }
+            files[post.Id] = append(files[post.Id], info)
+            manifest.Files += 1
+        }
+    }
+
+    gz := gzip.NewWriter(w)
+    a := &archiveWriter{tw: tar.NewWriter(gz)}
+
+    err = a.WriteJson("manifest.json", manifest)
+    if err != nil {
+        return nil, err
+    }
+
+    // The secret key signs preview links and logins, so it stays here
+    settings := *config
+    settings.SecretKey = ""
+    err = a.WriteJson("settings.json", settings)
+    if err != nil {
+        return nil, err
+    }
+
+    archiveUsers := []ArchiveUser{}
+    for _, user := range users {
+        archiveUsers = append(archiveUsers, ArchiveUser{
+            Id:           user.Id,
+            FirstName:    user.FirstName,
+            LastName:     user.LastName,
+            Email:        user.Email,
+            PasswordHash: user.PasswordHash,
+        })
+    }
+    err = a.WriteJson("users.json", archiveUsers)
+    if err != nil {
+        return nil, err
+    }
+
+    for _, post := range posts {
+        // Files go first so that they are available when the post is imported
+        for _, info := range files[post.Id] {
+            _, file, err := s.OpenFile(info.Id)
+            if err != nil {
+                return nil, err
+            }
+            name := path.Join("files", info.Id.Hex(), path.Base(info.Name))
+            err = a.WriteStream(name, info.Size, info.UploadDate, file)
+            file.Close()
+            if err != nil {
+                return nil, err
+            }
+        }
+
+        data, err := MarshalPostMarkdown(&post)
+        if err != nil {
+            return nil, err
+        }
+        err = a.WriteFile(path.Join("posts", post.Id.Hex() + ".md"), data)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    err = a.tw.Close()
+    if err != nil {
+        return nil, err
+    }
+    err = gz.Close()
+    if err != nil {
+        return nil, err
+    }
+    return manifest, nil
+}
+
+// ImportSite reads an archive written by ExportSite.
+func ImportSite(r io.Reader, options ImportOptions) error {
+    s := GetStore()
+
+    gz, err := gzip.NewReader(r)
+    if err != nil {
+        return err
+    }
+    tr := tar.NewReader(gz)
+
+    // Files are stored as they are read, and everything else is kept until the
+    // whole archive has been read successfully.
+    var manifest *ArchiveManifest
+    var settings *Config
+    var users []ArchiveUser
+    var posts []*Post
+    fileIds := make(map[bson.ObjectId]bson.ObjectId)
+    cleanup := func() {
+        for _, id := range fileIds {
+            s.DeleteFile(id)
+        }
+    }
+
+    for {
+        header, err := tr.Next()
+        if err == io.EOF {
+            break
+        }
+        if err != nil {
+            cleanup()
+            return err
+        }
+
+        parts := strings.Split(path.Clean(header.Name), "/")
+        if manifest == nil && header.Name != "manifest.json" {
+            cleanup()
+            return errors.New("Not a Compose archive: the manifest is missing")
+        }
+
+        switch {
+        case header.Name == "manifest.json":
+            manifest = &ArchiveManifest{}
+            err = json.NewDecoder(tr).Decode(manifest)
+            if err == nil && manifest.FormatVersion > ArchiveFormatVersion {
+                err = fmt.Errorf("The archive format (version %d) is newer than this version of Compose supports", manifest.FormatVersion)
+            }
+        case header.Name == "settings.json":
+            settings = &Config{}
+            err = json.NewDecoder(tr).Decode(settings)
+        case header.Name == "users.json":
+            err = json.NewDecoder(tr).Decode(&users)
+        case len(parts) == 3 && parts[0] == "files" && bson.IsObjectIdHex(parts[1]):
+            // Files always get new ids since posts only refer to them by name
+            var info *FileInfo
+            info, err = s.CreateFile(parts[2], tr)
+            if err == nil {
+                fileIds[bson.ObjectIdHex(parts[1])] = info.Id
+            }
+        case len(parts) == 2 && parts[0] == "posts" && strings.HasSuffix(parts[1], ".md"):
+            var data []byte
+            data, err = ioutil.ReadAll(tr)
+            if err == nil {
+                post := &Post{}
+                err = UnmarshalPostMarkdown(data, post)
+                posts = append(posts, post)
+            }
+        default:
+            fmt.Printf("Warning: skipping unknown archive entry '%s'\n", header.Name)
+        }
+
+        if err != nil {
+            cleanup()
+            return fmt.Errorf("%s: %s", header.Name, err.Error())
+        }
+    }
+    if manifest == nil {
+        return errors.New("Not a Compose archive: the manifest is missing")
+    }
+
+    // Nothing is deleted until the users are known to be good, so a bad
+    // archive can't leave the site without anyone who can login
+    err = checkArchiveUsers(users, options.Replace)
+    if err != nil {
+        cleanup()
+        return fmt.Errorf("users.json: %s", err.Error())
+    }
+
+    // Clear out the existing content
+    if options.Replace {
+        existing, err := s.ListPosts(0, 0, true)
+        if err != nil {
+            cleanup()
+            return err
+        }
+        pages, err := s.ListPages(true)
+        if err != nil {
+            cleanup()
+            return err
+        }
+        existing = append(existing, pages...)
+        for _, post := range existing {
+            post.Delete()
+        }
+        existingUsers, err := s.ListUsers()
+        if err != nil {
+            cleanup()
+            return err
+        }
+        for _, user := range existingUsers {
+            s.DeleteUser(user.Id)
+        }
+    }
+
+    // Users
+    userCount := 0
+    for _, imported := range users {
+        if _, err := s.FindUserByEmail(imported.Email); err == nil {
+            fmt.Printf("Skipping user '%s': a user with that e-mail address already exists\n", imported.Email)
+            continue
+        }
+        user := &User{
+            Id:           imported.Id,
+            FirstName:    imported.FirstName,
+            LastName:     imported.LastName,
+            Email:        imported.Email,
+            PasswordHash: imported.PasswordHash,
+        }
+        if _, err := s.FindUserById(user.Id); options.Remap || !user.Id.Valid() || err == nil {
+            user.Id = bson.NewObjectId()
+            fmt.Printf("User '%s' was given a new id, so the password must be reset\n", user.Email)
+        }
+        err := s.SaveUser(user)
+        if err != nil {
+            return fmt.Errorf("Failed to save user '%s': %s", user.Email, err.Error())
+        }
+        userCount += 1
+    }
+
+    // Posts
+    postCount := 0
+    for _, post := range posts {
+        files := post.Files
+        post.Files = []bson.ObjectId{}
+        for _, id := range files {
+            if newId, ok := fileIds[id]; ok {
+                post.Files = append(post.Files, newId)
+            }
+        }
+
+        if post.Tags != nil {
+            post.Tags = NormalizeTags(post.Tags)
+        }
+
+        // A post in the archive replaces an existing post with the same id
+        var existing *Post
+        if options.Remap || post.Id == "" {
+            post.Id = bson.NewObjectId()
+        } else {
+            existing, _ = s.FindPostById(post.Id)
+        }
+
+        post.Slug = normalizeSlugFor(post.Slug, post.IsPage())
+        err := CheckSlug(post.Slug, post.Id, post.IsPage())
+        if slugErr, ok := err.(*SlugError); ok {
+            fmt.Printf("Skipping post '%s': %s\n", post.Title, slugErr.Message)
+            for _, id := range post.Files {
+                s.DeleteFile(id)
+            }
+            continue
+        }
+        if err != nil {
+            return err
+        }
+
+        err = s.SavePost(post)
+        if err == ErrDuplicate {
+            fmt.Printf("Skipping post '%s': another post already uses the slug '%s'\n", post.Title, post.Slug)
+            for _, id := range post.Files {
+                s.DeleteFile(id)
+            }
+            continue
+        }
+        if err != nil {
+            return fmt.Errorf("Failed to save post '%s': %s", post.Title, err.Error())
+        }
+        if existing != nil {
+            for _, id := range existing.Files {
+                s.DeleteFile(id)
+            }
+        }
+        postCount += 1
+    }
+
+    // Settings
+    if options.Settings && settings != nil {
+        err = RestoreSettings(settings)
+        if err != nil {
+            return err
+        }
+    }
+
+    fmt.Printf("Imported %d posts, %d files and %d users\n", postCount, len(fileIds), userCount)
+    return nil
+}
+
+// checkArchiveUsers checks that the users in an archive can be imported.
+// Replacing the existing users needs at least one, or nobody could login.
+func checkArchiveUsers(users []ArchiveUser, replace bool) error {
+    if replace && len(users) == 0 {
+        return errors.New("there are no users, so replacing the existing ones would leave nobody able to login")
+    }
+    emails := make(map[string]bool)
+    for _, user := range users {
+        if user.Email == "" {
+            return errors.New("a user has no e-mail address")
+        }
+        if user.PasswordHash == "" {
+            return fmt.Errorf("the user '%s' has no password hash", user.Email)
+        }
+        if emails[user.Email] {
+            return fmt.Errorf("the e-mail address '%s' is used by more than one user", user.Email)
+        }
+        emails[user.Email] = true
+    }
+    return nil
+}
+
+// RestoreSettings saves the site settings from an imported config to the
+// config file. The database and theme locations are specific to this machine,
+// so they are kept, and so is the secret key.
+func RestoreSettings(imported *Config) error {
+    imported.SecretKey = config.SecretKey
+    imported.DatabaseBackend = config.DatabaseBackend
+    imported.DatabaseHost = config.DatabaseHost
+    imported.DatabaseName = config.DatabaseName
+    imported.DatabasePath = config.DatabasePath
+    imported.AssetsPath = config.AssetsPath
+    imported.TemplatesPath = config.TemplatesPath
+    imported.AdminAssetsPath = config.AdminAssetsPath
+    imported.AdminTemplatesPath = config.AdminTemplatesPath
+
+    err := imported.Save(ConfigDefaultFilename)
+    if err != nil {
+        return err
+    }
+    *config = *imported
+    return nil
+}
+
+// ExportCommand is the handler for the export command.
+func ExportCommand(args []string) error {
+    if len(args) != 1 {
+        return errors.New("Usage: compose export <archive.tar.gz>")
+    }
+
+    file, err := os.Create(args[0])
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    manifest, err := ExportSite(file)
+    if err != nil {
+        return err
+    }
+    fmt.Printf("Exported %d posts, %d files and %d users to %s\n", manifest.Posts, manifest.Files, manifest.Users, args[0])
+    return nil
+}
+
+// ImportCommand is the handler for the import command.
+func ImportCommand(args []string) error {
+    options := ImportOptions{}
+    flags := flag.NewFlagSet("import", flag.ContinueOnError)
+    flags.BoolVar(&options.Replace,  "replace",  false, "delete all existing posts, files and users first")
+    flags.BoolVar(&options.Remap,    "remap",    false, "give imported posts and users new ids")
+    flags.BoolVar(&options.Settings, "settings", false, "restore the settings to the config file")
+    err := flags.Parse(args)
+    if err != nil {
+        return err
+    }
+    if flags.NArg() != 1 {
+        return errors.New("Usage: compose import [-replace] [-remap] [-settings] <archive.tar.gz>")
+    }
+
+    file, err := os.Open(flags.Arg(0))
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    return ImportSite(file, options)
+}
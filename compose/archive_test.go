@@ -0,0 +1,261 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "bytes"
+    "compress/gzip"
+    "io/ioutil"
+    "os"
+    "strings"
+    "testing"
+    "time"
+)
+
+// setupArchiveContent creates a user and a couple of posts, one with a file.
+func setupArchiveContent(t *testing.T) (*Post, *FileInfo) {
+    loginTestUser(t)
+    createTestPost(t, "plain", false, 2 * time.Hour)
+    post := createTestPost(t, "with-file", true, time.Hour)
+    info, err := GetStore().CreateFile("data.txt", strings.NewReader("file contents"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    post.Files = append(post.Files, info.Id)
+    post.Save()
+    return post, info
+}
+
+func TestExportImportReplace(t *testing.T) {
+    setupTestServer(t)
+    post, _ := setupArchiveContent(t)
+    user, _ := FindUserByEmail("admin@example.com")
+
+    archive := &bytes.Buffer{}
+    manifest, err := ExportSite(archive)
+    if err != nil {
+        t.Fatal("Export failed:", err)
+    }
+    if manifest.Posts != 2 || manifest.Files != 1 || manifest.Users != 1 {
+        t.Errorf("Unexpected manifest %+v", manifest)
+    }
+
+    // Import into a fresh database
+    store = NewMemoryStore()
+    createTestPost(t, "leftover", false, 0)
+    err = ImportSite(bytes.NewReader(archive.Bytes()), ImportOptions{Replace: true})
+    if err != nil {
+        t.Fatal("Import failed:", err)
+    }
+
+    if _, err := FindPostBySlug("leftover"); err != ErrNotFound {
+        t.Error("Expected existing posts to be replaced")
+    }
+    if n, _ := CountPosts(true); n != 2 {
+        t.Errorf("Expected 2 posts, got %d", n)
+    }
+
+    imported, err := FindPostById(post.Id)
+    if err != nil {
+        t.Fatal("Expected the post id to be kept:", err)
+    }
+    if imported.Title != post.Title || imported.Slug != post.Slug || imported.Body != post.Body || !imported.Draft {
+        t.Errorf("Imported post %+v does not match %+v", imported, post)
+    }
+    if !imported.Date.Equal(post.Date) {
+        t.Errorf("Expected date %v, got %v", post.Date, imported.Date)
+    }
+    if len(imported.Files) != 1 {
+        t.Fatalf("Expected 1 file, got %d", len(imported.Files))
+    }
+    info, file, err := GetFileById(imported.Files[0])
+    if err != nil {
+        t.Fatal("Imported file is missing:", err)
+    }
+    contents, _ := ioutil.ReadAll(file)
+    if info.Name != "data.txt" || string(contents) != "file contents" {
+        t.Errorf("Unexpected file %+v with contents %q", info, contents)
+    }
+
+    // The password hash comes along, so the user can still login
+    importedUser, err := FindUserById(user.Id)
+    if err != nil || importedUser.PasswordHash != user.PasswordHash {
+        t.Errorf("Expected the user to be imported unchanged, got %+v, %v", importedUser, err)
+    }
+    if _, err := Login("admin@example.com", "secret"); err != nil {
+        t.Error("Expected to login as the imported user:", err)
+    }
+}
+
+func TestImportMerge(t *testing.T) {
+    setupTestServer(t)
+    post, info := setupArchiveContent(t)
+
+    archive := &bytes.Buffer{}
+    _, err := ExportSite(archive)
+    if err != nil {
+        t.Fatal("Export failed:", err)
+    }
+
+    // Importing into the same database replaces posts with the same id
+    post.Title = "Changed"
+    post.Save()
+    err = ImportSite(bytes.NewReader(archive.Bytes()), ImportOptions{})
+    if err != nil {
+        t.Fatal("Import failed:", err)
+    }
+    if n, _ := CountPosts(true); n != 2 {
+        t.Errorf("Expected 2 posts, got %d", n)
+    }
+    if users, _ := GetStore().ListUsers(); len(users) != 1 {
+        t.Errorf("Expected 1 user, got %d", len(users))
+    }
+    imported, _ := FindPostById(post.Id)
+    if imported.Title != "Title of with-file" {
+        t.Errorf("Expected the post to be restored, got title %q", imported.Title)
+    }
+    if _, err := GetFileInfoById(info.Id); err != ErrNotFound {
+        t.Error("Expected the replaced post's file to be deleted")
+    }
+
+    // With remapped ids, the posts are new but their slugs are taken
+    err = ImportSite(bytes.NewReader(archive.Bytes()), ImportOptions{Remap: true})
+    if err != nil {
+        t.Fatal("Import failed:", err)
+    }
+    if n, _ := CountPosts(true); n != 2 {
+        t.Errorf("Expected posts with taken slugs to be skipped, got %d posts", n)
+    }
+}
+
+func TestSecretKeyNotExported(t *testing.T) {
+    setupTestServer(t)
+    setupArchiveContent(t)
+    config.SecretKey = "local secret key"
+    config.SiteTitle = "Imported Title"
+
+    archive := &bytes.Buffer{}
+    _, err := ExportSite(archive)
+    if err != nil {
+        t.Fatal("Export failed:", err)
+    }
+    gz, err := gzip.NewReader(bytes.NewReader(archive.Bytes()))
+    if err != nil {
+        t.Fatal(err)
+    }
+    contents, _ := ioutil.ReadAll(gz)
+    if bytes.Contains(contents, []byte("local secret key")) {
+        t.Error("Expected the secret key to be left out of the archive")
+    }
+
+    // Restoring the settings keeps this machine's key
+    wd, _ := os.Getwd()
+    dir, _ := ioutil.TempDir("", "compose")
+    defer os.RemoveAll(dir)
+    os.Chdir(dir)
+    defer os.Chdir(wd)
+
+    config.SecretKey = "other key"
+    config.SiteTitle = "Local Title"
+    err = ImportSite(bytes.NewReader(archive.Bytes()), ImportOptions{Settings: true})
+    if err != nil {
+        t.Fatal("Import failed:", err)
+    }
+    if config.SecretKey != "other key" {
+        t.Errorf("Expected the local secret key to be kept, got %q", config.SecretKey)
+    }
+    if config.SiteTitle != "Imported Title" {
+        t.Errorf("Expected the settings to be restored, got title %q", config.SiteTitle)
+    }
+}
+
+func TestImportNotAnArchive(t *testing.T) {
+    setupTestServer(t)
+    err := ImportSite(strings.NewReader("hello"), ImportOptions{})
+    if err == nil {
+        t.Fatal("Expected an error")
+    }
+}
+
+func TestImportArchiveSlugs(t *testing.T) {
+    setupTestServer(t)
+    post := createTestPost(t, "Mixed Case", false, 0)
+    reserved := createTestPost(t, "admin", false, 0)
+
+    archive := &bytes.Buffer{}
+    _, err := ExportSite(archive)
+    if err != nil {
+        t.Fatal("Export failed:", err)
+    }
+
+    store = NewMemoryStore()
+    err = ImportSite(bytes.NewReader(archive.Bytes()), ImportOptions{})
+    if err != nil {
+        t.Fatal("Import failed:", err)
+    }
+    if imported, err := FindPostById(post.Id); err != nil || imported.Slug != "mixed-case" {
+        t.Errorf("Expected the slug to be normalized, got %+v %v", imported, err)
+    }
+    if _, err := FindPostById(reserved.Id); err != ErrNotFound {
+        t.Error("Expected the post with a reserved slug to be skipped")
+    }
+}
+
+func TestImportReplaceWithoutUsers(t *testing.T) {
+    setupTestServer(t)
+    createTestPost(t, "kept", false, 0)
+
+    // An archive of a site nobody can login to
+    archive := &bytes.Buffer{}
+    _, err := ExportSite(archive)
+    if err != nil {
+        t.Fatal("Export failed:", err)
+    }
+
+    loginTestUser(t)
+    err = ImportSite(bytes.NewReader(archive.Bytes()), ImportOptions{Replace: true})
+    if err == nil {
+        t.Fatal("Expected an error")
+    }
+    if _, err := FindUserByEmail("admin@example.com"); err != nil {
+        t.Error("Expected the existing user to be kept:", err)
+    }
+    if _, err := FindPostBySlug("kept"); err != nil {
+        t.Error("Expected the existing posts to be kept:", err)
+    }
+}
+
+func TestCheckArchiveUsers(t *testing.T) {
+    user := ArchiveUser{Email: "a@example.com", PasswordHash: "hash"}
+    tests := []struct {
+        users   []ArchiveUser
+        replace bool
+        ok      bool
+    }{
+        {nil,                                            false, true},
+        {nil,                                            true,  false},
+        {[]ArchiveUser{user},                            true,  true},
+        {[]ArchiveUser{user, user},                      false, false},
+        {[]ArchiveUser{{PasswordHash: "hash"}},          false, false},
+        {[]ArchiveUser{{Email: "b@example.com"}},        false, false},
+    }
+    for i, test := range tests {
+        if err := checkArchiveUsers(test.users, test.replace); (err == nil) != test.ok {
+            t.Errorf("Test %d: expected ok %v, got %v", i, test.ok, err)
+        }
+    }
+}
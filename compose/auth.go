@@ -17,37 +17,140 @@ package main
 
 import (
     "errors"
+    "fmt"
     "net/http"
+    "strings"
+    "sync"
+    "time"
     "github.com/zenazn/goji/web"
 )
 
 const (
     CookieName = "session_token"
+
+    // The names Angular's $http uses by default, so the admin sends the CSRF
+    // token without being told to.
+    CsrfCookieName = "XSRF-TOKEN"
+    CsrfHeaderName = "X-XSRF-TOKEN"
 )
 
 // MakeRestrictedHttpHandler creates a wrapper that requires the user to be
-// logged in to access the handler.
+// logged in to access the handler. Requests that could change something must
+// also send the session's CSRF token in the X-XSRF-TOKEN header, so that
+// other sites can't make them on the user's behalf.
 func MakeRestrictedHttpHandler(handler func(web.C, http.ResponseWriter, *http.Request)) (func(web.C, http.ResponseWriter, *http.Request)) {
     return func(c web.C, w http.ResponseWriter, r *http.Request) {
-        // Get cookie
-        cookie, err := r.Cookie(CookieName)
-        if err == nil && IsSessionTokenValid(cookie.Value) {
-            // Valid session. Continue to handler.
-            handler(c, w, r)
-        } else {
+        session, err := RequestSession(r)
+        if err != nil {
             // No. Redirect to login page.
             http.Redirect(w, r, "/login", http.StatusUnauthorized)
+            return
+        }
+        if !isSafeMethod(r.Method) && !session.CheckCsrfToken(r.Header.Get(CsrfHeaderName)) {
+            http.Error(w, "Missing or invalid CSRF token", http.StatusForbidden)
+            return
         }
+
+        // Valid session. Continue to handler.
+        handler(c, w, r)
     }
 }
 
-// Login will create a new session, given an e-mail and a password.
-func Login(email, password string) (*Session, error) {
+// isSafeMethod checks if an HTTP method only reads.
+func isSafeMethod(method string) (bool) {
+    return method == "GET" || method == "HEAD" || method == "OPTIONS"
+}
+
+// RequestSession finds the valid session of a request.
+func RequestSession(r *http.Request) (*Session, error) {
+    cookie, err := r.Cookie(CookieName)
+    if err != nil {
+        return nil, err
+    }
+    return FindValidSession(cookie.Value)
+}
+
+// IsRequestLoggedIn checks if a request has the cookie of a valid session.
+func IsRequestLoggedIn(r *http.Request) (bool) {
+    _, err := RequestSession(r)
+    return err == nil
+}
+
+// RequestUser finds the logged in user making a request.
+func RequestUser(r *http.Request) (*User, error) {
+    session, err := RequestSession(r)
+    if err != nil {
+        return nil, err
+    }
+    return FindUserById(session.User)
+}
+
+// MakeCookie makes a cookie with the attributes set in the config. Cookies
+// are Secure if CookieSecure is set or the request came over HTTPS, and
+// SameSite as set by CookieSameSite. A negative maxAge deletes the cookie.
+func MakeCookie(r *http.Request, name string, value string, maxAge int) (*http.Cookie) {
+    cookie := &http.Cookie{
+        Name:     name,
+        Value:    value,
+        Path:     "/",
+        MaxAge:   maxAge,
+        HttpOnly: true,
+        Secure:   config.CookieSecure || r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+    }
+    switch strings.ToLower(config.CookieSameSite) {
+    case "strict":
+        cookie.SameSite = http.SameSiteStrictMode
+    case "none":
+        // Browsers only accept this on secure cookies
+        cookie.SameSite = http.SameSiteNoneMode
+        cookie.Secure = true
+    default:
+        cookie.SameSite = http.SameSiteLaxMode
+    }
+    return cookie
+}
+
+// SetCsrfCookie sends the CSRF token of a session in a cookie the admin's
+// scripts can read.
+func SetCsrfCookie(w http.ResponseWriter, r *http.Request, session *Session) {
+    cookie := MakeCookie(r, CsrfCookieName, session.CsrfToken, 0)
+    cookie.HttpOnly = false
+    http.SetCookie(w, cookie)
+}
+
+var ErrTotpRequired = errors.New("a one-time code is required")
+
+// LoginPage is the data for the login page. LoginToken is set once the
+// password has been checked, if a one-time code is needed too.
+type LoginPage struct {
+    LoginToken string
+}
+
+// dummyUser is checked against the password when there's no user with the
+// e-mail, so that takes as long as a wrong password and doesn't give away
+// which e-mails have accounts.
+var (
+    dummyUser     *User
+    dummyUserOnce sync.Once
+)
+
+// getDummyUser gets dummyUser, hashing its password the first time.
+func getDummyUser() (*User) {
+    dummyUserOnce.Do(func() {
+        dummyUser, _ = CreateUser()
+        dummyUser.PasswordHash = dummyUser.GenPasswordHash("")
+    })
+    return dummyUser
+}
+
+// Authenticate finds the user with an e-mail and a password.
+func Authenticate(email, password string) (*User, error) {
     // Lookup user
     user, err := FindUserByEmail(email)
 
     if err != nil {
         // Error occurred. Probably bad email.
+        getDummyUser().TestPassword(password)
         return nil, err
     }
 
@@ -56,6 +159,34 @@ func Login(email, password string) (*Session, error) {
         return nil, errors.New("Invalid password")
     }
 
+    // Upgrade old password hashes while the password is at hand
+    if user.PasswordNeedsRehash() {
+        user.PasswordHash = user.GenPasswordHash(password)
+        _, err = user.Save()
+        if err != nil {
+            fmt.Println("Warning: failed to upgrade the password hash of", user.Email + ":", err.Error())
+        }
+    }
+
+    return user, nil
+}
+
+// Login will create a new session, given an e-mail and a password. Users with
+// two-factor authentication on get ErrTotpRequired, and have to login through
+// LoginHandler.
+func Login(email, password string) (*Session, error) {
+    user, err := Authenticate(email, password)
+    if err != nil {
+        return nil, err
+    }
+    if user.TotpEnabled {
+        return nil, ErrTotpRequired
+    }
+    return LoginUser(user)
+}
+
+// LoginUser creates a new session for a user who has proven who they are.
+func LoginUser(user *User) (*Session, error) {
     // Create session
     session, err := CreateSession(user)
     if err != nil {
@@ -69,11 +200,13 @@ func Login(email, password string) (*Session, error) {
     return session, nil
 }
 
-// LoginHandler is the handler for the login page.
+// LoginHandler is the handler for the login page. Logging in takes two steps
+// for users with two-factor authentication on. Once the password is checked,
+// a login token is sent back instead of a session. The one-time code is then
+// posted with the login token.
 func LoginHandler(w http.ResponseWriter, r *http.Request) {
     // Already logged in?
-    c, err := r.Cookie(CookieName)
-    if err == nil && IsSessionTokenValid(c.Value) {
+    if IsRequestLoggedIn(r) {
         // Yes. Redirect to admin page.
         http.Redirect(w, r, "/admin", http.StatusSeeOther)
         return
@@ -81,51 +214,131 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 
     if r.Method == "GET" {
         // Want the login page
-        err := AdminTemplates.ExecuteTemplate(w, "login.html", nil)
+        err := AdminTemplates.ExecuteTemplate(w, "login.html", &LoginPage{})
         if err != nil {
             http.Error(w, err.Error(), http.StatusInternalServerError)
         }
     } else if r.Method == "POST" {
-        // Trying to login
         r.ParseForm()
-        session, err := Login(r.FormValue("email"), r.FormValue("password"))
+        if r.FormValue("login_token") != "" {
+            loginWithCode(w, r)
+            return
+        }
 
-        if err == nil {
-            // Send cookie 
-            http.SetCookie(w, &http.Cookie{Name:  CookieName,
-                                           Value: session.Token,
-                                           Path:  "/"})
+        // Trying to login. Too many failures have to wait a while. The attempt
+        // counts as a failure until the login is finished.
+        keys := LoginThrottleKeys(r, r.FormValue("email"))
+        if wait := loginThrottle.Attempt(keys, time.Now()); wait > 0 {
+            WriteTooManyLogins(w, wait)
+            return
+        }
+        user, err := Authenticate(r.FormValue("email"), r.FormValue("password"))
+        if err != nil {
+            // Bad credentials!
+            http.Redirect(w, r, "/login", http.StatusUnauthorized)
+            return
+        }
 
-            // If this was an XMLHttpRequest, just return 200 OK.
+        if user.TotpEnabled {
+            // Now for the one-time code, which is an attempt of its own
+            loginThrottle.Release(keys)
+            page := &LoginPage{LoginToken: LoginToken(user.Id, time.Now().Add(LoginTokenMaxAge))}
             if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
-                w.WriteHeader(http.StatusOK)
-            } else {
-                // Continue to admin page.
-                http.Redirect(w, r, "/admin", http.StatusSeeOther)
+                w.Header().Set("Content-Type", "application/json")
+                WriteJson(w, map[string]string{"login_token": page.LoginToken})
+                return
             }
-        } else {
-            // Bad credentials!
-            http.Redirect(w, r, "/login", http.StatusUnauthorized)
+            err = AdminTemplates.ExecuteTemplate(w, "login.html", page)
+            if err != nil {
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+            }
+            return
         }
+        finishLogin(w, r, user, keys)
     } else {
         http.Error(w, "Invalid method", http.StatusMethodNotAllowed)
     }
 }
 
-// LogoutHandler is the handler for the logout page.
+// loginWithCode is the second step of logging in, for users with two-factor
+// authentication on. Failures are counted as failed logins.
+func loginWithCode(w http.ResponseWriter, r *http.Request) {
+    id, err := CheckLoginToken(r.FormValue("login_token"), time.Now())
+    if err == ErrExpiredLoginToken {
+        http.Error(w, "Took too long to enter the code. Login again.", http.StatusGone)
+        return
+    }
+    if err != nil {
+        http.Redirect(w, r, "/login", http.StatusUnauthorized)
+        return
+    }
+    user, err := FindUserById(id)
+    if err != nil {
+        http.Redirect(w, r, "/login", http.StatusUnauthorized)
+        return
+    }
+
+    keys := LoginThrottleKeys(r, user.Email)
+    if wait := loginThrottle.Attempt(keys, time.Now()); wait > 0 {
+        WriteTooManyLogins(w, wait)
+        return
+    }
+    if !user.CheckSecondFactor(r.FormValue("code"), time.Now()) {
+        // Bad code!
+        http.Redirect(w, r, "/login", http.StatusUnauthorized)
+        return
+    }
+
+    // The code can't be used again
+    _, err = user.Save()
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    finishLogin(w, r, user, keys)
+}
+
+// finishLogin creates a session for a user who has proven who they are, and
+// sends the cookies.
+func finishLogin(w http.ResponseWriter, r *http.Request, user *User, keys []string) {
+    session, err := LoginUser(user)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    loginThrottle.Succeed(keys)
+
+    // Send cookies
+    http.SetCookie(w, MakeCookie(r, CookieName, session.Token, 0))
+    SetCsrfCookie(w, r, session)
+
+    // If this was an XMLHttpRequest, just return 200 OK.
+    if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+        w.WriteHeader(http.StatusOK)
+    } else {
+        // Continue to admin page.
+        http.Redirect(w, r, "/admin", http.StatusSeeOther)
+    }
+}
+
+// LogoutHandler is the handler for logging out. It needs the CSRF token of the
+// session, so other sites can't log users out.
 func LogoutHandler(w http.ResponseWriter, r *http.Request) {
-    // Already logged in?
+    // End the session, if there is one
     c, err := r.Cookie(CookieName)
     if err == nil {
         session, err := FindSessionByToken(c.Value)
-        if err != nil {
+        if err == nil {
+            if !session.CheckCsrfToken(r.Header.Get(CsrfHeaderName)) {
+                http.Error(w, "Missing or invalid CSRF token", http.StatusForbidden)
+                return
+            }
             session.Destroy()
         }
     }
 
-    // Send cookie 
-    http.SetCookie(w, &http.Cookie{Name:  CookieName,
-                                   Value: "",
-                                   Path:  "/"})
+    // Clear cookies
+    http.SetCookie(w, MakeCookie(r, CookieName, "", -1))
+    http.SetCookie(w, MakeCookie(r, CsrfCookieName, "", -1))
     http.Redirect(w, r, "/login", http.StatusSeeOther)
 }
\ No newline at end of file
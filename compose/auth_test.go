@@ -0,0 +1,208 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "github.com/zenazn/goji/web"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+)
+
+// postLogin submits the login form, optionally as an XMLHttpRequest.
+func postLogin(m *web.Mux, email, password string, xhr bool) (*httptest.ResponseRecorder) {
+    form := url.Values{"email": {email}, "password": {password}}
+    r, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+    r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    if xhr {
+        r.Header.Set("X-Requested-With", "XMLHttpRequest")
+    }
+    return doRequestWith(m, r)
+}
+
+// responseCookie finds the cookie with the given name set by a response.
+func responseCookie(w *httptest.ResponseRecorder, name string) (*http.Cookie) {
+    resp := &http.Response{Header: w.Header()}
+    for _, cookie := range resp.Cookies() {
+        if cookie.Name == name {
+            return cookie
+        }
+    }
+    return nil
+}
+
+func TestRestrictedRequiresLogin(t *testing.T) {
+    m := setupTestServer(t)
+    paths := []string{"/admin", "/admin/posts", "/admin/partials/edit", "/api/posts", "/api/settings"}
+    for _, path := range paths {
+        w := doRequest(m, "GET", path, nil, nil)
+        if w.Code != http.StatusUnauthorized {
+            t.Errorf("GET %s: expected status %d, got %d", path, http.StatusUnauthorized, w.Code)
+        }
+    }
+
+    // A made up token is no good either
+    bogus := &http.Cookie{Name: CookieName, Value: "bogus"}
+    w := doRequest(m, "GET", "/api/posts", nil, bogus)
+    if w.Code != http.StatusUnauthorized {
+        t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+    }
+}
+
+func TestRestrictedWithSession(t *testing.T) {
+    m := setupTestServer(t)
+    cookie := loginTestUser(t)
+    w := doRequest(m, "GET", "/admin", nil, cookie)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+    }
+}
+
+func TestLoginHandler(t *testing.T) {
+    m := setupTestServer(t)
+    Setup()
+
+    w := doRequest(m, "GET", "/login", nil, nil)
+    if w.Code != http.StatusOK {
+        t.Fatalf("GET /login: expected status %d, got %d", http.StatusOK, w.Code)
+    }
+
+    w = postLogin(m, "admin@example.com", "wrong", false)
+    if w.Code != http.StatusUnauthorized {
+        t.Errorf("Bad password: expected status %d, got %d", http.StatusUnauthorized, w.Code)
+    }
+    if responseCookie(w, CookieName) != nil {
+        t.Error("Bad password: expected no session cookie")
+    }
+
+    w = postLogin(m, "nobody@example.com", "secret", false)
+    if w.Code != http.StatusUnauthorized {
+        t.Errorf("Bad email: expected status %d, got %d", http.StatusUnauthorized, w.Code)
+    }
+
+    w = postLogin(m, "admin@example.com", "secret", false)
+    if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/admin" {
+        t.Errorf("Expected redirect to /admin, got %d %q", w.Code, w.Header().Get("Location"))
+    }
+    cookie := responseCookie(w, CookieName)
+    if cookie == nil || !IsSessionTokenValid(cookie.Value) {
+        t.Fatal("Expected a valid session cookie")
+    }
+
+    // Already logged in
+    w = doRequest(m, "GET", "/login", nil, cookie)
+    if w.Code != http.StatusSeeOther {
+        t.Errorf("Logged in: expected status %d, got %d", http.StatusSeeOther, w.Code)
+    }
+
+    w = postLogin(m, "admin@example.com", "secret", true)
+    if w.Code != http.StatusOK {
+        t.Errorf("XMLHttpRequest: expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    if responseCookie(w, CookieName) == nil {
+        t.Error("XMLHttpRequest: expected a session cookie")
+    }
+}
+
+func TestAuthenticateUnknownEmail(t *testing.T) {
+    setupTestServer(t)
+    Setup()
+    if _, err := Authenticate("nobody@example.com", "secret"); err != ErrNotFound {
+        t.Errorf("Expected %v, got %v", ErrNotFound, err)
+    }
+
+    // The password is still checked, against a hash like the users' own
+    if dummyUser == nil || dummyUser.PasswordNeedsRehash() {
+        t.Errorf("Expected a dummy argon2id hash, got %+v", dummyUser)
+    }
+}
+
+func TestCookieAttributes(t *testing.T) {
+    m := setupTestServer(t)
+    Setup()
+
+    w := postLogin(m, "admin@example.com", "secret", false)
+    cookie := responseCookie(w, CookieName)
+    if cookie == nil || !cookie.HttpOnly || cookie.Secure || cookie.SameSite != http.SameSiteLaxMode {
+        t.Errorf("Expected an HttpOnly, Lax session cookie, got %+v", cookie)
+    }
+    csrf := responseCookie(w, CsrfCookieName)
+    if csrf == nil || csrf.HttpOnly || csrf.Value == "" {
+        t.Errorf("Expected a CSRF cookie scripts can read, got %+v", csrf)
+    }
+
+    // Behind an HTTPS proxy
+    form := url.Values{"email": {"admin@example.com"}, "password": {"secret"}}
+    r, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+    r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    r.Header.Set("X-Forwarded-Proto", "https")
+    w = doRequestWith(m, r)
+    if cookie := responseCookie(w, CookieName); cookie == nil || !cookie.Secure {
+        t.Errorf("HTTPS: expected a secure cookie, got %+v", cookie)
+    }
+
+    config.CookieSecure = true
+    config.CookieSameSite = "Strict"
+    w = postLogin(m, "admin@example.com", "secret", false)
+    cookie = responseCookie(w, CookieName)
+    if cookie == nil || !cookie.Secure || cookie.SameSite != http.SameSiteStrictMode {
+        t.Errorf("Configured: expected a secure, Strict cookie, got %+v", cookie)
+    }
+}
+
+func TestCsrfToken(t *testing.T) {
+    m := setupTestServer(t)
+    cookie := loginTestUser(t)
+    post := createTestPost(t, "csrf", true, 0)
+    path := "/api/post/" + post.Id.Hex()
+
+    // Reading doesn't need the token
+    r, _ := http.NewRequest("GET", path, nil)
+    r.AddCookie(cookie)
+    if w := doRequestWith(m, r); w.Code != http.StatusOK {
+        t.Errorf("GET: expected status %d, got %d", http.StatusOK, w.Code)
+    }
+
+    for _, token := range []string{"", "bogus"} {
+        r, _ = http.NewRequest("DELETE", path, nil)
+        r.AddCookie(cookie)
+        if token != "" {
+            r.Header.Set(CsrfHeaderName, token)
+        }
+        if w := doRequestWith(m, r); w.Code != http.StatusForbidden {
+            t.Errorf("Token %q: expected status %d, got %d", token, http.StatusForbidden, w.Code)
+        }
+    }
+    if _, err := FindPostById(post.Id); err != nil {
+        t.Fatalf("Expected the post to survive, got %v", err)
+    }
+
+    // The admin page hands out the token too
+    w := doRequest(m, "GET", "/admin", nil, cookie)
+    csrf := responseCookie(w, CsrfCookieName)
+    if csrf == nil {
+        t.Fatal("Expected the admin page to set the CSRF cookie")
+    }
+    r, _ = http.NewRequest("DELETE", path, nil)
+    r.AddCookie(cookie)
+    r.Header.Set(CsrfHeaderName, csrf.Value)
+    if w := doRequestWith(m, r); w.Code != http.StatusOK {
+        t.Errorf("Valid token: expected status %d, got %d", http.StatusOK, w.Code)
+    }
+}
@@ -0,0 +1,420 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "encoding/xml"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "io/ioutil"
+    "net/url"
+    "os"
+    "path"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// Matches root relative links, but not protocol relative ones, in href and src
+// attributes. The second group is the link and the others are around it.
+var rootLinkRegexp = regexp.MustCompile(`(?i)(\b(?:href|src)\s*=\s*["'])(/(?:[^/"'][^"']*)?)(["'])`)
+
+// BuildResult counts what was written by a static build.
+type BuildResult struct {
+    Pages int
+    Posts int
+    Files int
+}
+
+// staticBuilder renders the site to a directory.
+type staticBuilder struct {
+    out    string
+    result BuildResult
+
+    // pages maps the URL of each page to the file it is written to, relative
+    // to the output directory.
+    pages map[string]string
+}
+
+// BuildSite renders every index page, every tag's archive pages, every
+// published post and page and the files attached to them to the directory
+// out, along with the theme assets. Links are rewritten to be relative, so the
+// site can be served from anywhere, including straight from disk.
+func BuildSite(out string) (*BuildResult, error) {
+    posts, err := ListPosts(0, 0, false)
+    if err != nil {
+        return nil, err
+    }
+    pages, err := ListPages(false)
+    if err != nil {
+        return nil, err
+    }
+    allTags, err := CountTags(false)
+    if err != nil {
+        return nil, err
+    }
+
+    // Tags saved before they were checked could write outside of their
+    // directory, so they're left out
+    var tags []TagCount
+    for _, tag := range allTags {
+        if IsValidTag(tag.Tag) {
+            tags = append(tags, tag)
+        }
+    }
+
+    // Work out where everything goes first, so links between pages can be
+    // pointed at the right files. The site's index is written even if there
+    // are no posts, like the server does.
+    b := &staticBuilder{out: out, pages: make(map[string]string)}
+    numPages := make(map[string]int)
+    for _, tag := range append([]TagCount{{Tag: ""}}, tags...) {
+        n, err := IndexPageCount(tag.Tag)
+        if err != nil {
+            return nil, err
+        }
+        if n == 0 {
+            n = 1
+        }
+        numPages[tag.Tag] = n
+        for page := 1; page <= n; page++ {
+            b.pages[indexPageUrl(tag.Tag, page)] = indexPageFile(tag.Tag, page)
+        }
+    }
+    b.pages["/"] = "index.html"
+    for _, post := range append(posts, pages...) {
+        b.pages["/" + post.Slug] = path.Join(post.Slug, "index.html")
+    }
+
+    for tag, n := range numPages {
+        template := "index.html"
+        if tag != "" {
+            template = "tag.html"
+        }
+        for page := 1; page <= n; page++ {
+            v, err := IndexPageValues(tag, page, n)
+            if err != nil {
+                return nil, err
+            }
+            err = b.writePage(indexPageUrl(tag, page), template, v)
+            if err != nil {
+                return nil, err
+            }
+        }
+    }
+
+    for i := range posts {
+        post := &posts[i]
+        err = b.writePage("/" + post.Slug, "post.html", post)
+        if err != nil {
+            return nil, err
+        }
+        err = b.writePostFiles(post)
+        if err != nil {
+            return nil, err
+        }
+        b.result.Posts += 1
+    }
+    for i := range pages {
+        page := &pages[i]
+        err = b.writePage("/" + page.Slug, "page.html", page)
+        if err != nil {
+            return nil, err
+        }
+        err = b.writePostFiles(page)
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    // Feeds and sitemaps need absolute links, so the site's URL must be known
+    if config.SiteUrl != "" {
+        err = b.writeFeeds(tags)
+        if err != nil {
+            return nil, err
+        }
+        err = b.writeSitemap()
+        if err != nil {
+            return nil, err
+        }
+    } else {
+        fmt.Println("Warning: SiteUrl is not set in the config file, so the feeds and sitemap were not built")
+    }
+
+    err = b.copyAssets()
+    if err != nil {
+        return nil, err
+    }
+    return &b.result, nil
+}
+
+// writeSitemap writes the sitemap, any numbered sitemap pages and robots.txt.
+func (b *staticBuilder) writeSitemap() error {
+    siteUrl := strings.TrimSuffix(config.SiteUrl, "/")
+    for page := 0; ; page++ {
+        data, err := MakeSitemap(siteUrl, page)
+        if err == ErrNotFound && page > 0 {
+            break
+        }
+        if err != nil {
+            return err
+        }
+        name := "sitemap.xml"
+        if page > 0 {
+            name = "sitemap-" + strconv.Itoa(page) + ".xml"
+        }
+        err = b.writeFile(name, bytes.NewReader(data))
+        if err != nil {
+            return err
+        }
+    }
+    return b.writeFile("robots.txt", bytes.NewReader(MakeRobotsTxt(siteUrl)))
+}
+
+// writeFeeds writes the RSS, Atom and JSON feeds of the site and of each tag.
+func (b *staticBuilder) writeFeeds(tags []TagCount) error {
+    siteUrl := strings.TrimSuffix(config.SiteUrl, "/")
+    for _, tag := range append([]TagCount{{Tag: ""}}, tags...) {
+        posts, lastModified, err := FeedPosts(tag.Tag)
+        if err != nil {
+            return err
+        }
+        dir := ""
+        if tag.Tag != "" {
+            dir = path.Join("tag", tag.Tag)
+        }
+
+        rss, err := MakeRssFeed(posts, lastModified, siteUrl, tag.Tag)
+        if err != nil {
+            return err
+        }
+        atom, err := MakeAtomFeed(posts, lastModified, siteUrl, tag.Tag)
+        if err != nil {
+            return err
+        }
+        for name, feed := range map[string]interface{}{"feed.xml": rss, "atom.xml": atom} {
+            out, err := xml.MarshalIndent(feed, "", "  ")
+            if err != nil {
+                return err
+            }
+            err = b.writeFile(path.Join(dir, name), strings.NewReader(xml.Header + string(out)))
+            if err != nil {
+                return err
+            }
+        }
+
+        jsonFeed, err := MakeJsonFeed(posts, siteUrl, tag.Tag)
+        if err != nil {
+            return err
+        }
+        out, err := json.Marshal(jsonFeed)
+        if err != nil {
+            return err
+        }
+        err = b.writeFile(path.Join(dir, "feed.json"), bytes.NewReader(out))
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// indexPageUrl is the URL of a page of the index, or of a tag's archive.
+func indexPageUrl(tag string, page int) (string) {
+    base := ""
+    if tag != "" {
+        base = "/tag/" + tag
+    }
+    if page == 1 && tag != "" {
+        return base
+    }
+    return base + "/" + strconv.Itoa(page)
+}
+
+// indexPageFile is the file a page of the index, or of a tag's archive, is
+// written to.
+func indexPageFile(tag string, page int) (string) {
+    dir := ""
+    if tag != "" {
+        dir = path.Join("tag", tag)
+    }
+    if page == 1 {
+        return path.Join(dir, "index.html")
+    }
+    return path.Join(dir, strconv.Itoa(page), "index.html")
+}
+
+// writePage executes a site template and writes the result to the file for
+// the page at the given URL.
+func (b *staticBuilder) writePage(page string, template string, data interface{}) error {
+    buf := &bytes.Buffer{}
+    err := SiteTemplates.ExecuteTemplate(buf, template, data)
+    if err != nil {
+        return err
+    }
+
+    name := b.pages[page]
+    html := rootLinkRegexp.ReplaceAllStringFunc(buf.String(), func(m string) string {
+        parts := rootLinkRegexp.FindStringSubmatch(m)
+        return parts[1] + b.relativeLink(name, parts[2]) + parts[3]
+    })
+
+    err = b.writeFile(name, strings.NewReader(html))
+    if err != nil {
+        return err
+    }
+    b.result.Pages += 1
+    return nil
+}
+
+// writePostFiles writes the files attached to a post next to its page, where
+// ViewFileHandler would serve them from.
+func (b *staticBuilder) writePostFiles(post *Post) error {
+    infos, err := GetMultFileInfoById(post.Files)
+    if err != nil {
+        return err
+    }
+
+    for _, id := range post.Files {
+        info, ok := infos[id]
+        if !ok {
+            fmt.Printf("Warning: post '%s' refers to missing file %s\n", post.Title, id.Hex())
+            continue
+        }
+        if info.Name == "index.html" {
+            fmt.Printf("Warning: skipping file '%s' of post '%s', it would replace the post\n", info.Name, post.Title)
+            continue
+        }
+
+        _, file, err := GetFileById(id)
+        if err != nil {
+            return err
+        }
+        err = b.writeFile(path.Join(post.Slug, info.Name), file)
+        file.Close()
+        if err != nil {
+            return err
+        }
+        b.result.Files += 1
+    }
+    return nil
+}
+
+// copyAssets copies the theme assets to the assets directory.
+func (b *staticBuilder) copyAssets() error {
+    return filepath.Walk(config.AssetsPath, func(p string, info os.FileInfo, err error) error {
+        if err != nil || info.IsDir() {
+            return err
+        }
+        rel, err := filepath.Rel(config.AssetsPath, p)
+        if err != nil {
+            return err
+        }
+
+        file, err := os.Open(p)
+        if err != nil {
+            return err
+        }
+        defer file.Close()
+        return b.writeFile(path.Join("assets", filepath.ToSlash(rel)), file)
+    })
+}
+
+// writeFile writes a file under the output directory, creating directories
+// as needed. name is slash separated.
+func (b *staticBuilder) writeFile(name string, r io.Reader) error {
+    p := filepath.Join(b.out, filepath.FromSlash(name))
+    err := os.MkdirAll(filepath.Dir(p), 0755)
+    if err != nil {
+        return err
+    }
+
+    file, err := os.Create(p)
+    if err != nil {
+        return err
+    }
+    _, err = io.Copy(file, r)
+    if err != nil {
+        file.Close()
+        return err
+    }
+    return file.Close()
+}
+
+// relativeLink rewrites a root relative link found in the file from so it
+// works relative to that file. Links to pages point at their index.html.
+func (b *staticBuilder) relativeLink(from string, link string) (string) {
+    u, err := url.Parse(link)
+    if err != nil {
+        return link
+    }
+
+    p := u.Path
+    if p != "/" {
+        p = strings.TrimSuffix(p, "/")
+    }
+    target, ok := b.pages[p]
+    if !ok {
+        target = strings.TrimPrefix(u.Path, "/")
+    }
+
+    // Count how many directories up the root is from the file
+    rel := strings.Repeat("../", strings.Count(from, "/")) + target
+    if rel == "" {
+        rel = "./"
+    }
+    return (&url.URL{Path: rel, RawQuery: u.RawQuery, Fragment: u.Fragment}).String()
+}
+
+// BuildCommand is the handler for the build command.
+func BuildCommand(args []string) error {
+    flags := flag.NewFlagSet("build", flag.ContinueOnError)
+    out := flags.String("out", "public", "the directory to write the site to")
+    clean := flags.Bool("clean", false, "delete the directory first if it isn't empty")
+    err := flags.Parse(args)
+    if err != nil {
+        return err
+    }
+    if flags.NArg() != 0 || *out == "" {
+        return errors.New("Usage: compose build [-out dir] [-clean]")
+    }
+
+    // Pages left over from an earlier build, such as deleted posts, would
+    // still be published, so only build into an empty directory.
+    entries, err := ioutil.ReadDir(*out)
+    if err == nil && len(entries) > 0 {
+        if !*clean {
+            return fmt.Errorf("The directory '%s' is not empty. Run again with -clean to replace it.", *out)
+        }
+        err = os.RemoveAll(*out)
+        if err != nil {
+            return err
+        }
+    }
+
+    result, err := BuildSite(*out)
+    if err != nil {
+        return err
+    }
+    fmt.Printf("Built %d pages with %d posts and %d files in %s\n", result.Pages, result.Posts, result.Files, *out)
+    return nil
+}
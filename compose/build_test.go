@@ -0,0 +1,193 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "gopkg.in/mgo.v2/bson"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestBuildSite(t *testing.T) {
+    setupTestServer(t)
+    createTestPost(t, "first", false, 3 * time.Hour)
+    createTestPost(t, "second", false, 2 * time.Hour)
+    createTestPost(t, "draft", true, 1 * time.Hour)
+    post := createTestPost(t, "third", false, 0)
+
+    info, err := GetStore().CreateFile("pic.png", strings.NewReader("picture"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    post.Files = []bson.ObjectId{info.Id}
+    post.Body = "![Pic](/third/pic.png) [First](/first/) [Ext](//example.com/x)"
+    _, err = post.Save()
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    out, err := ioutil.TempDir("", "compose")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(out)
+
+    result, err := BuildSite(out)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if result.Pages != 5 || result.Posts != 3 || result.Files != 1 {
+        t.Errorf("Wrong counts %+v", result)
+    }
+
+    read := func(name string) (string) {
+        data, err := ioutil.ReadFile(filepath.Join(out, filepath.FromSlash(name)))
+        if err != nil {
+            t.Fatal(err)
+        }
+        return string(data)
+    }
+
+    index := read("index.html")
+    if !strings.Contains(index, `href="third/index.html"`) || !strings.Contains(index, `href="2/index.html"`) {
+        t.Errorf("Index links not relative: %s", index)
+    }
+    if !strings.Contains(index, `href="assets/css/style.min.css"`) {
+        t.Errorf("Asset link not relative: %s", index)
+    }
+    if !strings.Contains(read("2/index.html"), `href="../index.html"`) {
+        t.Errorf("Second page doesn't link back to the first")
+    }
+
+    third := read("third/index.html")
+    for _, link := range []string{`src="../third/pic.png"`, `href="../first/index.html"`, `href="//example.com/x"`, `href="../assets/css/style.min.css"`} {
+        if !strings.Contains(third, link) {
+            t.Errorf("Post is missing %s: %s", link, third)
+        }
+    }
+    if read("third/pic.png") != "picture" {
+        t.Errorf("Attached file not written")
+    }
+    read("assets/css/style.min.css")
+    for _, name := range []string{"feed.xml", "sitemap.xml"} {
+        if _, err := os.Stat(filepath.Join(out, name)); err == nil {
+            t.Errorf("%s built without a site URL", name)
+        }
+    }
+
+    if _, err := os.Stat(filepath.Join(out, "draft")); err == nil {
+        t.Errorf("Draft was built")
+    }
+}
+
+func TestBuildSiteSkipsDotTags(t *testing.T) {
+    setupTestServer(t)
+    createTestPost(t, "plain", false, time.Hour)
+    dotted := createTestPost(t, "dotted", false, 0)
+    dotted.Tags = []string{"..", "."}
+    dotted.Save()
+    if len(dotted.Tags) != 0 {
+        t.Errorf("Expected the tags to be removed, got %v", dotted.Tags)
+    }
+
+    // Tags saved before they were checked
+    dotted.Tags = []string{"..", ".", "ok"}
+    GetStore().SavePost(dotted)
+
+    out, err := ioutil.TempDir("", "compose")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(out)
+    _, err = BuildSite(out)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // The tag archives would have been written over the site's index
+    index, _ := ioutil.ReadFile(filepath.Join(out, "index.html"))
+    if !strings.Contains(string(index), "plain") {
+        t.Errorf("Expected the site's index, got %s", index)
+    }
+    if _, err := os.Stat(filepath.Join(out, "tag", "index.html")); err == nil {
+        t.Errorf("Expected no archive for the . tag")
+    }
+    if _, err := os.Stat(filepath.Join(out, "tag", "ok", "index.html")); err != nil {
+        t.Errorf("Expected the valid tag to be built, got %v", err)
+    }
+}
+
+func TestBuildSiteFeeds(t *testing.T) {
+    setupTestServer(t)
+    config.SiteUrl = "https://blog.example.com/"
+    SitemapMaxUrls = 2
+    defer func() { SitemapMaxUrls = 50000 }()
+    createTestPost(t, "first", false, time.Hour)
+    createTestPost(t, "second", false, 0)
+
+    out, err := ioutil.TempDir("", "compose")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(out)
+
+    _, err = BuildSite(out)
+    if err != nil {
+        t.Fatal(err)
+    }
+    for _, name := range []string{"feed.xml", "atom.xml", "feed.json", "sitemap.xml", "sitemap-1.xml", "sitemap-2.xml", "robots.txt"} {
+        data, err := ioutil.ReadFile(filepath.Join(out, name))
+        if err != nil {
+            t.Errorf("%s was not built", name)
+            continue
+        }
+        if !strings.Contains(string(data), "https://blog.example.com/") {
+            t.Errorf("%s has no absolute links: %s", name, data)
+        }
+    }
+    if _, err := os.Stat(filepath.Join(out, "sitemap-3.xml")); err == nil {
+        t.Errorf("Too many sitemap pages built")
+    }
+}
+
+func TestBuildCommandRefusesNonEmptyDir(t *testing.T) {
+    setupTestServer(t)
+
+    out, err := ioutil.TempDir("", "compose")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(out)
+    writeTestFiles(t, out, map[string]string{"old/index.html": "stale"})
+
+    err = BuildCommand([]string{"-out", out})
+    if err == nil {
+        t.Fatal("Expected an error for a non-empty directory")
+    }
+
+    err = BuildCommand([]string{"-out", out, "-clean"})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if _, err := os.Stat(filepath.Join(out, "old")); err == nil {
+        t.Errorf("Stale page was not removed")
+    }
+}
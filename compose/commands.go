@@ -0,0 +1,51 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "fmt"
+)
+
+// Commands maps the name of each command line subcommand to its handler. The
+// handler is passed the remaining arguments.
+var Commands = map[string]func(args []string) error {
+    "migrate":          MigrateCommand,
+    "export":           ExportCommand,
+    "import":           ImportCommand,
+    "import-markdown":  ImportMarkdownCommand,
+    "import-wordpress": ImportWordPressCommand,
+    "build":            BuildCommand,
+    "sync":             SyncCommand,
+}
+
+// RunCommand runs the subcommand named by the first argument. Every command
+// except migrate needs the database to be prepared first.
+func RunCommand(args []string) error {
+    command, ok := Commands[args[0]]
+    if !ok {
+        return fmt.Errorf("Unknown command '%s'", args[0])
+    }
+
+    if args[0] != "migrate" {
+        err := PrepareDatabase()
+        if err != nil {
+            return err
+        }
+    }
+
+    return command(args[1:])
+}
@@ -16,13 +16,16 @@
 package main
 
 import (
+    "flag"
     "fmt"
     "github.com/zenazn/goji"
+    "github.com/zenazn/goji/web"
     "html/template"
     "net/http"
     "os"
     "path/filepath"
     "regexp"
+    "time"
 )
 
 var SiteTemplates *template.Template
@@ -33,11 +36,15 @@ func BuildTemplates() error {
     funcMap := template.FuncMap {
         "add": func(a, b int) int { return a+b },
         "sub": func(a, b int) int { return a-b },
+        "tagurl": TagUrl,
+        "menu": SiteMenu,
     }
 
     files := []string{
         "index.html",
         "post.html",
+        "tag.html",
+        "page.html",
     }
 
     for i, file := range files {
@@ -80,9 +87,75 @@ func MakeStaticHandler(prefix, dir string) (http.HandlerFunc) {
     return http.StripPrefix(prefix, http.FileServer(http.Dir(dir))).ServeHTTP
 }
 
+// SetupRoutes registers all of the handlers with the router.
+func SetupRoutes(m *web.Mux) {
+    m.Get(    "/setup",                   SetupHandler)
+    m.Get(    "/admin/assets/*",          MakeStaticHandler("/admin/assets/", config.AdminAssetsPath))
+    m.Get(    "/admin/partials/edit",     MakeRestrictedHttpHandler(AdminEditHandler))
+    m.Get(    "/admin/partials/posts",    MakeRestrictedHttpHandler(AdminPostsHandler))
+    m.Get(    "/admin/partials/settings", MakeRestrictedHttpHandler(AdminSettingsHandler))
+    m.Get(    "/admin/",                  http.RedirectHandler("/admin", http.StatusMovedPermanently))
+    m.Get(    "/admin",                   MakeRestrictedHttpHandler(AdminHandler))
+    m.Get(    "/admin/*",                 MakeRestrictedHttpHandler(AdminHandler))
+    m.Post(   "/upload",                  MakeRestrictedHttpHandler(UploadHandler))
+    m.Get(    "/api/posts",               MakeRestrictedHttpHandler(ApiListPosts))
+    m.Post(   "/api/posts",               MakeRestrictedHttpHandler(ApiCreatePost))
+    m.Get(    "/api/pages",               MakeRestrictedHttpHandler(ApiListPages))
+    m.Post(   "/api/pages",               MakeRestrictedHttpHandler(ApiCreatePage))
+    m.Get(    "/api/post/:id",            MakeRestrictedHttpHandler(ApiGetPost))
+    m.Put(    "/api/post/:id",            MakeRestrictedHttpHandler(ApiUpdatePost))
+    m.Delete( "/api/post/:id",            MakeRestrictedHttpHandler(ApiDeletePost))
+    m.Get(    "/api/post/:id/revisions",  MakeRestrictedHttpHandler(ApiListRevisions))
+    m.Get(    "/api/revision/:id",        MakeRestrictedHttpHandler(ApiGetRevision))
+    m.Get(    "/api/revision/:id/diff",   MakeRestrictedHttpHandler(ApiDiffRevision))
+    m.Post(   "/api/restore/:id",         MakeRestrictedHttpHandler(ApiRestoreRevision))
+    m.Post(   "/api/post/:id/preview",    MakeRestrictedHttpHandler(ApiCreatePreviewLink))
+    m.Post(   "/api/file",                MakeRestrictedHttpHandler(ApiGetFileInfoList))
+    m.Get(    "/api/file/:id",            MakeRestrictedHttpHandler(ApiGetFileInfo))
+    m.Delete( "/api/file/:id",            MakeRestrictedHttpHandler(ApiDeleteFile))
+    m.Get(    "/api/tags",                MakeRestrictedHttpHandler(ApiListTags))
+    m.Get(    "/api/slug",                MakeRestrictedHttpHandler(ApiCheckSlug))
+    m.Get(    "/api/settings",            MakeRestrictedHttpHandler(ApiGetSettings))
+    m.Post(   "/api/settings",            MakeRestrictedHttpHandler(ApiUpdateSettings))
+    m.Post(   "/api/totp",                MakeRestrictedHttpHandler(ApiStartTotp))
+    m.Post(   "/api/totp/enable",         MakeRestrictedHttpHandler(ApiEnableTotp))
+    m.Post(   "/api/totp/disable",        MakeRestrictedHttpHandler(ApiDisableTotp))
+    m.Post(   "/api/totp/recovery",       MakeRestrictedHttpHandler(ApiNewRecoveryCodes))
+    m.Get(    "/api/lockouts",            MakeRestrictedHttpHandler(ApiListLockouts))
+    m.Delete( "/api/lockouts",            MakeRestrictedHttpHandler(ApiClearLockouts))
+    m.Delete( "/api/lockout/:key",        MakeRestrictedHttpHandler(ApiClearLockout))
+    m.Get(    "/assets/*",                MakeStaticHandler("/assets/", config.AssetsPath))
+    m.Get(    "/login",                   LoginHandler)
+    m.Post(   "/login",                   LoginHandler)
+    m.Post(   "/logout",                  LogoutHandler)
+    m.Get(    "/feed.xml",                RssHandler)
+    m.Get(    "/atom.xml",                AtomHandler)
+    m.Get(    "/feed.json",               JsonFeedHandler)
+    m.Get(    "/sitemap.xml",             SitemapHandler)
+    sitemapRegexp := regexp.MustCompile(`^/sitemap-(?P<page>[0-9]+)\.xml$`)
+    m.Get(    sitemapRegexp,              SitemapHandler)
+    m.Get(    "/robots.txt",              RobotsHandler)
+    m.Get(    "/preview/:token",          PreviewHandler)
+    m.Get(    "/preview/:token/:file",    PreviewFileHandler)
+    m.Get(    "/tag/:tag",                TagHandler)
+    m.Get(    "/tag/:tag/feed.xml",       RssHandler)
+    m.Get(    "/tag/:tag/atom.xml",       AtomHandler)
+    m.Get(    "/tag/:tag/feed.json",      JsonFeedHandler)
+    tagPageRegexp := regexp.MustCompile(`^/tag/(?P<tag>[^/]+)/(?P<page>[0-9]+)$`)
+    m.Get(    tagPageRegexp,              TagHandler)
+    indexRegexp := regexp.MustCompile("^/(?P<page>[0-9]*)$")
+    m.Get(    indexRegexp,                IndexHandler)
+    m.Get(    "/:slug",                   ViewHandler)
+    m.Get(    "/:slug/",                  ViewHandlerRemoveTrailingSlash)
+    m.Get(    "/:slug/:file",             ViewFileHandler)
+    m.Get(    "/*",                       ViewNestedPageHandler)
+}
+
 // main is the entry point. Loads the program resources and begins waiting for
 // connections.
 func main() {
+    flag.Parse()
+
     // Create a config file with the defaults
     if !FileExists(ConfigDefaultFilename) {
         config, _ := GetDefaultConfig()
@@ -102,6 +175,13 @@ func main() {
         os.Exit(1)
     }
 
+    // Older config files don't have a secret key for signing links
+    err = config.EnsureSecretKey(ConfigDefaultFilename)
+    if err != nil {
+        fmt.Println("Failed to save a secret key to the config file:", err.Error())
+        os.Exit(1)
+    }
+
     // Build Templates
     err = BuildTemplates()
     if err != nil {
@@ -116,35 +196,30 @@ func main() {
     }
     defer CleanupDatabaseSession()
 
+    // Run a command instead of serving?
+    if flag.NArg() > 0 {
+        err = RunCommand(flag.Args())
+        if err != nil {
+            fmt.Println(err.Error())
+            CleanupDatabaseSession()
+            os.Exit(1)
+        }
+        return
+    }
+
+    // Make sure the database schema and indexes are up to date
+    err = PrepareDatabase()
+    if err != nil {
+        fmt.Println("Failed to prepare the database:", err.Error())
+        CleanupDatabaseSession()
+        os.Exit(1)
+    }
+
+    // Logins expire, so clear out the old ones now and then
+    StartSessionSweeper(time.Hour)
+
     // Setup the router
-    goji.Get(    "/setup",                   SetupHandler)
-    goji.Get(    "/admin/assets/*",          MakeStaticHandler("/admin/assets/", config.AdminAssetsPath))
-    goji.Get(    "/admin/partials/edit",     MakeRestrictedHttpHandler(AdminEditHandler))
-    goji.Get(    "/admin/partials/posts",    MakeRestrictedHttpHandler(AdminPostsHandler))
-    goji.Get(    "/admin/partials/settings", MakeRestrictedHttpHandler(AdminSettingsHandler))
-    goji.Get(    "/admin/",                  http.RedirectHandler("/admin", http.StatusMovedPermanently))
-    goji.Get(    "/admin",                   MakeRestrictedHttpHandler(AdminHandler))
-    goji.Get(    "/admin/*",                 MakeRestrictedHttpHandler(AdminHandler))
-    goji.Post(   "/upload",                  MakeRestrictedHttpHandler(UploadHandler))
-    goji.Get(    "/api/posts",               MakeRestrictedHttpHandler(ApiListPosts))
-    goji.Post(   "/api/posts",               MakeRestrictedHttpHandler(ApiCreatePost))
-    goji.Get(    "/api/post/:id",            MakeRestrictedHttpHandler(ApiGetPost))
-    goji.Put(    "/api/post/:id",            MakeRestrictedHttpHandler(ApiUpdatePost))
-    goji.Delete( "/api/post/:id",            MakeRestrictedHttpHandler(ApiDeletePost))
-    goji.Post(   "/api/file",                MakeRestrictedHttpHandler(ApiGetFileInfoList))
-    goji.Get(    "/api/file/:id",            MakeRestrictedHttpHandler(ApiGetFileInfo))
-    goji.Delete( "/api/file/:id",            MakeRestrictedHttpHandler(ApiDeleteFile))
-    goji.Get(    "/api/settings",            MakeRestrictedHttpHandler(ApiGetSettings))
-    goji.Post(   "/api/settings",            MakeRestrictedHttpHandler(ApiUpdateSettings))
-    goji.Get(    "/assets/*",                MakeStaticHandler("/assets/", config.AssetsPath))
-    goji.Get(    "/login",                   LoginHandler)
-    goji.Post(   "/login",                   LoginHandler)
-    goji.Get(    "/logout",                  LogoutHandler)
-    indexRegexp := regexp.MustCompile("^/(?P<page>[0-9]*)$")
-    goji.Get(    indexRegexp,                IndexHandler)
-    goji.Get(    "/:slug",                   ViewHandler)
-    goji.Get(    "/:slug/",                  ViewHandlerRemoveTrailingSlash)
-    goji.Get(    "/:slug/:file",             ViewFileHandler)
+    SetupRoutes(goji.DefaultMux)
 
     // Begin serving
     goji.Serve()
@@ -0,0 +1,132 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "github.com/zenazn/goji/web"
+    "io"
+    "net/http"
+    "net/http/httptest"
+    "path/filepath"
+    "testing"
+    "time"
+)
+
+// setupTestServer points the config at the bundled themes, replaces the store
+// with an empty MemoryStore, empties the caches and returns a router with all
+// of the routes.
+func setupTestServer(t *testing.T) (*web.Mux) {
+    config = &Config{
+        DatabaseBackend:     "memory",
+        AssetsPath:          filepath.Join("..", "theme_site",  "dist", "assets"),
+        TemplatesPath:       filepath.Join("..", "theme_site",  "dist", "templates"),
+        AdminAssetsPath:     filepath.Join("..", "theme_admin", "dist", "assets"),
+        AdminTemplatesPath:  filepath.Join("..", "theme_admin", "dist", "templates"),
+        IndexPostsPerPage:   2,
+        AutoMigrate:         true,
+        SiteTitle:           "Test Blog",
+        FeedItems:           3,
+        FeedFullContent:     true,
+        SessionMaxDays:      30,
+        SessionIdleHours:    72,
+        LoginFreeAttempts:   3,
+        LoginBackoffSeconds: 1,
+        LoginMaxAttempts:    10,
+        LoginLockoutMinutes: 15,
+    }
+
+    // Cheap password hashes keep the tests fast
+    PasswordHashParams.Memory = 1024
+
+    err := BuildTemplates()
+    if err != nil {
+        t.Fatal("Failed to build templates:", err)
+    }
+
+    err = SetupDatabaseSession()
+    if err != nil {
+        t.Fatal("Failed to setup database:", err)
+    }
+    siteCache.Invalidate()
+    loginThrottle.Clear("")
+
+    m := web.New()
+    SetupRoutes(m)
+    return m
+}
+
+// doRequest sends a request through the router and records the response. If
+// cookie is not nil, it is sent with the request.
+func doRequest(m *web.Mux, method, path string, body io.Reader, cookie *http.Cookie) (*httptest.ResponseRecorder) {
+    r, err := http.NewRequest(method, path, body)
+    if err != nil {
+        panic(err)
+    }
+    if cookie != nil {
+        addSessionCookie(r, cookie)
+    }
+    return doRequestWith(m, r)
+}
+
+// addSessionCookie adds a session cookie to a request, along with the CSRF
+// token of its session.
+func addSessionCookie(r *http.Request, cookie *http.Cookie) {
+    r.AddCookie(cookie)
+    if session, err := FindSessionByToken(cookie.Value); err == nil {
+        r.Header.Set(CsrfHeaderName, session.CsrfToken)
+    }
+}
+
+// doRequestWith sends a prepared request through the router and records the
+// response.
+func doRequestWith(m *web.Mux, r *http.Request) (*httptest.ResponseRecorder) {
+    w := httptest.NewRecorder()
+    m.ServeHTTP(w, r)
+    return w
+}
+
+// loginTestUser creates the default admin user and returns a valid session
+// cookie for it.
+func loginTestUser(t *testing.T) (*http.Cookie) {
+    err := Setup()
+    if err != nil {
+        t.Fatal("Setup failed:", err)
+    }
+
+    session, err := Login("admin@example.com", "secret")
+    if err != nil {
+        t.Fatal("Login failed:", err)
+    }
+
+    return &http.Cookie{Name: CookieName, Value: session.Token}
+}
+
+// createTestPost saves a new post with the given slug, publication state and
+// age.
+func createTestPost(t *testing.T, slug string, draft bool, age time.Duration) (*Post) {
+    post, _ := CreatePost()
+    post.Title = "Title of " + slug
+    post.Slug = slug
+    post.Draft = draft
+    post.Date = time.Now().Add(-age)
+    post.Body = "Body of " + slug
+    _, err := post.Save()
+    if err != nil {
+        t.Fatal("Failed to save post:", err)
+    }
+    return post
+}
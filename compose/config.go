@@ -16,6 +16,8 @@
 package main
 
 import (
+    "crypto/rand"
+    "encoding/hex"
     "encoding/json"
     "errors"
     "os"
@@ -27,13 +29,35 @@ const (
 )
 
 type Config struct {
-    DatabaseHost       string
-    DatabaseName       string
-    AssetsPath         string
-    TemplatesPath      string
-    AdminAssetsPath    string
-    AdminTemplatesPath string
-    IndexPostsPerPage  int
+    DatabaseBackend     string
+    DatabaseHost        string
+    DatabaseName        string
+    DatabasePath        string
+    AssetsPath          string
+    TemplatesPath       string
+    AdminAssetsPath     string
+    AdminTemplatesPath  string
+    IndexPostsPerPage   int
+    AutoMigrate         bool
+    GitSyncPath         string
+    SiteTitle           string
+    SiteUrl             string
+    FeedItems           int
+    FeedFullContent     bool
+    RobotsTxt           string
+    RevisionsKept       int
+    RevisionMaxDays     int
+    SecretKey           string
+    PreviewLinkHours    int
+    SessionMaxDays      int
+    SessionIdleHours    int
+    CookieSecure        bool
+    CookieSameSite      string
+    LoginFreeAttempts   int
+    LoginBackoffSeconds int
+    LoginMaxAttempts    int
+    LoginLockoutMinutes int
+    TrustedProxies      []string
 }
 
 var config *Config = nil
@@ -49,16 +73,48 @@ func GetDefaultConfig() (*Config, error) {
     src_path := filepath.Join(gopath, "src", "github.com", "mborgerson", "Compose")
 
     return &Config{
-        DatabaseHost:       "127.0.0.1",
-        DatabaseName:       "compose",
-        AssetsPath:         filepath.Join(src_path, "theme_site",  "dist", "assets"),
-        TemplatesPath:      filepath.Join(src_path, "theme_site",  "dist", "templates"),
-        AdminAssetsPath:    filepath.Join(src_path, "theme_admin", "dist", "assets"),
-        AdminTemplatesPath: filepath.Join(src_path, "theme_admin", "dist", "templates"),
-        IndexPostsPerPage:  5,
+        DatabaseBackend:     "mongo",
+        DatabaseHost:        "127.0.0.1",
+        DatabaseName:        "compose",
+        DatabasePath:        "compose.db",
+        AssetsPath:          filepath.Join(src_path, "theme_site",  "dist", "assets"),
+        TemplatesPath:       filepath.Join(src_path, "theme_site",  "dist", "templates"),
+        AdminAssetsPath:     filepath.Join(src_path, "theme_admin", "dist", "assets"),
+        AdminTemplatesPath:  filepath.Join(src_path, "theme_admin", "dist", "templates"),
+        IndexPostsPerPage:   5,
+        AutoMigrate:         true,
+        GitSyncPath:         "",
+        SiteTitle:           "Compose",
+        SiteUrl:             "",
+        FeedItems:           20,
+        FeedFullContent:     true,
+        RobotsTxt:           "User-agent: *\nDisallow: /admin\n",
+        RevisionsKept:       50,
+        RevisionMaxDays:     0,
+        SecretKey:           NewSecretKey(),
+        PreviewLinkHours:    72,
+        SessionMaxDays:      30,
+        SessionIdleHours:    72,
+        CookieSecure:        false,
+        CookieSameSite:      "Lax",
+        LoginFreeAttempts:   3,
+        LoginBackoffSeconds: 1,
+        LoginMaxAttempts:    10,
+        LoginLockoutMinutes: 15,
+        TrustedProxies:      []string{},
     }, nil
 }
 
+// NewSecretKey generates a random key for signing links.
+func NewSecretKey() (string) {
+    key := make([]byte, 32)
+    _, err := rand.Read(key)
+    if err != nil {
+        panic(err)
+    }
+    return hex.EncodeToString(key)
+}
+
 // FileExists returns a bool indicating whether the path exists or not.
 func FileExists(path string) (bool) {
     _, err := os.Stat(path)
@@ -76,6 +132,7 @@ func LoadConfig(filename string) (*Config, error) {
     // Decode the config
     decoder := json.NewDecoder(file)
     config, _ := GetDefaultConfig()
+    config.SecretKey = ""
     err = decoder.Decode(config)
     if err != nil {
         return nil, err
@@ -115,4 +172,15 @@ func (c *Config) Save(filename string) (error) {
     }
     file.Write(encoding)
     return err
+}
+
+// EnsureSecretKey gives a configuration that was made before there was a
+// secret key a new one, and saves it, so that signed links keep working from
+// one run to the next.
+func (c *Config) EnsureSecretKey(filename string) (error) {
+    if c.SecretKey != "" {
+        return nil
+    }
+    c.SecretKey = NewSecretKey()
+    return c.Save(filename)
 }
\ No newline at end of file
@@ -17,32 +17,46 @@ package main
 
 import (
     "errors"
-    "gopkg.in/mgo.v2"
+    "fmt"
 )
 
-var MongoSession *mgo.Session
+var store Store = nil
 
-// SetupDatabaseSession initializes the session.
+// SetupDatabaseSession opens the storage backend selected by the config.
 func SetupDatabaseSession() error { 
-    mongoSession, err := mgo.Dial(config.DatabaseHost)
-    if err != nil {
-        return err
+    var err error
+    switch config.DatabaseBackend {
+    case "", "mongo":
+        store, err = OpenMongoStore(config.DatabaseHost, config.DatabaseName)
+    case "bolt":
+        store, err = OpenBoltStore(config.DatabasePath)
+    case "memory":
+        store = NewMemoryStore()
+    default:
+        err = fmt.Errorf("Unknown database backend '%s'", config.DatabaseBackend)
     }
-    mongoSession.SetMode(mgo.Monotonic, true)
-    MongoSession = mongoSession
-    return nil
+    return err
 }
 
-// GetDatabaseHandle gets the current database session handle.
-func GetDatabaseHandle() (*mgo.Database) {
-    if MongoSession == nil {
+// GetStore gets the current storage backend.
+func GetStore() (Store) {
+    if store == nil {
         panic(errors.New("No session available"))
     }
-    return MongoSession.DB(config.DatabaseName)
+    return store
+}
+
+// PrepareDatabase makes sure the database schema is up to date and that all
+// the indexes exist.
+func PrepareDatabase() error {
+    err := PrepareSchema(GetStore())
+    if err != nil {
+        return err
+    }
+    return GetStore().EnsureIndexes()
 }
 
-// CleanupDatabaseSession closes the current session.
+// CleanupDatabaseSession closes the current storage backend.
 func CleanupDatabaseSession() error {
-    MongoSession.Close()
-    return nil
-}
\ No newline at end of file
+    return store.Close()
+}
@@ -0,0 +1,445 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "encoding/json"
+    "encoding/xml"
+    "github.com/zenazn/goji/web"
+    "html/template"
+    "mime"
+    "net/http"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// Length of the post snippets in feeds that don't include the full posts.
+const FeedSnippetLength = 300
+
+// RssFeed is an RSS 2.0 document.
+type RssFeed struct {
+    XMLName xml.Name   `xml:"rss"`
+    Version string     `xml:"version,attr"`
+    AtomNs  string     `xml:"xmlns:atom,attr"`
+    Channel RssChannel `xml:"channel"`
+}
+
+// RssChannel describes the site and lists its latest posts.
+type RssChannel struct {
+    Title         string    `xml:"title"`
+    Link          string    `xml:"link"`
+    Description   string    `xml:"description"`
+    LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+    Self          AtomLink  `xml:"atom:link"`
+    Items         []RssItem `xml:"item"`
+}
+
+// RssItem is a post in an RSS feed.
+type RssItem struct {
+    Title       string  `xml:"title"`
+    Link        string  `xml:"link"`
+    Guid        RssGuid `xml:"guid"`
+    PubDate     string  `xml:"pubDate"`
+    Description string  `xml:"description"`
+}
+
+// RssGuid identifies an RSS item. The permalink is used.
+type RssGuid struct {
+    IsPermaLink bool   `xml:"isPermaLink,attr"`
+    Value       string `xml:",chardata"`
+}
+
+// AtomFeed is an Atom 1.0 document.
+type AtomFeed struct {
+    XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+    Title   string      `xml:"title"`
+    Id      string      `xml:"id"`
+    Updated string      `xml:"updated"`
+    Author  AtomPerson  `xml:"author"`
+    Links   []AtomLink  `xml:"link"`
+    Entries []AtomEntry `xml:"entry"`
+}
+
+// AtomPerson is the author of an Atom feed.
+type AtomPerson struct {
+    Name string `xml:"name"`
+}
+
+// AtomLink is a link from an Atom feed or entry.
+type AtomLink struct {
+    Rel  string `xml:"rel,attr,omitempty"`
+    Type string `xml:"type,attr,omitempty"`
+    Href string `xml:"href,attr"`
+}
+
+// AtomEntry is a post in an Atom feed.
+type AtomEntry struct {
+    Title     string      `xml:"title"`
+    Id        string      `xml:"id"`
+    Link      AtomLink    `xml:"link"`
+    Published string      `xml:"published"`
+    Updated   string      `xml:"updated"`
+    Content   AtomContent `xml:"content"`
+}
+
+// AtomContent is the HTML body of an Atom entry.
+type AtomContent struct {
+    Type string `xml:"type,attr"`
+    Body string `xml:",chardata"`
+}
+
+// JsonFeed is a JSON Feed 1.1 document.
+type JsonFeed struct {
+    Version     string         `json:"version"`
+    Title       string         `json:"title"`
+    HomePageUrl string         `json:"home_page_url"`
+    FeedUrl     string         `json:"feed_url"`
+    Items       []JsonFeedItem `json:"items"`
+}
+
+// JsonFeedItem is a post in a JSON Feed.
+type JsonFeedItem struct {
+    Id            string               `json:"id"`
+    Url           string               `json:"url"`
+    Title         string               `json:"title"`
+    ContentHtml   string               `json:"content_html"`
+    DatePublished string               `json:"date_published"`
+    DateModified  string               `json:"date_modified"`
+    Tags          []string             `json:"tags,omitempty"`
+    Attachments   []JsonFeedAttachment `json:"attachments,omitempty"`
+}
+
+// JsonFeedAttachment is a file attached to a post in a JSON Feed.
+type JsonFeedAttachment struct {
+    Url         string `json:"url"`
+    MimeType    string `json:"mime_type"`
+    Title       string `json:"title"`
+    SizeInBytes int64  `json:"size_in_bytes"`
+}
+
+// SiteUrl gets the URL the site is served from, without a trailing slash. The
+// SiteUrl setting is used if there is one, otherwise it is worked out from the
+// request.
+func SiteUrl(r *http.Request) (string) {
+    if config.SiteUrl != "" {
+        return strings.TrimSuffix(config.SiteUrl, "/")
+    }
+
+    scheme := "http"
+    if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+        scheme = "https"
+    }
+    return scheme + "://" + r.Host
+}
+
+// AbsoluteLinks makes the root relative links in a post's HTML absolute, as
+// feed readers show posts away from the site.
+func AbsoluteLinks(html string, siteUrl string) (string) {
+    return rootLinkRegexp.ReplaceAllString(html, "${1}" + strings.Replace(siteUrl, "$", "$$", -1) + "${2}${3}")
+}
+
+// FeedPosts gets the posts shown in feeds and when the newest change to them
+// was made. If tag is set, only posts with that tag are included.
+func FeedPosts(tag string) ([]Post, time.Time, error) {
+    var posts []Post
+    var err error
+    if tag == "" {
+        posts, err = ListPosts(0, config.FeedItems, false)
+    } else {
+        posts, err = ListPostsByTag(tag, 0, config.FeedItems, false)
+    }
+    if err != nil {
+        return nil, time.Time{}, err
+    }
+
+    var lastModified time.Time
+    for _, post := range posts {
+        if post.PublicModified().After(lastModified) {
+            lastModified = post.PublicModified()
+        }
+    }
+    return posts, lastModified, nil
+}
+
+// feedLastModified gets the Last-Modified time of a feed, given the newest
+// change to its posts. A post that's deleted, unpublished or pushed out of the
+// feed leaves nothing in it to date the change by, so the last change to any
+// post counts too. Empty feeds have no Last-Modified time.
+func feedLastModified(newest time.Time) (time.Time) {
+    if newest.IsZero() {
+        return newest
+    }
+    if changed := siteCache.Changed(); changed.After(newest) {
+        return changed
+    }
+    return newest
+}
+
+// feedTitle is the title of the feed for a tag, or the whole site.
+func feedTitle(tag string) (string) {
+    if tag == "" {
+        return config.SiteTitle
+    }
+    return config.SiteTitle + ": " + tag
+}
+
+// feedHome is the URL of the page a feed for a tag, or the whole site, is
+// about.
+func feedHome(siteUrl string, tag string) (string) {
+    if tag == "" {
+        return siteUrl + "/"
+    }
+    return siteUrl + TagUrl(tag)
+}
+
+// feedUrl is the URL of one of the feeds for a tag, or the whole site.
+func feedUrl(siteUrl string, tag string, name string) (string) {
+    if tag == "" {
+        return siteUrl + "/" + name
+    }
+    return siteUrl + TagUrl(tag) + "/" + name
+}
+
+// FeedContent renders the HTML shown for a post in feeds, which is either the
+// whole post or a snippet, depending on the FeedFullContent setting.
+func FeedContent(post *Post, siteUrl string) (string, error) {
+    var html template.HTML
+    var err error
+    if config.FeedFullContent {
+        html, err = post.RenderBody()
+    } else {
+        html, err = post.RenderBodySnippet(FeedSnippetLength, "...")
+    }
+    if err != nil {
+        return "", err
+    }
+    return AbsoluteLinks(string(html), siteUrl), nil
+}
+
+// MakeRssFeed builds the RSS feed for the given posts.
+func MakeRssFeed(posts []Post, lastModified time.Time, siteUrl string, tag string) (*RssFeed, error) {
+    home := feedHome(siteUrl, tag)
+    feed := &RssFeed{
+        Version: "2.0",
+        AtomNs:  "http://www.w3.org/2005/Atom",
+        Channel: RssChannel{
+            Title:       feedTitle(tag),
+            Link:        home,
+            Description: feedTitle(tag),
+            Self:        AtomLink{Rel: "self", Type: "application/rss+xml", Href: feedUrl(siteUrl, tag, "feed.xml")},
+        },
+    }
+    if !lastModified.IsZero() {
+        feed.Channel.LastBuildDate = lastModified.UTC().Format(time.RFC1123Z)
+    }
+
+    for i := range posts {
+        post := &posts[i]
+        content, err := FeedContent(post, siteUrl)
+        if err != nil {
+            return nil, err
+        }
+        link := siteUrl + "/" + post.Slug
+        feed.Channel.Items = append(feed.Channel.Items, RssItem{
+            Title:       post.Title,
+            Link:        link,
+            Guid:        RssGuid{IsPermaLink: true, Value: link},
+            PubDate:     post.Date.UTC().Format(time.RFC1123Z),
+            Description: content,
+        })
+    }
+    return feed, nil
+}
+
+// MakeAtomFeed builds the Atom feed for the given posts.
+func MakeAtomFeed(posts []Post, lastModified time.Time, siteUrl string, tag string) (*AtomFeed, error) {
+    // A feed with no posts was last updated when the site began
+    if lastModified.IsZero() {
+        lastModified = time.Unix(0, 0)
+    }
+
+    home := feedHome(siteUrl, tag)
+    feed := &AtomFeed{
+        Title:   feedTitle(tag),
+        Id:      home,
+        Updated: lastModified.UTC().Format(time.RFC3339),
+        Author:  AtomPerson{Name: config.SiteTitle},
+        Links:   []AtomLink{
+            {Rel: "alternate", Type: "text/html", Href: home},
+            {Rel: "self", Type: "application/atom+xml", Href: feedUrl(siteUrl, tag, "atom.xml")},
+        },
+    }
+
+    for i := range posts {
+        post := &posts[i]
+        content, err := FeedContent(post, siteUrl)
+        if err != nil {
+            return nil, err
+        }
+        link := siteUrl + "/" + post.Slug
+        feed.Entries = append(feed.Entries, AtomEntry{
+            Title:     post.Title,
+            Id:        link,
+            Link:      AtomLink{Rel: "alternate", Type: "text/html", Href: link},
+            Published: post.Date.UTC().Format(time.RFC3339),
+            Updated:   post.PublicModified().UTC().Format(time.RFC3339),
+            Content:   AtomContent{Type: "html", Body: content},
+        })
+    }
+    return feed, nil
+}
+
+// MakeJsonFeed builds the JSON Feed for the given posts.
+func MakeJsonFeed(posts []Post, siteUrl string, tag string) (*JsonFeed, error) {
+    feed := &JsonFeed{
+        Version:     "https://jsonfeed.org/version/1.1",
+        Title:       feedTitle(tag),
+        HomePageUrl: feedHome(siteUrl, tag),
+        FeedUrl:     feedUrl(siteUrl, tag, "feed.json"),
+        Items:       []JsonFeedItem{},
+    }
+
+    for i := range posts {
+        post := &posts[i]
+        content, err := FeedContent(post, siteUrl)
+        if err != nil {
+            return nil, err
+        }
+        link := siteUrl + "/" + post.Slug
+        item := JsonFeedItem{
+            Id:            post.Id.Hex(),
+            Url:           link,
+            Title:         post.Title,
+            ContentHtml:   content,
+            DatePublished: post.Date.UTC().Format(time.RFC3339),
+            DateModified:  post.PublicModified().UTC().Format(time.RFC3339),
+            Tags:          post.Tags,
+        }
+
+        infos, err := GetMultFileInfoById(post.Files)
+        if err != nil {
+            return nil, err
+        }
+        for _, id := range post.Files {
+            info := infos[id]
+            if info == nil {
+                continue
+            }
+            mimeType := mime.TypeByExtension(filepath.Ext(info.Name))
+            if mimeType == "" {
+                mimeType = "application/octet-stream"
+            }
+            item.Attachments = append(item.Attachments, JsonFeedAttachment{
+                Url:         siteUrl + PostFileUrl(post.Slug, info.Name),
+                MimeType:    mimeType,
+                Title:       info.Name,
+                SizeInBytes: info.Size,
+            })
+        }
+        feed.Items = append(feed.Items, item)
+    }
+    return feed, nil
+}
+
+// writeFeed sends a feed as XML.
+func writeFeed(w http.ResponseWriter, contentType string, lastModified time.Time, feed interface{}) {
+    out, err := xml.MarshalIndent(feed, "", "  ")
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", contentType + "; charset=utf-8")
+    if !lastModified.IsZero() {
+        w.Header().Set("Last-Modified", lastModified.UTC().Format(HttpDateTimeFormat))
+    }
+    w.Write([]byte(xml.Header))
+    w.Write(out)
+}
+
+// RssHandler is the handler for the RSS feeds of the site and of each tag.
+func RssHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+    tag := c.URLParams["tag"]
+    posts, lastModified, err := FeedPosts(tag)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    validator := feedLastModified(lastModified)
+    if !validator.IsZero() && CheckModifiedHandler(w, r, validator) {
+        // Not modified
+        return
+    }
+
+    feed, err := MakeRssFeed(posts, lastModified, SiteUrl(r), tag)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    writeFeed(w, "application/rss+xml", validator, feed)
+}
+
+// JsonFeedHandler is the handler for the JSON Feeds of the site and of each
+// tag.
+func JsonFeedHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+    tag := c.URLParams["tag"]
+    posts, lastModified, err := FeedPosts(tag)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    validator := feedLastModified(lastModified)
+    if !validator.IsZero() && CheckModifiedHandler(w, r, validator) {
+        // Not modified
+        return
+    }
+
+    feed, err := MakeJsonFeed(posts, SiteUrl(r), tag)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    w.Header().Set("Content-Type", "application/feed+json; charset=utf-8")
+    if !validator.IsZero() {
+        w.Header().Set("Last-Modified", validator.UTC().Format(HttpDateTimeFormat))
+    }
+    json.NewEncoder(w).Encode(feed)
+}
+
+// AtomHandler is the handler for the Atom feeds of the site and of each tag.
+func AtomHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+    tag := c.URLParams["tag"]
+    posts, lastModified, err := FeedPosts(tag)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    validator := feedLastModified(lastModified)
+    if !validator.IsZero() && CheckModifiedHandler(w, r, validator) {
+        // Not modified
+        return
+    }
+
+    feed, err := MakeAtomFeed(posts, lastModified, SiteUrl(r), tag)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    writeFeed(w, "application/atom+xml", validator, feed)
+}
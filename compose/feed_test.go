@@ -0,0 +1,225 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "encoding/json"
+    "encoding/xml"
+    "gopkg.in/mgo.v2/bson"
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestRssFeed(t *testing.T) {
+    m := setupTestServer(t)
+    config.SiteUrl = "http://blog.example.com/"
+    for i, slug := range []string{"one", "two", "three", "four"} {
+        createTestPost(t, slug, false, time.Duration(i + 1) * time.Hour)
+    }
+    createTestPost(t, "draft", true, 0)
+    post, _ := FindPostBySlug("one")
+    post.Body = "![Pic](/one/pic.png) [Two](/two)"
+    post.Save()
+
+    w := doRequest(m, "GET", "/feed.xml", nil, nil)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    if w.Header().Get("Content-Type") != "application/rss+xml; charset=utf-8" {
+        t.Errorf("Wrong content type %s", w.Header().Get("Content-Type"))
+    }
+
+    var rss struct {
+        Channel struct {
+            Title string `xml:"title"`
+            Items []struct {
+                Title       string `xml:"title"`
+                Link        string `xml:"link"`
+                PubDate     string `xml:"pubDate"`
+                Description string `xml:"description"`
+            } `xml:"item"`
+        } `xml:"channel"`
+    }
+    err := xml.Unmarshal(w.Body.Bytes(), &rss)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if rss.Channel.Title != "Test Blog" || len(rss.Channel.Items) != 3 {
+        t.Fatalf("Wrong feed: %+v", rss)
+    }
+    item := rss.Channel.Items[0]
+    if item.Title != "Title of one" || item.Link != "http://blog.example.com/one" {
+        t.Errorf("Wrong item: %+v", item)
+    }
+    if _, err := time.Parse(time.RFC1123Z, item.PubDate); err != nil {
+        t.Errorf("Bad date: %s", item.PubDate)
+    }
+    if !strings.Contains(item.Description, `src="http://blog.example.com/one/pic.png"`) || !strings.Contains(item.Description, `href="http://blog.example.com/two"`) {
+        t.Errorf("Links not made absolute: %s", item.Description)
+    }
+
+    // Conditional requests
+    r, _ := http.NewRequest("GET", "/feed.xml", nil)
+    r.Header.Set("If-Modified-Since", w.Header().Get("Last-Modified"))
+    w = doRequestWith(m, r)
+    if w.Code != http.StatusNotModified {
+        t.Errorf("Expected status %d, got %d", http.StatusNotModified, w.Code)
+    }
+}
+
+func TestAtomFeed(t *testing.T) {
+    m := setupTestServer(t)
+    config.FeedFullContent = false
+    post := createTestPost(t, "long", false, time.Hour)
+    post.Body = strings.Repeat("word ", 200)
+    post.Save()
+
+    r, _ := http.NewRequest("GET", "/atom.xml", nil)
+    r.Host = "example.org"
+    w := doRequestWith(m, r)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+    }
+
+    var feed AtomFeed
+    err := xml.Unmarshal(w.Body.Bytes(), &feed)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if feed.Id != "http://example.org/" || len(feed.Entries) != 1 {
+        t.Fatalf("Wrong feed: %+v", feed)
+    }
+    entry := feed.Entries[0]
+    if entry.Link.Href != "http://example.org/long" || entry.Content.Type != "html" {
+        t.Errorf("Wrong entry: %+v", entry)
+    }
+    if entry.Updated != post.LastModified.UTC().Format(time.RFC3339) || entry.Updated != feed.Updated {
+        t.Errorf("Wrong updated time %s", entry.Updated)
+    }
+    if len(entry.Content.Body) > FeedSnippetLength + 50 || !strings.Contains(entry.Content.Body, "...") {
+        t.Errorf("Expected a snippet, got %s", entry.Content.Body)
+    }
+}
+
+func TestJsonFeed(t *testing.T) {
+    m := setupTestServer(t)
+    config.SiteUrl = "https://blog.example.com"
+    post := createTestPost(t, "with-file", false, time.Hour)
+    info, err := GetStore().CreateFile("photo.jpg", strings.NewReader("jpeg data"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    post.Files = []bson.ObjectId{info.Id}
+    post.Tags = []string{"photos"}
+    post.Save()
+    createTestPost(t, "draft", true, 0)
+
+    w := doRequest(m, "GET", "/feed.json", nil, nil)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    if w.Header().Get("Content-Type") != "application/feed+json; charset=utf-8" {
+        t.Errorf("Wrong content type %s", w.Header().Get("Content-Type"))
+    }
+
+    var feed JsonFeed
+    err = json.Unmarshal(w.Body.Bytes(), &feed)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if feed.Version != "https://jsonfeed.org/version/1.1" || feed.FeedUrl != "https://blog.example.com/feed.json" || len(feed.Items) != 1 {
+        t.Fatalf("Wrong feed: %+v", feed)
+    }
+    item := feed.Items[0]
+    if item.Id != post.Id.Hex() || item.Url != "https://blog.example.com/with-file" || item.ContentHtml != "<p>Body of with-file</p>\n" {
+        t.Errorf("Wrong item: %+v", item)
+    }
+    if item.DatePublished != post.Date.UTC().Format(time.RFC3339) || item.DateModified != post.LastModified.UTC().Format(time.RFC3339) {
+        t.Errorf("Wrong dates: %+v", item)
+    }
+    if len(item.Tags) != 1 || len(item.Attachments) != 1 {
+        t.Fatalf("Wrong tags or attachments: %+v", item)
+    }
+    attachment := item.Attachments[0]
+    if attachment.Url != "https://blog.example.com/with-file/photo.jpg" || attachment.MimeType != "image/jpeg" || attachment.SizeInBytes != 9 {
+        t.Errorf("Wrong attachment: %+v", attachment)
+    }
+
+    r, _ := http.NewRequest("GET", "/feed.json", nil)
+    r.Header.Set("If-Modified-Since", w.Header().Get("Last-Modified"))
+    w = doRequestWith(m, r)
+    if w.Code != http.StatusNotModified {
+        t.Errorf("Expected status %d, got %d", http.StatusNotModified, w.Code)
+    }
+}
+
+// ageTestPosts makes every post, and the last change to the site, look two
+// hours old.
+func ageTestPosts(t *testing.T) {
+    posts, _ := ListPosts(0, 0, true)
+    for i := range posts {
+        posts[i].LastModified = posts[i].LastModified.Add(-2 * time.Hour)
+        GetStore().SavePost(&posts[i])
+    }
+    siteCache.changed = time.Now().Add(-2 * time.Hour)
+}
+
+func TestFeedChangesOnDelete(t *testing.T) {
+    m := setupTestServer(t)
+    createTagged := func(slug string, age time.Duration) (*Post) {
+        post := createTestPost(t, slug, false, age)
+        post.Tags = []string{"news"}
+        post.Save()
+        return post
+    }
+    createTagged("old", 3 * time.Hour)
+    newest := createTagged("newest", time.Minute)
+    ageTestPosts(t)
+
+    paths := []string{"/feed.xml", "/atom.xml", "/feed.json", "/tag/news/feed.xml", "/tag/news/atom.xml", "/tag/news/feed.json"}
+    for _, path := range paths {
+        w := doRequest(m, "GET", path, nil, nil)
+        lastModified := w.Header().Get("Last-Modified")
+
+        // Deleting the newest post leaves an older one at the top, but the
+        // feed has still changed
+        newest.Delete()
+        r, _ := http.NewRequest("GET", path, nil)
+        r.Header.Set("If-Modified-Since", lastModified)
+        w = doRequestWith(m, r)
+        if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "/newest") {
+            t.Errorf("GET %s: expected the feed without the deleted post, got %d", path, w.Code)
+        }
+
+        newest = createTagged("newest", time.Minute)
+        ageTestPosts(t)
+    }
+}
+
+func TestFeedEmpty(t *testing.T) {
+    m := setupTestServer(t)
+    for _, path := range []string{"/feed.xml", "/atom.xml", "/feed.json"} {
+        r, _ := http.NewRequest("GET", path, nil)
+        r.Header.Set("If-Modified-Since", time.Now().UTC().Format(HttpDateTimeFormat))
+        w := doRequestWith(m, r)
+        if w.Code != http.StatusOK {
+            t.Errorf("GET %s: expected status %d, got %d", path, http.StatusOK, w.Code)
+        }
+    }
+}
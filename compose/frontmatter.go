@@ -0,0 +1,152 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "bytes"
+    "errors"
+    "gopkg.in/mgo.v2/bson"
+    "gopkg.in/yaml.v2"
+    "time"
+)
+
+// PostFrontMatter is the metadata at the top of a post written out as a
+// Markdown file.
+type PostFrontMatter struct {
+    Id           string    `yaml:"id,omitempty"`
+    Title        string    `yaml:"title"`
+    Date         time.Time `yaml:"date"`
+    LastModified time.Time `yaml:"last_modified,omitempty"`
+    Slug         string    `yaml:"slug,omitempty"`
+    Draft        bool      `yaml:"draft"`
+    Files        []string  `yaml:"files,omitempty"`
+    Tags         []string  `yaml:"tags,omitempty"`
+    Kind         string    `yaml:"kind,omitempty"`
+    Menu         int       `yaml:"menu,omitempty"`
+    OldSlugs     []string  `yaml:"old_slugs,omitempty"`
+}
+
+// SplitFrontMatter splits a document into its front matter and body. Front
+// matter is delimited by "---" lines for YAML or "+++" lines for TOML, and
+// format is set to "yaml" or "toml" accordingly. If there is no front matter,
+// format is empty and the whole document is the body.
+func SplitFrontMatter(data []byte) (format string, front []byte, body []byte) {
+    delims := map[string]string{"---": "yaml", "+++": "toml"}
+
+    // The first line must be a delimiter
+    firstEnd := bytes.IndexByte(data, '\n')
+    if firstEnd < 0 {
+        return "", nil, data
+    }
+    delim := string(bytes.TrimRight(data[:firstEnd], " \r"))
+    format, ok := delims[delim]
+    if !ok {
+        return "", nil, data
+    }
+
+    // Find the matching closing line
+    pos := firstEnd + 1
+    for pos <= len(data) {
+        end := bytes.IndexByte(data[pos:], '\n')
+        next := len(data) + 1
+        line := data[pos:]
+        if end >= 0 {
+            line = data[pos:pos+end]
+            next = pos + end + 1
+        }
+        if string(bytes.TrimRight(line, " \r")) == delim {
+            front = data[firstEnd+1:pos]
+            if next > len(data) {
+                return format, front, nil
+            }
+            return format, front, data[next:]
+        }
+        pos = next
+    }
+    return "", nil, data
+}
+
+// MarshalPostMarkdown writes out a post as Markdown with YAML front matter.
+func MarshalPostMarkdown(post *Post) ([]byte, error) {
+    front := PostFrontMatter{
+        Id:           post.Id.Hex(),
+        Title:        post.Title,
+        Date:         post.Date.UTC(),
+        LastModified: post.LastModified.UTC(),
+        Slug:         post.Slug,
+        Draft:        post.Draft,
+        Tags:         post.Tags,
+        Kind:         post.Kind,
+        Menu:         post.Menu,
+        OldSlugs:     post.OldSlugs,
+    }
+    for _, id := range post.Files {
+        front.Files = append(front.Files, id.Hex())
+    }
+
+    encoded, err := yaml.Marshal(&front)
+    if err != nil {
+        return nil, err
+    }
+
+    out := &bytes.Buffer{}
+    out.WriteString("---\n")
+    out.Write(encoded)
+    out.WriteString("---\n")
+    out.WriteString(post.Body)
+    return out.Bytes(), nil
+}
+
+// UnmarshalPostMarkdown reads a post written by MarshalPostMarkdown.
+func UnmarshalPostMarkdown(data []byte, post *Post) error {
+    format, encoded, body := SplitFrontMatter(data)
+    if format != "yaml" {
+        return errors.New("Missing YAML front matter")
+    }
+
+    front := PostFrontMatter{}
+    err := yaml.Unmarshal(encoded, &front)
+    if err != nil {
+        return err
+    }
+
+    *post = Post{}
+    if front.Id != "" {
+        if !bson.IsObjectIdHex(front.Id) {
+            return errors.New("Invalid post id '" + front.Id + "'")
+        }
+        post.Id = bson.ObjectIdHex(front.Id)
+    }
+    post.Title = front.Title
+    post.Date = front.Date
+    post.LastModified = front.LastModified
+    post.Slug = front.Slug
+    post.Draft = front.Draft
+    post.Files = []bson.ObjectId{}
+    for _, id := range front.Files {
+        if !bson.IsObjectIdHex(id) {
+            return errors.New("Invalid file id '" + id + "'")
+        }
+        post.Files = append(post.Files, bson.ObjectIdHex(id))
+    }
+    post.Tags = append([]string{}, front.Tags...)
+    post.Kind = front.Kind
+    post.Menu = front.Menu
+    post.OldSlugs = front.OldSlugs
+    post.Body = string(body)
+    return nil
+}
@@ -0,0 +1,79 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "reflect"
+    "testing"
+    "time"
+)
+
+func TestSplitFrontMatter(t *testing.T) {
+    tests := []struct {
+        in     string
+        format string
+        front  string
+        body   string
+    }{
+        {"---\ntitle: Hi\n---\nBody\n", "yaml", "title: Hi\n", "Body\n"},
+        {"+++\ntitle = \"Hi\"\n+++\nBody", "toml", "title = \"Hi\"\n", "Body"},
+        {"---\r\ntitle: Hi\r\n---\r\nBody", "yaml", "title: Hi\r\n", "Body"},
+        {"---\ntitle: Hi\n---", "yaml", "title: Hi\n", ""},
+        {"---\n---\nBody", "yaml", "", "Body"},
+        {"Just a body\n---\n", "", "", "Just a body\n---\n"},
+        {"---\nnever closed\n", "", "", "---\nnever closed\n"},
+    }
+
+    for _, test := range tests {
+        format, front, body := SplitFrontMatter([]byte(test.in))
+        if format != test.format || string(front) != test.front || string(body) != test.body {
+            t.Errorf("SplitFrontMatter(%q) = %q, %q, %q", test.in, format, front, body)
+        }
+    }
+}
+
+func TestPostMarkdownRoundTrip(t *testing.T) {
+    post, _ := CreatePost()
+    post.Title = "A: \"tricky\" title"
+    post.Slug = "tricky"
+    post.Draft = false
+    post.Date = time.Date(2015, 6, 1, 12, 30, 0, 0, time.UTC)
+    post.LastModified = time.Date(2015, 6, 2, 8, 0, 0, 0, time.UTC)
+    post.Body = "---\nA body that looks like front matter\n---\n"
+    post.OldSlugs = []string{"first", "second"}
+
+    data, err := MarshalPostMarkdown(post)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    parsed := &Post{}
+    err = UnmarshalPostMarkdown(data, parsed)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if parsed.Id != post.Id || parsed.Title != post.Title || parsed.Slug != post.Slug ||
+       parsed.Draft != post.Draft || parsed.Body != post.Body ||
+       !parsed.Date.Equal(post.Date) || !parsed.LastModified.Equal(post.LastModified) ||
+       !reflect.DeepEqual(parsed.OldSlugs, post.OldSlugs) {
+        t.Errorf("Round trip changed the post:\n%+v\n%+v", post, parsed)
+    }
+
+    if err := UnmarshalPostMarkdown([]byte("no front matter"), parsed); err == nil {
+        t.Error("Expected an error without front matter")
+    }
+}
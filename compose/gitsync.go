@@ -0,0 +1,444 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "gopkg.in/mgo.v2/bson"
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Git commands on the working tree are run one at a time.
+var gitMutex sync.Mutex
+
+// SyncOptions controls how the git working tree is synchronized with the
+// database.
+type SyncOptions struct {
+    // Force lets changes in the tree win over newer changes in the database.
+    Force bool
+
+    // Delete removes posts from the database when their file has been removed
+    // from the tree. Otherwise the file is written again.
+    Delete bool
+}
+
+// SyncResult describes what a sync did.
+type SyncResult struct {
+    Created   int
+    Updated   int
+    Unchanged int
+    Exported  int
+    Deleted   int
+    Conflicts []string
+}
+
+// runGit runs a git command in dir. The output is returned, and included in
+// the error if the command fails.
+func runGit(dir string, args ...string) (string, error) {
+    cmd := exec.Command("git", args...)
+    cmd.Dir = dir
+    out, err := cmd.CombinedOutput()
+    if err != nil {
+        return string(out), fmt.Errorf("git %s: %s: %s", args[0], err.Error(), strings.TrimSpace(string(out)))
+    }
+    return string(out), nil
+}
+
+// EnsureGitRepo creates dir and a git repository in it if needed.
+func EnsureGitRepo(dir string) error {
+    if FileExists(filepath.Join(dir, ".git")) {
+        return nil
+    }
+    err := os.MkdirAll(dir, 0755)
+    if err != nil {
+        return err
+    }
+    _, err = runGit(dir, "init", "-q")
+    return err
+}
+
+// gitCommit commits the changes to the given files, which are relative to
+// dir. Anything else in the tree is left alone, so a writer's uncommitted
+// work isn't swept into the commit.
+func gitCommit(dir string, message string, names ...string) error {
+    // Only files that exist or that git knows about can be staged
+    var paths []string
+    for _, name := range names {
+        _, err := runGit(dir, "ls-files", "--error-unmatch", "--", name)
+        if err == nil || FileExists(filepath.Join(dir, name)) {
+            paths = append(paths, name)
+        }
+    }
+    if len(paths) == 0 {
+        return nil
+    }
+
+    _, err := runGit(dir, append([]string{"add", "-A", "--"}, paths...)...)
+    if err != nil {
+        return err
+    }
+    _, err = runGit(dir, append([]string{"diff", "--cached", "--quiet", "--"}, paths...)...)
+    if err == nil {
+        // Nothing changed
+        return nil
+    }
+
+    // Commits need an author, so use a generic one if git doesn't have one
+    args := []string{"commit", "-q", "-m", message}
+    if out, _ := runGit(dir, "config", "user.email"); strings.TrimSpace(out) == "" {
+        args = append([]string{"-c", "user.name=Compose", "-c", "user.email=compose@localhost"}, args...)
+    }
+    _, err = runGit(dir, append(append(args, "--"), paths...)...)
+    return err
+}
+
+// PostFileName is the name of the file a post is written to in the working
+// tree.
+func PostFileName(post *Post) (string) {
+    if post.Slug != "" {
+        return post.Slug + ".md"
+    }
+    return post.Id.Hex() + ".md"
+}
+
+// MirrorPost writes a post to the git working tree and commits it. old is the
+// post as it was in the database before it was saved, or nil for a new post,
+// and the file for its slug is replaced.
+//
+// A file that was edited in the tree since it was written holds changes the
+// database doesn't have yet, so it isn't replaced and an error is returned.
+// The edits show up as a conflict on the next sync.
+func MirrorPost(post *Post, old *Post, message string) error {
+    dir := config.GitSyncPath
+    gitMutex.Lock()
+    defer gitMutex.Unlock()
+
+    names := []string{PostFileName(post)}
+    if old != nil {
+        names = append(names, PostFileName(old))
+    }
+    for _, name := range names {
+        if !isTreeFileSynced(dir, name, old) {
+            return fmt.Errorf("%s has changes that haven't been synced", name)
+        }
+    }
+    return writeTreePost(dir, post, message, names[1:]...)
+}
+
+// isTreeFileSynced checks if the file name in the working tree can be replaced
+// by a newer version of the post old. It can if it's missing, or if it has the
+// same content as old.
+func isTreeFileSynced(dir string, name string, old *Post) (bool) {
+    data, err := ioutil.ReadFile(filepath.Join(dir, name))
+    if os.IsNotExist(err) {
+        return true
+    }
+    if err != nil || old == nil {
+        return false
+    }
+    tree := &Post{}
+    err = UnmarshalPostMarkdown(data, tree)
+    return err == nil && tree.Id == old.Id && samePostContent(tree, old)
+}
+
+// writeTreePost writes a post to the working tree in dir and commits it. Any
+// of oldNames that differ from the post's file name, such as the file for its
+// old slug, are removed. The caller holds gitMutex.
+func writeTreePost(dir string, post *Post, message string, oldNames ...string) error {
+    err := EnsureGitRepo(dir)
+    if err != nil {
+        return err
+    }
+
+    data, err := MarshalPostMarkdown(post)
+    if err != nil {
+        return err
+    }
+    name := PostFileName(post)
+    err = os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+    if err != nil {
+        return err
+    }
+    err = ioutil.WriteFile(filepath.Join(dir, name), data, 0644)
+    if err != nil {
+        return err
+    }
+
+    names := []string{name}
+    for _, old := range oldNames {
+        if old != "" && old != name {
+            os.Remove(filepath.Join(dir, old))
+            names = append(names, old)
+        }
+    }
+    return gitCommit(dir, message, names...)
+}
+
+// MirrorPostDelete removes a post from the git working tree and commits it.
+func MirrorPostDelete(post *Post) error {
+    dir := config.GitSyncPath
+    gitMutex.Lock()
+    defer gitMutex.Unlock()
+
+    err := EnsureGitRepo(dir)
+    if err != nil {
+        return err
+    }
+
+    name := PostFileName(post)
+    os.Remove(filepath.Join(dir, name))
+    return gitCommit(dir, "Delete post '" + post.Title + "'", name)
+}
+
+// sameTime compares times to the millisecond, which is all MongoDB keeps.
+func sameTime(a time.Time, b time.Time) (bool) {
+    d := a.Sub(b)
+    return d < time.Millisecond && d > -time.Millisecond
+}
+
+// samePostContent checks whether two posts have the same content, ignoring
+// when they were last modified.
+func samePostContent(a *Post, b *Post) (bool) {
+    return a.Title == b.Title &&
+           sameTime(a.Date, b.Date) &&
+           a.Slug == b.Slug &&
+           a.Draft == b.Draft &&
+           reflect.DeepEqual(NormalizeTags(a.Tags), NormalizeTags(b.Tags)) &&
+           a.Kind == b.Kind &&
+           a.Menu == b.Menu &&
+           a.Body == b.Body
+}
+
+// SyncGitTree imports posts that were added or changed in the git working
+// tree, then writes out any posts the tree is missing.
+//
+// Each file records when the post it came from was last modified. If the post
+// in the database has been modified since, the file and the database have
+// both changed and the file is reported as a conflict instead of imported.
+func SyncGitTree(opts SyncOptions) (*SyncResult, error) {
+    dir := config.GitSyncPath
+    if dir == "" {
+        return nil, errors.New("GitSyncPath is not set in the config file")
+    }
+    err := EnsureGitRepo(dir)
+    if err != nil {
+        return nil, err
+    }
+
+    result := &SyncResult{}
+    conflict := func(format string, args ...interface{}) {
+        result.Conflicts = append(result.Conflicts, fmt.Sprintf(format, args...))
+    }
+
+    var names []string
+    err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        if info.IsDir() && strings.HasPrefix(info.Name(), ".") && p != dir {
+            return filepath.SkipDir
+        }
+        if !info.IsDir() && strings.ToLower(filepath.Ext(p)) == ".md" {
+            name, _ := filepath.Rel(dir, p)
+            names = append(names, name)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    seen := make(map[string]string)
+    for _, name := range names {
+        data, err := ioutil.ReadFile(filepath.Join(dir, name))
+        if err != nil {
+            return nil, err
+        }
+        imported := &Post{}
+        err = UnmarshalPostMarkdown(data, imported)
+        if err != nil {
+            conflict("%s: %s", name, err.Error())
+            continue
+        }
+
+        if imported.Id == "" {
+            // A new post written in the tree
+            post, _ := CreatePost()
+            post.Title = imported.Title
+            post.Date = imported.Date
+            post.Slug = imported.Slug
+            post.Draft = imported.Draft
+            post.Tags = imported.Tags
+            post.Kind = imported.Kind
+            post.Menu = imported.Menu
+            post.Body = imported.Body
+            if post.Slug == "" {
+                post.Slug = strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+            }
+            if post.Date.IsZero() {
+                post.Date = time.Now()
+            }
+            err = syncSavePost(post, "Add post '" + post.Title + "'", name)
+            if err != nil {
+                conflict("%s: %s", name, err.Error())
+                continue
+            }
+            seen[post.Id.Hex()] = name
+            result.Created += 1
+            continue
+        }
+
+        id := imported.Id.Hex()
+        if other, ok := seen[id]; ok {
+            conflict("%s: the post is also in %s", name, other)
+            continue
+        }
+        seen[id] = name
+
+        post, err := FindPostById(imported.Id)
+        if err == ErrNotFound {
+            // A post that was deleted from the database, or comes from another
+            // site, is added back with the same id.
+            post, _ = CreatePost()
+            post.Id = imported.Id
+            post.Files = []bson.ObjectId{}
+        } else if err != nil {
+            return nil, err
+        } else if samePostContent(post, imported) {
+            result.Unchanged += 1
+            continue
+        } else if post.LastModified.Sub(imported.LastModified) >= time.Millisecond && !opts.Force {
+            conflict("%s: '%s' was changed in the database at %s, after this file was written", name, post.Title, post.LastModified.Format(time.RFC3339))
+            continue
+        }
+
+        isNew := post.LastModified.IsZero()
+        post.Title = imported.Title
+        post.Date = imported.Date
+        post.Slug = imported.Slug
+        post.Draft = imported.Draft
+        post.Tags = imported.Tags
+        post.Kind = imported.Kind
+        post.Menu = imported.Menu
+        post.Body = imported.Body
+        err = syncSavePost(post, "Update post '" + post.Title + "'", name)
+        if err != nil {
+            conflict("%s: %s", name, err.Error())
+            continue
+        }
+        if isNew {
+            result.Created += 1
+        } else {
+            result.Updated += 1
+        }
+    }
+
+    // Posts without a file were deleted from the tree, or were written before
+    // the tree was set up.
+    posts, err := ListPosts(0, 0, true)
+    if err != nil {
+        return nil, err
+    }
+    pages, err := ListPages(true)
+    if err != nil {
+        return nil, err
+    }
+    posts = append(posts, pages...)
+    for i := range posts {
+        post := &posts[i]
+        if _, ok := seen[post.Id.Hex()]; ok {
+            continue
+        }
+        if opts.Delete {
+            _, err = post.Delete()
+            if err != nil {
+                return nil, err
+            }
+            result.Deleted += 1
+            continue
+        }
+
+        // A file that couldn't be read is left for the writer to fix
+        err = MirrorPost(post, post, "Add post '" + post.Title + "'")
+        if err != nil {
+            conflict("%s", err.Error())
+            continue
+        }
+        result.Exported += 1
+    }
+
+    return result, nil
+}
+
+// syncSavePost saves a post imported from the file name in the working tree,
+// then writes it back so the file has its id and modification time. The slug
+// is checked like one typed into the editor.
+func syncSavePost(post *Post, message string, name string) error {
+    post.Slug = normalizeSlugFor(post.Slug, post.IsPage())
+    err := CheckSlug(post.Slug, post.Id, post.IsPage())
+    if err != nil {
+        return err
+    }
+    _, err = post.saveBy(nil)
+    if err != nil {
+        return err
+    }
+
+    // The file is replaced, even though the database didn't have its content
+    gitMutex.Lock()
+    defer gitMutex.Unlock()
+    return writeTreePost(config.GitSyncPath, post, message, name)
+}
+
+// SyncCommand is the handler for the sync command.
+func SyncCommand(args []string) error {
+    opts := SyncOptions{}
+    flags := flag.NewFlagSet("sync", flag.ContinueOnError)
+    flags.BoolVar(&opts.Force,  "force",  false, "import changed files even if the post was changed in the database since")
+    flags.BoolVar(&opts.Delete, "delete", false, "delete posts whose files were removed from the working tree")
+    err := flags.Parse(args)
+    if err != nil {
+        return err
+    }
+    if flags.NArg() != 0 {
+        return errors.New("Usage: compose sync [-force] [-delete]")
+    }
+
+    result, err := SyncGitTree(opts)
+    if err != nil {
+        return err
+    }
+
+    for _, c := range result.Conflicts {
+        fmt.Println("Conflict:", c)
+    }
+    fmt.Printf("Created %d, updated %d, exported %d and deleted %d posts. %d were unchanged.\n",
+        result.Created, result.Updated, result.Exported, result.Deleted, result.Unchanged)
+    if len(result.Conflicts) > 0 {
+        return fmt.Errorf("%d files could not be synced. Resolve the conflicts, or run again with -force to keep the files.", len(result.Conflicts))
+    }
+    return nil
+}
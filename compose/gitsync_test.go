@@ -0,0 +1,273 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "os/exec"
+    "path/filepath"
+    "strings"
+    "testing"
+)
+
+// setupGitSync points the config at a new git working tree.
+func setupGitSync(t *testing.T) (string) {
+    if _, err := exec.LookPath("git"); err != nil {
+        t.Skip("git is not installed")
+    }
+    setupTestServer(t)
+
+    dir, err := ioutil.TempDir("", "compose")
+    if err != nil {
+        t.Fatal(err)
+    }
+    config.GitSyncPath = dir
+    return dir
+}
+
+// readTreePost reads a post from the working tree.
+func readTreePost(t *testing.T, dir string, name string) (*Post) {
+    data, err := ioutil.ReadFile(filepath.Join(dir, name))
+    if err != nil {
+        t.Fatal(err)
+    }
+    post := &Post{}
+    err = UnmarshalPostMarkdown(data, post)
+    if err != nil {
+        t.Fatal(err)
+    }
+    return post
+}
+
+func TestGitMirrorPost(t *testing.T) {
+    dir := setupGitSync(t)
+    defer os.RemoveAll(dir)
+
+    post := createTestPost(t, "mirrored", false, 0)
+    if readTreePost(t, dir, "mirrored.md").Body != "Body of mirrored" {
+        t.Errorf("Post not written to the tree")
+    }
+
+    post.Slug = "renamed"
+    post.Save()
+    if FileExists(filepath.Join(dir, "mirrored.md")) {
+        t.Errorf("File for the old slug was not removed")
+    }
+    readTreePost(t, dir, "renamed.md")
+
+    // Untracked work in the tree isn't committed
+    writeTestFiles(t, dir, map[string]string{"notes.txt": "mine"})
+
+    post.Delete()
+    if FileExists(filepath.Join(dir, "renamed.md")) {
+        t.Errorf("File was not removed when the post was deleted")
+    }
+
+    log, err := runGit(dir, "log", "--format=%s")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if log != "Delete post 'Title of mirrored'\nUpdate post 'Title of mirrored'\nUpdate post 'Title of mirrored'\n" {
+        t.Errorf("Wrong commits:\n%s", log)
+    }
+    status, _ := runGit(dir, "status", "--porcelain")
+    if status != "?? notes.txt\n" {
+        t.Errorf("Wrong status:\n%s", status)
+    }
+}
+
+func TestGitSync(t *testing.T) {
+    dir := setupGitSync(t)
+    defer os.RemoveAll(dir)
+
+    edited := createTestPost(t, "edited", false, 0)
+    createTestPost(t, "same", false, 0)
+    conflicted := createTestPost(t, "conflicted", false, 0)
+    removed := createTestPost(t, "removed", false, 0)
+
+    // Edit a file, based on the current version of the post
+    tree := readTreePost(t, dir, "edited.md")
+    tree.Body = "Edited in the tree"
+    tree.Slug = "edited-slug"
+    data, _ := MarshalPostMarkdown(tree)
+    writeTestFiles(t, dir, map[string]string{
+        "edited.md": string(data),
+        "drafts/new.md": "---\ntitle: New\ndraft: true\n---\nWritten in the tree\n",
+    })
+
+    // Edit a file, and the post in the database without mirroring it
+    tree = readTreePost(t, dir, "conflicted.md")
+    tree.Body = "Edited in the tree"
+    data, _ = MarshalPostMarkdown(tree)
+    writeTestFiles(t, dir, map[string]string{"conflicted.md": string(data)})
+    config.GitSyncPath = ""
+    conflicted.Body = "Edited in the database"
+    conflicted.Save()
+    config.GitSyncPath = dir
+
+    os.Remove(filepath.Join(dir, "removed.md"))
+
+    result, err := SyncGitTree(SyncOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if result.Created != 1 || result.Updated != 1 || result.Unchanged != 1 || result.Exported != 1 || len(result.Conflicts) != 1 {
+        t.Errorf("Wrong result %+v", result)
+    }
+    if !strings.Contains(result.Conflicts[0], "conflicted.md") {
+        t.Errorf("Wrong conflict %s", result.Conflicts[0])
+    }
+
+    post, _ := FindPostById(edited.Id)
+    if post.Body != "Edited in the tree" || post.Slug != "edited-slug" {
+        t.Errorf("Edit not imported: %+v", post)
+    }
+    if FileExists(filepath.Join(dir, "edited.md")) || readTreePost(t, dir, "edited-slug.md").Id != edited.Id {
+        t.Errorf("File not renamed for the new slug")
+    }
+
+    post, err = FindPostBySlug("new")
+    if err != nil || !post.Draft || post.Body != "Written in the tree\n" {
+        t.Fatalf("New post not imported: %+v %v", post, err)
+    }
+    if FileExists(filepath.Join(dir, "drafts", "new.md")) || readTreePost(t, dir, "new.md").Id != post.Id {
+        t.Errorf("New post not written back with its id")
+    }
+
+    post, _ = FindPostById(conflicted.Id)
+    if post.Body != "Edited in the database" {
+        t.Errorf("Conflicting edit was imported")
+    }
+    readTreePost(t, dir, "removed.md")
+
+    // Force the conflicting edit, and delete a removed file
+    os.Remove(filepath.Join(dir, "removed.md"))
+    result, err = SyncGitTree(SyncOptions{Force: true, Delete: true})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if result.Updated != 1 || result.Deleted != 1 || len(result.Conflicts) != 0 {
+        t.Errorf("Wrong result %+v", result)
+    }
+    post, _ = FindPostById(conflicted.Id)
+    if post.Body != "Edited in the tree" {
+        t.Errorf("Forced edit was not imported")
+    }
+    if _, err := FindPostById(removed.Id); err == nil {
+        t.Errorf("Removed post was not deleted")
+    }
+}
+
+func TestGitSyncSlugs(t *testing.T) {
+    dir := setupGitSync(t)
+    defer os.RemoveAll(dir)
+
+    renamed := createTestPost(t, "renamed", false, 0)
+    renamed.Slug = "renamed-again"
+    renamed.Save()
+    moved := createTestPost(t, "moved", false, 0)
+    changed := siteCache.Changed()
+
+    tree := readTreePost(t, dir, "moved.md")
+    tree.Slug = "moved-in-tree"
+    data, _ := MarshalPostMarkdown(tree)
+    writeTestFiles(t, dir, map[string]string{
+        "moved.md": string(data),
+        "My First Post.md": "---\ntitle: Mine\n---\nBody\n",
+        "taken.md": "---\ntitle: Taken\nslug: renamed\n---\nBody\n",
+        "reserved.md": "---\ntitle: Reserved\nslug: admin\n---\nBody\n",
+    })
+
+    result, err := SyncGitTree(SyncOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if result.Created != 1 || result.Updated != 1 || len(result.Conflicts) != 2 {
+        t.Errorf("Wrong result %+v", result)
+    }
+
+    // Slugs are normalized, and ones that can't be used are conflicts
+    if _, err := FindPostBySlug("my-first-post"); err != nil {
+        t.Error("Expected the slug to be normalized:", err)
+    }
+    for _, c := range result.Conflicts {
+        if !strings.Contains(c, "taken.md") && !strings.Contains(c, "reserved.md") {
+            t.Errorf("Wrong conflict %s", c)
+        }
+    }
+
+    // Saves from the tree keep the slug history, and change the site
+    post, err := FindPostByOldSlug("moved")
+    if err != nil || post.Id != moved.Id {
+        t.Errorf("Expected the old slug to be recorded, got %+v %v", post, err)
+    }
+    if !siteCache.Changed().After(changed) {
+        t.Error("Expected the site cache to be invalidated")
+    }
+}
+
+func TestGitMirrorKeepsTreeEdits(t *testing.T) {
+    dir := setupGitSync(t)
+    defer os.RemoveAll(dir)
+
+    post := createTestPost(t, "both", false, 0)
+    tree := readTreePost(t, dir, "both.md")
+    tree.Body = "Edited in the tree"
+    data, _ := MarshalPostMarkdown(tree)
+    writeTestFiles(t, dir, map[string]string{"both.md": string(data)})
+
+    // Saving in the editor doesn't overwrite the edit
+    post.Body = "Edited in the database"
+    post.Save()
+    if readTreePost(t, dir, "both.md").Body != "Edited in the tree" {
+        t.Error("Expected the edit in the tree to be kept")
+    }
+    result, err := SyncGitTree(SyncOptions{})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(result.Conflicts) != 1 || !strings.Contains(result.Conflicts[0], "both.md") {
+        t.Errorf("Expected a conflict, got %+v", result)
+    }
+
+    // Once the edit is synced, saves are written again
+    _, err = SyncGitTree(SyncOptions{Force: true})
+    if err != nil {
+        t.Fatal(err)
+    }
+    post, _ = FindPostById(post.Id)
+    post.Body = "Edited again"
+    post.Save()
+    if readTreePost(t, dir, "both.md").Body != "Edited again" {
+        t.Error("Expected the save to be written to the tree")
+    }
+}
+
+func TestSamePostContentTags(t *testing.T) {
+    a, _ := CreatePost()
+    b := *a
+    a.Tags = nil
+    b.Tags = []string{}
+    if !samePostContent(a, &b) {
+        t.Error("Expected no tags to be the same as empty tags")
+    }
+    b.Tags = []string{"go"}
+    if samePostContent(a, &b) {
+        t.Error("Expected different tags to differ")
+    }
+}
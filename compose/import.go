@@ -0,0 +1,182 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// ImportImage is a local image referenced by an imported post.
+type ImportImage struct {
+    Link string // The link as written in the post
+    Path string // The local file
+    Name string // The name of the file once attached to the post
+}
+
+// PostImport is a post read from another blogging platform, ready to be
+// imported.
+type PostImport struct {
+    Path     string // Where the post came from
+    Post     *Post
+    Images   []*ImportImage
+    Warnings []string
+
+    // Skip is the reason the post won't be imported, if any.
+    Skip string
+}
+
+// AddImage adds a local image to the import, unless it is already there, and
+// returns it. Attached file names must be unique within the post, so a number
+// is added to the name if needed.
+func (imp *PostImport) AddImage(link string, local string) (*ImportImage) {
+    names := make(map[string]bool)
+    for _, image := range imp.Images {
+        if image.Path == local {
+            return image
+        }
+        names[image.Name] = true
+    }
+
+    name := filepath.Base(local)
+    for i := 2; names[name]; i++ {
+        name = fmt.Sprintf("%d-%s", i, filepath.Base(local))
+    }
+    image := &ImportImage{Link: link, Path: local, Name: name}
+    imp.Images = append(imp.Images, image)
+    return image
+}
+
+// normalizeSlug normalizes the slug of an imported post, with a warning
+// if that changed it.
+func (imp *PostImport) normalizeSlug() {
+    slug := NormalizeSlug(imp.Post.Slug)
+    if slug != imp.Post.Slug {
+        imp.Warnings = append(imp.Warnings, fmt.Sprintf("the slug '%s' was changed to '%s'", imp.Post.Slug, slug))
+        imp.Post.Slug = slug
+    }
+}
+
+// SkipTakenSlugs marks the imports whose slug can't be used to be skipped.
+// That's a slug that isn't normalized, is reserved for the site's own pages,
+// or is used by an earlier import, or by an existing post now or before.
+func SkipTakenSlugs(imports []*PostImport) {
+    slugs := make(map[string]string)
+    for _, imp := range imports {
+        if imp.Skip != "" {
+            continue
+        }
+        slug := imp.Post.Slug
+        err := CheckSlug(slug, imp.Post.Id, false)
+        if other, ok := slugs[slug]; ok {
+            imp.Skip = "the slug '" + slug + "' is also used by " + other
+        } else if slugErr, ok := err.(*SlugError); ok {
+            switch slugErr.Reason {
+            case SlugInvalid:
+                imp.Skip = "the slug '" + slug + "' can only have lower case letters and digits, separated by hyphens"
+            case SlugReserved:
+                imp.Skip = "the slug '" + slug + "' is used by the site itself"
+            default:
+                imp.Skip = "another post uses, or used to use, the slug '" + slug + "'"
+            }
+        } else if err != nil {
+            imp.Skip = err.Error()
+        }
+        slugs[slug] = imp.Path
+    }
+}
+
+// Apply imports the post, attaching its images.
+func (imp *PostImport) Apply() error {
+    if imp.Skip != "" {
+        return errors.New(imp.Skip)
+    }
+
+    s := GetStore()
+    for _, image := range imp.Images {
+        file, err := os.Open(image.Path)
+        if err != nil {
+            return err
+        }
+        info, err := s.CreateFile(image.Name, file)
+        file.Close()
+        if err != nil {
+            return err
+        }
+        imp.Post.Files = append(imp.Post.Files, info.Id)
+    }
+
+    _, err := imp.Post.Save()
+    if err != nil {
+        for _, id := range imp.Post.Files {
+            s.DeleteFile(id)
+        }
+    }
+    return err
+}
+
+// PrintReport describes how the post will be imported.
+func (imp *PostImport) PrintReport() {
+    post := imp.Post
+    fmt.Println(imp.Path)
+    fmt.Println("    title:  ", post.Title)
+    fmt.Println("    slug:   ", post.Slug)
+    fmt.Println("    date:   ", post.Date.Format(time.RFC3339))
+    fmt.Println("    draft:  ", post.Draft)
+    if len(post.Tags) > 0 {
+        fmt.Println("    tags:   ", strings.Join(post.Tags, ", "))
+    }
+    for _, image := range imp.Images {
+        fmt.Printf("    image:   %s -> %s\n", image.Link, PostFileUrl(post.Slug, image.Name))
+    }
+    for _, warning := range imp.Warnings {
+        fmt.Println("    warning:", warning)
+    }
+    if imp.Skip != "" {
+        fmt.Println("    SKIPPED:", imp.Skip)
+    }
+}
+
+// RunImports prints a report for each post and, if apply is set, imports the
+// ones that aren't skipped.
+func RunImports(imports []*PostImport, apply bool) error {
+    count := 0
+    for _, imp := range imports {
+        imp.PrintReport()
+        if imp.Skip != "" {
+            continue
+        }
+        if apply {
+            err := imp.Apply()
+            if err != nil {
+                return fmt.Errorf("Failed to import %s: %s", imp.Path, err.Error())
+            }
+        }
+        count += 1
+    }
+
+    if apply {
+        fmt.Printf("Imported %d of %d posts.\n", count, len(imports))
+    } else {
+        fmt.Printf("%d of %d posts can be imported. Run again with -apply to import them.\n", count, len(imports))
+    }
+    return nil
+}
@@ -0,0 +1,328 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "errors"
+    "flag"
+    "fmt"
+    "github.com/BurntSushi/toml"
+    "gopkg.in/yaml.v2"
+    "io/ioutil"
+    "net/url"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+    "time"
+)
+
+// Patterns matching the link of an image in Markdown (![alt](link)) and in
+// HTML or a Hugo figure shortcode (src="link"). The first group is the link.
+var markdownImageRegexp = regexp.MustCompile(`!\[[^\]]*\]\(\s*<?([^)\s>]+)>?`)
+var htmlImageRegexp = regexp.MustCompile(`(?i)(?:<img|\{\{<\s*figure)\s[^>]*?\bsrc\s*=\s*["']([^"']+)["']`)
+
+// Jekyll post file names start with the date.
+var jekyllDateRegexp = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})-`)
+
+// Date formats seen in front matter, tried in order.
+var frontMatterDateFormats = []string{
+    time.RFC3339Nano,
+    "2006-01-02T15:04:05",
+    "2006-01-02 15:04:05 -0700",
+    "2006-01-02 15:04:05 MST",
+    "2006-01-02 15:04:05",
+    "2006-01-02 15:04 -0700",
+    "2006-01-02 15:04",
+    "2006-01-02",
+}
+
+// metaString gets a string from front matter.
+func metaString(meta map[string]interface{}, key string) (string) {
+    switch v := meta[key].(type) {
+    case string:
+        return strings.TrimSpace(v)
+    case nil:
+        return ""
+    default:
+        return fmt.Sprint(v)
+    }
+}
+
+// metaStrings gets a list of strings from front matter. Both lists and
+// comma or space separated strings are accepted.
+func metaStrings(meta map[string]interface{}, key string) ([]string) {
+    var out []string
+    switch v := meta[key].(type) {
+    case []interface{}:
+        for _, item := range v {
+            out = append(out, strings.TrimSpace(fmt.Sprint(item)))
+        }
+    case string:
+        sep := " "
+        if strings.Contains(v, ",") {
+            sep = ","
+        }
+        for _, item := range strings.Split(v, sep) {
+            out = append(out, strings.TrimSpace(item))
+        }
+    }
+    return out
+}
+
+// metaTime gets a time from front matter. ok is false if the key is missing or
+// the time could not be parsed.
+func metaTime(meta map[string]interface{}, key string) (t time.Time, ok bool) {
+    switch v := meta[key].(type) {
+    case time.Time:
+        return v, true
+    case string:
+        for _, format := range frontMatterDateFormats {
+            t, err := time.Parse(format, strings.TrimSpace(v))
+            if err == nil {
+                return t, true
+            }
+        }
+    }
+    return time.Time{}, false
+}
+
+// ReadMarkdownPost reads a Markdown file with front matter and works out how
+// it would be imported, without changing anything. siteRoot is used to find
+// images linked with absolute paths.
+func ReadMarkdownPost(filename string, siteRoot string) (*PostImport, error) {
+    data, err := ioutil.ReadFile(filename)
+    if err != nil {
+        return nil, err
+    }
+    stat, err := os.Stat(filename)
+    if err != nil {
+        return nil, err
+    }
+
+    imp := &PostImport{Path: filename}
+    warn := func(format string, args ...interface{}) {
+        imp.Warnings = append(imp.Warnings, fmt.Sprintf(format, args...))
+    }
+
+    format, front, body := SplitFrontMatter(data)
+    meta := map[string]interface{}{}
+    switch format {
+    case "yaml":
+        err = yaml.Unmarshal(front, &meta)
+    case "toml":
+        _, err = toml.Decode(string(front), &meta)
+    default:
+        warn("no front matter")
+    }
+    if err != nil {
+        return nil, fmt.Errorf("%s: bad front matter: %s", filename, err.Error())
+    }
+
+    post, _ := CreatePost()
+    imp.Post = post
+
+    // The slug comes from the front matter, or the file name without the date
+    // and extension, or the directory name for Hugo's page bundles.
+    base := filepath.Base(filename)
+    name := strings.TrimSuffix(base, filepath.Ext(base))
+    post.Slug = metaString(meta, "slug")
+    if post.Slug == "" {
+        if name == "index" {
+            post.Slug = filepath.Base(filepath.Dir(filename))
+        } else {
+            post.Slug = jekyllDateRegexp.ReplaceAllString(name, "")
+        }
+    }
+
+    post.Title = metaString(meta, "title")
+    if post.Title == "" {
+        warn("no title, using the slug")
+        post.Title = post.Slug
+    }
+    imp.normalizeSlug()
+
+    // The date comes from the front matter, or the Jekyll file name, or the
+    // time the file was last modified.
+    if date, ok := metaTime(meta, "date"); ok {
+        post.Date = date
+    } else if m := jekyllDateRegexp.FindStringSubmatch(base); m != nil {
+        post.Date, _ = time.Parse("2006-01-02", m[1])
+    } else {
+        if _, ok := meta["date"]; ok {
+            warn("could not understand the date '%s', using the file time", metaString(meta, "date"))
+        }
+        post.Date = stat.ModTime()
+    }
+
+    // Hugo uses draft, Jekyll uses published and the _drafts directory
+    post.Draft = meta["draft"] == true || meta["published"] == false
+    for _, dir := range strings.Split(filepath.ToSlash(filepath.Dir(filename)), "/") {
+        if dir == "_drafts" {
+            post.Draft = true
+        }
+    }
+
+    // Tags and categories both become tags
+    seen := make(map[string]bool)
+    for _, tag := range append(metaStrings(meta, "tags"), metaStrings(meta, "categories")...) {
+        if tag != "" && !seen[tag] {
+            seen[tag] = true
+            post.Tags = append(post.Tags, tag)
+        }
+    }
+
+    post.Body = imp.rewriteImages(string(body), siteRoot, warn)
+    return imp, nil
+}
+
+// resolveImage finds the local file for an image link. An empty string is
+// returned for remote or missing images.
+func resolveImage(link string, dir string, siteRoot string) (string) {
+    u, err := url.Parse(link)
+    if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+        return ""
+    }
+
+    // Absolute paths are relative to the site (or Hugo's static directory)
+    var candidates []string
+    if strings.HasPrefix(u.Path, "/") {
+        candidates = []string{
+            filepath.Join(siteRoot, filepath.FromSlash(u.Path)),
+            filepath.Join(siteRoot, "static", filepath.FromSlash(u.Path)),
+        }
+    } else {
+        candidates = []string{filepath.Join(dir, filepath.FromSlash(u.Path))}
+    }
+
+    for _, candidate := range candidates {
+        stat, err := os.Stat(candidate)
+        if err == nil && !stat.IsDir() {
+            return candidate
+        }
+    }
+    return ""
+}
+
+// rewriteImages finds the local images in the body, adds them to the import
+// and points their links at the URLs they will be served from.
+func (imp *PostImport) rewriteImages(body string, siteRoot string, warn func(string, ...interface{})) (string) {
+    // Compose is always served from the root, so Jekyll's base URL goes away
+    for _, baseurl := range []string{"{{ site.baseurl }}", "{{site.baseurl}}"} {
+        body = strings.Replace(body, baseurl, "", -1)
+    }
+
+    var spans [][]int
+    for _, re := range []*regexp.Regexp{markdownImageRegexp, htmlImageRegexp} {
+        for _, m := range re.FindAllStringSubmatchIndex(body, -1) {
+            spans = append(spans, m[2:4])
+        }
+    }
+    sort.Sort(spansByStart(spans))
+
+    out := ""
+    last := 0
+    for _, span := range spans {
+        if span[0] < last {
+            continue
+        }
+        link := body[span[0]:span[1]]
+        local := resolveImage(link, filepath.Dir(imp.Path), siteRoot)
+        if local == "" {
+            if !strings.Contains(link, "//") && !strings.HasPrefix(link, "data:") {
+                warn("image '%s' not found", link)
+            }
+            continue
+        }
+
+        image := imp.AddImage(link, local)
+        out += body[last:span[0]] + PostFileUrl(imp.Post.Slug, image.Name)
+        last = span[1]
+    }
+    return out + body[last:]
+}
+
+// spansByStart sorts regexp match spans by their start.
+type spansByStart [][]int
+
+func (s spansByStart) Len() int           { return len(s) }
+func (s spansByStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s spansByStart) Less(i, j int) bool { return s[i][0] < s[j][0] }
+
+// ScanMarkdownDir reads every Markdown file under dir and works out how each
+// would be imported. Posts whose slug is taken are marked to be skipped.
+func ScanMarkdownDir(dir string, siteRoot string) ([]*PostImport, error) {
+    var imports []*PostImport
+
+    err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+        if err != nil {
+            return err
+        }
+        name := info.Name()
+        if info.IsDir() {
+            if p != dir && (strings.HasPrefix(name, ".") || name == "_site" || name == "public") {
+                return filepath.SkipDir
+            }
+            return nil
+        }
+
+        // Skip Hugo's section pages and anything that isn't Markdown
+        ext := strings.ToLower(filepath.Ext(name))
+        if (ext != ".md" && ext != ".markdown") || strings.HasPrefix(name, "_") {
+            return nil
+        }
+
+        imp, err := ReadMarkdownPost(p, siteRoot)
+        if err != nil {
+            return err
+        }
+        imports = append(imports, imp)
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+
+    SkipTakenSlugs(imports)
+    return imports, nil
+}
+
+// ImportMarkdownCommand is the handler for the import-markdown command.
+func ImportMarkdownCommand(args []string) error {
+    flags := flag.NewFlagSet("import-markdown", flag.ContinueOnError)
+    apply := flags.Bool("apply", false, "import the posts instead of only reporting what would be imported")
+    root := flags.String("root", "", "the root of the site, for images with absolute paths (default: the posts directory)")
+    err := flags.Parse(args)
+    if err != nil {
+        return err
+    }
+    if flags.NArg() != 1 {
+        return errors.New("Usage: compose import-markdown [-apply] [-root site] <posts directory>")
+    }
+    dir := flags.Arg(0)
+    if *root == "" {
+        *root = dir
+    }
+
+    imports, err := ScanMarkdownDir(dir, *root)
+    if err != nil {
+        return err
+    }
+
+    return RunImports(imports, *apply)
+}
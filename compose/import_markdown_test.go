@@ -0,0 +1,192 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// writeTestFiles creates files under dir from a map of relative paths to
+// contents.
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+    for name, contents := range files {
+        p := filepath.Join(dir, filepath.FromSlash(name))
+        os.MkdirAll(filepath.Dir(p), 0755)
+        err := ioutil.WriteFile(p, []byte(contents), 0644)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+}
+
+func TestImportMarkdown(t *testing.T) {
+    m := setupTestServer(t)
+    createTestPost(t, "taken", false, 0)
+
+    dir, err := ioutil.TempDir("", "compose")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    writeTestFiles(t, dir, map[string]string{
+        // Jekyll
+        "_posts/2015-03-04-hello-world.md": "---\n" +
+            "title: Hello World\n" +
+            "tags: [go, blogging]\n" +
+            "categories: news\n" +
+            "---\n" +
+            "![Pic]({{ site.baseurl }}/assets/pic.png)\n" +
+            "![Again](/assets/pic.png \"title\")\n" +
+            "![Local](local.png)\n" +
+            "![Remote](http://example.com/remote.png)\n" +
+            "![Missing](nope.png)\n",
+        "_posts/local.png":               "local image",
+        "assets/pic.png":                 "site image",
+        "_drafts/unfinished.markdown":    "---\ntitle: Unfinished\ndate: 2015-05-01 10:30:00 -0700\n---\nTODO\n",
+        "_posts/2015-01-01-private.md":   "---\ntitle: Private\npublished: false\nslug: secret\n---\nShh\n",
+        "_posts/2015-01-02-taken.md":     "---\ntitle: Taken\n---\nOops\n",
+
+        // Hugo page bundle with TOML front matter
+        "content/posts/bundle/index.md":  "+++\ntitle = \"Bundle\"\ndate = 2016-02-03T04:05:06Z\ndraft = true\ntags = [\"hugo\"]\n+++\n<img src=\"photo.jpg\" alt=\"\">\n",
+        "content/posts/bundle/photo.jpg": "bundle image",
+        "content/posts/_index.md":        "---\ntitle: Section\n---\n",
+    })
+
+    imports, err := ScanMarkdownDir(dir, dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    bySlug := make(map[string]*PostImport)
+    for _, imp := range imports {
+        bySlug[imp.Post.Slug] = imp
+    }
+    if len(imports) != 5 {
+        t.Fatalf("Expected 5 posts, got %d", len(imports))
+    }
+
+    // Scanning doesn't change anything
+    if n, _ := CountPosts(true); n != 1 {
+        t.Fatalf("Expected nothing to be imported yet, got %d posts", n)
+    }
+
+    hello := bySlug["hello-world"]
+    if hello == nil {
+        t.Fatal("Expected the slug to come from the file name")
+    }
+    if hello.Post.Title != "Hello World" || hello.Post.Draft ||
+       !hello.Post.Date.Equal(time.Date(2015, 3, 4, 0, 0, 0, 0, time.UTC)) {
+        t.Errorf("Unexpected post %+v", hello.Post)
+    }
+    if strings.Join(hello.Post.Tags, ",") != "go,blogging,news" {
+        t.Errorf("Unexpected tags %v", hello.Post.Tags)
+    }
+    if len(hello.Images) != 2 {
+        t.Fatalf("Expected 2 images, got %d", len(hello.Images))
+    }
+    if len(hello.Warnings) != 1 || !strings.Contains(hello.Warnings[0], "nope.png") {
+        t.Errorf("Expected a warning about the missing image, got %v", hello.Warnings)
+    }
+    expected := "![Pic](/hello-world/pic.png)\n" +
+                "![Again](/hello-world/pic.png \"title\")\n" +
+                "![Local](/hello-world/local.png)\n" +
+                "![Remote](http://example.com/remote.png)\n" +
+                "![Missing](nope.png)\n"
+    if hello.Post.Body != expected {
+        t.Errorf("Unexpected body:\n%s", hello.Post.Body)
+    }
+
+    if imp := bySlug["unfinished"]; imp == nil || !imp.Post.Draft ||
+       !imp.Post.Date.Equal(time.Date(2015, 5, 1, 17, 30, 0, 0, time.UTC)) {
+        t.Errorf("Expected _drafts to be a draft with the front matter date, got %+v", imp)
+    }
+    if imp := bySlug["secret"]; imp == nil || !imp.Post.Draft {
+        t.Errorf("Expected an unpublished post with the front matter slug, got %+v", imp)
+    }
+    if imp := bySlug["taken"]; imp == nil || imp.Skip == "" {
+        t.Error("Expected the post with a taken slug to be skipped")
+    }
+    bundle := bySlug["bundle"]
+    if bundle == nil || !bundle.Post.Draft || len(bundle.Images) != 1 ||
+       bundle.Post.Body != "<img src=\"/bundle/photo.jpg\" alt=\"\">\n" {
+        t.Errorf("Unexpected Hugo bundle import %+v", bundle)
+    }
+
+    // Import for real
+    err = RunCommand([]string{"import-markdown", "-apply", dir})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if n, _ := CountPosts(true); n != 5 {
+        t.Fatalf("Expected 5 posts, got %d", n)
+    }
+
+    w := doRequest(m, "GET", "/hello-world/pic.png", nil, nil)
+    if w.Code != 200 || w.Body.String() != "site image" {
+        t.Errorf("Expected the image to be served, got %d %q", w.Code, w.Body.String())
+    }
+    // The bundle is a draft, so only logged in users can see its files
+    if w = doRequest(m, "GET", "/bundle/photo.jpg", nil, nil); w.Code != 404 {
+        t.Errorf("Expected the draft's image to be hidden, got %d", w.Code)
+    }
+    w = doRequest(m, "GET", "/bundle/photo.jpg", nil, loginTestUser(t))
+    if w.Code != 200 || w.Body.String() != "bundle image" {
+        t.Errorf("Expected the image to be served, got %d %q", w.Code, w.Body.String())
+    }
+}
+
+func TestImportMarkdownSlugs(t *testing.T) {
+    setupTestServer(t)
+    moved := createTestPost(t, "moved", false, 0)
+    moved.Slug = "moved-again"
+    moved.Save()
+
+    dir, err := ioutil.TempDir("", "compose")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    writeTestFiles(t, dir, map[string]string{
+        "My First Post.md": "---\ntitle: Mine\n---\nBody\n",
+        "dots.md":          "---\ntitle: Dots\nslug: ../..\n---\nBody\n",
+        "reserved.md":      "---\ntitle: Reserved\nslug: Admin\n---\nBody\n",
+        "moved.md":         "---\ntitle: Moved\n---\nBody\n",
+    })
+    imports, err := ScanMarkdownDir(dir, dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    bySlug := make(map[string]*PostImport)
+    for _, imp := range imports {
+        bySlug[imp.Post.Slug] = imp
+    }
+    if imp := bySlug["my-first-post"]; imp == nil || imp.Skip != "" || len(imp.Warnings) != 1 {
+        t.Errorf("Expected the slug to be normalized with a warning, got %+v", imp)
+    }
+    for _, slug := range []string{"", "admin", "moved"} {
+        if imp := bySlug[slug]; imp == nil || imp.Skip == "" {
+            t.Errorf("Expected the post with the slug %q to be skipped, got %+v", slug, imp)
+        }
+    }
+}
@@ -0,0 +1,325 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "encoding/xml"
+    "errors"
+    "flag"
+    "fmt"
+    "io"
+    "net/url"
+    "os"
+    "path"
+    "path/filepath"
+    "regexp"
+    "strings"
+    "time"
+)
+
+// WxrFile is a WordPress eXtended RSS export. The wp: elements are matched by
+// their local name, so any version of the format can be read.
+type WxrFile struct {
+    Items []WxrItem `xml:"channel>item"`
+}
+
+// WxrItem is a post, page or attachment in a WordPress export.
+type WxrItem struct {
+    Title         string        `xml:"title"`
+    PubDate       string        `xml:"pubDate"`
+    Content       string        `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+    PostId        string        `xml:"post_id"`
+    PostDate      string        `xml:"post_date"`
+    PostDateGmt   string        `xml:"post_date_gmt"`
+    PostName      string        `xml:"post_name"`
+    Status        string        `xml:"status"`
+    PostParent    string        `xml:"post_parent"`
+    PostType      string        `xml:"post_type"`
+    AttachmentUrl string        `xml:"attachment_url"`
+    Categories    []WxrCategory `xml:"category"`
+    Meta          []WxrMeta     `xml:"postmeta"`
+}
+
+// WxrCategory is a category or tag of a WordPress post.
+type WxrCategory struct {
+    Domain   string `xml:"domain,attr"`
+    Nicename string `xml:"nicename,attr"`
+    Name     string `xml:",chardata"`
+}
+
+// WxrMeta is a custom field of a WordPress post.
+type WxrMeta struct {
+    Key   string `xml:"meta_key"`
+    Value string `xml:"meta_value"`
+}
+
+// WordPressOptions controls how a WordPress export is imported.
+type WordPressOptions struct {
+    // Uploads is the local copy of wp-content/uploads. Images can't be
+    // imported without it.
+    Uploads string
+
+    // Html keeps post bodies as HTML instead of converting them to Markdown.
+    Html bool
+}
+
+// Matches links to uploaded files in src and href attributes. The first group
+// is the link and the second is the path under the uploads directory.
+var wordPressUploadRegexp = regexp.MustCompile(`(?i)\b(?:src|href)\s*=\s*["']([^"']*/wp-content/uploads/([^"'?#]+)[^"']*)["']`)
+
+// Tags that start a block, which WordPress doesn't wrap in paragraphs.
+var wordPressBlockRegexp = regexp.MustCompile(`(?i)^<(?:p|div|h[1-6]|ul|ol|li|blockquote|pre|table|hr|figure|dl|form|address|section|!--)\b`)
+
+// Paragraphs are separated by blank lines.
+var wordPressParagraphRegexp = regexp.MustCompile(`\n[ \t]*\n\s*`)
+
+// Matches preformatted blocks.
+var wordPressPreRegexp = regexp.MustCompile(`(?is)<pre\b.*?</pre>`)
+
+// The date WordPress uses for posts that were never published.
+const wordPressZeroDate = "0000-00-00 00:00:00"
+
+// WordPressAutoP adds the paragraphs that WordPress adds when showing a post.
+// Posts are stored with blank lines between paragraphs and single line breaks
+// within them.
+func WordPressAutoP(content string) (string) {
+    content = strings.Replace(content, "\r\n", "\n", -1)
+
+    // Line breaks in preformatted text are left alone
+    content = wordPressPreRegexp.ReplaceAllStringFunc(content, func(pre string) string {
+        return strings.Replace(pre, "\n", "\x00", -1)
+    })
+
+    out := ""
+    for _, block := range wordPressParagraphRegexp.Split(content, -1) {
+        block = strings.TrimSpace(block)
+        if block == "" {
+            continue
+        }
+        if wordPressBlockRegexp.MatchString(block) {
+            out += block + "\n\n"
+        } else {
+            out += "<p>" + strings.Replace(block, "\n", "<br />\n", -1) + "</p>\n\n"
+        }
+    }
+    return strings.Replace(out, "\x00", "\n", -1)
+}
+
+// wordPressUploadPath finds the local copy of an uploaded file. An empty
+// string is returned if it's missing.
+func wordPressUploadPath(uploads string, rel string) (string) {
+    if uploads == "" {
+        return ""
+    }
+    rel, err := url.QueryUnescape(rel)
+    if err != nil {
+        return ""
+    }
+    // Cleaning it as an absolute path keeps it inside the uploads directory
+    rel = strings.TrimPrefix(path.Clean("/" + rel), "/")
+    p := filepath.Join(uploads, filepath.FromSlash(rel))
+    stat, err := os.Stat(p)
+    if err != nil || stat.IsDir() {
+        return ""
+    }
+    return p
+}
+
+// wordPressDate works out when a post was published. Drafts have no GMT date,
+// so the local date or the RSS date is used instead.
+func wordPressDate(item *WxrItem) (time.Time, bool) {
+    if item.PostDateGmt != "" && item.PostDateGmt != wordPressZeroDate {
+        if t, err := time.Parse("2006-01-02 15:04:05", item.PostDateGmt); err == nil {
+            return t, true
+        }
+    }
+    if item.PostDate != "" && item.PostDate != wordPressZeroDate {
+        if t, err := time.ParseInLocation("2006-01-02 15:04:05", item.PostDate, time.Local); err == nil {
+            return t, true
+        }
+    }
+    if t, err := time.Parse(time.RFC1123Z, item.PubDate); err == nil {
+        return t, true
+    }
+    return time.Time{}, false
+}
+
+// ReadWordPressExport reads a WordPress export and works out how each post in
+// it would be imported, without changing anything. Pages and other content
+// types are left out.
+func ReadWordPressExport(r io.Reader, opts WordPressOptions) ([]*PostImport, error) {
+    var wxr WxrFile
+    err := xml.NewDecoder(r).Decode(&wxr)
+    if err != nil {
+        return nil, fmt.Errorf("Not a WordPress export: %s", err.Error())
+    }
+
+    // Attachments are linked to their post by the parent id
+    attachments := make(map[string][]*WxrItem)
+    for i := range wxr.Items {
+        item := &wxr.Items[i]
+        if item.PostType == "attachment" && item.PostParent != "" && item.PostParent != "0" {
+            attachments[item.PostParent] = append(attachments[item.PostParent], item)
+        }
+    }
+
+    var imports []*PostImport
+    for i := range wxr.Items {
+        item := &wxr.Items[i]
+        if item.PostType != "post" {
+            continue
+        }
+        imp, err := readWordPressPost(item, attachments[item.PostId], opts)
+        if err != nil {
+            return nil, err
+        }
+        imports = append(imports, imp)
+    }
+
+    SkipTakenSlugs(imports)
+    return imports, nil
+}
+
+// readWordPressPost converts one post from a WordPress export.
+func readWordPressPost(item *WxrItem, attachments []*WxrItem, opts WordPressOptions) (*PostImport, error) {
+    imp := &PostImport{Path: "post " + item.PostId}
+    warn := func(format string, args ...interface{}) {
+        imp.Warnings = append(imp.Warnings, fmt.Sprintf(format, args...))
+    }
+
+    post, _ := CreatePost()
+    imp.Post = post
+
+    // WordPress percent-encodes slugs with non-ASCII characters
+    post.Slug, _ = url.QueryUnescape(item.PostName)
+    imp.normalizeSlug()
+    if post.Slug == "" {
+        post.Slug = "post-" + item.PostId
+        warn("no slug, using '%s'", post.Slug)
+    }
+
+    post.Title = strings.TrimSpace(item.Title)
+    if post.Title == "" {
+        warn("no title, using the slug")
+        post.Title = post.Slug
+    }
+
+    if date, ok := wordPressDate(item); ok {
+        post.Date = date
+    } else {
+        warn("no date, using the current time")
+    }
+
+    switch item.Status {
+    case "publish":
+        post.Draft = false
+    case "trash":
+        imp.Skip = "the post is in the trash"
+    default:
+        // Drafts, pending review, private and future posts
+        post.Draft = true
+    }
+
+    // Both tags and categories become tags
+    seen := make(map[string]bool)
+    for _, category := range item.Categories {
+        name := strings.TrimSpace(category.Name)
+        if (category.Domain == "post_tag" || category.Domain == "category") && name != "" && !seen[name] {
+            seen[name] = true
+            post.Tags = append(post.Tags, name)
+        }
+    }
+
+    // Uploaded files linked from the post are attached to it
+    content := WordPressAutoP(item.Content)
+    out := ""
+    last := 0
+    for _, m := range wordPressUploadRegexp.FindAllStringSubmatchIndex(content, -1) {
+        link := content[m[2]:m[3]]
+        local := wordPressUploadPath(opts.Uploads, content[m[4]:m[5]])
+        if local == "" {
+            warn("upload '%s' not found", link)
+            continue
+        }
+        image := imp.AddImage(link, local)
+        out += content[last:m[2]] + PostFileUrl(post.Slug, image.Name)
+        last = m[3]
+    }
+    content = out + content[last:]
+
+    // So are the post's other attachments, such as gallery images
+    for _, attachment := range attachments {
+        rel := ""
+        for _, meta := range attachment.Meta {
+            if meta.Key == "_wp_attached_file" {
+                rel = meta.Value
+            }
+        }
+        if i := strings.Index(attachment.AttachmentUrl, "/wp-content/uploads/"); rel == "" && i >= 0 {
+            rel = attachment.AttachmentUrl[i + len("/wp-content/uploads/"):]
+        }
+        local := wordPressUploadPath(opts.Uploads, rel)
+        if local == "" {
+            warn("attachment '%s' not found", attachment.AttachmentUrl)
+            continue
+        }
+        imp.AddImage(attachment.AttachmentUrl, local)
+    }
+
+    if opts.Html {
+        post.Body = content
+    } else {
+        body, err := HtmlToMarkdown(content)
+        if err != nil {
+            return nil, fmt.Errorf("post %s: %s", item.PostId, err.Error())
+        }
+        post.Body = body
+    }
+
+    return imp, nil
+}
+
+// ImportWordPressCommand is the handler for the import-wordpress command.
+func ImportWordPressCommand(args []string) error {
+    flags := flag.NewFlagSet("import-wordpress", flag.ContinueOnError)
+    apply := flags.Bool("apply", false, "import the posts instead of only reporting what would be imported")
+    uploads := flags.String("uploads", "", "a local copy of wp-content/uploads, to import images and attachments from")
+    format := flags.String("format", "markdown", "the format to store post bodies in: markdown or html")
+    err := flags.Parse(args)
+    if err != nil {
+        return err
+    }
+    if flags.NArg() != 1 || (*format != "markdown" && *format != "html") {
+        return errors.New("Usage: compose import-wordpress [-apply] [-uploads dir] [-format markdown|html] <export.xml>")
+    }
+
+    file, err := os.Open(flags.Arg(0))
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+
+    imports, err := ReadWordPressExport(file, WordPressOptions{
+        Uploads: *uploads,
+        Html:    *format == "html",
+    })
+    if err != nil {
+        return err
+    }
+
+    return RunImports(imports, *apply)
+}
@@ -0,0 +1,212 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "io/ioutil"
+    "os"
+    "strings"
+    "testing"
+    "time"
+)
+
+const testWxr = `<?xml version="1.0" encoding="UTF-8" ?>
+<rss version="2.0"
+    xmlns:excerpt="http://wordpress.org/export/1.2/excerpt/"
+    xmlns:content="http://purl.org/rss/1.0/modules/content/"
+    xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:wp="http://wordpress.org/export/1.2/">
+<channel>
+    <title>Old Blog</title>
+    <item>
+        <title>Hello World</title>
+        <pubDate>Wed, 04 Mar 2015 10:00:00 +0000</pubDate>
+        <category domain="category" nicename="news"><![CDATA[News]]></category>
+        <category domain="post_tag" nicename="go"><![CDATA[go]]></category>
+        <content:encoded><![CDATA[First paragraph
+with a line break.
+
+<a href="http://old.example.com/wp-content/uploads/2015/03/photo.jpg"><img class="size-medium" src="http://old.example.com/wp-content/uploads/2015/03/photo-300x200.jpg" alt="Photo" /></a>
+
+Missing <img src="http://old.example.com/wp-content/uploads/2015/03/gone.png" alt="" />]]></content:encoded>
+        <excerpt:encoded><![CDATA[]]></excerpt:encoded>
+        <wp:post_id>10</wp:post_id>
+        <wp:post_date>2015-03-04 11:00:00</wp:post_date>
+        <wp:post_date_gmt>2015-03-04 10:00:00</wp:post_date_gmt>
+        <wp:post_name>hello-world</wp:post_name>
+        <wp:status>publish</wp:status>
+        <wp:post_parent>0</wp:post_parent>
+        <wp:post_type>post</wp:post_type>
+    </item>
+    <item>
+        <title>photo</title>
+        <wp:post_id>11</wp:post_id>
+        <wp:post_parent>10</wp:post_parent>
+        <wp:post_type>attachment</wp:post_type>
+        <wp:attachment_url>http://old.example.com/wp-content/uploads/2015/03/photo.jpg</wp:attachment_url>
+    </item>
+    <item>
+        <title>gallery</title>
+        <wp:post_id>12</wp:post_id>
+        <wp:post_parent>10</wp:post_parent>
+        <wp:post_type>attachment</wp:post_type>
+        <wp:attachment_url>http://cdn.example.com/gallery.jpg</wp:attachment_url>
+        <wp:postmeta>
+            <wp:meta_key>_wp_attached_file</wp:meta_key>
+            <wp:meta_value><![CDATA[2015/03/gallery.jpg]]></wp:meta_value>
+        </wp:postmeta>
+    </item>
+    <item>
+        <title>Work in Progress</title>
+        <content:encoded><![CDATA[<p>Not done</p>]]></content:encoded>
+        <wp:post_id>20</wp:post_id>
+        <wp:post_date>2015-05-01 09:30:00</wp:post_date>
+        <wp:post_date_gmt>0000-00-00 00:00:00</wp:post_date_gmt>
+        <wp:post_name></wp:post_name>
+        <wp:status>draft</wp:status>
+        <wp:post_type>post</wp:post_type>
+    </item>
+    <item>
+        <title>Deleted</title>
+        <wp:post_id>30</wp:post_id>
+        <wp:post_name>deleted</wp:post_name>
+        <wp:status>trash</wp:status>
+        <wp:post_type>post</wp:post_type>
+    </item>
+    <item>
+        <title>Taken</title>
+        <wp:post_id>40</wp:post_id>
+        <wp:post_name>taken</wp:post_name>
+        <wp:status>publish</wp:status>
+        <wp:post_type>post</wp:post_type>
+    </item>
+    <item>
+        <title>About</title>
+        <wp:post_id>50</wp:post_id>
+        <wp:post_name>about</wp:post_name>
+        <wp:status>publish</wp:status>
+        <wp:post_type>page</wp:post_type>
+    </item>
+</channel>
+</rss>
+`
+
+func TestImportWordPress(t *testing.T) {
+    m := setupTestServer(t)
+    createTestPost(t, "taken", false, 0)
+
+    dir, err := ioutil.TempDir("", "compose")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    writeTestFiles(t, dir, map[string]string{
+        "2015/03/photo.jpg":         "full photo",
+        "2015/03/photo-300x200.jpg": "small photo",
+        "2015/03/gallery.jpg":       "gallery photo",
+    })
+
+    imports, err := ReadWordPressExport(strings.NewReader(testWxr), WordPressOptions{Uploads: dir})
+    if err != nil {
+        t.Fatal(err)
+    }
+    if len(imports) != 4 {
+        t.Fatalf("Expected 4 posts, got %d", len(imports))
+    }
+
+    hello := imports[0].Post
+    if hello.Slug != "hello-world" || hello.Title != "Hello World" || hello.Draft {
+        t.Errorf("Wrong post: %+v", hello.PostHeader)
+    }
+    if !hello.Date.Equal(time.Date(2015, 3, 4, 10, 0, 0, 0, time.UTC)) {
+        t.Errorf("Wrong date %s", hello.Date)
+    }
+    if strings.Join(hello.Tags, ",") != "News,go" {
+        t.Errorf("Wrong tags %v", hello.Tags)
+    }
+    if !strings.Contains(hello.Body, "First paragraph  \nwith a line break.\n\n[![Photo]") {
+        t.Errorf("Paragraphs not converted: %q", hello.Body)
+    }
+    if !strings.Contains(hello.Body, `(/hello-world/photo.jpg)`) || !strings.Contains(hello.Body, `(/hello-world/photo-300x200.jpg)`) {
+        t.Errorf("Uploads not rewritten: %q", hello.Body)
+    }
+    var names []string
+    for _, image := range imports[0].Images {
+        names = append(names, image.Name)
+    }
+    if strings.Join(names, ",") != "photo.jpg,photo-300x200.jpg,gallery.jpg" {
+        t.Errorf("Wrong attachments %v", names)
+    }
+    if len(imports[0].Warnings) != 1 || !strings.Contains(imports[0].Warnings[0], "gone.png") {
+        t.Errorf("Expected a warning for the missing upload, got %v", imports[0].Warnings)
+    }
+
+    draft := imports[1].Post
+    if draft.Slug != "post-20" || !draft.Draft || draft.Body != "Not done\n" {
+        t.Errorf("Wrong draft: %+v", draft)
+    }
+    if !draft.Date.Equal(time.Date(2015, 5, 1, 9, 30, 0, 0, time.Local)) {
+        t.Errorf("Wrong draft date %s", draft.Date)
+    }
+
+    if imports[2].Skip == "" || imports[3].Skip == "" {
+        t.Errorf("Trashed and taken posts should be skipped")
+    }
+
+    err = RunImports(imports, true)
+    if err != nil {
+        t.Fatal(err)
+    }
+    rec := doRequest(m, "GET", "/hello-world/gallery.jpg", nil, nil)
+    if rec.Code != 200 || rec.Body.String() != "gallery photo" {
+        t.Errorf("Attachment not served: %d %q", rec.Code, rec.Body.String())
+    }
+    if _, err := FindPostBySlug("deleted"); err == nil {
+        t.Errorf("Trashed post was imported")
+    }
+}
+
+func TestImportWordPressHtml(t *testing.T) {
+    setupTestServer(t)
+
+    imports, err := ReadWordPressExport(strings.NewReader(testWxr), WordPressOptions{Html: true})
+    if err != nil {
+        t.Fatal(err)
+    }
+    body := imports[0].Post.Body
+    if !strings.HasPrefix(body, "<p>First paragraph<br />\nwith a line break.</p>") {
+        t.Errorf("Wrong HTML body: %q", body)
+    }
+    if !strings.Contains(body, "http://old.example.com/wp-content/uploads/2015/03/photo.jpg") {
+        t.Errorf("Links rewritten without an uploads directory: %q", body)
+    }
+
+    _, err = ReadWordPressExport(strings.NewReader("not xml"), WordPressOptions{})
+    if err == nil {
+        t.Errorf("Expected an error for a bad export")
+    }
+}
+
+func TestWordPressAutoP(t *testing.T) {
+    in := "One\ntwo\n\n<h2>Head</h2>\n\n<pre>a\n\nb</pre>\n\n\nEnd"
+    out := WordPressAutoP(in)
+    want := "<p>One<br />\ntwo</p>\n\n<h2>Head</h2>\n\n<pre>a\n\nb</pre>\n\n<p>End</p>\n\n"
+    if out != want {
+        t.Errorf("WordPressAutoP(%q) = %q, want %q", in, out, want)
+    }
+}
@@ -32,15 +32,10 @@ func IndexHandler(c web.C, w http.ResponseWriter, r *http.Request) {
         page = desiredPage
     }
 
-    // Get total number of posts that are not drafts
-    total, err := CountPosts(false)
+    numPages, err := IndexPageCount("")
     if err != nil {
         panic(err)
     }
-    numPages := total/config.IndexPostsPerPage
-    if total % config.IndexPostsPerPage != 0 {
-        numPages += 1
-    }
 
     // Is this page valid?
     if page < 1 || (page != 1 && page > numPages) {
@@ -48,19 +43,62 @@ func IndexHandler(c web.C, w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    v := map[string]interface{}{}
-    posts, err := ListPosts((page-1) * config.IndexPostsPerPage,
-                            config.IndexPostsPerPage,
-                            false)
+    v, err := IndexPageValues("", page, numPages)
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
     }
-    v["Posts"] = posts
-    v["CurrentPage"] = page
-    v["TotalPages"] = numPages
 
     err = SiteTemplates.ExecuteTemplate(w, "index.html", v)
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
     }
-}
\ No newline at end of file
+}
+
+// IndexPageCount gets the number of index pages needed to list every post
+// that is not a draft. If tag is set, only posts with that tag are counted.
+func IndexPageCount(tag string) (int, error) {
+    var total int
+    var err error
+    if tag == "" {
+        total, err = CountPosts(false)
+    } else {
+        total, err = CountPostsByTag(tag, false)
+    }
+    if err != nil {
+        return 0, err
+    }
+    numPages := total/config.IndexPostsPerPage
+    if total % config.IndexPostsPerPage != 0 {
+        numPages += 1
+    }
+    return numPages, nil
+}
+
+// IndexPageValues gets the values the index template is executed with for a
+// page of the index. If tag is set, it's a page of that tag's archive instead.
+func IndexPageValues(tag string, page int, numPages int) (map[string]interface{}, error) {
+    start := (page-1) * config.IndexPostsPerPage
+    var posts []Post
+    var err error
+    if tag == "" {
+        posts, err = ListPosts(start, config.IndexPostsPerPage, false)
+    } else {
+        posts, err = ListPostsByTag(tag, start, config.IndexPostsPerPage, false)
+    }
+    if err != nil {
+        return nil, err
+    }
+    tags, err := CountTags(false)
+    if err != nil {
+        return nil, err
+    }
+
+    v := map[string]interface{}{}
+    v["Posts"] = posts
+    v["CurrentPage"] = page
+    v["TotalPages"] = numPages
+    v["Tag"] = tag
+    v["Tags"] = tags
+    return v, nil
+}
@@ -0,0 +1,74 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestIndexPagination(t *testing.T) {
+    m := setupTestServer(t)
+    for i, slug := range []string{"one", "two", "three", "four", "five"} {
+        createTestPost(t, slug, false, time.Duration(i) * time.Hour)
+    }
+    createTestPost(t, "draft", true, 0)
+
+    // 5 published posts at 2 per page is 3 pages
+    tests := []struct {
+        path   string
+        status int
+        has    []string
+        hasNot []string
+    }{
+        {"/",  http.StatusOK,       []string{"/one", "/two", `href="/2"`}, []string{"/three", "/draft"}},
+        {"/1", http.StatusOK,       []string{"/one", "/two"},              []string{"/three"}},
+        {"/2", http.StatusOK,       []string{"/three", "/four", `href="/"`, `href="/3"`}, []string{"/two"}},
+        {"/3", http.StatusOK,       []string{"/five", `href="/2"`},        []string{"/four", `href="/4"`}},
+        {"/4", http.StatusNotFound, nil, nil},
+        {"/0", http.StatusNotFound, nil, nil},
+    }
+
+    for _, test := range tests {
+        w := doRequest(m, "GET", test.path, nil, nil)
+        if w.Code != test.status {
+            t.Errorf("GET %s: expected status %d, got %d", test.path, test.status, w.Code)
+            continue
+        }
+        body := w.Body.String()
+        for _, s := range test.has {
+            if !strings.Contains(body, s) {
+                t.Errorf("GET %s: expected body to contain %q", test.path, s)
+            }
+        }
+        for _, s := range test.hasNot {
+            if strings.Contains(body, s) {
+                t.Errorf("GET %s: expected body not to contain %q", test.path, s)
+            }
+        }
+    }
+}
+
+func TestIndexEmpty(t *testing.T) {
+    m := setupTestServer(t)
+    w := doRequest(m, "GET", "/", nil, nil)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+    }
+}
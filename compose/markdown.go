@@ -0,0 +1,199 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "bytes"
+    "golang.org/x/net/html"
+    "golang.org/x/net/html/atom"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+// Characters that must be escaped in Markdown text.
+var markdownEscaper = strings.NewReplacer(
+    `\`, `\\`,
+    "*", `\*`,
+    "_", `\_`,
+    "`", "\\`",
+    "&", "&amp;",
+    "<", "&lt;",
+)
+
+// Runs of whitespace, which HTML shows as one space.
+var whitespaceRegexp = regexp.MustCompile(`\s+`)
+
+// Runs of blank lines are collapsed to one.
+var blankLinesRegexp = regexp.MustCompile(`\n[ \t]*\n(?:[ \t]*\n)+`)
+
+// HtmlToMarkdown converts an HTML fragment to Markdown. Elements without a
+// Markdown equivalent, such as tables, are kept as HTML.
+func HtmlToMarkdown(src string) (string, error) {
+    nodes, err := html.ParseFragment(strings.NewReader(src), &html.Node{
+        Type:     html.ElementNode,
+        Data:     "body",
+        DataAtom: atom.Body,
+    })
+    if err != nil {
+        return "", err
+    }
+
+    out := &bytes.Buffer{}
+    for _, node := range nodes {
+        writeMarkdown(out, node)
+    }
+
+    md := blankLinesRegexp.ReplaceAllString(out.String(), "\n\n")
+    return strings.TrimSpace(md) + "\n", nil
+}
+
+// markdownChildren converts the children of a node.
+func markdownChildren(n *html.Node) (string) {
+    out := &bytes.Buffer{}
+    for c := n.FirstChild; c != nil; c = c.NextSibling {
+        writeMarkdown(out, c)
+    }
+    return out.String()
+}
+
+// textContent gets the text of a node and its children, unconverted.
+func textContent(n *html.Node) (string) {
+    if n.Type == html.TextNode {
+        return n.Data
+    }
+    out := ""
+    for c := n.FirstChild; c != nil; c = c.NextSibling {
+        out += textContent(c)
+    }
+    return out
+}
+
+// attr gets an attribute of an element.
+func attr(n *html.Node, name string) (string) {
+    for _, a := range n.Attr {
+        if a.Key == name {
+            return a.Val
+        }
+    }
+    return ""
+}
+
+// writeMarkdown converts a node and its children.
+func writeMarkdown(out *bytes.Buffer, n *html.Node) {
+    switch n.Type {
+    case html.TextNode:
+        // Line breaks in HTML text are only spaces
+        text := whitespaceRegexp.ReplaceAllString(n.Data, " ")
+        out.WriteString(markdownEscaper.Replace(text))
+        return
+    case html.ElementNode:
+    default:
+        return
+    }
+
+    switch n.DataAtom {
+    case atom.P, atom.Div:
+        if n.DataAtom == atom.Div && len(n.Attr) > 0 {
+            // Probably styled or a layout, so keep it
+            break
+        }
+        out.WriteString("\n\n" + markdownChildren(n) + "\n\n")
+        return
+    case atom.Br:
+        out.WriteString("  \n")
+        if n.NextSibling != nil && n.NextSibling.Type == html.TextNode {
+            n.NextSibling.Data = strings.TrimLeft(n.NextSibling.Data, " \t\r\n")
+        }
+        return
+    case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+        level := int(n.Data[1] - '0')
+        text := strings.TrimSpace(markdownChildren(n))
+        out.WriteString("\n\n" + strings.Repeat("#", level) + " " + text + "\n\n")
+        return
+    case atom.Strong, atom.B:
+        out.WriteString("**" + markdownChildren(n) + "**")
+        return
+    case atom.Em, atom.I:
+        out.WriteString("*" + markdownChildren(n) + "*")
+        return
+    case atom.A:
+        if attr(n, "href") == "" {
+            break
+        }
+        out.WriteString("[" + markdownChildren(n) + "](" + attr(n, "href"))
+        if title := attr(n, "title"); title != "" {
+            out.WriteString(` "` + strings.Replace(title, `"`, `\"`, -1) + `"`)
+        }
+        out.WriteString(")")
+        return
+    case atom.Img:
+        out.WriteString("![" + markdownEscaper.Replace(attr(n, "alt")) + "](" + attr(n, "src") + ")")
+        return
+    case atom.Code:
+        out.WriteString("`" + textContent(n) + "`")
+        return
+    case atom.Pre:
+        out.WriteString("\n\n```\n" + strings.Trim(textContent(n), "\n") + "\n```\n\n")
+        return
+    case atom.Blockquote:
+        quoted := strings.TrimSpace(markdownChildren(n))
+        quoted = blankLinesRegexp.ReplaceAllString(quoted, "\n\n")
+        out.WriteString("\n\n> " + strings.Replace(quoted, "\n", "\n> ", -1) + "\n\n")
+        return
+    case atom.Hr:
+        out.WriteString("\n\n---\n\n")
+        return
+    case atom.Ul, atom.Ol:
+        out.WriteString("\n\n")
+        i := 1
+        for c := n.FirstChild; c != nil; c = c.NextSibling {
+            if c.Type != html.ElementNode || c.DataAtom != atom.Li {
+                continue
+            }
+            marker := "- "
+            if n.DataAtom == atom.Ol {
+                marker = strconv.Itoa(i) + ". "
+            }
+
+            // Everything after the first line is indented to line up with it
+            item := strings.TrimSpace(markdownChildren(c))
+            item = blankLinesRegexp.ReplaceAllString(item, "\n\n")
+            item = strings.Replace(item, "\n\n", "\n", -1)
+            indent := strings.Repeat(" ", len(marker))
+            out.WriteString(marker + strings.Replace(item, "\n", "\n" + indent, -1) + "\n")
+            i += 1
+        }
+        out.WriteString("\n")
+        return
+    case atom.Span, atom.U, atom.Small, atom.Big, atom.Font:
+        out.WriteString(markdownChildren(n))
+        return
+    case atom.Script, atom.Style:
+        return
+    }
+
+    // No Markdown equivalent, so keep the HTML. At the top level it's a block
+    // of its own, anywhere else it stays where it is.
+    raw := &bytes.Buffer{}
+    html.Render(raw, n)
+    if n.Parent == nil {
+        out.WriteString("\n\n" + raw.String() + "\n\n")
+    } else {
+        out.WriteString(raw.String())
+    }
+}
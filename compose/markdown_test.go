@@ -0,0 +1,52 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "testing"
+)
+
+func TestHtmlToMarkdown(t *testing.T) {
+    tests := []struct {
+        html     string
+        markdown string
+    }{
+        {"<p>Hello <strong>bold</strong> and <em>soft</em>\nworld</p>", "Hello **bold** and *soft* world\n"},
+        {"<p>One</p><p>Two<br />\nThree</p>", "One\n\nTwo  \nThree\n"},
+        {"<h2>Title</h2><hr>", "## Title\n\n---\n"},
+        {`<p><a href="http://example.com/" title="Ex">link</a> <img src="/a.png" alt="A"></p>`, "[link](http://example.com/ \"Ex\") ![A](/a.png)\n"},
+        {"<ul><li>a</li><li>b<ol><li>c</li></ol></li></ul>", "- a\n- b\n  1. c\n"},
+        {"<ol><li>a<pre>b\nc</pre></li></ol>", "1. a\n   ```\n   b\n   c\n   ```\n"},
+        {"<blockquote><p>One</p><p>Two</p></blockquote>", "> One\n> \n> Two\n"},
+        {"<pre><code>x := 1\n\ny := 2</code></pre>", "```\nx := 1\n\ny := 2\n```\n"},
+        {"<p>Use <code>a*b</code> not a*b_c &amp; &lt;d&gt;</p>", "Use `a*b` not a\\*b\\_c &amp; &lt;d>\n"},
+        {"<table><tr><td>cell</td></tr></table>", "<table><tbody><tr><td>cell</td></tr></tbody></table>\n"},
+        {`<p><span style="color: red">red</span></p>`, "red\n"},
+        {"<p>E = mc<sup>2</sup></p>", "E = mc<sup>2</sup>\n"},
+        {`<p><img class="alignnone size-medium" src="/b.png" alt="" width="300" height="200" /></p>`, "![](/b.png)\n"},
+    }
+
+    for _, test := range tests {
+        md, err := HtmlToMarkdown(test.html)
+        if err != nil {
+            t.Fatal(err)
+        }
+        if md != test.markdown {
+            t.Errorf("HtmlToMarkdown(%q) = %q, want %q", test.html, md, test.markdown)
+        }
+    }
+}
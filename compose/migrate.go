@@ -0,0 +1,238 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "gopkg.in/mgo.v2/bson"
+    "strconv"
+)
+
+// Migration is a single step in the evolution of the database schema. Up
+// moves the database from Version-1 to Version and Down moves it back. A nil
+// Down means there is nothing to undo.
+type Migration struct {
+    Version     int
+    Description string
+    Up          func(s Store) error
+    Down        func(s Store) error
+}
+
+// Migrations is the ordered list of schema changes. New migrations must be
+// appended with the next version number and never edited once released.
+var Migrations = []Migration{
+    {1, "Fill in missing post file lists and modification times", migrateFillPostFields, nil},
+    {2, "Remove empty post slugs so they can be uniquely indexed",  migrateRemoveEmptySlugs, nil},
+}
+
+// LatestSchemaVersion is the schema version this version of Compose expects.
+func LatestSchemaVersion() (int) {
+    if len(Migrations) == 0 {
+        return 0
+    }
+    return Migrations[len(Migrations)-1].Version
+}
+
+// MigrateUp applies all of the migrations needed to bring the database up to
+// the target version.
+func MigrateUp(s Store, target int) error {
+    version, err := s.SchemaVersion()
+    if err != nil {
+        return err
+    }
+
+    for _, m := range Migrations {
+        if m.Version <= version || m.Version > target {
+            continue
+        }
+        fmt.Printf("Applying migration %d: %s\n", m.Version, m.Description)
+        err = m.Up(s)
+        if err != nil {
+            return fmt.Errorf("Migration %d failed: %s", m.Version, err.Error())
+        }
+        err = s.SetSchemaVersion(m.Version)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// MigrateDown reverts migrations, newest first, until the database is at the
+// target version.
+func MigrateDown(s Store, target int) error {
+    version, err := s.SchemaVersion()
+    if err != nil {
+        return err
+    }
+
+    for i := len(Migrations)-1; i >= 0; i-- {
+        m := Migrations[i]
+        if m.Version > version || m.Version <= target {
+            continue
+        }
+        fmt.Printf("Reverting migration %d: %s\n", m.Version, m.Description)
+        if m.Down != nil {
+            err = m.Down(s)
+            if err != nil {
+                return fmt.Errorf("Reverting migration %d failed: %s", m.Version, err.Error())
+            }
+        }
+        err = s.SetSchemaVersion(m.Version - 1)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// PrepareSchema makes sure the database can be used by this version of
+// Compose. An older database is migrated if AutoMigrate is enabled; a newer
+// one is always refused.
+func PrepareSchema(s Store) error {
+    version, err := s.SchemaVersion()
+    if err != nil {
+        return err
+    }
+
+    latest := LatestSchemaVersion()
+    if version > latest {
+        return fmt.Errorf("The database schema (version %d) is newer than this version of Compose supports (version %d). Please upgrade Compose.", version, latest)
+    }
+    if version < latest {
+        if !config.AutoMigrate {
+            return fmt.Errorf("The database schema (version %d) is out of date (version %d is required). Run 'compose migrate up' to upgrade it.", version, latest)
+        }
+        return MigrateUp(s, latest)
+    }
+    return nil
+}
+
+// MigrateCommand is the handler for the migrate command.
+func MigrateCommand(args []string) error {
+    if len(args) < 1 || len(args) > 2 {
+        return errors.New("Usage: compose migrate up|down|status [version]")
+    }
+
+    s := GetStore()
+    version, err := s.SchemaVersion()
+    if err != nil {
+        return err
+    }
+
+    // Parse the optional target version
+    target := -1
+    if len(args) == 2 {
+        target, err = strconv.Atoi(args[1])
+        if err != nil || target < 0 || target > LatestSchemaVersion() {
+            return fmt.Errorf("Invalid version '%s'", args[1])
+        }
+    }
+
+    switch args[0] {
+    case "up":
+        if target < 0 {
+            target = LatestSchemaVersion()
+        }
+        if target < version {
+            return fmt.Errorf("The database is already at version %d", version)
+        }
+        return MigrateUp(s, target)
+    case "down":
+        if target < 0 {
+            target = version - 1
+        }
+        if target < 0 || target > version {
+            return fmt.Errorf("Can't migrate down from version %d", version)
+        }
+        return MigrateDown(s, target)
+    case "status":
+        fmt.Printf("Database schema version: %d (latest is %d)\n", version, LatestSchemaVersion())
+        for _, m := range Migrations {
+            applied := " "
+            if m.Version <= version {
+                applied = "x"
+            }
+            fmt.Printf("  [%s] %3d  %s\n", applied, m.Version, m.Description)
+        }
+        return nil
+    }
+    return fmt.Errorf("Unknown migrate command '%s'", args[0])
+}
+
+// migratePosts lists every post and page, drafts included, for a migration.
+func migratePosts(s Store) ([]Post, error) {
+    posts, err := s.ListPosts(0, 0, true)
+    if err != nil {
+        return nil, err
+    }
+    pages, err := s.ListPages(true)
+    if err != nil {
+        return nil, err
+    }
+    return append(posts, pages...), nil
+}
+
+// migrateFillPostFields gives posts saved by early versions of Compose an
+// empty file list and a modification time so they can be served with caching
+// headers.
+func migrateFillPostFields(s Store) error {
+    posts, err := migratePosts(s)
+    if err != nil {
+        return err
+    }
+
+    for _, post := range posts {
+        changed := false
+        if post.Files == nil {
+            post.Files = []bson.ObjectId{}
+            changed = true
+        }
+        if post.LastModified.IsZero() {
+            post.LastModified = post.Date
+            changed = true
+        }
+        if changed {
+            err = s.SavePost(&post)
+            if err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+// migrateRemoveEmptySlugs re-saves posts without a slug. Empty slugs are now
+// left out of the stored document so that they are skipped by the sparse
+// unique slug index.
+func migrateRemoveEmptySlugs(s Store) error {
+    posts, err := migratePosts(s)
+    if err != nil {
+        return err
+    }
+
+    for _, post := range posts {
+        if post.Slug == "" {
+            err = s.SavePost(&post)
+            if err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
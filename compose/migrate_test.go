@@ -0,0 +1,173 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "errors"
+    "testing"
+    "time"
+)
+
+// withMigrations swaps in a list of migrations for the duration of a test.
+func withMigrations(migrations []Migration) (func()) {
+    saved := Migrations
+    Migrations = migrations
+    return func() { Migrations = saved }
+}
+
+func TestMigrateUpAndDown(t *testing.T) {
+    s := NewMemoryStore()
+    var applied []int
+    up := func(v int) func(Store) error {
+        return func(Store) error { applied = append(applied, v); return nil }
+    }
+    down := func(v int) func(Store) error {
+        return func(Store) error { applied = append(applied, -v); return nil }
+    }
+    defer withMigrations([]Migration{
+        {1, "one",   up(1), down(1)},
+        {2, "two",   up(2), nil},
+        {3, "three", up(3), down(3)},
+    })()
+
+    if LatestSchemaVersion() != 3 {
+        t.Fatalf("Expected latest version 3, got %d", LatestSchemaVersion())
+    }
+
+    if err := MigrateUp(s, 2); err != nil {
+        t.Fatal(err)
+    }
+    if v, _ := s.SchemaVersion(); v != 2 {
+        t.Fatalf("Expected version 2, got %d", v)
+    }
+    if err := MigrateUp(s, 3); err != nil {
+        t.Fatal(err)
+    }
+    if err := MigrateDown(s, 0); err != nil {
+        t.Fatal(err)
+    }
+    if v, _ := s.SchemaVersion(); v != 0 {
+        t.Fatalf("Expected version 0, got %d", v)
+    }
+
+    expected := []int{1, 2, 3, -3, -1}
+    if len(applied) != len(expected) {
+        t.Fatalf("Expected steps %v, got %v", expected, applied)
+    }
+    for i := range expected {
+        if applied[i] != expected[i] {
+            t.Fatalf("Expected steps %v, got %v", expected, applied)
+        }
+    }
+}
+
+func TestMigrateUpStopsOnError(t *testing.T) {
+    s := NewMemoryStore()
+    fail := func(Store) error { return errors.New("broken") }
+    ok := func(Store) error { return nil }
+    defer withMigrations([]Migration{
+        {1, "one", ok,   nil},
+        {2, "two", fail, nil},
+        {3, "three", ok, nil},
+    })()
+
+    if err := MigrateUp(s, 3); err == nil {
+        t.Fatal("Expected an error")
+    }
+    if v, _ := s.SchemaVersion(); v != 1 {
+        t.Fatalf("Expected version 1, got %d", v)
+    }
+}
+
+func TestPrepareSchema(t *testing.T) {
+    setupTestServer(t)
+    s := GetStore()
+
+    // Older databases are migrated, unless disabled
+    config.AutoMigrate = false
+    if err := PrepareSchema(s); err == nil {
+        t.Error("Expected an error with AutoMigrate disabled")
+    }
+    config.AutoMigrate = true
+    if err := PrepareSchema(s); err != nil {
+        t.Fatal(err)
+    }
+    if v, _ := s.SchemaVersion(); v != LatestSchemaVersion() {
+        t.Fatalf("Expected version %d, got %d", LatestSchemaVersion(), v)
+    }
+
+    // Newer databases are refused
+    s.SetSchemaVersion(LatestSchemaVersion() + 1)
+    if err := PrepareSchema(s); err == nil {
+        t.Error("Expected an error for a newer database")
+    }
+}
+
+func TestMigrateFillPostFields(t *testing.T) {
+    setupTestServer(t)
+    post := createTestPost(t, "old", false, time.Hour)
+    post.Files = nil
+    post.LastModified = time.Time{}
+    GetStore().SavePost(post)
+    page := createTestPost(t, "about", false, time.Hour)
+    page.Kind = PostKindPage
+    page.LastModified = time.Time{}
+    GetStore().SavePost(page)
+
+    if err := migrateFillPostFields(GetStore()); err != nil {
+        t.Fatal(err)
+    }
+    post, _ = FindPostById(post.Id)
+    if post.Files == nil {
+        t.Error("Expected an empty file list")
+    }
+    if !post.LastModified.Equal(post.Date) {
+        t.Errorf("Expected LastModified %v, got %v", post.Date, post.LastModified)
+    }
+    page, _ = FindPostById(page.Id)
+    if !page.LastModified.Equal(page.Date) {
+        t.Errorf("Expected the page to be migrated too, got LastModified %v", page.LastModified)
+    }
+}
+
+func TestMigrateCommand(t *testing.T) {
+    setupTestServer(t)
+    s := GetStore()
+    latest := LatestSchemaVersion()
+
+    if err := RunCommand([]string{"migrate", "up"}); err != nil {
+        t.Fatal(err)
+    }
+    if v, _ := s.SchemaVersion(); v != latest {
+        t.Fatalf("Expected version %d, got %d", latest, v)
+    }
+    if err := RunCommand([]string{"migrate", "down"}); err != nil {
+        t.Fatal(err)
+    }
+    if v, _ := s.SchemaVersion(); v != latest - 1 {
+        t.Fatalf("Expected version %d, got %d", latest - 1, v)
+    }
+    if err := RunCommand([]string{"migrate", "status"}); err != nil {
+        t.Fatal(err)
+    }
+    if err := RunCommand([]string{"migrate", "sideways"}); err == nil {
+        t.Error("Expected an error for an unknown migrate command")
+    }
+    if err := RunCommand([]string{"bogus"}); err == nil {
+        t.Error("Expected an error for an unknown command")
+    }
+}
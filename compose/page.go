@@ -0,0 +1,159 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "github.com/zenazn/goji/web"
+    "net/http"
+    "path"
+    "sort"
+    "strings"
+)
+
+// ListPages lists every page, ordered by slug, optionally including drafts
+// and scheduled pages.
+func ListPages(includeDrafts bool) ([]Post, error) {
+    return GetStore().ListPages(includeDrafts)
+}
+
+// CreatePage creates a new page object. Call Save() on the page to write it to
+// the database.
+func CreatePage() (*Post, error) {
+    page, err := CreatePost()
+    if err != nil {
+        return nil, err
+    }
+    page.Kind = PostKindPage
+    return page, nil
+}
+
+// pagesByMenu sorts pages by their position in the menu.
+type pagesByMenu []PostHeader
+
+func (p pagesByMenu) Len() int      { return len(p) }
+func (p pagesByMenu) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p pagesByMenu) Less(i, j int) bool {
+    if p[i].Menu == p[j].Menu {
+        return p[i].Slug < p[j].Slug
+    }
+    return p[i].Menu < p[j].Menu
+}
+
+// SiteMenu lists the published pages in the site's navigation menu, in order.
+// Pages are put in the menu by giving them a position greater than 0. It is
+// available to templates as "menu".
+func SiteMenu() ([]PostHeader, error) {
+    pages, err := ListPages(false)
+    if err != nil {
+        return nil, err
+    }
+
+    var menu []PostHeader
+    for _, page := range pages {
+        if page.Menu > 0 {
+            menu = append(menu, page.PostHeader)
+        }
+    }
+    sort.Sort(pagesByMenu(menu))
+    return menu, nil
+}
+
+// NormalizePageSlug is NormalizeSlug for the slug of a page. Pages can be
+// nested, like docs/install, so slashes are allowed, but not at either end or
+// repeated.
+func NormalizePageSlug(slug string) (string) {
+    var parts []string
+    for _, part := range strings.Split(slug, "/") {
+        part = NormalizeSlug(part)
+        if part != "" {
+            parts = append(parts, part)
+        }
+    }
+    return strings.Join(parts, "/")
+}
+
+// ViewNestedPageHandler is the handler for paths with more than two parts,
+// which can only be nested pages or the files attached to them. Old slugs of
+// pages are redirected.
+func ViewNestedPageHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+    p := strings.TrimPrefix(r.URL.Path, "/")
+
+    // Remove the trailing slash from a valid page url
+    if strings.HasSuffix(p, "/") {
+        slug := strings.TrimSuffix(p, "/")
+        page, err := findViewablePostBySlug(r, slug)
+        if err != nil || !page.IsPage() {
+            if !redirectOldSlug(w, r, slug, "") {
+                http.NotFound(w, r)
+            }
+            return
+        }
+        http.Redirect(w, r, "/" + slug, http.StatusMovedPermanently)
+        return
+    }
+
+    page, err := findViewablePostBySlug(r, p)
+    if err == nil && page.IsPage() {
+        renderPost(w, r, page)
+        return
+    }
+
+    slug, name := path.Split(p)
+    slug = strings.TrimSuffix(slug, "/")
+    page, err = findViewablePostBySlug(r, slug)
+    if err != nil || !page.IsPage() {
+        if !redirectOldSlug(w, r, p, "") && !redirectOldSlug(w, r, slug, "/" + name) {
+            http.NotFound(w, r)
+        }
+        return
+    }
+    servePostFile(w, r, page, name)
+}
+
+// ApiListPages is a handler to list pages, drafts included.
+func ApiListPages(c web.C, w http.ResponseWriter, r *http.Request) {
+    pages, err := ListPages(true)
+    if err != nil {
+        panic(err)
+    }
+
+    headers := []PostHeader{}
+    for _, page := range pages {
+        page.Status = page.CurrentStatus()
+        headers = append(headers, page.PostHeader)
+    }
+    WriteJson(w, headers)
+}
+
+// ApiCreatePage is a handler to create a new page.
+func ApiCreatePage(c web.C, w http.ResponseWriter, r *http.Request) {
+    page, err := CreatePage()
+    if err != nil {
+        panic(err)
+    }
+
+    page.Title = "New Page"
+    page.Slug, err = UniqueSlug(NormalizeSlug(page.Title), page.Id, true)
+    if err != nil {
+        panic(err)
+    }
+    user, _ := RequestUser(r)
+    page.SaveBy(user)
+    page.Status = page.CurrentStatus()
+
+    WriteJson(w, page)
+}
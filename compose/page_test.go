@@ -0,0 +1,224 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "gopkg.in/mgo.v2/bson"
+    "io/ioutil"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "testing"
+    "time"
+)
+
+// createTestPage saves a new page with the given slug and menu position.
+func createTestPage(t *testing.T, slug string, menu int) (*Post) {
+    page, _ := CreatePage()
+    page.Title = "Title of " + slug
+    page.Slug = slug
+    page.Draft = false
+    page.Date = time.Now().Add(-time.Hour)
+    page.Menu = menu
+    page.Body = "Body of " + slug
+    _, err := page.Save()
+    if err != nil {
+        t.Fatal("Failed to save page:", err)
+    }
+    return page
+}
+
+func TestNormalizePageSlug(t *testing.T) {
+    tests := map[string]string{
+        "about":           "about",
+        "/docs/install/":  "docs/install",
+        "docs//install":   "docs/install",
+        " docs / install": "docs/install",
+        "/":               "",
+    }
+    for slug, expected := range tests {
+        if normalized := NormalizePageSlug(slug); normalized != expected {
+            t.Errorf("NormalizePageSlug(%q): expected %q, got %q", slug, expected, normalized)
+        }
+    }
+}
+
+func TestPagesLeftOutOfPosts(t *testing.T) {
+    m := setupTestServer(t)
+    config.SiteUrl = "http://blog.example.com"
+    createTestPost(t, "post", false, time.Hour)
+    page := createTestPage(t, "about", 1)
+    page.Tags = []string{"info"}
+    page.Save()
+
+    if n, _ := CountPosts(true); n != 1 {
+        t.Errorf("Expected pages not to be counted as posts, got %d", n)
+    }
+    if tags, _ := CountTags(true); len(tags) != 0 {
+        t.Errorf("Expected no tags, got %v", tags)
+    }
+    for _, path := range []string{"/", "/feed.xml", "/feed.json"} {
+        w := doRequest(m, "GET", path, nil, nil)
+        if strings.Contains(w.Body.String(), "Body of about") {
+            t.Errorf("GET %s: expected the page to be left out:\n%s", path, w.Body.String())
+        }
+    }
+    w := doRequest(m, "GET", "/sitemap.xml", nil, nil)
+    if !strings.Contains(w.Body.String(), "http://blog.example.com/about") {
+        t.Errorf("Expected the page in the sitemap:\n%s", w.Body.String())
+    }
+}
+
+func TestViewPage(t *testing.T) {
+    m := setupTestServer(t)
+    createTestPage(t, "about", 2)
+    createTestPage(t, "docs", 1)
+    install := createTestPage(t, "docs/install", 0)
+    createTestPost(t, "post", false, time.Hour)
+    draft := createTestPage(t, "secret", 3)
+    draft.Draft = true
+    draft.Save()
+
+    info, err := GetStore().CreateFile("diagram.png", strings.NewReader("diagram"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    install.Files = []bson.ObjectId{info.Id}
+    install.Save()
+
+    tests := []struct {
+        path   string
+        status int
+        body   string
+    }{
+        {"/about",                    http.StatusOK,               "Body of about"},
+        {"/docs",                     http.StatusOK,               "Body of docs"},
+        {"/docs/install",             http.StatusOK,               "Body of docs/install"},
+        {"/docs/install/diagram.png", http.StatusOK,               "diagram"},
+        {"/docs/install/",            http.StatusMovedPermanently, ""},
+        {"/docs/install/missing.png", http.StatusNotFound,         ""},
+        {"/docs/missing/page",        http.StatusNotFound,         ""},
+        {"/post/x/y",                 http.StatusNotFound,         ""},
+    }
+    for _, test := range tests {
+        w := doRequest(m, "GET", test.path, nil, nil)
+        if w.Code != test.status {
+            t.Errorf("GET %s: expected status %d, got %d", test.path, test.status, w.Code)
+            continue
+        }
+        if !strings.Contains(w.Body.String(), test.body) {
+            t.Errorf("GET %s: expected body to contain %q", test.path, test.body)
+        }
+    }
+    if w := doRequest(m, "GET", "/docs/install/", nil, nil); w.Header().Get("Location") != "/docs/install" {
+        t.Errorf("Expected redirect to /docs/install, got %q", w.Header().Get("Location"))
+    }
+
+    // Pages are rendered without a date, and every page has the menu in order
+    w := doRequest(m, "GET", "/about", nil, nil)
+    if strings.Contains(w.Body.String(), "<small>") {
+        t.Errorf("Expected the page template to be used:\n%s", w.Body.String())
+    }
+    for _, path := range []string{"/", "/about", "/post"} {
+        body := doRequest(m, "GET", path, nil, nil).Body.String()
+        docs := strings.Index(body, `<li><a href="/docs">`)
+        about := strings.Index(body, `<li><a href="/about">`)
+        if docs < 0 || about < docs || strings.Contains(body, `href="/secret"`) || strings.Contains(body, `<li><a href="/docs/install">`) {
+            t.Errorf("GET %s: wrong menu:\n%s", path, body)
+        }
+    }
+}
+
+func TestApiPages(t *testing.T) {
+    m := setupTestServer(t)
+    cookie := loginTestUser(t)
+    createTestPost(t, "post", false, time.Hour)
+
+    w := doRequest(m, "POST", "/api/pages", nil, cookie)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    page := &Post{}
+    json.Unmarshal(w.Body.Bytes(), page)
+    if page.Kind != PostKindPage || page.Title != "New Page" {
+        t.Fatalf("Wrong page: %+v", page)
+    }
+
+    // The kind can't be changed, and nested slugs are tidied up
+    page.Kind = PostKindPost
+    page.Slug = "/docs/install/"
+    page.Menu = 2
+    payload, _ := json.Marshal(page)
+    doRequest(m, "PUT", "/api/post/" + page.Id.Hex(), bytes.NewReader(payload), cookie)
+    saved, _ := FindPostById(page.Id)
+    if !saved.IsPage() || saved.Slug != "docs/install" || saved.Menu != 2 {
+        t.Errorf("Wrong page after update: %+v", saved)
+    }
+
+    // The post in the URL is the one saved, whatever id the payload has
+    other, _ := FindPostBySlug("post")
+    hijack := *page
+    hijack.Id = other.Id
+    hijack.Title = "Hijacked"
+    payload, _ = json.Marshal(hijack)
+    doRequest(m, "PUT", "/api/post/" + page.Id.Hex(), bytes.NewReader(payload), cookie)
+    if other, _ := FindPostById(other.Id); other.IsPage() || other.Title == "Hijacked" {
+        t.Errorf("Expected the other post to be left alone, got %+v", other)
+    }
+    if saved, _ := FindPostById(page.Id); !saved.IsPage() || saved.Title != "Hijacked" {
+        t.Errorf("Expected the page to be updated, got %+v", saved)
+    }
+
+    w = doRequest(m, "GET", "/api/pages", nil, cookie)
+    var headers []PostHeader
+    json.Unmarshal(w.Body.Bytes(), &headers)
+    if len(headers) != 1 || headers[0].Id != page.Id || headers[0].Status != PostStatusDraft {
+        t.Errorf("Wrong pages: %+v", headers)
+    }
+    w = doRequest(m, "GET", "/api/posts", nil, cookie)
+    json.Unmarshal(w.Body.Bytes(), &headers)
+    if len(headers) != 1 || headers[0].Slug != "post" {
+        t.Errorf("Wrong posts: %+v", headers)
+    }
+}
+
+func TestBuildSitePages(t *testing.T) {
+    setupTestServer(t)
+    createTestPage(t, "docs", 1)
+    createTestPage(t, "docs/install", 0)
+
+    out, err := ioutil.TempDir("", "compose")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(out)
+
+    _, err = BuildSite(out)
+    if err != nil {
+        t.Fatal(err)
+    }
+    data, err := ioutil.ReadFile(filepath.Join(out, "docs", "install", "index.html"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !strings.Contains(string(data), "Body of docs/install") || !strings.Contains(string(data), `href="../../docs/index.html"`) {
+        t.Errorf("Wrong nested page:\n%s", data)
+    }
+}
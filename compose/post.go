@@ -16,9 +16,9 @@
 package main
 
 import (
+    "fmt"
     "github.com/mborgerson/GoTruncateHtml/truncatehtml"
     "github.com/russross/blackfriday"
-    "gopkg.in/mgo.v2"
     "gopkg.in/mgo.v2/bson"
     "html/template"
     "net/http"
@@ -31,9 +31,15 @@ type PostHeader struct {
     Title        string          `json:"title"         bson:"title"`
     Date         time.Time       `json:"date"          bson:"date"`
     LastModified time.Time       `json:"last_modified" bson:"last_modified"`
-    Slug         string          `json:"slug"          bson:"slug"`
+    Slug         string          `json:"slug"          bson:"slug,omitempty"`
     Draft        bool            `json:"draft"         bson:"draft"`
     Files        []bson.ObjectId `json:"files"         bson:"files"`
+    Tags         []string        `json:"tags"          bson:"tags"`
+    Status       string          `json:"status"        bson:"-"`
+    Kind         string          `json:"kind"          bson:"kind,omitempty"`
+    Menu         int             `json:"menu"          bson:"menu,omitempty"`
+    OldSlugs     []string        `json:"old_slugs"     bson:"old_slugs,omitempty"`
+    Preview      bool            `json:"-"             bson:"-"`
 }
 
 type Post struct {
@@ -41,64 +47,49 @@ type Post struct {
     Body         string          `json:"body"          bson:"body"`
 }
 
+// The kinds of post. Pages are left out of the index, tags and feeds, and are
+// only reached by their slug, which can be a nested path, and the site menu.
+const (
+    PostKindPost = ""
+    PostKindPage = "page"
+)
+
+// The states a post can be in, as reported by the admin API. A post that isn't
+// a draft is scheduled until its date comes around.
+const (
+    PostStatusDraft     = "draft"
+    PostStatusScheduled = "scheduled"
+    PostStatusPublished = "published"
+)
+
 // FindPostBySlug finds a post by the slug. An error is returned if the post
 // for the given slug could not be found.
 func FindPostBySlug(slug string) (*Post, error) {
-    db := GetDatabaseHandle()
-    c := db.C("posts")
-    post := &Post{}
-    err := c.Find(bson.M{"slug":slug}).One(post)
-    if err != nil {
-        return nil, err
-    }
-    return post, nil
+    return GetStore().FindPostBySlug(slug)
+}
+
+// FindPostByOldSlug finds the post that used to have the given slug. An error
+// is returned if no post ever had the slug before its current one.
+func FindPostByOldSlug(slug string) (*Post, error) {
+    return GetStore().FindPostByOldSlug(slug)
 }
 
 // FindPostById finds a post given a post id. An error is ruterned if the post
 // for the given id could not be found.
 func FindPostById(id bson.ObjectId) (*Post, error) {
-    db := GetDatabaseHandle()
-    c := db.C("posts")
-    post := &Post{}
-    err := c.FindId(id).One(post)
-    if err != nil {
-        return nil, err
-    }
-    return post, nil
+    return GetStore().FindPostById(id)
 }
 
 // ListPosts will return a slice of limit reverse-chronologicaly orderded posts,
 // starting from start and optionally including drafts.
 func ListPosts(start int, limit int, includeDrafts bool) ([]Post, error) {
-    db := GetDatabaseHandle()
-    c := db.C("posts")
-    var posts []Post
-    posts = nil
-    var q *mgo.Query
-    if includeDrafts {
-        q = c.Find(nil)
-    } else {
-        q = c.Find(bson.M{"draft":false})
-    }
-    err := q.Sort("-date").Skip(start).Limit(limit).All(&posts)
-    return posts, err
+    return GetStore().ListPosts(start, limit, includeDrafts)
 }
 
 // ListPostHeaders will return a slice of limit reverse-chronologicaly orderded posts,
 // starting from start and optionally including drafts.
 func ListPostHeaders(start int, limit int, includeDrafts bool) ([]PostHeader, error) {
-    db := GetDatabaseHandle()
-    c := db.C("posts")
-    var posts []PostHeader
-    posts = nil
-    var q *mgo.Query
-    if includeDrafts {
-        q = c.Find(nil)
-    } else {
-        q = c.Find(bson.M{"draft":false})
-    }
-    err := q.Sort("-date").Skip(start).Limit(limit).All(&posts)
-    return posts, err
+    return GetStore().ListPostHeaders(start, limit, includeDrafts)
 }
 
 // CreatePost creates a new post object. Call Save() on the post to write it
@@ -112,47 +103,188 @@ func CreatePost() (*Post, error) {
             Date:  time.Now(),
             Slug:  "",
             Draft: true,
-            Files: []bson.ObjectId{}},
+            Files: []bson.ObjectId{},
+            Tags:  []string{}},
         Body:  ""}
     return newPost, nil
 }
 
 // CountPosts counts the total number of posts, optionally including drafts.
+// Scheduled posts are counted as drafts.
 func CountPosts(includeDrafts bool) (int, error) {
-    db := GetDatabaseHandle()
-    c := db.C("posts")
-    var q *mgo.Query
-    if includeDrafts {
-        q = c.Find(nil)
-    } else {
-        q = c.Find(bson.M{"draft":false})
+    return GetStore().CountPosts(includeDrafts)
+}
+
+// NextPublishTime gets the date of the next scheduled post or page to go live,
+// or the zero time if nothing is scheduled.
+func NextPublishTime() (time.Time, error) {
+    posts, err := ListPostHeaders(0, 0, true)
+    if err != nil {
+        return time.Time{}, err
+    }
+
+    pages, err := ListPages(true)
+    if err != nil {
+        return time.Time{}, err
+    }
+    for _, page := range pages {
+        posts = append(posts, page.PostHeader)
+    }
+
+    var next time.Time
+    for _, post := range posts {
+        if post.IsScheduled() && (next.IsZero() || post.Date.Before(next)) {
+            next = post.Date
+        }
+    }
+    return next, nil
+}
+
+// IsPage checks if the post is a page rather than part of the blog.
+func (post *PostHeader) IsPage() (bool) {
+    return post.Kind == PostKindPage
+}
+
+// IsPublished checks if the post is live.
+func (post *PostHeader) IsPublished() (bool) {
+    return !post.Draft && !post.Date.After(time.Now())
+}
+
+// IsScheduled checks if the post will go live when its date comes around.
+func (post *PostHeader) IsScheduled() (bool) {
+    return !post.Draft && post.Date.After(time.Now())
+}
+
+// CurrentStatus gets the state the post is in now.
+func (post *PostHeader) CurrentStatus() (string) {
+    switch {
+    case post.Draft:
+        return PostStatusDraft
+    case post.IsScheduled():
+        return PostStatusScheduled
+    }
+    return PostStatusPublished
+}
+
+// PublicModified is when the public version of the post last changed. That's
+// when it was last saved or, for a post that was scheduled, when it went live.
+func (post *PostHeader) PublicModified() (time.Time) {
+    if post.Date.After(post.LastModified) {
+        return post.Date
+    }
+    return post.LastModified
+}
+
+// rememberSlug adds a slug the post no longer has to its old slugs, so links
+// to it can be redirected.
+func (post *PostHeader) rememberSlug(slug string) {
+    oldSlugs := []string{}
+    for _, old := range post.OldSlugs {
+        if old != post.Slug && old != slug {
+            oldSlugs = append(oldSlugs, old)
+        }
+    }
+    if slug != "" && slug != post.Slug {
+        oldSlugs = append(oldSlugs, slug)
+    }
+    post.OldSlugs = oldSlugs
+}
+
+// findViewablePostBySlug finds a post by the slug for one of the public pages.
+// Drafts and scheduled posts are only found for logged in users, who see them
+// as a preview.
+func findViewablePostBySlug(r *http.Request, slug string) (*Post, error) {
+    post, err := FindPostBySlug(slug)
+    if err != nil {
+        return nil, err
     }
-    return q.Count() 
+    if !post.IsPublished() {
+        if !IsRequestLoggedIn(r) {
+            return nil, ErrNotFound
+        }
+        post.Preview = true
+    }
+    return post, nil
 }
 
-// Save writes the post to the database.
+// Save writes the post to the database. If a git working tree is configured,
+// the post is also written there and committed.
 func (post *Post) Save() (*Post, error) {
-    db := GetDatabaseHandle()
-    c := db.C("posts")
+    return post.SaveBy(nil)
+}
+
+// SaveBy is like Save, but records the user who saved the post in the
+// revision history.
+func (post *Post) SaveBy(author *User) (*Post, error) {
+    old, err := post.saveBy(author)
+    if err != nil {
+        return post, err
+    }
+
+    // The database is what's served, so a failure here shouldn't fail the save
+    if config.GitSyncPath != "" {
+        err = MirrorPost(post, old, "Update post '" + post.Title + "'")
+        if err != nil {
+            fmt.Println("Warning: failed to write post to the git working tree:", err.Error())
+        }
+    }
+    return post, nil
+}
+
+// saveBy writes the post to the database and records the revision, but leaves
+// the git working tree alone. The post as it was stored before is returned, or
+// nil for a new post.
+func (post *Post) saveBy(author *User) (*Post, error) {
+    // The stored post has the slug history
+    old, err := FindPostById(post.Id)
+    if err != nil && err != ErrNotFound {
+        return nil, err
+    }
+    if old != nil {
+        post.OldSlugs = old.OldSlugs
+        post.rememberSlug(old.Slug)
+    }
+
+    if post.Tags != nil {
+        post.Tags = NormalizeTags(post.Tags)
+    }
     post.LastModified = time.Now()
-    _, err := c.UpsertId(post.Id, post)
-    return post, err
+    err = GetStore().SavePost(post)
+    if err != nil {
+        return nil, err
+    }
+    siteCache.Invalidate()
+    err = RecordRevision(post, old, author)
+    if err != nil {
+        return nil, err
+    }
+    return old, nil
 }
 
 // Delete removes the post and all of its files from the database.
 func (post *Post) Delete() (*Post, error) {
-    db := GetDatabaseHandle()
     // Delete post files
     file_infos, err := GetMultFileInfoById(post.Files)
     if err != nil {
         panic(err)
     }
     for _, info := range file_infos {
-        info.DeleteFile()
+        if info != nil {
+            info.DeleteFile()
+        }
     }
 
-    c := db.C("posts")
-    err = c.RemoveId(post.Id)
+    err = GetStore().DeletePost(post.Id)
+    siteCache.Invalidate()
+    if err == nil {
+        err = DeleteRevisions(post.Id)
+    }
+    if err == nil && config.GitSyncPath != "" {
+        err := MirrorPostDelete(post)
+        if err != nil {
+            fmt.Println("Warning: failed to remove post from the git working tree:", err.Error())
+        }
+    }
     return post, err
 }
 
@@ -174,34 +306,66 @@ func (post *Post) RenderBodySnippet(maxlen int, ellipsis string) (template.HTML,
     return template.HTML(truncated), nil
 }
 
-// ViewHandler is the handler for viewing a post.
+// redirectOldSlug sends a permanent redirect to the current URL of the post
+// that used to have the given slug, with rest added to the end. It returns
+// false, and sends nothing, if there is no such post or it can't be viewed.
+func redirectOldSlug(w http.ResponseWriter, r *http.Request, slug string, rest string) (bool) {
+    post, err := FindPostByOldSlug(slug)
+    if err != nil || (!post.IsPublished() && !IsRequestLoggedIn(r)) {
+        return false
+    }
+    http.Redirect(w, r, "/" + post.Slug + rest, http.StatusMovedPermanently)
+    return true
+}
+
+// ViewHandler is the handler for viewing a post. Old slugs redirect to the
+// post.
 func ViewHandler(c web.C, w http.ResponseWriter, r *http.Request) {
-    post, err := FindPostBySlug(c.URLParams["slug"])
-    if post == nil {
-        http.NotFound(w, r)
+    post, err := findViewablePostBySlug(r, c.URLParams["slug"])
+    if err == ErrNotFound {
+        if !redirectOldSlug(w, r, c.URLParams["slug"], "") {
+            http.NotFound(w, r)
+        }
         return
     }
     if err != nil {
         panic(err)
     }
 
-    if CheckModifiedHandler(w, r, post.LastModified) {
-        // Not modified
-        return
+    renderPost(w, r, post)
+}
+
+// renderPost sends the page for a post, or a page, unless the client's copy
+// is up to date. Previews are kept out of caches and search engines.
+func renderPost(w http.ResponseWriter, r *http.Request, post *Post) {
+    if post.Preview {
+        w.Header().Set("Cache-Control", "private, no-store")
+        w.Header().Set("X-Robots-Tag", "noindex")
+    } else {
+        if CheckModifiedHandler(w, r, post.PublicModified()) {
+            // Not modified
+            return
+        }
+        w.Header().Set("Last-Modified", post.PublicModified().UTC().Format(HttpDateTimeFormat))
     }
 
-    w.Header().Set("Last-Modified", post.LastModified.UTC().Format(HttpDateTimeFormat))
-    err = SiteTemplates.ExecuteTemplate(w, "post.html", post)
+    template := "post.html"
+    if post.IsPage() {
+        template = "page.html"
+    }
+    err := SiteTemplates.ExecuteTemplate(w, template, post)
     if err != nil {
         http.Error(w, err.Error(), http.StatusInternalServerError)
     }
 }
 // ViewHandlerRemoveTrailingSlash will remove the trailing slash from a valid
-// post url.
+// post url, or redirect an old slug straight to the post.
 func ViewHandlerRemoveTrailingSlash(c web.C, w http.ResponseWriter, r *http.Request) {
-    post, err := FindPostBySlug(c.URLParams["slug"])
-    if post == nil {
-        http.NotFound(w, r)
+    _, err := findViewablePostBySlug(r, c.URLParams["slug"])
+    if err == ErrNotFound {
+        if !redirectOldSlug(w, r, c.URLParams["slug"], "") {
+            http.NotFound(w, r)
+        }
         return
     }
     if err != nil {
@@ -211,17 +375,35 @@ func ViewHandlerRemoveTrailingSlash(c web.C, w http.ResponseWriter, r *http.Requ
     http.Redirect(w, r, "/"+c.URLParams["slug"], http.StatusMovedPermanently)
 }
 
-// ViewFileHandler is the handler for viewing a post file.
+// ViewFileHandler is the handler for viewing a post file. Paths with two
+// parts might also be a nested page. Files of a post with an old slug, and
+// nested pages that used to have the path, are redirected.
 func ViewFileHandler(c web.C, w http.ResponseWriter, r *http.Request) {
-    post, err := FindPostBySlug(c.URLParams["slug"])
-    if post == nil {
-        http.NotFound(w, r)
+    page, err := findViewablePostBySlug(r, c.URLParams["slug"] + "/" + c.URLParams["file"])
+    if err != nil && err != ErrNotFound {
+        panic(err)
+    }
+    if err == nil && page.IsPage() {
+        renderPost(w, r, page)
+        return
+    }
+
+    post, err := findViewablePostBySlug(r, c.URLParams["slug"])
+    if err == ErrNotFound {
+        if !redirectOldSlug(w, r, c.URLParams["slug"] + "/" + c.URLParams["file"], "") &&
+           !redirectOldSlug(w, r, c.URLParams["slug"], "/" + c.URLParams["file"]) {
+            http.NotFound(w, r)
+        }
         return
     }
     if err != nil {
         panic(err)
     }
+    servePostFile(w, r, post, c.URLParams["file"])
+}
 
+// servePostFile sends the file with the given name attached to a post.
+func servePostFile(w http.ResponseWriter, r *http.Request, post *Post, name string) {
     // Get the list of files for this post and see if the filename in this
     // request matches any of those files
     file_infos, err := GetMultFileInfoById(post.Files)
@@ -230,7 +412,8 @@ func ViewFileHandler(c web.C, w http.ResponseWriter, r *http.Request) {
         return
     }
     for _, info := range file_infos {
-        if info.Name == c.URLParams["file"] {
+        // Files that can't be found are left out
+        if info != nil && info.Name == name {
             DownloadHandler(w, r, info.Id)
             return
         }
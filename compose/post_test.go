@@ -0,0 +1,268 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "encoding/json"
+    "errors"
+    "gopkg.in/mgo.v2/bson"
+    "net/http"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestViewPost(t *testing.T) {
+    m := setupTestServer(t)
+    post := createTestPost(t, "hello", false, time.Hour)
+
+    w := doRequest(m, "GET", "/hello", nil, nil)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    if !strings.Contains(w.Body.String(), post.Title) {
+        t.Error("Expected body to contain the post title")
+    }
+    if !strings.Contains(w.Body.String(), "<p>Body of hello</p>") {
+        t.Error("Expected body to contain the rendered post body")
+    }
+    if w.Header().Get("Last-Modified") == "" {
+        t.Error("Expected a Last-Modified header")
+    }
+}
+
+func TestViewPostNotModified(t *testing.T) {
+    m := setupTestServer(t)
+    createTestPost(t, "hello", false, time.Hour)
+
+    r, _ := http.NewRequest("GET", "/hello", nil)
+    r.Header.Set("If-Modified-Since", time.Now().Add(time.Minute).UTC().Format(HttpDateTimeFormat))
+    w := doRequestWith(m, r)
+    if w.Code != http.StatusNotModified {
+        t.Fatalf("Expected status %d, got %d", http.StatusNotModified, w.Code)
+    }
+
+    r, _ = http.NewRequest("GET", "/hello", nil)
+    r.Header.Set("If-Modified-Since", time.Now().Add(-time.Hour).UTC().Format(HttpDateTimeFormat))
+    w = doRequestWith(m, r)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+    }
+}
+
+func TestViewPostNotFound(t *testing.T) {
+    m := setupTestServer(t)
+    w := doRequest(m, "GET", "/missing", nil, nil)
+    if w.Code != http.StatusNotFound {
+        t.Fatalf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+    }
+}
+
+// brokenSlugStore is a store that fails to look up posts by slug.
+type brokenSlugStore struct {
+    Store
+}
+
+func (s brokenSlugStore) FindPostBySlug(slug string) (*Post, error) {
+    return nil, errors.New("the database is down")
+}
+
+func TestViewPostStoreError(t *testing.T) {
+    m := setupTestServer(t)
+    createTestPost(t, "hello", false, time.Hour)
+    store = brokenSlugStore{store}
+
+    // Errors other than not finding the post aren't hidden as a 404
+    for _, path := range []string{"/hello", "/hello/", "/hello/file.txt"} {
+        func() {
+            defer func() {
+                if recover() == nil {
+                    t.Errorf("%s: expected a panic", path)
+                }
+            }()
+            doRequest(m, "GET", path, nil, nil)
+        }()
+    }
+}
+
+func TestViewPostRemoveTrailingSlash(t *testing.T) {
+    m := setupTestServer(t)
+    createTestPost(t, "hello", false, time.Hour)
+
+    w := doRequest(m, "GET", "/hello/", nil, nil)
+    if w.Code != http.StatusMovedPermanently {
+        t.Fatalf("Expected status %d, got %d", http.StatusMovedPermanently, w.Code)
+    }
+    if w.Header().Get("Location") != "/hello" {
+        t.Errorf("Expected redirect to /hello, got %q", w.Header().Get("Location"))
+    }
+
+    w = doRequest(m, "GET", "/missing/", nil, nil)
+    if w.Code != http.StatusNotFound {
+        t.Fatalf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+    }
+}
+
+func TestViewFile(t *testing.T) {
+    m := setupTestServer(t)
+    post := createTestPost(t, "hello", false, time.Hour)
+    info, err := GetStore().CreateFile("image.png", strings.NewReader("not really a png"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    other, err := GetStore().CreateFile("other.txt", strings.NewReader("unattached"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    // A file that has gone missing is skipped
+    post.Files = append(post.Files, bson.NewObjectId(), info.Id)
+    post.Save()
+
+    w := doRequest(m, "GET", "/hello/image.png", nil, nil)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    if w.Body.String() != "not really a png" {
+        t.Errorf("Unexpected file contents %q", w.Body.String())
+    }
+    if w.Header().Get("Content-Type") != "image/png" {
+        t.Errorf("Expected Content-Type image/png, got %q", w.Header().Get("Content-Type"))
+    }
+
+    // Files must be attached to the post to be served from it
+    w = doRequest(m, "GET", "/hello/" + other.Name, nil, nil)
+    if w.Code != http.StatusNotFound {
+        t.Fatalf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+    }
+}
+
+func TestScheduledPost(t *testing.T) {
+    m := setupTestServer(t)
+    cookie := loginTestUser(t)
+    config.SiteUrl = "http://blog.example.com"
+    live := createTestPost(t, "live", false, time.Hour)
+    post := createTestPost(t, "soon", false, -time.Hour)
+    draft := createTestPost(t, "draft", true, -time.Hour)
+
+    // Hidden from the public until it goes live
+    for _, path := range []string{"/soon", "/soon/"} {
+        if w := doRequest(m, "GET", path, nil, nil); w.Code != http.StatusNotFound {
+            t.Errorf("GET %s: expected status %d, got %d", path, http.StatusNotFound, w.Code)
+        }
+    }
+    for _, path := range []string{"/", "/feed.xml", "/sitemap.xml"} {
+        w := doRequest(m, "GET", path, nil, nil)
+        if !strings.Contains(w.Body.String(), "/live") || strings.Contains(w.Body.String(), "/soon") {
+            t.Errorf("GET %s: expected only the live post:\n%s", path, w.Body.String())
+        }
+    }
+    if n, _ := CountPosts(false); n != 1 {
+        t.Errorf("Expected 1 published post, got %d", n)
+    }
+    if next, _ := NextPublishTime(); !next.Equal(post.Date) {
+        t.Errorf("Expected the next post to go live at %v, got %v", post.Date, next)
+    }
+
+    // The admin API reports the state of each post
+    w := doRequest(m, "GET", "/api/posts", nil, cookie)
+    var headers []PostHeader
+    json.Unmarshal(w.Body.Bytes(), &headers)
+    status := map[string]string{}
+    for _, header := range headers {
+        status[header.Slug] = header.Status
+    }
+    expected := map[string]string{"live": PostStatusPublished, "soon": PostStatusScheduled, "draft": PostStatusDraft}
+    if !reflect.DeepEqual(status, expected) {
+        t.Errorf("Expected %v, got %v", expected, status)
+    }
+    w = doRequest(m, "GET", "/api/post/" + draft.Id.Hex(), nil, cookie)
+    if !strings.Contains(w.Body.String(), `"status": "draft"`) {
+        t.Errorf("Expected the post to have a status: %s", w.Body.String())
+    }
+
+    // Make the feed look old, then let the post go live without saving it
+    live.LastModified = live.LastModified.Add(-2 * time.Hour)
+    GetStore().SavePost(live)
+    post.LastModified = post.LastModified.Add(-2 * time.Hour)
+    GetStore().SavePost(post)
+    siteCache.changed = time.Now().Add(-2 * time.Hour)
+    w = doRequest(m, "GET", "/feed.xml", nil, nil)
+    lastModified := w.Header().Get("Last-Modified")
+    post.Date = time.Now().Add(-time.Minute)
+    GetStore().SavePost(post)
+
+    w = doRequest(m, "GET", "/soon", nil, nil)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    r, _ := http.NewRequest("GET", "/feed.xml", nil)
+    r.Header.Set("If-Modified-Since", lastModified)
+    w = doRequestWith(m, r)
+    if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "/soon") {
+        t.Errorf("Expected the feed to change when the post went live, got %d", w.Code)
+    }
+}
+
+func TestOldSlugRedirects(t *testing.T) {
+    m := setupTestServer(t)
+    post := createTestPost(t, "first", false, time.Hour)
+    info, _ := GetStore().CreateFile("image.png", strings.NewReader("not really a png"))
+    post.Files = append(post.Files, info.Id)
+    post.Slug = "second"
+    post.Save()
+    post.Slug = "third"
+    post.Save()
+    if !reflect.DeepEqual(post.OldSlugs, []string{"first", "second"}) {
+        t.Errorf("Expected the old slugs to be remembered, got %v", post.OldSlugs)
+    }
+
+    redirects := map[string]string{
+        "/first":            "/third",
+        "/second/":          "/third",
+        "/second/image.png": "/third/image.png",
+    }
+    for path, location := range redirects {
+        w := doRequest(m, "GET", path, nil, nil)
+        if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != location {
+            t.Errorf("GET %s: expected a redirect to %s, got %d %s", path, location, w.Code, w.Header().Get("Location"))
+        }
+    }
+
+    // Another post can't take an old slug, but the post itself can go back
+    other := createTestPost(t, "other", false, time.Hour)
+    other.Slug = "first"
+    if _, err := other.Save(); err != ErrDuplicate {
+        t.Errorf("Expected ErrDuplicate, got %v", err)
+    }
+    post.OldSlugs = nil
+    post.Slug = "first"
+    post.Save()
+    if !reflect.DeepEqual(post.OldSlugs, []string{"second", "third"}) {
+        t.Errorf("Expected the slug to leave the old slugs, got %v", post.OldSlugs)
+    }
+    if w := doRequest(m, "GET", "/first", nil, nil); w.Code != http.StatusOK {
+        t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+    }
+
+    // Drafts aren't given away by their old slugs
+    post.Draft = true
+    post.Save()
+    if w := doRequest(m, "GET", "/third", nil, nil); w.Code != http.StatusNotFound {
+        t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+    }
+}
@@ -0,0 +1,189 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "crypto/hmac"
+    "crypto/sha256"
+    "encoding/hex"
+    "errors"
+    "github.com/zenazn/goji/web"
+    "gopkg.in/mgo.v2/bson"
+    "net/http"
+    "net/url"
+    "path"
+    "strconv"
+    "strings"
+    "time"
+)
+
+var ErrInvalidPreviewToken = errors.New("invalid preview link")
+var ErrExpiredPreviewToken = errors.New("the preview link has expired")
+
+// PreviewLinkMaxHours is the longest a preview link can be asked to last.
+const PreviewLinkMaxHours = 24 * 365
+
+// A PreviewLink lets anyone who has it see a post before it is published,
+// until it expires.
+type PreviewLink struct {
+    Url     string    `json:"url"`
+    Expires time.Time `json:"expires"`
+}
+
+// tokenSignature signs the parts of a token with the secret key. The kind of
+// token is signed too, so one kind can't be passed off as another.
+func tokenSignature(kind, id, expires string) (string) {
+    mac := hmac.New(sha256.New, []byte(config.SecretKey))
+    mac.Write([]byte(kind + ":" + id + ":" + expires))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// PreviewToken makes the token for a link to preview a post until the given
+// time. It is made up of the post id, the expiry time and a signature of both,
+// so nothing needs to be stored.
+func PreviewToken(id bson.ObjectId, expires time.Time) (string) {
+    e := strconv.FormatInt(expires.Unix(), 10)
+    return id.Hex() + "-" + e + "-" + tokenSignature("preview", id.Hex(), e)
+}
+
+// CheckPreviewToken gets the id of the post a preview token is for. An error
+// is returned if the token wasn't signed with the secret key or has expired.
+func CheckPreviewToken(token string, now time.Time) (bson.ObjectId, error) {
+    parts := strings.Split(token, "-")
+    if config.SecretKey == "" || len(parts) != 3 || !bson.IsObjectIdHex(parts[0]) {
+        return "", ErrInvalidPreviewToken
+    }
+    if !hmac.Equal([]byte(parts[2]), []byte(tokenSignature("preview", parts[0], parts[1]))) {
+        return "", ErrInvalidPreviewToken
+    }
+    expires, err := strconv.ParseInt(parts[1], 10, 64)
+    if err != nil {
+        return "", ErrInvalidPreviewToken
+    }
+    if !now.Before(time.Unix(expires, 0)) {
+        return "", ErrExpiredPreviewToken
+    }
+    return bson.ObjectIdHex(parts[0]), nil
+}
+
+// PreviewFileUrl gets the URL of a file attached to a post, through the
+// preview link with the given token.
+func PreviewFileUrl(token, name string) (string) {
+    return (&url.URL{Path: path.Join("/preview", token, name)}).String()
+}
+
+// previewFileLinks points the links in a post's body to its files at the
+// preview link instead, since only logged in users can see the files of a
+// draft at their usual URL.
+func previewFileLinks(post *Post, token string) (string) {
+    body := post.Body
+    if post.Slug == "" {
+        return body
+    }
+    infos, err := GetMultFileInfoById(post.Files)
+    if err != nil {
+        return body
+    }
+    for _, info := range infos {
+        if info != nil {
+            body = strings.Replace(body, PostFileUrl(post.Slug, info.Name), PreviewFileUrl(token, info.Name), -1)
+        }
+    }
+    return body
+}
+
+// findPreviewPost finds the post for the preview token in a request, and
+// sends an error if there isn't one.
+func findPreviewPost(c web.C, w http.ResponseWriter, r *http.Request) (*Post) {
+    id, err := CheckPreviewToken(c.URLParams["token"], time.Now())
+    if err == ErrExpiredPreviewToken {
+        http.Error(w, "This preview link has expired.", http.StatusGone)
+        return nil
+    }
+    if err != nil {
+        http.NotFound(w, r)
+        return nil
+    }
+
+    post, err := FindPostById(id)
+    if err == ErrNotFound {
+        http.NotFound(w, r)
+        return nil
+    }
+    if err != nil {
+        panic(err)
+    }
+    return post
+}
+
+// PreviewHandler is the handler for viewing a post through a preview link.
+// Once the post is published, the link leads to it.
+func PreviewHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+    post := findPreviewPost(c, w, r)
+    if post == nil {
+        return
+    }
+    if post.IsPublished() {
+        http.Redirect(w, r, "/" + post.Slug, http.StatusFound)
+        return
+    }
+
+    post.Preview = true
+    post.Body = previewFileLinks(post, c.URLParams["token"])
+    renderPost(w, r, post)
+}
+
+// PreviewFileHandler is the handler for viewing a file attached to a post
+// through a preview link.
+func PreviewFileHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+    post := findPreviewPost(c, w, r)
+    if post == nil {
+        return
+    }
+    w.Header().Set("X-Robots-Tag", "noindex")
+    servePostFile(w, r, post, c.URLParams["file"])
+}
+
+// ApiCreatePreviewLink is a handler to make a link to preview a post without
+// logging in. The link lasts for the number of hours in the hours parameter,
+// up to PreviewLinkMaxHours, or PreviewLinkHours by default.
+func ApiCreatePreviewLink(c web.C, w http.ResponseWriter, r *http.Request) {
+    post, err := FindPostById(bson.ObjectIdHex(c.URLParams["id"]))
+    if err != nil {
+        http.NotFound(w, r)
+        return
+    }
+    if config.SecretKey == "" {
+        http.Error(w, "There is no SecretKey in the config file to sign links with.", http.StatusInternalServerError)
+        return
+    }
+
+    hours := config.PreviewLinkHours
+    if h := r.FormValue("hours"); h != "" {
+        hours, err = strconv.Atoi(h)
+        if err != nil || hours <= 0 || hours > PreviewLinkMaxHours {
+            http.Error(w, "Invalid hours", http.StatusBadRequest)
+            return
+        }
+    }
+
+    expires := time.Now().Add(time.Duration(hours) * time.Hour).Truncate(time.Second)
+    WriteJson(w, &PreviewLink{
+        Url:     SiteUrl(r) + "/preview/" + PreviewToken(post.Id, expires),
+        Expires: expires,
+    })
+}
@@ -0,0 +1,155 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestPreviewToken(t *testing.T) {
+    setupTestServer(t)
+    config.SecretKey = "test key"
+    post := createTestPost(t, "draft", true, 0)
+    now := time.Now()
+
+    token := PreviewToken(post.Id, now.Add(time.Hour))
+    id, err := CheckPreviewToken(token, now)
+    if err != nil || id != post.Id {
+        t.Errorf("Expected the token to be for %s, got %s, %v", post.Id.Hex(), id.Hex(), err)
+    }
+    if _, err := CheckPreviewToken(token, now.Add(2 * time.Hour)); err != ErrExpiredPreviewToken {
+        t.Errorf("Expected the token to expire, got %v", err)
+    }
+
+    // Tampering with the token, or changing the key, invalidates it
+    parts := strings.Split(token, "-")
+    later := PreviewToken(post.Id, now.Add(24 * time.Hour))
+    tampered := []string{
+        "",
+        parts[0],
+        parts[0] + "-" + strings.Split(later, "-")[1] + "-" + parts[2],
+        createTestPost(t, "other", true, 0).Id.Hex() + "-" + parts[1] + "-" + parts[2],
+    }
+    for _, bad := range tampered {
+        if _, err := CheckPreviewToken(bad, now); err != ErrInvalidPreviewToken {
+            t.Errorf("Expected %q to be invalid, got %v", bad, err)
+        }
+    }
+    config.SecretKey = "other key"
+    if _, err := CheckPreviewToken(token, now); err != ErrInvalidPreviewToken {
+        t.Errorf("Expected the token to be invalid with another key, got %v", err)
+    }
+}
+
+func TestDraftsHidden(t *testing.T) {
+    m := setupTestServer(t)
+    cookie := loginTestUser(t)
+    createTestPost(t, "draft", true, time.Hour)
+    createTestPost(t, "live", false, time.Hour)
+
+    if w := doRequest(m, "GET", "/draft", nil, nil); w.Code != http.StatusNotFound {
+        t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+    }
+
+    // Logged in users see a preview
+    w := doRequest(m, "GET", "/draft", nil, cookie)
+    if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "hasn't been published yet") {
+        t.Errorf("Expected a preview of the draft, got %d:\n%s", w.Code, w.Body.String())
+    }
+    if w.Header().Get("X-Robots-Tag") != "noindex" || w.Header().Get("Last-Modified") != "" {
+        t.Errorf("Expected the preview to be kept out of caches and search engines: %v", w.Header())
+    }
+
+    w = doRequest(m, "GET", "/live", nil, cookie)
+    if strings.Contains(w.Body.String(), "hasn't been published yet") || strings.Contains(w.Body.String(), "noindex") {
+        t.Errorf("Expected a published post not to be a preview:\n%s", w.Body.String())
+    }
+}
+
+func TestPreviewLink(t *testing.T) {
+    m := setupTestServer(t)
+    cookie := loginTestUser(t)
+    config.SecretKey = "test key"
+    config.PreviewLinkHours = 1
+    config.SiteUrl = "http://blog.example.com"
+    post := createTestPost(t, "draft", true, time.Hour)
+    info, err := GetStore().CreateFile("pic.png", strings.NewReader("picture"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    post.Files = append(post.Files, info.Id)
+    post.Body = "Body of draft\n\n![Pic](/draft/pic.png)\n"
+    post.Save()
+
+    if w := doRequest(m, "POST", "/api/post/" + post.Id.Hex() + "/preview", nil, nil); w.Code == http.StatusOK {
+        t.Errorf("Expected preview links to need a login")
+    }
+    for _, hours := range []string{"0", "8761", "9223372036854775807"} {
+        if w := doRequest(m, "POST", "/api/post/" + post.Id.Hex() + "/preview?hours=" + hours, nil, cookie); w.Code != http.StatusBadRequest {
+            t.Errorf("Hours %s: expected status %d, got %d", hours, http.StatusBadRequest, w.Code)
+        }
+    }
+    w := doRequest(m, "POST", "/api/post/" + post.Id.Hex() + "/preview", nil, cookie)
+    var link PreviewLink
+    err = json.Unmarshal(w.Body.Bytes(), &link)
+    if err != nil || !strings.HasPrefix(link.Url, "http://blog.example.com/preview/") {
+        t.Fatalf("Expected a preview link, got %d: %s", w.Code, w.Body.String())
+    }
+    if d := link.Expires.Sub(time.Now()); d < 59 * time.Minute || d > time.Hour {
+        t.Errorf("Expected the link to last an hour, got %v", d)
+    }
+    path := strings.TrimPrefix(link.Url, "http://blog.example.com")
+
+    // Anyone with the link can see the draft
+    w = doRequest(m, "GET", path, nil, nil)
+    body := w.Body.String()
+    if w.Code != http.StatusOK || !strings.Contains(body, "Body of draft") || !strings.Contains(body, `<meta name="robots" content="noindex">`) {
+        t.Errorf("Expected a preview of the draft, got %d:\n%s", w.Code, body)
+    }
+    if w.Header().Get("X-Robots-Tag") != "noindex" || !strings.Contains(w.Header().Get("Cache-Control"), "no-store") {
+        t.Errorf("Expected the preview to be kept out of caches and search engines: %v", w.Header())
+    }
+
+    // And its files, which are linked through the preview link
+    if !strings.Contains(body, `src="` + path + `/pic.png"`) {
+        t.Errorf("Expected the image to be linked through the preview link:\n%s", body)
+    }
+    if w := doRequest(m, "GET", path + "/pic.png", nil, nil); w.Code != http.StatusOK || w.Body.String() != "picture" {
+        t.Errorf("Expected the file through the preview link, got %d %q", w.Code, w.Body.String())
+    }
+
+    // A link that was tampered with or has expired doesn't work
+    if w := doRequest(m, "GET", path + "0", nil, nil); w.Code != http.StatusNotFound {
+        t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+    }
+    expired := "/preview/" + PreviewToken(post.Id, time.Now().Add(-time.Minute))
+    if w := doRequest(m, "GET", expired, nil, nil); w.Code != http.StatusGone {
+        t.Errorf("Expected status %d, got %d", http.StatusGone, w.Code)
+    }
+
+    // Once published, the link leads to the post
+    post.Draft = false
+    post.Save()
+    w = doRequest(m, "GET", path, nil, nil)
+    if w.Code != http.StatusFound || w.Header().Get("Location") != "/draft" {
+        t.Errorf("Expected a redirect to the post, got %d %s", w.Code, w.Header().Get("Location"))
+    }
+}
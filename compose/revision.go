@@ -0,0 +1,295 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "github.com/pmezard/go-difflib/difflib"
+    "github.com/zenazn/goji/web"
+    "gopkg.in/mgo.v2/bson"
+    "net/http"
+    "time"
+)
+
+// Revision is a copy of a post as it was when it was saved.
+type Revision struct {
+    Id     bson.ObjectId `json:"_id,omitempty" bson:"_id,omitempty"`
+    Post   bson.ObjectId `json:"post"          bson:"post"`
+    Date   time.Time     `json:"date"          bson:"date"`
+    Author string        `json:"author"        bson:"author"`
+    Title  string        `json:"title"         bson:"title"`
+    Slug   string        `json:"slug"          bson:"slug"`
+    Body   string        `json:"body"          bson:"body"`
+}
+
+// CreateRevision creates a new revision from the current state of a post.
+// The author is the user who saved it, or nil if it was saved by a command.
+func CreateRevision(post *Post, author *User) (*Revision) {
+    revision := &Revision{
+        Id:    bson.NewObjectId(),
+        Post:  post.Id,
+        Date:  post.LastModified,
+        Title: post.Title,
+        Slug:  post.Slug,
+        Body:  post.Body,
+    }
+    if author != nil {
+        revision.Author = author.Email
+    }
+    return revision
+}
+
+// FindRevisionById finds a revision given its id.
+func FindRevisionById(id bson.ObjectId) (*Revision, error) {
+    return GetStore().FindRevisionById(id)
+}
+
+// ListRevisions lists the revisions of a post, newest first.
+func ListRevisions(post bson.ObjectId) ([]Revision, error) {
+    return GetStore().ListRevisions(post)
+}
+
+// RecordRevision saves a revision of a post that was just saved, then drops
+// any revisions the retention policy no longer keeps. Nothing is recorded if
+// the title, slug and body are the same as in the last revision.
+//
+// old is the post as it was stored before, or nil for a new post. A post with
+// no revisions yet, such as one saved before revisions were kept, gets one of
+// old first, so the save can be undone.
+func RecordRevision(post *Post, old *Post, author *User) (error) {
+    revisions, err := ListRevisions(post.Id)
+    if err != nil {
+        return err
+    }
+
+    if len(revisions) == 0 && old != nil {
+        revision := CreateRevision(old, nil)
+        if !revision.SameContent(post) {
+            err = GetStore().SaveRevision(revision)
+            if err != nil {
+                return err
+            }
+            revisions = []Revision{*revision}
+        }
+    }
+
+    if len(revisions) == 0 || !revisions[0].SameContent(post) {
+        revision := CreateRevision(post, author)
+        err = GetStore().SaveRevision(revision)
+        if err != nil {
+            return err
+        }
+        revisions = append([]Revision{*revision}, revisions...)
+    }
+
+    for _, revision := range ExpiredRevisions(revisions, time.Now()) {
+        err = GetStore().DeleteRevision(revision.Id)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// ExpiredRevisions picks the revisions, given newest first, that the
+// retention policy no longer keeps. At most RevisionsKept revisions are kept,
+// and none older than RevisionMaxDays, except that the newest is always kept.
+// Either limit is turned off by setting it to 0.
+func ExpiredRevisions(revisions []Revision, now time.Time) ([]Revision) {
+    var expired []Revision
+    oldest := now.AddDate(0, 0, -config.RevisionMaxDays)
+    for i, revision := range revisions {
+        if i == 0 {
+            continue
+        }
+        if (config.RevisionsKept > 0 && i >= config.RevisionsKept) ||
+           (config.RevisionMaxDays > 0 && revision.Date.Before(oldest)) {
+            expired = append(expired, revision)
+        }
+    }
+    return expired
+}
+
+// DeleteRevisions deletes every revision of a post.
+func DeleteRevisions(post bson.ObjectId) (error) {
+    revisions, err := ListRevisions(post)
+    if err != nil {
+        return err
+    }
+    for _, revision := range revisions {
+        err = GetStore().DeleteRevision(revision.Id)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// SameContent checks whether a revision has the same title, slug and body as
+// a post.
+func (revision *Revision) SameContent(post *Post) (bool) {
+    return revision.Title == post.Title &&
+           revision.Slug == post.Slug &&
+           revision.Body == post.Body
+}
+
+// Text is the revision as it's compared in diffs: the title and slug,
+// followed by the body.
+func (revision *Revision) Text() (string) {
+    return "Title: " + revision.Title + "\n" +
+           "Slug: " + revision.Slug + "\n" +
+           "\n" +
+           revision.Body + "\n"
+}
+
+// Name identifies the revision in diffs. A revision without an id is the post
+// as it is now.
+func (revision *Revision) Name() (string) {
+    name := "current"
+    if revision.Id != "" {
+        name = revision.Id.Hex()
+    }
+    name += " " + revision.Date.UTC().Format(time.RFC3339)
+    if revision.Author != "" {
+        name += " " + revision.Author
+    }
+    return name
+}
+
+// DiffRevisions makes a unified diff from one revision to another.
+func DiffRevisions(from *Revision, to *Revision) (string, error) {
+    return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+        A:        difflib.SplitLines(from.Text()),
+        B:        difflib.SplitLines(to.Text()),
+        FromFile: from.Name(),
+        ToFile:   to.Name(),
+        Context:  3,
+    })
+}
+
+// Restore puts the title, slug and body of the revision back into its post
+// and saves it, which records a new revision. A *SlugError is returned if the
+// slug can't be used any more, such as when another post has taken it.
+func (revision *Revision) Restore(author *User) (*Post, error) {
+    post, err := FindPostById(revision.Post)
+    if err != nil {
+        return nil, err
+    }
+    post.Title = revision.Title
+    post.Slug = normalizeSlugFor(revision.Slug, post.IsPage())
+    post.Body = revision.Body
+    err = CheckSlug(post.Slug, post.Id, post.IsPage())
+    if err != nil {
+        return nil, err
+    }
+    return post.SaveBy(author)
+}
+
+// ApiListRevisions is a handler to list the revisions of a post, newest
+// first.
+func ApiListRevisions(c web.C, w http.ResponseWriter, r *http.Request) {
+    post, err := FindPostById(bson.ObjectIdHex(c.URLParams["id"]))
+    if err != nil {
+        http.NotFound(w, r)
+        return
+    }
+    revisions, err := ListRevisions(post.Id)
+    if err != nil {
+        panic(err)
+    }
+    if revisions == nil {
+        revisions = []Revision{}
+    }
+
+    WriteJson(w, revisions)
+}
+
+// ApiGetRevision is a handler to get a revision given its id.
+func ApiGetRevision(c web.C, w http.ResponseWriter, r *http.Request) {
+    revision, err := FindRevisionById(bson.ObjectIdHex(c.URLParams["id"]))
+    if err != nil {
+        http.NotFound(w, r)
+        return
+    }
+
+    WriteJson(w, revision)
+}
+
+// ApiDiffRevision is a handler to get a unified diff from a revision to the
+// revision given by the "to" query parameter. Without it, the diff is to the
+// post as it is now.
+func ApiDiffRevision(c web.C, w http.ResponseWriter, r *http.Request) {
+    from, err := FindRevisionById(bson.ObjectIdHex(c.URLParams["id"]))
+    if err != nil {
+        http.NotFound(w, r)
+        return
+    }
+
+    var to *Revision
+    if id := r.URL.Query().Get("to"); id != "" {
+        if !bson.IsObjectIdHex(id) {
+            http.NotFound(w, r)
+            return
+        }
+        to, err = FindRevisionById(bson.ObjectIdHex(id))
+        if err != nil || to.Post != from.Post {
+            http.NotFound(w, r)
+            return
+        }
+    } else {
+        post, err := FindPostById(from.Post)
+        if err != nil {
+            http.NotFound(w, r)
+            return
+        }
+        to = CreateRevision(post, nil)
+        to.Id = ""
+    }
+
+    diff, err := DiffRevisions(from, to)
+    if err != nil {
+        panic(err)
+    }
+    w.Header().Set("Content-Type", "text/x-diff; charset=utf-8")
+    w.Write([]byte(diff))
+}
+
+// ApiRestoreRevision is a handler to restore a post to the revision with the
+// given id. The restored post is sent back.
+func ApiRestoreRevision(c web.C, w http.ResponseWriter, r *http.Request) {
+    revision, err := FindRevisionById(bson.ObjectIdHex(c.URLParams["id"]))
+    if err != nil {
+        http.NotFound(w, r)
+        return
+    }
+
+    user, _ := RequestUser(r)
+    post, err := revision.Restore(user)
+    if slugErr, ok := err.(*SlugError); ok {
+        WriteSlugError(w, slugErr)
+        return
+    }
+    if err == ErrDuplicate {
+        WriteSlugError(w, slugTakenError(revision.Slug))
+        return
+    }
+    if err != nil {
+        panic(err)
+    }
+
+    post.Status = post.CurrentStatus()
+    WriteJson(w, post)
+}
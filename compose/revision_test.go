@@ -0,0 +1,225 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "net/http"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestRecordRevision(t *testing.T) {
+    setupTestServer(t)
+    post := createTestPost(t, "hello", false, time.Hour)
+
+    // Saving without changing the content doesn't record a revision
+    post.Draft = true
+    post.Save()
+    revisions, _ := ListRevisions(post.Id)
+    if len(revisions) != 1 || revisions[0].Body != "Body of hello" || revisions[0].Author != "" {
+        t.Fatalf("Expected one revision, got %+v", revisions)
+    }
+
+    post.Body = "Changed"
+    post.Save()
+    revisions, _ = ListRevisions(post.Id)
+    if len(revisions) != 2 || revisions[0].Body != "Changed" || revisions[1].Body != "Body of hello" {
+        t.Errorf("Expected the newest revision first, got %+v", revisions)
+    }
+
+    // Revisions go with the post
+    post.Delete()
+    if revisions, _ := ListRevisions(post.Id); len(revisions) != 0 {
+        t.Errorf("Expected revisions to be deleted, got %+v", revisions)
+    }
+}
+
+func TestRecordRevisionOfOldPost(t *testing.T) {
+    setupTestServer(t)
+
+    // A post saved before revisions were kept
+    post, _ := CreatePost()
+    post.Title = "Original"
+    post.Slug = "original"
+    post.Body = "Original body"
+    post.LastModified = time.Now().Add(-time.Hour)
+    GetStore().SavePost(post)
+
+    post.Title = "Overwritten"
+    post.Body = "Oops"
+    post.Save()
+    revisions, _ := ListRevisions(post.Id)
+    if len(revisions) != 2 || revisions[0].Body != "Oops" || revisions[1].Body != "Original body" {
+        t.Fatalf("Expected revisions of the new and original content, got %+v", revisions)
+    }
+
+    restored, err := revisions[1].Restore(nil)
+    if err != nil || restored.Title != "Original" || restored.Body != "Original body" {
+        t.Errorf("Expected the original content to be restored, got %+v %v", restored, err)
+    }
+}
+
+func TestExpiredRevisions(t *testing.T) {
+    setupTestServer(t)
+    now := time.Now()
+    var revisions []Revision
+    for i, body := range []string{"a", "b", "c", "d", "e"} {
+        revisions = append(revisions, Revision{Body: body, Date: now.AddDate(0, 0, -10 * i)})
+    }
+    bodies := func(revisions []Revision) (string) {
+        s := ""
+        for _, revision := range revisions {
+            s += revision.Body
+        }
+        return s
+    }
+
+    tests := []struct {
+        kept    int
+        maxDays int
+        expired string
+    }{
+        {0, 0,  ""},
+        {3, 0,  "de"},
+        {0, 15, "cde"},
+        {2, 25, "cde"},
+        {4, 25, "de"},
+        {1, 0,  "bcde"},
+    }
+    for _, test := range tests {
+        config.RevisionsKept = test.kept
+        config.RevisionMaxDays = test.maxDays
+        if expired := bodies(ExpiredRevisions(revisions, now)); expired != test.expired {
+            t.Errorf("Keeping %d for %d days: expected %q to expire, got %q", test.kept, test.maxDays, test.expired, expired)
+        }
+    }
+
+    // The newest revision is kept, however old
+    config.RevisionMaxDays = 1
+    if expired := ExpiredRevisions(revisions[4:], now); len(expired) != 0 {
+        t.Errorf("Expected the newest revision to be kept, got %+v", expired)
+    }
+
+    // Old revisions are dropped as new ones are recorded
+    config.RevisionsKept = 2
+    config.RevisionMaxDays = 0
+    post := createTestPost(t, "hello", false, time.Hour)
+    for _, body := range []string{"one", "two", "three"} {
+        post.Body = body
+        post.Save()
+    }
+    kept, _ := ListRevisions(post.Id)
+    if len(kept) != 2 || kept[0].Body != "three" || kept[1].Body != "two" {
+        t.Errorf("Expected the two newest revisions to be kept, got %+v", kept)
+    }
+}
+
+func TestApiRevisions(t *testing.T) {
+    m := setupTestServer(t)
+    cookie := loginTestUser(t)
+    post := createTestPost(t, "hello", false, time.Hour)
+
+    // Edit the post through the API, then overwrite it by accident
+    post.Body = "First line\nSecond line\n"
+    payload, _ := json.Marshal(post)
+    doRequest(m, "PUT", "/api/post/" + post.Id.Hex(), bytes.NewReader(payload), cookie)
+    post.Title = "Oops"
+    post.Slug = "oops"
+    post.Body = "First line\n"
+    payload, _ = json.Marshal(post)
+    doRequest(m, "PUT", "/api/post/" + post.Id.Hex(), bytes.NewReader(payload), cookie)
+
+    w := doRequest(m, "GET", "/api/post/" + post.Id.Hex() + "/revisions", nil, cookie)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    var revisions []Revision
+    json.Unmarshal(w.Body.Bytes(), &revisions)
+    if len(revisions) != 3 || revisions[0].Title != "Oops" || revisions[0].Author != "admin@example.com" || revisions[2].Author != "" {
+        t.Fatalf("Wrong revisions: %+v", revisions)
+    }
+    good := revisions[1]
+
+    w = doRequest(m, "GET", "/api/revision/" + good.Id.Hex(), nil, cookie)
+    if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Second line") {
+        t.Errorf("Wrong revision: %d %s", w.Code, w.Body.String())
+    }
+
+    // Diff against the post as it is now, and against another revision
+    w = doRequest(m, "GET", "/api/revision/" + good.Id.Hex() + "/diff", nil, cookie)
+    diff := w.Body.String()
+    for _, s := range []string{"--- " + good.Id.Hex(), "+++ current", "-Title: Title of hello", "+Title: Oops", "-Slug: hello", "+Slug: oops", " First line", "-Second line"} {
+        if !strings.Contains(diff, s) {
+            t.Errorf("Expected diff to contain %q:\n%s", s, diff)
+        }
+    }
+    w = doRequest(m, "GET", "/api/revision/" + revisions[2].Id.Hex() + "/diff?to=" + good.Id.Hex(), nil, cookie)
+    diff = w.Body.String()
+    if !strings.Contains(diff, "+++ " + good.Id.Hex()) || !strings.Contains(diff, "-Body of hello") || !strings.Contains(diff, "+Second line") {
+        t.Errorf("Wrong diff between revisions:\n%s", diff)
+    }
+
+    // Restore the good revision
+    w = doRequest(m, "POST", "/api/restore/" + good.Id.Hex(), nil, cookie)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    restored, _ := FindPostBySlug("hello")
+    if restored == nil || restored.Title != "Title of hello" || restored.Body != "First line\nSecond line\n" {
+        t.Errorf("Post was not restored: %+v", restored)
+    }
+    if revisions, _ := ListRevisions(post.Id); len(revisions) != 4 {
+        t.Errorf("Expected restoring to record a revision, got %d", len(revisions))
+    }
+
+    // Restoring a slug that's been taken since fails. Old slugs are kept from
+    // other posts, so forget them first, as for posts saved before they were.
+    restored.OldSlugs = nil
+    GetStore().SavePost(restored)
+    createTestPost(t, "oops", false, 0)
+    w = doRequest(m, "POST", "/api/restore/" + revisions[0].Id.Hex(), nil, cookie)
+    if w.Code != http.StatusConflict {
+        t.Errorf("Expected status %d, got %d", http.StatusConflict, w.Code)
+    }
+
+    w = doRequest(m, "GET", "/api/revision/" + post.Id.Hex(), nil, cookie)
+    if w.Code != http.StatusNotFound {
+        t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+    }
+}
+
+func TestRestoreRevisionOldSlug(t *testing.T) {
+    setupTestServer(t)
+    moved := createTestPost(t, "first", false, 0)
+    moved.Slug = "second"
+    moved.Save()
+
+    // A revision can't take a slug that redirects to another post
+    post := createTestPost(t, "other", false, 0)
+    revision := CreateRevision(post, nil)
+    revision.Slug = "first"
+    _, err := revision.Restore(nil)
+    if slugErr, ok := err.(*SlugError); !ok || slugErr.Reason != SlugTaken {
+        t.Errorf("Expected the slug to be taken, got %v", err)
+    }
+    if post, _ := FindPostById(post.Id); post.Slug != "other" {
+        t.Errorf("Expected the post to be left alone, got slug %q", post.Slug)
+    }
+}
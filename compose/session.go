@@ -16,17 +16,37 @@
 package main
 
 import (
+    "crypto/rand"
     "crypto/sha256"
+    "crypto/subtle"
+    "encoding/hex"
     "errors"
     "fmt"
     "gopkg.in/mgo.v2/bson"
     "time"
 )
 
+// ErrSessionExpired is returned when a session token is used after the
+// session has expired.
+var ErrSessionExpired = errors.New("session expired")
+
+// Sessions that are in use are marked as seen at most this often, to save a
+// write on every request.
+const sessionSeenInterval = time.Minute
+
+// A Session is a login. Only a hash of the token is stored, so the token is
+// only known when the session is created, and is sent to the browser.
+// Sessions expire SessionMaxDays after they're created, or when they haven't
+// been used for SessionIdleHours. Each session has its own CSRF token.
 type Session struct {
-    Id    bson.ObjectId `json:"_id,omitempty" bson:"_id,omitempty"`
-    Token string        `json:"token"         bson:"token"`
-    User  bson.ObjectId `json:"userId"        bson:"userId"`
+    Id        bson.ObjectId `json:"_id,omitempty" bson:"_id,omitempty"`
+    Token     string        `json:"-"             bson:"-"`
+    TokenHash string        `json:"-"             bson:"token"`
+    CsrfToken string        `json:"-"             bson:"csrf"`
+    User      bson.ObjectId `json:"userId"        bson:"userId"`
+    CreatedAt time.Time     `json:"createdAt"     bson:"createdAt"`
+    LastSeen  time.Time     `json:"lastSeen"      bson:"lastSeen"`
+    ExpiresAt time.Time     `json:"expiresAt"     bson:"expiresAt"`
 }
 
 // CreateSession creates a new session object. Save() should be called on the
@@ -37,61 +57,127 @@ func CreateSession(user *User) (*Session, error) {
         return nil, errors.New("Invalid user")
     }
 
+    // Create the session and CSRF tokens from 32 random bytes each
+    token := make([]byte, 32)
+    _, err := rand.Read(token)
+    if err != nil {
+        return nil, err
+    }
+    csrf := make([]byte, 32)
+    _, err = rand.Read(csrf)
+    if err != nil {
+        return nil, err
+    }
+
     // Create session object
+    now := time.Now()
     session := &Session{}
     session.Id = bson.NewObjectId()
+    session.Token = hex.EncodeToString(token)
+    session.TokenHash = HashSessionToken(session.Token)
+    session.CsrfToken = hex.EncodeToString(csrf)
     session.User = user.Id
-
-    // Create the session token ... sha256(email:timestamp)
-    x := fmt.Sprintf("%s:%s", user.Email, time.Now().String())
-    session.Token = fmt.Sprintf("%x", sha256.Sum256([]byte(x)))
+    session.CreatedAt = now
+    session.LastSeen = now
+    session.ExpiresAt = now.AddDate(0, 0, config.SessionMaxDays)
 
     return session, nil
 }
 
-// FindSessionById looks up a session by the session id.
-func FindSessionById(id bson.ObjectId) (*Session, error) {
-    c := GetDatabaseHandle().C("sessions")
+// HashSessionToken hashes a session token for storing. The tokens are random,
+// so a plain SHA-256 is enough to keep them from being used if the database
+// leaks.
+func HashSessionToken(token string) (string) {
+    return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
+}
 
-    // Find session by id
-    session := &Session{}
-    err := c.FindId(id).One(session)
-    if err != nil {
-        return nil, err
-    }
+// sessionIdleSince is the time sessions must have been used since to not have
+// expired for being idle.
+func sessionIdleSince(now time.Time) (time.Time) {
+    return now.Add(-time.Duration(config.SessionIdleHours) * time.Hour)
+}
 
-    return session, nil
+// FindSessionById looks up a session by the session id.
+func FindSessionById(id bson.ObjectId) (*Session, error) {
+    return GetStore().FindSessionById(id)
 }
 
-// FindSessionByToken looks up a session by the session token.
+// FindSessionByToken looks up a session by the session token, whether it has
+// expired or not.
 func FindSessionByToken(token string) (*Session, error) {
-    c := GetDatabaseHandle().C("sessions")
+    return GetStore().FindSessionByTokenHash(HashSessionToken(token))
+}
 
-    // Find session by token
-    session := &Session{}
-    err := c.Find(bson.M{"token": token}).One(session)
+// FindValidSession looks up a session by the session token, and checks that
+// it hasn't expired. Expired sessions are deleted. Otherwise the session is
+// marked as seen, which keeps it from expiring for being idle.
+func FindValidSession(token string) (*Session, error) {
+    session, err := FindSessionByToken(token)
     if err != nil {
         return nil, err
     }
 
+    now := time.Now()
+    if session.IsExpired(now, sessionIdleSince(now)) {
+        session.Destroy()
+        return nil, ErrSessionExpired
+    }
+    if now.Sub(session.LastSeen) >= sessionSeenInterval {
+        session.LastSeen = now
+        _, err = session.Save()
+        if err != nil {
+            return nil, err
+        }
+    }
     return session, nil
 }
 
 // IsSessionTokenValid determines if a session token is valid.
 func IsSessionTokenValid(token string) (bool) {
-    _, err := FindSessionByToken(token)
+    _, err := FindValidSession(token)
     return err == nil
 }
 
+// IsExpired checks if the session expired by now, or hasn't been used since
+// idleSince.
+func (s *Session) IsExpired(now time.Time, idleSince time.Time) (bool) {
+    return !now.Before(s.ExpiresAt) || s.LastSeen.Before(idleSince)
+}
+
+// CheckCsrfToken checks a CSRF token sent with a request against the
+// session's.
+func (s *Session) CheckCsrfToken(token string) (bool) {
+    return s.CsrfToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.CsrfToken)) == 1
+}
+
 // Destroy destroys a session.
 func (s *Session) Destroy() (error) {
-    // ...
-    return nil
+    return GetStore().DeleteSession(s.Id)
 }
 
 // Save updates or creates a session in the database.
 func (s *Session) Save() (*Session, error) {
-    c := GetDatabaseHandle().C("sessions")
-    _, err := c.UpsertId(s.Id, s)
+    err := GetStore().SaveSession(s)
     return s, err
 }
+
+// SweepSessions deletes every expired session, and returns how many there
+// were.
+func SweepSessions() (int, error) {
+    now := time.Now()
+    return GetStore().DeleteExpiredSessions(now, sessionIdleSince(now))
+}
+
+// StartSessionSweeper deletes expired sessions in the background, now and
+// then every interval.
+func StartSessionSweeper(interval time.Duration) {
+    go func() {
+        for {
+            _, err := SweepSessions()
+            if err != nil {
+                fmt.Println("Warning: failed to delete expired sessions:", err.Error())
+            }
+            time.Sleep(interval)
+        }
+    }()
+}
\ No newline at end of file
@@ -0,0 +1,123 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "net/http"
+    "testing"
+    "time"
+)
+
+func TestSessionTokens(t *testing.T) {
+    setupTestServer(t)
+    user, _ := CreateUser()
+    first, _ := CreateSession(user)
+    second, _ := CreateSession(user)
+    if len(first.Token) != 64 || first.Token == second.Token {
+        t.Errorf("Expected random tokens, got %q and %q", first.Token, second.Token)
+    }
+    if first.TokenHash != HashSessionToken(first.Token) || first.TokenHash == first.Token {
+        t.Errorf("Expected the token to be hashed, got %q", first.TokenHash)
+    }
+    if d := first.ExpiresAt.Sub(first.CreatedAt); d != 30 * 24 * time.Hour {
+        t.Errorf("Expected the session to last 30 days, got %v", d)
+    }
+}
+
+func TestSessionExpiry(t *testing.T) {
+    m := setupTestServer(t)
+    cookie := loginTestUser(t)
+    session, _ := FindSessionByToken(cookie.Value)
+
+    // Using the session keeps it alive
+    session.LastSeen = time.Now().Add(-71 * time.Hour)
+    session.Save()
+    if w := doRequest(m, "GET", "/api/posts", nil, cookie); w.Code != http.StatusOK {
+        t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    session, _ = FindSessionByToken(cookie.Value)
+    if time.Since(session.LastSeen) > time.Minute {
+        t.Errorf("Expected the session to be marked as seen, got %v", session.LastSeen)
+    }
+
+    // Until it's been idle too long
+    session.LastSeen = time.Now().Add(-73 * time.Hour)
+    session.Save()
+    if w := doRequest(m, "GET", "/api/posts", nil, cookie); w.Code != http.StatusUnauthorized {
+        t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+    }
+    if _, err := FindSessionById(session.Id); err != ErrNotFound {
+        t.Errorf("Expected the expired session to be deleted, got %v", err)
+    }
+
+    // Sessions also end after a while, however much they're used
+    session, _ = Login("admin@example.com", "secret")
+    cookie = &http.Cookie{Name: CookieName, Value: session.Token}
+    session.ExpiresAt = time.Now().Add(-time.Second)
+    session.Save()
+    if w := doRequest(m, "GET", "/api/posts", nil, cookie); w.Code != http.StatusUnauthorized {
+        t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+    }
+}
+
+func TestSweepSessions(t *testing.T) {
+    setupTestServer(t)
+    user, _ := CreateUser()
+    live, _ := CreateSession(user)
+    live.Save()
+    idle, _ := CreateSession(user)
+    idle.LastSeen = time.Now().Add(-100 * time.Hour)
+    idle.Save()
+
+    if n, err := SweepSessions(); n != 1 || err != nil {
+        t.Errorf("Expected 1 session to be swept, got %d, %v", n, err)
+    }
+    if !IsSessionTokenValid(live.Token) || IsSessionTokenValid(idle.Token) {
+        t.Errorf("Expected only the idle session to be swept")
+    }
+}
+
+func TestLogout(t *testing.T) {
+    m := setupTestServer(t)
+    cookie := loginTestUser(t)
+
+    // Logging out takes the CSRF token
+    r, _ := http.NewRequest("POST", "/logout", nil)
+    r.AddCookie(cookie)
+    if w := doRequestWith(m, r); w.Code != http.StatusForbidden {
+        t.Errorf("Expected status %d, got %d", http.StatusForbidden, w.Code)
+    }
+    if _, err := FindSessionByToken(cookie.Value); err != nil {
+        t.Fatal("Expected the session to be kept:", err)
+    }
+
+    w := doRequest(m, "POST", "/logout", nil, cookie)
+    if w.Code != http.StatusSeeOther {
+        t.Errorf("Expected status %d, got %d", http.StatusSeeOther, w.Code)
+    }
+    if cleared := responseCookie(w, CookieName); cleared == nil || cleared.Value != "" || cleared.MaxAge >= 0 {
+        t.Errorf("Expected the cookie to be cleared, got %+v", cleared)
+    }
+
+    // The old cookie is no good any more
+    if _, err := FindSessionByToken(cookie.Value); err != ErrNotFound {
+        t.Errorf("Expected the session to be deleted, got %v", err)
+    }
+    if w := doRequest(m, "GET", "/api/posts", nil, cookie); w.Code != http.StatusUnauthorized {
+        t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+    }
+}
@@ -22,7 +22,7 @@ import (
 // SetupAlreadyComplete determines if setup has been completed or not. For now,
 // consider setup complete if there is at least one user in the database.
 func SetupAlreadyComplete() (bool) {
-    count, _ := GetDatabaseHandle().C("users").Find(nil).Count()
+    count, _ := GetStore().CountUsers()
     return count > 0
 }
 
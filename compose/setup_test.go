@@ -0,0 +1,39 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "net/http"
+    "testing"
+)
+
+func TestSetupHandler(t *testing.T) {
+    m := setupTestServer(t)
+    w := doRequest(m, "GET", "/setup", nil, nil)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    if !SetupAlreadyComplete() {
+        t.Fatal("Expected setup to be complete")
+    }
+
+    // Setup can only be run once
+    w = doRequest(m, "GET", "/setup", nil, nil)
+    if w.Code != http.StatusNotFound {
+        t.Fatalf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+    }
+}
@@ -0,0 +1,269 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "bytes"
+    "encoding/xml"
+    "github.com/zenazn/goji/web"
+    "net/http"
+    "strconv"
+    "sync"
+    "time"
+)
+
+// The most URLs allowed in one sitemap. Bigger sitemaps are split up and
+// listed in a sitemap index.
+var SitemapMaxUrls = 50000
+
+// SitemapUrlSet is a sitemap.
+type SitemapUrlSet struct {
+    XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+    Urls    []SitemapUrl `xml:"url"`
+}
+
+// SitemapIndex lists the sitemaps a big site is split into.
+type SitemapIndex struct {
+    XMLName  xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 sitemapindex"`
+    Sitemaps []SitemapUrl `xml:"sitemap"`
+}
+
+// SitemapUrl is a page in a sitemap, or a sitemap in a sitemap index.
+type SitemapUrl struct {
+    Loc     string `xml:"loc"`
+    LastMod string `xml:"lastmod,omitempty"`
+}
+
+// How long generated documents are cached for. Posts changed by commands, such
+// as sync, are changed by another process, so the cache doesn't hear about
+// them. Documents are also dropped when the next scheduled post goes live.
+var SiteCacheMaxAge = time.Hour
+
+// The most documents the cache holds. Without a SiteUrl, each host name a
+// request is sent with gets documents of its own, so the cache starts over
+// once it has this many.
+var SiteCacheMaxDocuments = 100
+
+// SiteCache holds generated documents, such as the sitemap, until a post is
+// changed or they get too old. It also keeps the time of the last change, so
+// documents that aren't cached, such as feeds, know when they last changed
+// even if the change was a post being deleted.
+type SiteCache struct {
+    mutex   sync.Mutex
+    docs    map[string]*CachedDocument
+    changed time.Time
+}
+
+// CachedDocument is a document held by the SiteCache.
+type CachedDocument struct {
+    Data     []byte
+    Modified time.Time
+    Expires  time.Time
+}
+
+// Nothing is known about changes made before the server started, so that
+// counts as a change.
+var siteCache = &SiteCache{changed: time.Now()}
+
+// Get gets a document from the cache, building it if it isn't there. If it
+// can't be built, the error is returned and nothing is cached.
+func (c *SiteCache) Get(key string, build func() ([]byte, error)) (*CachedDocument, error) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+
+    if doc, ok := c.docs[key]; ok && time.Now().Before(doc.Expires) {
+        return doc, nil
+    }
+
+    data, err := build()
+    if err != nil {
+        return nil, err
+    }
+    next, err := NextPublishTime()
+    if err != nil {
+        return nil, err
+    }
+    if c.docs == nil || len(c.docs) >= SiteCacheMaxDocuments {
+        c.docs = make(map[string]*CachedDocument)
+    }
+    doc := &CachedDocument{Data: data, Modified: time.Now()}
+    doc.Expires = doc.Modified.Add(SiteCacheMaxAge)
+    if !next.IsZero() && next.Before(doc.Expires) {
+        doc.Expires = next
+    }
+    c.docs[key] = doc
+    return doc, nil
+}
+
+// Invalidate empties the cache and records a change.
+func (c *SiteCache) Invalidate() {
+    c.mutex.Lock()
+    c.docs = nil
+    c.changed = time.Now()
+    c.mutex.Unlock()
+}
+
+// Changed gets the time of the last change.
+func (c *SiteCache) Changed() (time.Time) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    return c.changed
+}
+
+// SitemapUrls lists the home page, every published post and every published
+// page.
+func SitemapUrls(siteUrl string) ([]SitemapUrl, error) {
+    posts, err := ListPostHeaders(0, 0, false)
+    if err != nil {
+        return nil, err
+    }
+
+    home := SitemapUrl{Loc: siteUrl + "/"}
+    urls := []SitemapUrl{home}
+    var newest time.Time
+    for _, post := range posts {
+        if post.Slug == "" {
+            continue
+        }
+        urls = append(urls, SitemapUrl{
+            Loc:     siteUrl + "/" + post.Slug,
+            LastMod: post.PublicModified().UTC().Format(time.RFC3339),
+        })
+        if post.PublicModified().After(newest) {
+            newest = post.PublicModified()
+        }
+    }
+
+    // The home page changes whenever a post does
+    if !newest.IsZero() {
+        urls[0].LastMod = newest.UTC().Format(time.RFC3339)
+    }
+
+    pages, err := ListPages(false)
+    if err != nil {
+        return nil, err
+    }
+    for _, page := range pages {
+        urls = append(urls, SitemapUrl{
+            Loc:     siteUrl + "/" + page.Slug,
+            LastMod: page.PublicModified().UTC().Format(time.RFC3339),
+        })
+    }
+    return urls, nil
+}
+
+// MakeSitemap builds a sitemap. Page 0 is /sitemap.xml, which lists every URL
+// or, for big sites, is an index of the numbered pages the URLs are split
+// into. ErrNotFound is returned for pages that don't exist.
+func MakeSitemap(siteUrl string, page int) ([]byte, error) {
+    urls, err := SitemapUrls(siteUrl)
+    if err != nil {
+        return nil, err
+    }
+
+    var doc interface{}
+    split := len(urls) > SitemapMaxUrls
+    switch {
+    case page == 0 && !split:
+        doc = &SitemapUrlSet{Urls: urls}
+    case page == 0:
+        index := &SitemapIndex{}
+        for start := 0; start < len(urls); start += SitemapMaxUrls {
+            index.Sitemaps = append(index.Sitemaps, SitemapUrl{
+                Loc: siteUrl + "/sitemap-" + strconv.Itoa(start/SitemapMaxUrls + 1) + ".xml",
+            })
+        }
+        doc = index
+    case split && page > 0 && (page-1) * SitemapMaxUrls < len(urls):
+        start := (page-1) * SitemapMaxUrls
+        end := start + SitemapMaxUrls
+        if end > len(urls) {
+            end = len(urls)
+        }
+        doc = &SitemapUrlSet{Urls: urls[start:end]}
+    default:
+        return nil, ErrNotFound
+    }
+
+    out, err := xml.MarshalIndent(doc, "", "  ")
+    if err != nil {
+        return nil, err
+    }
+    return append([]byte(xml.Header), out...), nil
+}
+
+// MakeRobotsTxt builds robots.txt from the RobotsTxt setting, pointing
+// crawlers at the sitemap.
+func MakeRobotsTxt(siteUrl string) ([]byte) {
+    out := &bytes.Buffer{}
+    out.WriteString(config.RobotsTxt)
+    if config.RobotsTxt != "" && !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+        out.WriteString("\n")
+    }
+    out.WriteString("Sitemap: " + siteUrl + "/sitemap.xml\n")
+    return out.Bytes()
+}
+
+// serveCached sends a document from the cache, building it if needed. Without
+// the SiteUrl setting, the URLs in the document come from the request's Host
+// header, which anyone can set to anything, so documents are cached for each
+// site URL.
+func serveCached(w http.ResponseWriter, r *http.Request, contentType string, build func() ([]byte, error)) {
+    doc, err := siteCache.Get(SiteUrl(r) + r.URL.Path, build)
+    if err == ErrNotFound {
+        http.NotFound(w, r)
+        return
+    }
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    if CheckModifiedHandler(w, r, doc.Modified) {
+        // Not modified
+        return
+    }
+    w.Header().Set("Content-Type", contentType)
+    w.Header().Set("Last-Modified", doc.Modified.UTC().Format(HttpDateTimeFormat))
+    w.Write(doc.Data)
+}
+
+// SitemapHandler is the handler for the sitemap and its numbered pages.
+func SitemapHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+    page := 0
+    if c.URLParams["page"] != "" {
+        var err error
+        page, err = strconv.Atoi(c.URLParams["page"])
+        if err != nil || page < 1 {
+            http.NotFound(w, r)
+            return
+        }
+    }
+
+    siteUrl := SiteUrl(r)
+    serveCached(w, r, "application/xml; charset=utf-8", func() ([]byte, error) {
+        return MakeSitemap(siteUrl, page)
+    })
+}
+
+// RobotsHandler is the handler for robots.txt.
+func RobotsHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+    siteUrl := SiteUrl(r)
+    serveCached(w, r, "text/plain; charset=utf-8", func() ([]byte, error) {
+        return MakeRobotsTxt(siteUrl), nil
+    })
+}
@@ -0,0 +1,206 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "encoding/xml"
+    "net/http"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestSitemap(t *testing.T) {
+    m := setupTestServer(t)
+    config.SiteUrl = "https://blog.example.com"
+    older := createTestPost(t, "older", false, 2 * time.Hour)
+    newer := createTestPost(t, "newer", false, time.Hour)
+    createTestPost(t, "draft", true, 0)
+
+    w := doRequest(m, "GET", "/sitemap.xml", nil, nil)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+    }
+
+    var sitemap SitemapUrlSet
+    err := xml.Unmarshal(w.Body.Bytes(), &sitemap)
+    if err != nil {
+        t.Fatal(err)
+    }
+    want := []SitemapUrl{
+        {"https://blog.example.com/", newer.LastModified.UTC().Format(time.RFC3339)},
+        {"https://blog.example.com/newer", newer.LastModified.UTC().Format(time.RFC3339)},
+        {"https://blog.example.com/older", older.LastModified.UTC().Format(time.RFC3339)},
+    }
+    if len(sitemap.Urls) != len(want) {
+        t.Fatalf("Expected %d URLs, got %+v", len(want), sitemap.Urls)
+    }
+    for i := range want {
+        if sitemap.Urls[i] != want[i] {
+            t.Errorf("Expected %+v, got %+v", want[i], sitemap.Urls[i])
+        }
+    }
+
+    // Cached until a post is saved
+    r, _ := http.NewRequest("GET", "/sitemap.xml", nil)
+    r.Header.Set("If-Modified-Since", w.Header().Get("Last-Modified"))
+    if w := doRequestWith(m, r); w.Code != http.StatusNotModified {
+        t.Errorf("Expected status %d, got %d", http.StatusNotModified, w.Code)
+    }
+    GetStore().DeletePost(older.Id)
+    if w := doRequest(m, "GET", "/sitemap.xml", nil, nil); !strings.Contains(w.Body.String(), "/older") {
+        t.Errorf("Sitemap was not cached")
+    }
+    createTestPost(t, "newest", false, 0)
+    w = doRequest(m, "GET", "/sitemap.xml", nil, nil)
+    if !strings.Contains(w.Body.String(), "/newest") || strings.Contains(w.Body.String(), "/older") {
+        t.Errorf("Sitemap was not rebuilt after a post was saved:\n%s", w.Body.String())
+    }
+
+    if w := doRequest(m, "GET", "/sitemap-1.xml", nil, nil); w.Code != http.StatusNotFound {
+        t.Errorf("Expected status %d for a page of an unsplit sitemap, got %d", http.StatusNotFound, w.Code)
+    }
+}
+
+func TestSitemapIndex(t *testing.T) {
+    m := setupTestServer(t)
+    SitemapMaxUrls = 2
+    defer func() { SitemapMaxUrls = 50000 }()
+    for _, slug := range []string{"a", "b", "c", "d"} {
+        createTestPost(t, slug, false, 0)
+    }
+
+    r, _ := http.NewRequest("GET", "/sitemap.xml", nil)
+    r.Host = "example.org"
+    w := doRequestWith(m, r)
+    var index SitemapIndex
+    err := xml.Unmarshal(w.Body.Bytes(), &index)
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    // The home page and 4 posts is 3 pages
+    if len(index.Sitemaps) != 3 || index.Sitemaps[2].Loc != "http://example.org/sitemap-3.xml" {
+        t.Fatalf("Wrong sitemap index: %+v", index)
+    }
+
+    tests := []struct {
+        path   string
+        status int
+        urls   int
+    }{
+        {"/sitemap-1.xml", http.StatusOK, 2},
+        {"/sitemap-3.xml", http.StatusOK, 1},
+        {"/sitemap-4.xml", http.StatusNotFound, 0},
+        {"/sitemap-0.xml", http.StatusNotFound, 0},
+    }
+    for _, test := range tests {
+        r, _ := http.NewRequest("GET", test.path, nil)
+        r.Host = "example.org"
+        w := doRequestWith(m, r)
+        if w.Code != test.status {
+            t.Errorf("GET %s: expected status %d, got %d", test.path, test.status, w.Code)
+            continue
+        }
+        if test.status != http.StatusOK {
+            continue
+        }
+        var sitemap SitemapUrlSet
+        xml.Unmarshal(w.Body.Bytes(), &sitemap)
+        if len(sitemap.Urls) != test.urls {
+            t.Errorf("GET %s: expected %d URLs, got %d", test.path, test.urls, len(sitemap.Urls))
+        }
+    }
+}
+
+func TestSitemapCachedForEachHost(t *testing.T) {
+    m := setupTestServer(t)
+    createTestPost(t, "post", false, time.Hour)
+
+    // Without a SiteUrl, each host gets its own URLs
+    modified := make(map[string]string)
+    for _, host := range []string{"example.org", "evil.example.com", "example.org"} {
+        r, _ := http.NewRequest("GET", "/sitemap.xml", nil)
+        r.Host = host
+        w := doRequestWith(m, r)
+        if !strings.Contains(w.Body.String(), "http://" + host + "/post") {
+            t.Errorf("Host %s: expected its own URLs, got\n%s", host, w.Body.String())
+        }
+        if last, ok := modified[host]; ok && last != w.Header().Get("Last-Modified") {
+            t.Errorf("Host %s: expected the cached sitemap, modified %s, got %s", host, last, w.Header().Get("Last-Modified"))
+        }
+        modified[host] = w.Header().Get("Last-Modified")
+    }
+    if len(siteCache.docs) != 2 {
+        t.Errorf("Expected a document for each host, got %d documents", len(siteCache.docs))
+    }
+
+    // Which is up to date as far as conditional requests go
+    r, _ := http.NewRequest("GET", "/sitemap.xml", nil)
+    r.Host = "example.org"
+    r.Header.Set("If-Modified-Since", modified["example.org"])
+    if w := doRequestWith(m, r); w.Code != http.StatusNotModified {
+        t.Errorf("Expected status %d, got %d", http.StatusNotModified, w.Code)
+    }
+
+    // The cache can't be filled up with host names
+    for i := 0; i < SiteCacheMaxDocuments * 2; i++ {
+        r, _ := http.NewRequest("GET", "/sitemap.xml", nil)
+        r.Host = "host" + strconv.Itoa(i) + ".example.com"
+        doRequestWith(m, r)
+    }
+    if len(siteCache.docs) > SiteCacheMaxDocuments {
+        t.Errorf("Expected at most %d documents, got %d", SiteCacheMaxDocuments, len(siteCache.docs))
+    }
+}
+
+func TestRobotsTxt(t *testing.T) {
+    m := setupTestServer(t)
+    config.SiteUrl = "https://blog.example.com/"
+    config.RobotsTxt = "User-agent: *\nDisallow: /admin"
+
+    w := doRequest(m, "GET", "/robots.txt", nil, nil)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    want := "User-agent: *\nDisallow: /admin\nSitemap: https://blog.example.com/sitemap.xml\n"
+    if w.Body.String() != want {
+        t.Errorf("Expected %q, got %q", want, w.Body.String())
+    }
+}
+
+func TestSiteCacheExpires(t *testing.T) {
+    setupTestServer(t)
+    build := func() ([]byte, error) { return []byte("doc"), nil }
+
+    doc, err := siteCache.Get("doc", build)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if !doc.Expires.Equal(doc.Modified.Add(SiteCacheMaxAge)) {
+        t.Errorf("Expected the document to expire after %v, got %v", SiteCacheMaxAge, doc.Expires)
+    }
+
+    // Documents are rebuilt when the next scheduled post goes live
+    post := createTestPost(t, "soon", false, -time.Minute)
+    createTestPost(t, "later", false, -2 * time.Minute)
+    doc, _ = siteCache.Get("doc", build)
+    if !doc.Expires.Equal(post.Date) {
+        t.Errorf("Expected the document to expire at %v, got %v", post.Date, doc.Expires)
+    }
+}
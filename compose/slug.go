@@ -0,0 +1,261 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "bytes"
+    "fmt"
+    "github.com/zenazn/goji/web"
+    "golang.org/x/text/unicode/norm"
+    "gopkg.in/mgo.v2/bson"
+    "net/http"
+    "regexp"
+    "strings"
+    "unicode"
+)
+
+// ReservedSlugs are the paths that have routes of their own. No post or page
+// can have one as its slug, or as the first part of it.
+var ReservedSlugs = map[string]bool{
+    "admin":       true,
+    "api":         true,
+    "assets":      true,
+    "atom.xml":    true,
+    "feed.json":   true,
+    "feed.xml":    true,
+    "login":       true,
+    "logout":      true,
+    "preview":     true,
+    "robots.txt":  true,
+    "setup":       true,
+    "sitemap.xml": true,
+    "tag":         true,
+    "upload":      true,
+}
+
+// The reasons a slug can't be used.
+const (
+    SlugInvalid  = "invalid"
+    SlugReserved = "reserved"
+    SlugTaken    = "taken"
+)
+
+// A SlugError explains why a post can't be given a slug. The admin API sends
+// it as JSON.
+type SlugError struct {
+    Slug    string `json:"slug"`
+    Reason  string `json:"reason"`
+    Message string `json:"message"`
+}
+
+func (e *SlugError) Error() (string) {
+    return e.Message
+}
+
+// SlugCheck is the answer to whether a post can be given a slug. Suggestion is
+// a slug like it that can be used.
+type SlugCheck struct {
+    Slug       string `json:"slug"`
+    Available  bool   `json:"available"`
+    Reason     string `json:"reason,omitempty"`
+    Message    string `json:"message,omitempty"`
+    Suggestion string `json:"suggestion"`
+}
+
+// transliterations spells letters that don't decompose into ASCII letters
+// and accents, such as Cyrillic and Greek, with ASCII letters. Apostrophes are
+// dropped rather than splitting words.
+var transliterations = map[rune]string{
+    '\'': "", '’': "",
+    'ß': "ss", 'æ': "ae", 'œ': "oe", 'ø': "o", 'đ': "d", 'ð': "d", 'þ': "th",
+    'ł': "l", 'ı': "i", 'ŋ': "ng", 'ħ': "h",
+    'а': "a", 'б': "b", 'в': "v", 'г': "g", 'ґ': "g", 'д': "d", 'е': "e",
+    'ё': "e", 'є': "ye", 'ж': "zh", 'з': "z", 'и': "i", 'і': "i", 'ї': "yi",
+    'й': "y", 'к': "k", 'л': "l", 'м': "m", 'н': "n", 'о': "o", 'п': "p",
+    'р': "r", 'с': "s", 'т': "t", 'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts",
+    'ч': "ch", 'ш': "sh", 'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e",
+    'ю': "yu", 'я': "ya",
+    'α': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "i",
+    'θ': "th", 'ι': "i", 'κ': "k", 'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x",
+    'ο': "o", 'π': "p", 'ρ': "r", 'σ': "s", 'ς': "s", 'τ': "t", 'υ': "y",
+    'φ': "f", 'χ': "ch", 'ψ': "ps", 'ω': "o",
+}
+
+var digitsRegexp = regexp.MustCompile(`^[0-9]+$`)
+
+// NormalizeSlug makes a URL-safe slug out of a title, or a slug typed in by
+// hand. Letters are lower cased and spelled in ASCII where possible, and
+// anything between the letters and digits becomes a single hyphen.
+func NormalizeSlug(s string) (string) {
+    buf := &bytes.Buffer{}
+    hyphen := false
+    write := func(ascii string) {
+        for _, c := range ascii {
+            if hyphen && buf.Len() > 0 {
+                buf.WriteByte('-')
+            }
+            hyphen = false
+            buf.WriteRune(c)
+        }
+    }
+
+    for _, r := range strings.ToLower(s) {
+        if ascii, ok := transliterations[r]; ok {
+            write(ascii)
+            continue
+        }
+        // Split accented letters into the letter and the accents
+        for _, c := range norm.NFKD.String(string(r)) {
+            if ascii, ok := transliterations[c]; ok {
+                write(ascii)
+            } else if ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') {
+                write(string(c))
+            } else if !unicode.Is(unicode.Mn, c) {
+                hyphen = true
+            }
+        }
+    }
+    return buf.String()
+}
+
+// normalizeSlugFor normalizes the slug of a post, or a page.
+func normalizeSlugFor(slug string, isPage bool) (string) {
+    if isPage {
+        return NormalizePageSlug(slug)
+    }
+    return NormalizeSlug(slug)
+}
+
+// IsReservedSlug checks if a slug would be hidden by one of the site's own
+// routes. Slugs made of digits alone are taken by the pages of the index.
+func IsReservedSlug(slug string) (bool) {
+    return ReservedSlugs[strings.SplitN(slug, "/", 2)[0]] || digitsRegexp.MatchString(slug)
+}
+
+// slugTakenError is the SlugError for a slug that another post has, or had.
+func slugTakenError(slug string) (*SlugError) {
+    return &SlugError{slug, SlugTaken, "Another post uses, or used to use, the slug '" + slug + "'"}
+}
+
+// CheckSlug checks if the post with the given id can be given a slug. Page
+// slugs can have more than one part. A *SlugError is returned if it can't.
+func CheckSlug(slug string, id bson.ObjectId, isPage bool) (error) {
+    if slug == "" || slug != normalizeSlugFor(slug, isPage) {
+        return &SlugError{slug, SlugInvalid, "A slug can only have lower case letters and digits, separated by hyphens"}
+    }
+    if IsReservedSlug(slug) {
+        return &SlugError{slug, SlugReserved, "The slug '" + slug + "' is used by the site itself"}
+    }
+
+    post, err := FindPostBySlug(slug)
+    if err == nil && post.Id != id {
+        return slugTakenError(slug)
+    }
+    if err != nil && err != ErrNotFound {
+        return err
+    }
+    post, err = FindPostByOldSlug(slug)
+    if err == nil && post.Id != id {
+        return slugTakenError(slug)
+    }
+    if err != nil && err != ErrNotFound {
+        return err
+    }
+    return nil
+}
+
+// UniqueSlug finds a slug the post with the given id can have, starting from
+// a normalized slug and adding a number to it until one can be used. The
+// number goes on the first part of a reserved page slug, and on the end of any
+// other slug.
+func UniqueSlug(base string, id bson.ObjectId, isPage bool) (string, error) {
+    if base == "" {
+        base = "post"
+        if isPage {
+            base = "page"
+        }
+    }
+    first, rest := base, ""
+    if IsReservedSlug(base) {
+        if i := strings.Index(base, "/"); i >= 0 {
+            first, rest = base[:i], base[i:]
+        }
+    }
+
+    slug := base
+    for i := 2; ; i++ {
+        err := CheckSlug(slug, id, isPage)
+        if err == nil {
+            return slug, nil
+        }
+        if _, ok := err.(*SlugError); !ok {
+            return "", err
+        }
+        slug = fmt.Sprintf("%s-%d%s", first, i, rest)
+    }
+}
+
+// WriteSlugError sends the reason a slug can't be used. A slug that's taken
+// is a conflict, anything else is a bad request.
+func WriteSlugError(w http.ResponseWriter, err *SlugError) {
+    status := http.StatusBadRequest
+    if err.Reason == SlugTaken {
+        status = http.StatusConflict
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    WriteJson(w, err)
+}
+
+// ApiCheckSlug is a handler to check if a post can be given the slug in the
+// slug parameter, or the slug made from the title parameter. The id parameter
+// is the post being edited, and the kind parameter says if a new post is a
+// page.
+func ApiCheckSlug(c web.C, w http.ResponseWriter, r *http.Request) {
+    query := r.URL.Query()
+    id := bson.ObjectId("")
+    isPage := query.Get("kind") == PostKindPage
+    if bson.IsObjectIdHex(query.Get("id")) {
+        id = bson.ObjectIdHex(query.Get("id"))
+        if post, err := FindPostById(id); err == nil {
+            isPage = post.IsPage()
+        }
+    }
+
+    slug := query.Get("slug")
+    base := normalizeSlugFor(slug, isPage)
+    if slug == "" {
+        slug = NormalizeSlug(query.Get("title"))
+        base = slug
+    }
+
+    check := &SlugCheck{Slug: slug, Available: true}
+    err := CheckSlug(slug, id, isPage)
+    if e, ok := err.(*SlugError); ok {
+        check.Available = false
+        check.Reason = e.Reason
+        check.Message = e.Message
+    } else if err != nil {
+        panic(err)
+    }
+
+    check.Suggestion, err = UniqueSlug(base, id, isPage)
+    if err != nil {
+        panic(err)
+    }
+    WriteJson(w, check)
+}
@@ -0,0 +1,162 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "gopkg.in/mgo.v2/bson"
+    "net/http"
+    "testing"
+    "time"
+)
+
+func TestNormalizeSlug(t *testing.T) {
+    tests := map[string]string{
+        "Hello, World!":          "hello-world",
+        "  Don't Panic  ":        "dont-panic",
+        "Crème Brûlée à la café": "creme-brulee-a-la-cafe",
+        "Straße nach Øresund":    "strasse-nach-oresund",
+        "Привет, мир":            "privet-mir",
+        "Καλημέρα κόσμε":         "kalimera-kosme",
+        "Go 1.4 -- released":     "go-1-4-released",
+        "ＦＵＬＬ ｗｉｄｔｈ":      "full-width",
+        "日本語":                 "",
+    }
+    for title, expected := range tests {
+        if slug := NormalizeSlug(title); slug != expected {
+            t.Errorf("NormalizeSlug(%q): expected %q, got %q", title, expected, slug)
+        }
+    }
+}
+
+func TestCheckSlug(t *testing.T) {
+    setupTestServer(t)
+    post := createTestPost(t, "taken", false, time.Hour)
+    post.Slug = "moved"
+    post.Save()
+    id := bson.NewObjectId()
+
+    reasons := map[string]string{
+        "":           SlugInvalid,
+        "Not-Normal": SlugInvalid,
+        "docs/intro": SlugInvalid,
+        "admin":      SlugReserved,
+        "feed.xml":   SlugInvalid,
+        "2":          SlugReserved,
+        "moved":      SlugTaken,
+        "taken":      SlugTaken,
+        "free":       "",
+        "2-in-1":     "",
+    }
+    for slug, reason := range reasons {
+        err := CheckSlug(slug, id, false)
+        got := ""
+        if slugErr, ok := err.(*SlugError); ok {
+            got = slugErr.Reason
+        } else if err != nil {
+            t.Fatal(err)
+        }
+        if got != reason {
+            t.Errorf("CheckSlug(%q): expected %q, got %q", slug, reason, got)
+        }
+    }
+
+    // A post can keep its own slugs, and pages can be nested, but not under a
+    // reserved path
+    if err := CheckSlug("moved", post.Id, false); err != nil {
+        t.Errorf("Expected a post to keep its slug, got %v", err)
+    }
+    if err := CheckSlug("docs/intro", id, true); err != nil {
+        t.Errorf("Expected a nested page slug to be allowed, got %v", err)
+    }
+    if err := CheckSlug("api/intro", id, true); err == nil {
+        t.Errorf("Expected a page under a reserved path to be rejected")
+    }
+
+    for base, expected := range map[string]string{"moved": "moved-2", "admin": "admin-2", "": "post"} {
+        if slug, _ := UniqueSlug(base, id, false); slug != expected {
+            t.Errorf("UniqueSlug(%q): expected %q, got %q", base, expected, slug)
+        }
+    }
+    if slug, _ := UniqueSlug("tag/x", id, true); slug != "tag-2/x" {
+        t.Errorf("UniqueSlug: expected tag-2/x, got %q", slug)
+    }
+}
+
+func TestApiSlugs(t *testing.T) {
+    m := setupTestServer(t)
+    cookie := loginTestUser(t)
+
+    // New posts get a slug from their title
+    var first, second Post
+    w := doRequest(m, "POST", "/api/posts", nil, cookie)
+    json.Unmarshal(w.Body.Bytes(), &first)
+    w = doRequest(m, "POST", "/api/posts", nil, cookie)
+    json.Unmarshal(w.Body.Bytes(), &second)
+    if first.Slug != "new-post" || second.Slug != "new-post-2" {
+        t.Errorf("Expected slugs made from the title, got %q and %q", first.Slug, second.Slug)
+    }
+
+    // Saving normalizes the slug, or makes one from the title if it's empty
+    saved := [][2]string{{"Übersicht 2015", "ubersicht-2015"}, {"", "mein-beitrag"}}
+    for _, pair := range saved {
+        slug, expected := pair[0], pair[1]
+        first.Title = "Mein Beitrag"
+        first.Slug = slug
+        payload, _ := json.Marshal(first)
+        w = doRequest(m, "PUT", "/api/post/" + first.Id.Hex(), bytes.NewReader(payload), cookie)
+        var post Post
+        json.Unmarshal(w.Body.Bytes(), &post)
+        if w.Code != http.StatusOK || post.Slug != expected {
+            t.Errorf("Saving slug %q: expected %q, got %d %q", slug, expected, w.Code, post.Slug)
+        }
+    }
+
+    // Reserved and taken slugs are refused with the reason
+    statuses := map[string]int{"login": http.StatusBadRequest, "new-post-2": http.StatusConflict}
+    for slug, status := range statuses {
+        first.Slug = slug
+        payload, _ := json.Marshal(first)
+        w = doRequest(m, "PUT", "/api/post/" + first.Id.Hex(), bytes.NewReader(payload), cookie)
+        var slugErr SlugError
+        json.Unmarshal(w.Body.Bytes(), &slugErr)
+        if w.Code != status || slugErr.Slug != slug || slugErr.Message == "" {
+            t.Errorf("Saving slug %q: expected status %d, got %d %s", slug, status, w.Code, w.Body.String())
+        }
+    }
+    if post, _ := FindPostById(first.Id); post.Slug != "mein-beitrag" {
+        t.Errorf("Expected the post to keep its slug, got %q", post.Slug)
+    }
+
+    // Check slugs before saving
+    checks := map[string]SlugCheck{
+        "/api/slug?slug=new-post-2":                          {Slug: "new-post-2", Reason: SlugTaken, Suggestion: "new-post-2-2"},
+        "/api/slug?slug=new-post-2&id=" + second.Id.Hex():    {Slug: "new-post-2", Available: true, Suggestion: "new-post-2"},
+        "/api/slug?title=Mein+Beitrag&id=" + second.Id.Hex(): {Slug: "mein-beitrag", Reason: SlugTaken, Suggestion: "mein-beitrag-2"},
+        "/api/slug?slug=Setup":                               {Slug: "Setup", Reason: SlugInvalid, Suggestion: "setup-2"},
+    }
+    for path, expected := range checks {
+        w = doRequest(m, "GET", path, nil, cookie)
+        var check SlugCheck
+        json.Unmarshal(w.Body.Bytes(), &check)
+        check.Message = ""
+        if check != expected {
+            t.Errorf("GET %s: expected %+v, got %+v", path, expected, check)
+        }
+    }
+}
@@ -0,0 +1,206 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+    "errors"
+    "gopkg.in/mgo.v2/bson"
+    "io"
+    "sort"
+    "time"
+)
+
+// ErrNotFound is returned by a Store when the requested object does not exist.
+var ErrNotFound = errors.New("not found")
+
+// ErrDuplicate is returned by a Store when saving an object would give it the
+// same slug, e-mail address or token as another object. A post can't take a
+// slug that another post used to have either.
+var ErrDuplicate = errors.New("duplicate key")
+
+// PostStore is the interface to the storage of posts. Unless includeDrafts is
+// set, posts are only listed and counted once they're live, so scheduled
+// posts are left out along with drafts. Pages are kept with the posts and
+// share their slugs, but are only listed by ListPages.
+type PostStore interface {
+    FindPostBySlug(slug string) (*Post, error)
+    FindPostByOldSlug(slug string) (*Post, error)
+    FindPostById(id bson.ObjectId) (*Post, error)
+    ListPosts(start int, limit int, includeDrafts bool) ([]Post, error)
+    ListPostHeaders(start int, limit int, includeDrafts bool) ([]PostHeader, error)
+    CountPosts(includeDrafts bool) (int, error)
+    ListPostsByTag(tag string, start int, limit int, includeDrafts bool) ([]Post, error)
+    ListPostHeadersByTag(tag string, start int, limit int, includeDrafts bool) ([]PostHeader, error)
+    CountPostsByTag(tag string, includeDrafts bool) (int, error)
+    CountTags(includeDrafts bool) ([]TagCount, error)
+    ListPages(includeDrafts bool) ([]Post, error)
+    SavePost(post *Post) error
+    DeletePost(id bson.ObjectId) error
+}
+
+// UserStore is the interface to the storage of users.
+type UserStore interface {
+    FindUserById(id bson.ObjectId) (*User, error)
+    FindUserByEmail(email string) (*User, error)
+    ListUsers() ([]User, error)
+    CountUsers() (int, error)
+    SaveUser(user *User) error
+    DeleteUser(id bson.ObjectId) error
+}
+
+// SessionStore is the interface to the storage of login sessions. Sessions
+// are looked up by the hash of their token, which is all that is stored.
+type SessionStore interface {
+    FindSessionById(id bson.ObjectId) (*Session, error)
+    FindSessionByTokenHash(hash string) (*Session, error)
+    SaveSession(session *Session) error
+    DeleteSession(id bson.ObjectId) error
+    DeleteExpiredSessions(now time.Time, idleSince time.Time) (int, error)
+}
+
+// RevisionStore is the interface to the storage of post revisions.
+// Revisions are listed newest first.
+type RevisionStore interface {
+    FindRevisionById(id bson.ObjectId) (*Revision, error)
+    ListRevisions(post bson.ObjectId) ([]Revision, error)
+    SaveRevision(revision *Revision) error
+    DeleteRevision(id bson.ObjectId) error
+}
+
+// BlobStore is the interface to the storage of uploaded files.
+type BlobStore interface {
+    CreateFile(name string, data io.Reader) (*FileInfo, error)
+    OpenFile(id bson.ObjectId) (*FileInfo, io.ReadCloser, error)
+    FindFileInfoById(id bson.ObjectId) (*FileInfo, error)
+    DeleteFile(id bson.ObjectId) error
+}
+
+// MetaStore is the interface to the storage of information about the
+// database itself.
+type MetaStore interface {
+    SchemaVersion() (int, error)
+    SetSchemaVersion(version int) error
+}
+
+// Store is a complete storage backend for Compose.
+type Store interface {
+    PostStore
+    UserStore
+    SessionStore
+    RevisionStore
+    BlobStore
+    MetaStore
+    EnsureIndexes() error
+    Close() error
+}
+
+// postsByDate sorts posts reverse-chronologically. Posts with the same date
+// are ordered newest id first.
+type postsByDate []Post
+
+func (p postsByDate) Len() int      { return len(p) }
+func (p postsByDate) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p postsByDate) Less(i, j int) bool {
+    if p[i].Date.Equal(p[j].Date) {
+        return p[i].Id > p[j].Id
+    }
+    return p[i].Date.After(p[j].Date)
+}
+
+// pagesBySlug sorts pages by slug, so nested pages follow their parent.
+type pagesBySlug []Post
+
+func (p pagesBySlug) Len() int           { return len(p) }
+func (p pagesBySlug) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p pagesBySlug) Less(i, j int) bool { return p[i].Slug < p[j].Slug }
+
+// revisionsByDate sorts revisions newest first.
+type revisionsByDate []Revision
+
+func (r revisionsByDate) Len() int      { return len(r) }
+func (r revisionsByDate) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r revisionsByDate) Less(i, j int) bool {
+    if r[i].Date.Equal(r[j].Date) {
+        return r[i].Id > r[j].Id
+    }
+    return r[i].Date.After(r[j].Date)
+}
+
+// hasOldSlug checks if a post used to have the given slug.
+func hasOldSlug(post *PostHeader, slug string) (bool) {
+    for _, old := range post.OldSlugs {
+        if old == slug {
+            return true
+        }
+    }
+    return false
+}
+
+// pagePosts applies skip and limit to a list of posts. A limit of zero means
+// no limit.
+func pagePosts(posts []Post, start int, limit int) ([]Post) {
+    if start >= len(posts) {
+        return nil
+    }
+    posts = posts[start:]
+    if limit > 0 && limit < len(posts) {
+        posts = posts[:limit]
+    }
+    return posts
+}
+
+// postsWithTag filters a list of posts down to those with the given tag.
+func postsWithTag(posts []Post, tag string) ([]Post) {
+    var tagged []Post
+    for _, post := range posts {
+        for _, t := range post.Tags {
+            if t == tag {
+                tagged = append(tagged, post)
+                break
+            }
+        }
+    }
+    return tagged
+}
+
+// countTags counts how many of the posts have each tag, most used first.
+func countTags(posts []Post) ([]TagCount) {
+    counts := make(map[string]int)
+    for _, post := range posts {
+        for _, tag := range post.Tags {
+            counts[tag] += 1
+        }
+    }
+
+    tags := []TagCount{}
+    for tag, count := range counts {
+        tags = append(tags, TagCount{Tag: tag, Count: count})
+    }
+    sort.Sort(tagsByCount(tags))
+    return tags
+}
+
+// tagsByCount sorts tags most used first, then alphabetically.
+type tagsByCount []TagCount
+
+func (t tagsByCount) Len() int      { return len(t) }
+func (t tagsByCount) Swap(i, j int) { t[i], t[j] = t[j], t[i] }
+func (t tagsByCount) Less(i, j int) bool {
+    if t[i].Count == t[j].Count {
+        return t[i].Tag < t[j].Tag
+    }
+    return t[i].Count > t[j].Count
+}
@@ -0,0 +1,597 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "bytes"
+    "errors"
+    bolt "go.etcd.io/bbolt"
+    "gopkg.in/mgo.v2/bson"
+    "io"
+    "io/ioutil"
+    "sort"
+    "strconv"
+    "time"
+)
+
+// Names of the buckets used by the BoltStore.
+var boltBuckets = []string{
+    "posts",
+    "users",
+    "sessions",
+    "revisions",
+    "files",
+    "blobs",
+    "meta",
+}
+
+// BoltStore is a Store kept in a single local BoltDB file. Objects are
+// encoded with BSON, keyed by id, and looked up by scanning the bucket, which
+// is plenty fast for a small site.
+type BoltStore struct {
+    db *bolt.DB
+}
+
+// OpenBoltStore opens (or creates) the database file at path.
+func OpenBoltStore(path string) (*BoltStore, error) {
+    db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+    if err != nil {
+        return nil, err
+    }
+
+    // Make sure all the buckets exist
+    err = db.Update(func(tx *bolt.Tx) error {
+        for _, name := range boltBuckets {
+            _, err := tx.CreateBucketIfNotExists([]byte(name))
+            if err != nil {
+                return err
+            }
+        }
+        return nil
+    })
+    if err != nil {
+        db.Close()
+        return nil, err
+    }
+
+    return &BoltStore{db: db}, nil
+}
+
+// Close closes the database file.
+func (s *BoltStore) Close() error {
+    return s.db.Close()
+}
+
+// EnsureIndexes does nothing. There are no indexes, and uniqueness is checked
+// when saving.
+func (s *BoltStore) EnsureIndexes() error {
+    return nil
+}
+
+// get decodes the object with the given id from bucket into out.
+func (s *BoltStore) get(bucket string, id bson.ObjectId, out interface{}) error {
+    return s.db.View(func(tx *bolt.Tx) error {
+        data := tx.Bucket([]byte(bucket)).Get([]byte(id))
+        if data == nil {
+            return ErrNotFound
+        }
+        return bson.Unmarshal(data, out)
+    })
+}
+
+// put encodes obj and stores it in bucket under the given id.
+func (s *BoltStore) put(bucket string, id bson.ObjectId, obj interface{}) error {
+    data, err := bson.Marshal(obj)
+    if err != nil {
+        return err
+    }
+    return s.db.Update(func(tx *bolt.Tx) error {
+        return tx.Bucket([]byte(bucket)).Put([]byte(id), data)
+    })
+}
+
+// putUnique is like put, but fails with ErrDuplicate if conflicts returns
+// true for the encoded form of any other object in the bucket.
+func (s *BoltStore) putUnique(bucket string, id bson.ObjectId, obj interface{}, conflicts func(data []byte) (bool, error)) error {
+    data, err := bson.Marshal(obj)
+    if err != nil {
+        return err
+    }
+    return s.db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket([]byte(bucket))
+        err := b.ForEach(func(k, v []byte) error {
+            if string(k) == string(id) {
+                return nil
+            }
+            conflict, err := conflicts(v)
+            if err != nil {
+                return err
+            }
+            if conflict {
+                return ErrDuplicate
+            }
+            return nil
+        })
+        if err != nil {
+            return err
+        }
+        return b.Put([]byte(id), data)
+    })
+}
+
+// remove deletes the object with the given id from bucket.
+func (s *BoltStore) remove(bucket string, id bson.ObjectId) error {
+    return s.db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket([]byte(bucket))
+        if b.Get([]byte(id)) == nil {
+            return ErrNotFound
+        }
+        return b.Delete([]byte(id))
+    })
+}
+
+// errStop can be returned from the function passed to each to end the
+// iteration early without an error.
+var errStop = errors.New("stop")
+
+// each calls fn with the encoded form of every object in bucket. Iteration
+// stops at the first error.
+func (s *BoltStore) each(bucket string, fn func(data []byte) error) error {
+    err := s.db.View(func(tx *bolt.Tx) error {
+        return tx.Bucket([]byte(bucket)).ForEach(func(k, v []byte) error {
+            return fn(v)
+        })
+    })
+    if err == errStop {
+        return nil
+    }
+    return err
+}
+
+// allPosts gets every post of the given kind, newest first, optionally
+// including drafts and scheduled posts.
+func (s *BoltStore) allPosts(kind string, includeDrafts bool) ([]Post, error) {
+    var posts []Post
+    err := s.each("posts", func(data []byte) error {
+        post := Post{}
+        err := bson.Unmarshal(data, &post)
+        if err != nil {
+            return err
+        }
+        if post.Kind == kind && (includeDrafts || post.IsPublished()) {
+            posts = append(posts, post)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    sort.Sort(postsByDate(posts))
+    return posts, nil
+}
+
+func (s *BoltStore) FindPostBySlug(slug string) (*Post, error) {
+    var found *Post
+    err := s.each("posts", func(data []byte) error {
+        post := &Post{}
+        err := bson.Unmarshal(data, post)
+        if err != nil {
+            return err
+        }
+        if post.Slug == slug {
+            found = post
+            return errStop
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    if found == nil {
+        return nil, ErrNotFound
+    }
+    return found, nil
+}
+
+func (s *BoltStore) FindPostByOldSlug(slug string) (*Post, error) {
+    var found *Post
+    err := s.each("posts", func(data []byte) error {
+        post := &Post{}
+        err := bson.Unmarshal(data, post)
+        if err != nil {
+            return err
+        }
+        if hasOldSlug(&post.PostHeader, slug) {
+            found = post
+            return errStop
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    if found == nil {
+        return nil, ErrNotFound
+    }
+    return found, nil
+}
+
+func (s *BoltStore) FindPostById(id bson.ObjectId) (*Post, error) {
+    post := &Post{}
+    err := s.get("posts", id, post)
+    if err != nil {
+        return nil, err
+    }
+    return post, nil
+}
+
+func (s *BoltStore) ListPosts(start int, limit int, includeDrafts bool) ([]Post, error) {
+    posts, err := s.allPosts(PostKindPost, includeDrafts)
+    if err != nil {
+        return nil, err
+    }
+    return pagePosts(posts, start, limit), nil
+}
+
+func (s *BoltStore) ListPostHeaders(start int, limit int, includeDrafts bool) ([]PostHeader, error) {
+    posts, err := s.ListPosts(start, limit, includeDrafts)
+    if err != nil {
+        return nil, err
+    }
+    var headers []PostHeader
+    for _, post := range posts {
+        headers = append(headers, post.PostHeader)
+    }
+    return headers, nil
+}
+
+func (s *BoltStore) CountPosts(includeDrafts bool) (int, error) {
+    posts, err := s.allPosts(PostKindPost, includeDrafts)
+    return len(posts), err
+}
+
+func (s *BoltStore) ListPostsByTag(tag string, start int, limit int, includeDrafts bool) ([]Post, error) {
+    posts, err := s.allPosts(PostKindPost, includeDrafts)
+    if err != nil {
+        return nil, err
+    }
+    return pagePosts(postsWithTag(posts, tag), start, limit), nil
+}
+
+func (s *BoltStore) ListPostHeadersByTag(tag string, start int, limit int, includeDrafts bool) ([]PostHeader, error) {
+    posts, err := s.ListPostsByTag(tag, start, limit, includeDrafts)
+    if err != nil {
+        return nil, err
+    }
+    var headers []PostHeader
+    for _, post := range posts {
+        headers = append(headers, post.PostHeader)
+    }
+    return headers, nil
+}
+
+func (s *BoltStore) CountPostsByTag(tag string, includeDrafts bool) (int, error) {
+    posts, err := s.allPosts(PostKindPost, includeDrafts)
+    return len(postsWithTag(posts, tag)), err
+}
+
+func (s *BoltStore) CountTags(includeDrafts bool) ([]TagCount, error) {
+    posts, err := s.allPosts(PostKindPost, includeDrafts)
+    if err != nil {
+        return nil, err
+    }
+    return countTags(posts), nil
+}
+
+func (s *BoltStore) ListPages(includeDrafts bool) ([]Post, error) {
+    pages, err := s.allPosts(PostKindPage, includeDrafts)
+    if err != nil {
+        return nil, err
+    }
+    sort.Sort(pagesBySlug(pages))
+    return pages, nil
+}
+
+func (s *BoltStore) SavePost(post *Post) error {
+    if post.Slug == "" {
+        return s.put("posts", post.Id, post)
+    }
+    return s.putUnique("posts", post.Id, post, func(data []byte) (bool, error) {
+        other := PostHeader{}
+        err := bson.Unmarshal(data, &other)
+        return other.Slug == post.Slug || hasOldSlug(&other, post.Slug), err
+    })
+}
+
+func (s *BoltStore) DeletePost(id bson.ObjectId) error {
+    return s.remove("posts", id)
+}
+
+func (s *BoltStore) FindUserById(id bson.ObjectId) (*User, error) {
+    user := &User{}
+    err := s.get("users", id, user)
+    if err != nil {
+        return nil, err
+    }
+    return user, nil
+}
+
+func (s *BoltStore) FindUserByEmail(email string) (*User, error) {
+    var found *User
+    err := s.each("users", func(data []byte) error {
+        user := &User{}
+        err := bson.Unmarshal(data, user)
+        if err != nil {
+            return err
+        }
+        if user.Email == email {
+            found = user
+            return errStop
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    if found == nil {
+        return nil, ErrNotFound
+    }
+    return found, nil
+}
+
+func (s *BoltStore) ListUsers() ([]User, error) {
+    var users []User
+    err := s.each("users", func(data []byte) error {
+        user := User{}
+        err := bson.Unmarshal(data, &user)
+        users = append(users, user)
+        return err
+    })
+    return users, err
+}
+
+func (s *BoltStore) CountUsers() (int, error) {
+    count := 0
+    err := s.db.View(func(tx *bolt.Tx) error {
+        count = tx.Bucket([]byte("users")).Stats().KeyN
+        return nil
+    })
+    return count, err
+}
+
+func (s *BoltStore) SaveUser(user *User) error {
+    return s.putUnique("users", user.Id, user, func(data []byte) (bool, error) {
+        other := User{}
+        err := bson.Unmarshal(data, &other)
+        return other.Email == user.Email, err
+    })
+}
+
+func (s *BoltStore) DeleteUser(id bson.ObjectId) error {
+    return s.remove("users", id)
+}
+
+func (s *BoltStore) FindSessionById(id bson.ObjectId) (*Session, error) {
+    session := &Session{}
+    err := s.get("sessions", id, session)
+    if err != nil {
+        return nil, err
+    }
+    return session, nil
+}
+
+func (s *BoltStore) FindSessionByTokenHash(hash string) (*Session, error) {
+    var found *Session
+    err := s.each("sessions", func(data []byte) error {
+        session := &Session{}
+        err := bson.Unmarshal(data, session)
+        if err != nil {
+            return err
+        }
+        if session.TokenHash == hash {
+            found = session
+            return errStop
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    if found == nil {
+        return nil, ErrNotFound
+    }
+    return found, nil
+}
+
+func (s *BoltStore) SaveSession(session *Session) error {
+    return s.putUnique("sessions", session.Id, session, func(data []byte) (bool, error) {
+        other := Session{}
+        err := bson.Unmarshal(data, &other)
+        return other.TokenHash == session.TokenHash, err
+    })
+}
+
+func (s *BoltStore) DeleteSession(id bson.ObjectId) error {
+    return s.remove("sessions", id)
+}
+
+func (s *BoltStore) DeleteExpiredSessions(now time.Time, idleSince time.Time) (int, error) {
+    n := 0
+    err := s.db.Update(func(tx *bolt.Tx) error {
+        b := tx.Bucket([]byte("sessions"))
+
+        // Keys can't be deleted while iterating over the bucket
+        var expired [][]byte
+        err := b.ForEach(func(k, v []byte) error {
+            session := Session{}
+            err := bson.Unmarshal(v, &session)
+            if err != nil {
+                return err
+            }
+            if session.IsExpired(now, idleSince) {
+                expired = append(expired, k)
+            }
+            return nil
+        })
+        if err != nil {
+            return err
+        }
+        for _, k := range expired {
+            err = b.Delete(k)
+            if err != nil {
+                return err
+            }
+        }
+        n = len(expired)
+        return nil
+    })
+    return n, err
+}
+
+func (s *BoltStore) FindRevisionById(id bson.ObjectId) (*Revision, error) {
+    revision := &Revision{}
+    err := s.get("revisions", id, revision)
+    if err != nil {
+        return nil, err
+    }
+    return revision, nil
+}
+
+func (s *BoltStore) ListRevisions(post bson.ObjectId) ([]Revision, error) {
+    var revisions []Revision
+    err := s.each("revisions", func(data []byte) error {
+        revision := Revision{}
+        err := bson.Unmarshal(data, &revision)
+        if err != nil {
+            return err
+        }
+        if revision.Post == post {
+            revisions = append(revisions, revision)
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    sort.Sort(revisionsByDate(revisions))
+    return revisions, nil
+}
+
+func (s *BoltStore) SaveRevision(revision *Revision) error {
+    return s.put("revisions", revision.Id, revision)
+}
+
+func (s *BoltStore) DeleteRevision(id bson.ObjectId) error {
+    return s.remove("revisions", id)
+}
+
+func (s *BoltStore) CreateFile(name string, data io.Reader) (*FileInfo, error) {
+    contents, err := ioutil.ReadAll(data)
+    if err != nil {
+        return nil, err
+    }
+
+    info := &FileInfo{Id:         bson.NewObjectId(),
+                      Name:       name,
+                      UploadDate: time.Now(),
+                      Size:       int64(len(contents))}
+    encoded, err := bson.Marshal(info)
+    if err != nil {
+        return nil, err
+    }
+
+    // Write the info and the contents together
+    err = s.db.Update(func(tx *bolt.Tx) error {
+        err := tx.Bucket([]byte("blobs")).Put([]byte(info.Id), contents)
+        if err != nil {
+            return err
+        }
+        return tx.Bucket([]byte("files")).Put([]byte(info.Id), encoded)
+    })
+    if err != nil {
+        return nil, err
+    }
+    return info, nil
+}
+
+func (s *BoltStore) OpenFile(id bson.ObjectId) (*FileInfo, io.ReadCloser, error) {
+    info := &FileInfo{}
+    var contents []byte
+    err := s.db.View(func(tx *bolt.Tx) error {
+        data := tx.Bucket([]byte("files")).Get([]byte(id))
+        if data == nil {
+            return ErrNotFound
+        }
+        err := bson.Unmarshal(data, info)
+        if err != nil {
+            return err
+        }
+
+        // The value is only valid during the transaction, so copy it out
+        contents = append([]byte{}, tx.Bucket([]byte("blobs")).Get([]byte(id))...)
+        return nil
+    })
+    if err != nil {
+        return nil, nil, err
+    }
+    return info, ioutil.NopCloser(bytes.NewReader(contents)), nil
+}
+
+func (s *BoltStore) FindFileInfoById(id bson.ObjectId) (*FileInfo, error) {
+    info := &FileInfo{}
+    err := s.get("files", id, info)
+    if err != nil {
+        return nil, err
+    }
+    return info, nil
+}
+
+func (s *BoltStore) DeleteFile(id bson.ObjectId) error {
+    return s.db.Update(func(tx *bolt.Tx) error {
+        files := tx.Bucket([]byte("files"))
+        if files.Get([]byte(id)) == nil {
+            return ErrNotFound
+        }
+        err := tx.Bucket([]byte("blobs")).Delete([]byte(id))
+        if err != nil {
+            return err
+        }
+        return files.Delete([]byte(id))
+    })
+}
+
+// SchemaVersion gets the schema version from the meta bucket. A database
+// without one is at version 0.
+func (s *BoltStore) SchemaVersion() (int, error) {
+    version := 0
+    err := s.db.View(func(tx *bolt.Tx) error {
+        data := tx.Bucket([]byte("meta")).Get([]byte("schema_version"))
+        if data == nil {
+            return nil
+        }
+        var err error
+        version, err = strconv.Atoi(string(data))
+        return err
+    })
+    return version, err
+}
+
+func (s *BoltStore) SetSchemaVersion(version int) error {
+    return s.db.Update(func(tx *bolt.Tx) error {
+        return tx.Bucket([]byte("meta")).Put([]byte("schema_version"), []byte(strconv.Itoa(version)))
+    })
+}
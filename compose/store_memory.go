@@ -0,0 +1,430 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "bytes"
+    "gopkg.in/mgo.v2/bson"
+    "io"
+    "io/ioutil"
+    "sort"
+    "sync"
+    "time"
+)
+
+// MemoryStore is a Store that keeps everything in memory. Nothing is
+// persisted, so it is mostly useful for testing and for trying out themes.
+// Objects are copied on the way in and out so that callers can't modify the
+// stored versions, just like with the other backends.
+type MemoryStore struct {
+    lock      sync.RWMutex
+    posts     map[bson.ObjectId]Post
+    users     map[bson.ObjectId]User
+    sessions  map[bson.ObjectId]Session
+    revisions map[bson.ObjectId]Revision
+    files     map[bson.ObjectId]FileInfo
+    blobs     map[bson.ObjectId][]byte
+    version   int
+}
+
+// NewMemoryStore creates a new, empty MemoryStore.
+func NewMemoryStore() (*MemoryStore) {
+    return &MemoryStore{
+        posts:     make(map[bson.ObjectId]Post),
+        users:     make(map[bson.ObjectId]User),
+        sessions:  make(map[bson.ObjectId]Session),
+        revisions: make(map[bson.ObjectId]Revision),
+        files:     make(map[bson.ObjectId]FileInfo),
+        blobs:     make(map[bson.ObjectId][]byte),
+    }
+}
+
+// Close does nothing.
+func (s *MemoryStore) Close() error {
+    return nil
+}
+
+// EnsureIndexes does nothing. There are no indexes, and uniqueness is checked
+// when saving.
+func (s *MemoryStore) EnsureIndexes() error {
+    return nil
+}
+
+// copyPost makes a copy of a post that shares no memory with the original.
+func copyPost(post Post) (Post) {
+    post.Files = append([]bson.ObjectId{}, post.Files...)
+    post.Tags = append([]string{}, post.Tags...)
+    post.OldSlugs = append([]string{}, post.OldSlugs...)
+    return post
+}
+
+// copyUser makes a copy of a user that shares no memory with the original.
+func copyUser(user User) (User) {
+    user.RecoveryCodes = append([]string{}, user.RecoveryCodes...)
+    return user
+}
+
+// allPosts gets every post of the given kind, newest first, optionally
+// including drafts and scheduled posts.
+func (s *MemoryStore) allPosts(kind string, includeDrafts bool) ([]Post) {
+    var posts []Post
+    for _, post := range s.posts {
+        if post.Kind == kind && (includeDrafts || post.IsPublished()) {
+            posts = append(posts, copyPost(post))
+        }
+    }
+    sort.Sort(postsByDate(posts))
+    return posts
+}
+
+func (s *MemoryStore) FindPostBySlug(slug string) (*Post, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    for _, post := range s.posts {
+        if post.Slug == slug {
+            post = copyPost(post)
+            return &post, nil
+        }
+    }
+    return nil, ErrNotFound
+}
+
+func (s *MemoryStore) FindPostByOldSlug(slug string) (*Post, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    for _, post := range s.posts {
+        if hasOldSlug(&post.PostHeader, slug) {
+            post = copyPost(post)
+            return &post, nil
+        }
+    }
+    return nil, ErrNotFound
+}
+
+func (s *MemoryStore) FindPostById(id bson.ObjectId) (*Post, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    post, ok := s.posts[id]
+    if !ok {
+        return nil, ErrNotFound
+    }
+    post = copyPost(post)
+    return &post, nil
+}
+
+func (s *MemoryStore) ListPosts(start int, limit int, includeDrafts bool) ([]Post, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    return pagePosts(s.allPosts(PostKindPost, includeDrafts), start, limit), nil
+}
+
+func (s *MemoryStore) ListPostHeaders(start int, limit int, includeDrafts bool) ([]PostHeader, error) {
+    posts, _ := s.ListPosts(start, limit, includeDrafts)
+    var headers []PostHeader
+    for _, post := range posts {
+        headers = append(headers, post.PostHeader)
+    }
+    return headers, nil
+}
+
+func (s *MemoryStore) CountPosts(includeDrafts bool) (int, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    return len(s.allPosts(PostKindPost, includeDrafts)), nil
+}
+
+func (s *MemoryStore) ListPostsByTag(tag string, start int, limit int, includeDrafts bool) ([]Post, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    return pagePosts(postsWithTag(s.allPosts(PostKindPost, includeDrafts), tag), start, limit), nil
+}
+
+func (s *MemoryStore) ListPostHeadersByTag(tag string, start int, limit int, includeDrafts bool) ([]PostHeader, error) {
+    posts, _ := s.ListPostsByTag(tag, start, limit, includeDrafts)
+    var headers []PostHeader
+    for _, post := range posts {
+        headers = append(headers, post.PostHeader)
+    }
+    return headers, nil
+}
+
+func (s *MemoryStore) CountPostsByTag(tag string, includeDrafts bool) (int, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    return len(postsWithTag(s.allPosts(PostKindPost, includeDrafts), tag)), nil
+}
+
+func (s *MemoryStore) CountTags(includeDrafts bool) ([]TagCount, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    return countTags(s.allPosts(PostKindPost, includeDrafts)), nil
+}
+
+func (s *MemoryStore) ListPages(includeDrafts bool) ([]Post, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    pages := s.allPosts(PostKindPage, includeDrafts)
+    sort.Sort(pagesBySlug(pages))
+    return pages, nil
+}
+
+func (s *MemoryStore) SavePost(post *Post) error {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if post.Slug != "" {
+        for id, other := range s.posts {
+            if id != post.Id && (other.Slug == post.Slug || hasOldSlug(&other.PostHeader, post.Slug)) {
+                return ErrDuplicate
+            }
+        }
+    }
+    s.posts[post.Id] = copyPost(*post)
+    return nil
+}
+
+func (s *MemoryStore) DeletePost(id bson.ObjectId) error {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if _, ok := s.posts[id]; !ok {
+        return ErrNotFound
+    }
+    delete(s.posts, id)
+    return nil
+}
+
+func (s *MemoryStore) FindUserById(id bson.ObjectId) (*User, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    user, ok := s.users[id]
+    if !ok {
+        return nil, ErrNotFound
+    }
+    user = copyUser(user)
+    return &user, nil
+}
+
+func (s *MemoryStore) FindUserByEmail(email string) (*User, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    for _, user := range s.users {
+        if user.Email == email {
+            user = copyUser(user)
+            return &user, nil
+        }
+    }
+    return nil, ErrNotFound
+}
+
+func (s *MemoryStore) ListUsers() ([]User, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    var users []User
+    for _, user := range s.users {
+        users = append(users, copyUser(user))
+    }
+    return users, nil
+}
+
+func (s *MemoryStore) CountUsers() (int, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    return len(s.users), nil
+}
+
+func (s *MemoryStore) SaveUser(user *User) error {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    for id, other := range s.users {
+        if id != user.Id && other.Email == user.Email {
+            return ErrDuplicate
+        }
+    }
+    s.users[user.Id] = copyUser(*user)
+    return nil
+}
+
+func (s *MemoryStore) DeleteUser(id bson.ObjectId) error {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if _, ok := s.users[id]; !ok {
+        return ErrNotFound
+    }
+    delete(s.users, id)
+    return nil
+}
+
+func (s *MemoryStore) FindSessionById(id bson.ObjectId) (*Session, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    session, ok := s.sessions[id]
+    if !ok {
+        return nil, ErrNotFound
+    }
+    return &session, nil
+}
+
+func (s *MemoryStore) FindSessionByTokenHash(hash string) (*Session, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    for _, session := range s.sessions {
+        if session.TokenHash == hash {
+            return &session, nil
+        }
+    }
+    return nil, ErrNotFound
+}
+
+func (s *MemoryStore) SaveSession(session *Session) error {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    for id, other := range s.sessions {
+        if id != session.Id && other.TokenHash == session.TokenHash {
+            return ErrDuplicate
+        }
+    }
+    // Only the hash of the token is stored, as in the other stores
+    stored := *session
+    stored.Token = ""
+    s.sessions[session.Id] = stored
+    return nil
+}
+
+func (s *MemoryStore) DeleteSession(id bson.ObjectId) error {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if _, ok := s.sessions[id]; !ok {
+        return ErrNotFound
+    }
+    delete(s.sessions, id)
+    return nil
+}
+
+func (s *MemoryStore) DeleteExpiredSessions(now time.Time, idleSince time.Time) (int, error) {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    n := 0
+    for id, session := range s.sessions {
+        if session.IsExpired(now, idleSince) {
+            delete(s.sessions, id)
+            n++
+        }
+    }
+    return n, nil
+}
+
+func (s *MemoryStore) FindRevisionById(id bson.ObjectId) (*Revision, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    revision, ok := s.revisions[id]
+    if !ok {
+        return nil, ErrNotFound
+    }
+    return &revision, nil
+}
+
+func (s *MemoryStore) ListRevisions(post bson.ObjectId) ([]Revision, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    var revisions []Revision
+    for _, revision := range s.revisions {
+        if revision.Post == post {
+            revisions = append(revisions, revision)
+        }
+    }
+    sort.Sort(revisionsByDate(revisions))
+    return revisions, nil
+}
+
+func (s *MemoryStore) SaveRevision(revision *Revision) error {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.revisions[revision.Id] = *revision
+    return nil
+}
+
+func (s *MemoryStore) DeleteRevision(id bson.ObjectId) error {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if _, ok := s.revisions[id]; !ok {
+        return ErrNotFound
+    }
+    delete(s.revisions, id)
+    return nil
+}
+
+func (s *MemoryStore) CreateFile(name string, data io.Reader) (*FileInfo, error) {
+    contents, err := ioutil.ReadAll(data)
+    if err != nil {
+        return nil, err
+    }
+
+    info := FileInfo{Id:         bson.NewObjectId(),
+                     Name:       name,
+                     UploadDate: time.Now(),
+                     Size:       int64(len(contents))}
+
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.files[info.Id] = info
+    s.blobs[info.Id] = contents
+    return &info, nil
+}
+
+func (s *MemoryStore) OpenFile(id bson.ObjectId) (*FileInfo, io.ReadCloser, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    info, ok := s.files[id]
+    if !ok {
+        return nil, nil, ErrNotFound
+    }
+    // Blobs are never modified in place, so the reader can share the slice
+    return &info, ioutil.NopCloser(bytes.NewReader(s.blobs[id])), nil
+}
+
+func (s *MemoryStore) FindFileInfoById(id bson.ObjectId) (*FileInfo, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    info, ok := s.files[id]
+    if !ok {
+        return nil, ErrNotFound
+    }
+    return &info, nil
+}
+
+func (s *MemoryStore) DeleteFile(id bson.ObjectId) error {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    if _, ok := s.files[id]; !ok {
+        return ErrNotFound
+    }
+    delete(s.files, id)
+    delete(s.blobs, id)
+    return nil
+}
+
+func (s *MemoryStore) SchemaVersion() (int, error) {
+    s.lock.RLock()
+    defer s.lock.RUnlock()
+    return s.version, nil
+}
+
+func (s *MemoryStore) SetSchemaVersion(version int) error {
+    s.lock.Lock()
+    defer s.lock.Unlock()
+    s.version = version
+    return nil
+}
@@ -0,0 +1,395 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+    "errors"
+    "fmt"
+    "gopkg.in/mgo.v2"
+    "gopkg.in/mgo.v2/bson"
+    "io"
+    "strings"
+    "time"
+)
+
+// MongoStore is a Store backed by a MongoDB database, with files kept in
+// GridFS.
+type MongoStore struct {
+    session *mgo.Session
+    name    string
+}
+
+// MongoIndexes are the indexes needed on each collection. Posts without a slug
+// don't store one at all, so the sparse slug index lets any number of them
+// exist.
+var MongoIndexes = []struct {
+    Collection string
+    Index      mgo.Index
+}{
+    {"posts",     mgo.Index{Key: []string{"slug"}, Unique: true, Sparse: true}},
+    {"posts",     mgo.Index{Key: []string{"draft", "-date"}}},
+    {"posts",     mgo.Index{Key: []string{"-date"}}},
+    {"posts",     mgo.Index{Key: []string{"tags", "-date"}}},
+    {"posts",     mgo.Index{Key: []string{"old_slugs"}}},
+    {"users",     mgo.Index{Key: []string{"email"}, Unique: true}},
+    {"sessions",  mgo.Index{Key: []string{"token"}, Unique: true}},
+    {"revisions", mgo.Index{Key: []string{"post", "-date"}}},
+}
+
+// OpenMongoStore connects to the MongoDB server at host and uses the database
+// with the given name.
+func OpenMongoStore(host, name string) (*MongoStore, error) {
+    session, err := mgo.Dial(host)
+    if err != nil {
+        return nil, err
+    }
+    session.SetMode(mgo.Monotonic, true)
+    return &MongoStore{session: session, name: name}, nil
+}
+
+// DB gets the database handle.
+func (s *MongoStore) DB() (*mgo.Database) {
+    return s.session.DB(s.name)
+}
+
+// Close closes the session.
+func (s *MongoStore) Close() error {
+    s.session.Close()
+    return nil
+}
+
+// EnsureIndexes creates any of the MongoIndexes that don't exist yet.
+func (s *MongoStore) EnsureIndexes() error {
+    for _, index := range MongoIndexes {
+        err := s.DB().C(index.Collection).EnsureIndex(index.Index)
+        if err != nil {
+            msg := fmt.Sprintf("Failed to create index on %s (%s): %s",
+                               index.Collection,
+                               strings.Join(index.Index.Key, ", "),
+                               err.Error())
+            if mgo.IsDup(err) {
+                msg += ". Remove the duplicate values and try again."
+            }
+            return errors.New(msg)
+        }
+    }
+    return nil
+}
+
+// mongoError translates mgo errors into Store errors.
+func mongoError(err error) error {
+    if err == mgo.ErrNotFound {
+        return ErrNotFound
+    }
+    if mgo.IsDup(err) {
+        return ErrDuplicate
+    }
+    return err
+}
+
+// postSelector selects posts of the given kind, optionally including drafts
+// and scheduled posts. Posts that aren't pages don't store a kind at all.
+func postSelector(kind string, includeDrafts bool) (bson.M) {
+    selector := bson.M{"kind":kind}
+    if kind == PostKindPost {
+        selector["kind"] = bson.M{"$ne":PostKindPage}
+    }
+    if !includeDrafts {
+        selector["draft"] = false
+        selector["date"] = bson.M{"$lte":time.Now()}
+    }
+    return selector
+}
+
+// postQuery builds a query on the posts collection, optionally including
+// drafts and scheduled posts.
+func (s *MongoStore) postQuery(includeDrafts bool) (*mgo.Query) {
+    return s.DB().C("posts").Find(postSelector(PostKindPost, includeDrafts))
+}
+
+// postTagQuery builds a query on the posts collection for posts with the
+// given tag, optionally including drafts and scheduled posts.
+func (s *MongoStore) postTagQuery(tag string, includeDrafts bool) (*mgo.Query) {
+    selector := postSelector(PostKindPost, includeDrafts)
+    selector["tags"] = tag
+    return s.DB().C("posts").Find(selector)
+}
+
+func (s *MongoStore) FindPostBySlug(slug string) (*Post, error) {
+    post := &Post{}
+    err := s.DB().C("posts").Find(bson.M{"slug":slug}).One(post)
+    if err != nil {
+        return nil, mongoError(err)
+    }
+    return post, nil
+}
+
+func (s *MongoStore) FindPostByOldSlug(slug string) (*Post, error) {
+    post := &Post{}
+    err := s.DB().C("posts").Find(bson.M{"old_slugs":slug}).One(post)
+    if err != nil {
+        return nil, mongoError(err)
+    }
+    return post, nil
+}
+
+func (s *MongoStore) FindPostById(id bson.ObjectId) (*Post, error) {
+    post := &Post{}
+    err := s.DB().C("posts").FindId(id).One(post)
+    if err != nil {
+        return nil, mongoError(err)
+    }
+    return post, nil
+}
+
+func (s *MongoStore) ListPosts(start int, limit int, includeDrafts bool) ([]Post, error) {
+    var posts []Post
+    err := s.postQuery(includeDrafts).Sort("-date").Skip(start).Limit(limit).All(&posts)
+    return posts, err
+}
+
+func (s *MongoStore) ListPostHeaders(start int, limit int, includeDrafts bool) ([]PostHeader, error) {
+    var posts []PostHeader
+    err := s.postQuery(includeDrafts).Sort("-date").Skip(start).Limit(limit).All(&posts)
+    return posts, err
+}
+
+func (s *MongoStore) CountPosts(includeDrafts bool) (int, error) {
+    return s.postQuery(includeDrafts).Count()
+}
+
+func (s *MongoStore) ListPostsByTag(tag string, start int, limit int, includeDrafts bool) ([]Post, error) {
+    var posts []Post
+    err := s.postTagQuery(tag, includeDrafts).Sort("-date").Skip(start).Limit(limit).All(&posts)
+    return posts, err
+}
+
+func (s *MongoStore) ListPostHeadersByTag(tag string, start int, limit int, includeDrafts bool) ([]PostHeader, error) {
+    var posts []PostHeader
+    err := s.postTagQuery(tag, includeDrafts).Sort("-date").Skip(start).Limit(limit).All(&posts)
+    return posts, err
+}
+
+func (s *MongoStore) CountPostsByTag(tag string, includeDrafts bool) (int, error) {
+    return s.postTagQuery(tag, includeDrafts).Count()
+}
+
+func (s *MongoStore) CountTags(includeDrafts bool) ([]TagCount, error) {
+    pipeline := []bson.M{
+        {"$match": postSelector(PostKindPost, includeDrafts)},
+        {"$unwind": "$tags"},
+        {"$group": bson.M{"_id": "$tags", "count": bson.M{"$sum": 1}}},
+        {"$sort": bson.D{{Name: "count", Value: -1}, {Name: "_id", Value: 1}}},
+    }
+
+    tags := []TagCount{}
+    err := s.DB().C("posts").Pipe(pipeline).All(&tags)
+    return tags, err
+}
+
+func (s *MongoStore) ListPages(includeDrafts bool) ([]Post, error) {
+    var pages []Post
+    err := s.DB().C("posts").Find(postSelector(PostKindPage, includeDrafts)).Sort("slug").All(&pages)
+    return pages, err
+}
+
+func (s *MongoStore) SavePost(post *Post) error {
+    // The unique index only covers current slugs
+    if post.Slug != "" {
+        n, err := s.DB().C("posts").Find(bson.M{"_id":bson.M{"$ne":post.Id}, "old_slugs":post.Slug}).Count()
+        if err != nil {
+            return mongoError(err)
+        }
+        if n > 0 {
+            return ErrDuplicate
+        }
+    }
+    _, err := s.DB().C("posts").UpsertId(post.Id, post)
+    return mongoError(err)
+}
+
+func (s *MongoStore) DeletePost(id bson.ObjectId) error {
+    return mongoError(s.DB().C("posts").RemoveId(id))
+}
+
+func (s *MongoStore) FindUserById(id bson.ObjectId) (*User, error) {
+    user := &User{}
+    err := s.DB().C("users").FindId(id).One(user)
+    if err != nil {
+        return nil, mongoError(err)
+    }
+    return user, nil
+}
+
+func (s *MongoStore) FindUserByEmail(email string) (*User, error) {
+    user := &User{}
+    err := s.DB().C("users").Find(bson.M{"email": email}).One(user)
+    if err != nil {
+        return nil, mongoError(err)
+    }
+    return user, nil
+}
+
+func (s *MongoStore) ListUsers() ([]User, error) {
+    var users []User
+    err := s.DB().C("users").Find(nil).All(&users)
+    return users, err
+}
+
+func (s *MongoStore) CountUsers() (int, error) {
+    return s.DB().C("users").Find(nil).Count()
+}
+
+func (s *MongoStore) SaveUser(user *User) error {
+    _, err := s.DB().C("users").UpsertId(user.Id, user)
+    return mongoError(err)
+}
+
+func (s *MongoStore) DeleteUser(id bson.ObjectId) error {
+    return mongoError(s.DB().C("users").RemoveId(id))
+}
+
+func (s *MongoStore) FindSessionById(id bson.ObjectId) (*Session, error) {
+    session := &Session{}
+    err := s.DB().C("sessions").FindId(id).One(session)
+    if err != nil {
+        return nil, mongoError(err)
+    }
+    return session, nil
+}
+
+func (s *MongoStore) FindSessionByTokenHash(hash string) (*Session, error) {
+    session := &Session{}
+    err := s.DB().C("sessions").Find(bson.M{"token": hash}).One(session)
+    if err != nil {
+        return nil, mongoError(err)
+    }
+    return session, nil
+}
+
+func (s *MongoStore) SaveSession(session *Session) error {
+    _, err := s.DB().C("sessions").UpsertId(session.Id, session)
+    return mongoError(err)
+}
+
+func (s *MongoStore) DeleteSession(id bson.ObjectId) error {
+    return mongoError(s.DB().C("sessions").RemoveId(id))
+}
+
+func (s *MongoStore) DeleteExpiredSessions(now time.Time, idleSince time.Time) (int, error) {
+    // Sessions from before they expired don't have the times at all, so $not
+    // is used to match them too
+    info, err := s.DB().C("sessions").RemoveAll(bson.M{"$or": []bson.M{
+        {"expiresAt": bson.M{"$not": bson.M{"$gt": now}}},
+        {"lastSeen":  bson.M{"$not": bson.M{"$gte": idleSince}}},
+    }})
+    if err != nil {
+        return 0, mongoError(err)
+    }
+    return info.Removed, nil
+}
+
+func (s *MongoStore) FindRevisionById(id bson.ObjectId) (*Revision, error) {
+    revision := &Revision{}
+    err := s.DB().C("revisions").FindId(id).One(revision)
+    if err != nil {
+        return nil, mongoError(err)
+    }
+    return revision, nil
+}
+
+func (s *MongoStore) ListRevisions(post bson.ObjectId) ([]Revision, error) {
+    var revisions []Revision
+    err := s.DB().C("revisions").Find(bson.M{"post": post}).Sort("-date", "-_id").All(&revisions)
+    return revisions, err
+}
+
+func (s *MongoStore) SaveRevision(revision *Revision) error {
+    _, err := s.DB().C("revisions").UpsertId(revision.Id, revision)
+    return mongoError(err)
+}
+
+func (s *MongoStore) DeleteRevision(id bson.ObjectId) error {
+    return mongoError(s.DB().C("revisions").RemoveId(id))
+}
+
+// gridFileInfo gets the FileInfo for an open GridFS file.
+func gridFileInfo(file *mgo.GridFile) (*FileInfo) {
+    return &FileInfo{Id:         file.Id().(bson.ObjectId),
+                     Name:       file.Name(),
+                     UploadDate: file.UploadDate(),
+                     Size:       file.Size()}
+}
+
+func (s *MongoStore) CreateFile(name string, data io.Reader) (*FileInfo, error) {
+    out, err := s.DB().GridFS("fs").Create(name)
+    if err != nil {
+        return nil, err
+    }
+
+    _, err = io.Copy(out, data)
+    if err != nil {
+        out.Abort()
+        out.Close()
+        return nil, err
+    }
+
+    // The upload date and size are only final once the file is closed
+    err = out.Close()
+    if err != nil {
+        return nil, err
+    }
+    return gridFileInfo(out), nil
+}
+
+func (s *MongoStore) OpenFile(id bson.ObjectId) (*FileInfo, io.ReadCloser, error) {
+    file, err := s.DB().GridFS("fs").OpenId(id)
+    if err != nil {
+        return nil, nil, mongoError(err)
+    }
+    return gridFileInfo(file), file, nil
+}
+
+func (s *MongoStore) FindFileInfoById(id bson.ObjectId) (*FileInfo, error) {
+    file, err := s.DB().GridFS("fs").OpenId(id)
+    if err != nil {
+        return nil, mongoError(err)
+    }
+    defer file.Close()
+    return gridFileInfo(file), nil
+}
+
+func (s *MongoStore) DeleteFile(id bson.ObjectId) error {
+    return mongoError(s.DB().GridFS("fs").RemoveId(id))
+}
+
+// SchemaVersion gets the schema version from the meta collection. A database
+// without one is at version 0.
+func (s *MongoStore) SchemaVersion() (int, error) {
+    doc := struct {
+        Version int `bson:"version"`
+    }{}
+    err := s.DB().C("meta").FindId("schema").One(&doc)
+    if err == mgo.ErrNotFound {
+        return 0, nil
+    }
+    return doc.Version, err
+}
+
+func (s *MongoStore) SetSchemaVersion(version int) error {
+    _, err := s.DB().C("meta").UpsertId("schema", bson.M{"version": version})
+    return err
+}
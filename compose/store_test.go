@@ -0,0 +1,346 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "gopkg.in/mgo.v2/bson"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+// testStore runs the same checks against any Store implementation.
+func testStore(t *testing.T, s Store) {
+    // Posts
+    now := time.Now()
+    var ids []bson.ObjectId
+    for i, slug := range []string{"a", "b", "c"} {
+        post, _ := CreatePost()
+        post.Slug = slug
+        post.Draft = slug == "b"
+        post.Date = now.Add(time.Duration(i - 3) * time.Hour)
+        post.Files = []bson.ObjectId{bson.NewObjectId()}
+        post.Tags = []string{"all", "tag-" + slug}
+        if err := s.SavePost(post); err != nil {
+            t.Fatal("SavePost:", err)
+        }
+        ids = append(ids, post.Id)
+    }
+
+    post, err := s.FindPostBySlug("b")
+    if err != nil || post.Id != ids[1] || len(post.Files) != 1 {
+        t.Errorf("FindPostBySlug: got %+v, %v", post, err)
+    }
+    if _, err := s.FindPostBySlug("missing"); err != ErrNotFound {
+        t.Errorf("FindPostBySlug: expected ErrNotFound, got %v", err)
+    }
+    post, err = s.FindPostById(ids[0])
+    if err != nil || post.Slug != "a" {
+        t.Errorf("FindPostById: got %+v, %v", post, err)
+    }
+
+    // Scheduled posts are only listed with drafts
+    scheduled, _ := CreatePost()
+    scheduled.Slug = "scheduled"
+    scheduled.Draft = false
+    scheduled.Date = now.Add(time.Hour)
+    scheduled.Tags = []string{"all"}
+    if err := s.SavePost(scheduled); err != nil {
+        t.Fatal("SavePost:", err)
+    }
+    if n, _ := s.CountPosts(false); n != 2 {
+        t.Errorf("CountPosts(false) with a scheduled post: expected 2, got %d", n)
+    }
+    if n, _ := s.CountPostsByTag("all", false); n != 2 {
+        t.Errorf("CountPostsByTag(all, false) with a scheduled post: expected 2, got %d", n)
+    }
+    if posts, _ := s.ListPosts(0, 0, true); len(posts) != 4 || posts[0].Slug != "scheduled" {
+        t.Errorf("ListPosts(0, 0, true) with a scheduled post: got %v", posts)
+    }
+    s.DeletePost(scheduled.Id)
+
+    // Changing a returned post must not change the stored post
+    post.Files[0] = bson.NewObjectId()
+    post.Slug = "changed"
+    if again, _ := s.FindPostById(ids[0]); again.Slug != "a" || again.Files[0] == post.Files[0] {
+        t.Error("Stored post was modified without SavePost")
+    }
+
+    if n, _ := s.CountPosts(true); n != 3 {
+        t.Errorf("CountPosts(true): expected 3, got %d", n)
+    }
+    if n, _ := s.CountPosts(false); n != 2 {
+        t.Errorf("CountPosts(false): expected 2, got %d", n)
+    }
+    posts, err := s.ListPosts(0, 0, true)
+    if err != nil || len(posts) != 3 || posts[0].Slug != "c" || posts[2].Slug != "a" {
+        t.Errorf("ListPosts(0, 0, true): got %v, %v", posts, err)
+    }
+    posts, _ = s.ListPosts(1, 1, false)
+    if len(posts) != 1 || posts[0].Slug != "a" {
+        t.Errorf("ListPosts(1, 1, false): got %v", posts)
+    }
+    posts, _ = s.ListPosts(5, 1, false)
+    if len(posts) != 0 {
+        t.Errorf("ListPosts(5, 1, false): got %v", posts)
+    }
+    headers, _ := s.ListPostHeaders(0, 2, true)
+    if len(headers) != 2 || headers[0].Slug != "c" || headers[1].Slug != "b" {
+        t.Errorf("ListPostHeaders(0, 2, true): got %v", headers)
+    }
+
+    // Tags
+    posts, err = s.ListPostsByTag("all", 0, 0, true)
+    if err != nil || len(posts) != 3 || posts[0].Slug != "c" {
+        t.Errorf("ListPostsByTag(all, 0, 0, true): got %v, %v", posts, err)
+    }
+    posts, _ = s.ListPostsByTag("tag-b", 0, 0, false)
+    if len(posts) != 0 {
+        t.Errorf("ListPostsByTag(tag-b, 0, 0, false): got %v", posts)
+    }
+    headers, _ = s.ListPostHeadersByTag("all", 1, 1, false)
+    if len(headers) != 1 || headers[0].Slug != "a" {
+        t.Errorf("ListPostHeadersByTag(all, 1, 1, false): got %v", headers)
+    }
+    if n, _ := s.CountPostsByTag("all", false); n != 2 {
+        t.Errorf("CountPostsByTag(all, false): expected 2, got %d", n)
+    }
+    tags, err := s.CountTags(false)
+    expected := []TagCount{{"all", 2}, {"tag-a", 1}, {"tag-c", 1}}
+    if err != nil || !reflect.DeepEqual(tags, expected) {
+        t.Errorf("CountTags(false): got %v, %v", tags, err)
+    }
+    if tags, _ := s.CountTags(true); len(tags) != 4 || tags[0].Count != 3 {
+        t.Errorf("CountTags(true): got %v", tags)
+    }
+
+    // Slugs are unique, but any number of posts can have no slug
+    dup, _ := CreatePost()
+    dup.Slug = "c"
+    if err := s.SavePost(dup); err != ErrDuplicate {
+        t.Errorf("SavePost with a duplicate slug: expected ErrDuplicate, got %v", err)
+    }
+    for i := 0; i < 2; i++ {
+        empty, _ := CreatePost()
+        if err := s.SavePost(empty); err != nil {
+            t.Errorf("SavePost with an empty slug: %v", err)
+        }
+        s.DeletePost(empty.Id)
+    }
+
+    // Nor can a post take a slug another post used to have
+    post, _ = s.FindPostById(ids[2])
+    post.OldSlugs = []string{"old-c"}
+    if err := s.SavePost(post); err != nil {
+        t.Error("SavePost with old slugs:", err)
+    }
+    if post, err := s.FindPostByOldSlug("old-c"); err != nil || post.Id != ids[2] {
+        t.Errorf("FindPostByOldSlug: got %+v, %v", post, err)
+    }
+    if _, err := s.FindPostByOldSlug("c"); err != ErrNotFound {
+        t.Errorf("FindPostByOldSlug: expected ErrNotFound, got %v", err)
+    }
+    dup.Slug = "old-c"
+    if err := s.SavePost(dup); err != ErrDuplicate {
+        t.Errorf("SavePost with another post's old slug: expected ErrDuplicate, got %v", err)
+    }
+
+    if err := s.DeletePost(ids[0]); err != nil {
+        t.Error("DeletePost:", err)
+    }
+    if _, err := s.FindPostById(ids[0]); err != ErrNotFound {
+        t.Errorf("FindPostById after delete: expected ErrNotFound, got %v", err)
+    }
+
+    // Users
+    if n, _ := s.CountUsers(); n != 0 {
+        t.Errorf("CountUsers: expected 0, got %d", n)
+    }
+    user, _ := CreateUser()
+    user.Email = "someone@example.com"
+    user.RecoveryCodes = []string{"code-1", "code-2"}
+    if err := s.SaveUser(user); err != nil {
+        t.Fatal("SaveUser:", err)
+    }
+
+    // Changing a user doesn't change the stored one until it's saved
+    user.RecoveryCodes[0] = "changed"
+    if found, err := s.FindUserById(user.Id); err != nil || found.RecoveryCodes[0] != "code-1" {
+        t.Errorf("FindUserById after a change: got %+v, %v", found, err)
+    } else {
+        found.RecoveryCodes[0] = "changed"
+    }
+    if found, err := s.FindUserByEmail(user.Email); err != nil || found.RecoveryCodes[0] != "code-1" {
+        t.Errorf("FindUserByEmail after a change: got %+v, %v", found, err)
+    }
+    if found, err := s.FindUserByEmail("someone@example.com"); err != nil || found.Id != user.Id {
+        t.Errorf("FindUserByEmail: got %+v, %v", found, err)
+    }
+    if _, err := s.FindUserByEmail("nobody@example.com"); err != ErrNotFound {
+        t.Errorf("FindUserByEmail: expected ErrNotFound, got %v", err)
+    }
+    if found, err := s.FindUserById(user.Id); err != nil || found.Email != user.Email {
+        t.Errorf("FindUserById: got %+v, %v", found, err)
+    }
+    if n, _ := s.CountUsers(); n != 1 {
+        t.Errorf("CountUsers: expected 1, got %d", n)
+    }
+    other, _ := CreateUser()
+    other.Email = user.Email
+    if err := s.SaveUser(other); err != ErrDuplicate {
+        t.Errorf("SaveUser with a duplicate email: expected ErrDuplicate, got %v", err)
+    }
+
+    // Sessions, which get their lifetime from the config
+    config = &Config{SessionMaxDays: 30, SessionIdleHours: 72}
+    session, _ := CreateSession(user)
+    if err := s.SaveSession(session); err != nil {
+        t.Fatal("SaveSession:", err)
+    }
+    if found, err := s.FindSessionByTokenHash(session.TokenHash); err != nil || found.Id != session.Id || found.Token != "" {
+        t.Errorf("FindSessionByTokenHash: got %+v, %v", found, err)
+    }
+    if found, err := s.FindSessionById(session.Id); err != nil || found.User != user.Id {
+        t.Errorf("FindSessionById: got %+v, %v", found, err)
+    }
+    if _, err := s.FindSessionByTokenHash("missing"); err != ErrNotFound {
+        t.Errorf("FindSessionByTokenHash: expected ErrNotFound, got %v", err)
+    }
+
+    // Expired sessions are swept, along with ones that have been idle
+    idle, _ := CreateSession(user)
+    idle.LastSeen = now.Add(-2 * time.Hour)
+    s.SaveSession(idle)
+    expired, _ := CreateSession(user)
+    expired.ExpiresAt = now
+    s.SaveSession(expired)
+    if n, err := s.DeleteExpiredSessions(now, now.Add(-time.Hour)); n != 2 || err != nil {
+        t.Errorf("DeleteExpiredSessions: expected 2, got %d, %v", n, err)
+    }
+    if _, err := s.FindSessionById(session.Id); err != nil {
+        t.Errorf("DeleteExpiredSessions deleted a live session: %v", err)
+    }
+    if _, err := s.FindSessionById(idle.Id); err != ErrNotFound {
+        t.Errorf("DeleteExpiredSessions: expected the idle session to be gone, got %v", err)
+    }
+    if err := s.DeleteSession(session.Id); err != nil {
+        t.Error("DeleteSession:", err)
+    }
+    if _, err := s.FindSessionById(session.Id); err != ErrNotFound {
+        t.Errorf("FindSessionById after delete: expected ErrNotFound, got %v", err)
+    }
+
+    // Pages are only listed by ListPages
+    for _, slug := range []string{"contact", "about", "about/me"} {
+        page, _ := CreatePage()
+        page.Slug = slug
+        page.Draft = slug == "contact"
+        page.Date = now.Add(-time.Hour)
+        if err := s.SavePost(page); err != nil {
+            t.Fatal("SavePost:", err)
+        }
+    }
+    pages, err := s.ListPages(true)
+    if err != nil || len(pages) != 3 || pages[0].Slug != "about" || pages[1].Slug != "about/me" || pages[2].Slug != "contact" {
+        t.Errorf("ListPages(true): got %v, %v", pages, err)
+    }
+    if pages, _ := s.ListPages(false); len(pages) != 2 {
+        t.Errorf("ListPages(false): got %v", pages)
+    }
+    if n, _ := s.CountPosts(true); n != 2 {
+        t.Errorf("CountPosts(true) with pages: expected 2, got %d", n)
+    }
+    if page, err := s.FindPostBySlug("about/me"); err != nil || !page.IsPage() {
+        t.Errorf("FindPostBySlug for a page: got %+v, %v", page, err)
+    }
+
+    // Revisions
+    for i, body := range []string{"old", "new"} {
+        revision := &Revision{Id: bson.NewObjectId(), Post: ids[1], Date: now.Add(time.Duration(i) * time.Minute), Body: body}
+        if err := s.SaveRevision(revision); err != nil {
+            t.Fatal("SaveRevision:", err)
+        }
+    }
+    latest := &Revision{Id: bson.NewObjectId(), Post: ids[2], Date: now}
+    s.SaveRevision(latest)
+    revisions, err := s.ListRevisions(ids[1])
+    if err != nil || len(revisions) != 2 || revisions[0].Body != "new" || revisions[1].Body != "old" {
+        t.Errorf("ListRevisions: got %+v, %v", revisions, err)
+    }
+    if found, err := s.FindRevisionById(latest.Id); err != nil || found.Post != ids[2] {
+        t.Errorf("FindRevisionById: got %+v, %v", found, err)
+    }
+    if err := s.DeleteRevision(latest.Id); err != nil {
+        t.Error("DeleteRevision:", err)
+    }
+    if _, err := s.FindRevisionById(latest.Id); err != ErrNotFound {
+        t.Errorf("FindRevisionById after delete: expected ErrNotFound, got %v", err)
+    }
+
+    // Files
+    info, err := s.CreateFile("hello.txt", strings.NewReader("hello, world"))
+    if err != nil {
+        t.Fatal("CreateFile:", err)
+    }
+    if info.Name != "hello.txt" || info.Size != 12 {
+        t.Errorf("CreateFile: got %+v", info)
+    }
+    found, file, err := s.OpenFile(info.Id)
+    if err != nil {
+        t.Fatal("OpenFile:", err)
+    }
+    contents, _ := ioutil.ReadAll(file)
+    file.Close()
+    if found.Name != "hello.txt" || string(contents) != "hello, world" {
+        t.Errorf("OpenFile: got %+v with contents %q", found, contents)
+    }
+    if found, err := s.FindFileInfoById(info.Id); err != nil || found.Size != 12 {
+        t.Errorf("FindFileInfoById: got %+v, %v", found, err)
+    }
+    if err := s.DeleteFile(info.Id); err != nil {
+        t.Error("DeleteFile:", err)
+    }
+    if _, _, err := s.OpenFile(info.Id); err != ErrNotFound {
+        t.Errorf("OpenFile after delete: expected ErrNotFound, got %v", err)
+    }
+    if err := s.DeleteFile(info.Id); err != ErrNotFound {
+        t.Errorf("DeleteFile after delete: expected ErrNotFound, got %v", err)
+    }
+}
+
+func TestMemoryStore(t *testing.T) {
+    testStore(t, NewMemoryStore())
+}
+
+func TestBoltStore(t *testing.T) {
+    dir, err := ioutil.TempDir("", "compose")
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer os.RemoveAll(dir)
+
+    s, err := OpenBoltStore(filepath.Join(dir, "compose.db"))
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer s.Close()
+    testStore(t, s)
+}
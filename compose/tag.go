@@ -0,0 +1,120 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "github.com/zenazn/goji/web"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+)
+
+// TagCount is a tag and the number of posts that have it.
+type TagCount struct {
+    Tag   string `json:"tag"   bson:"_id"`
+    Count int    `json:"count" bson:"count"`
+}
+
+// ListPostsByTag will return a slice of limit reverse-chronologicaly ordered
+// posts with the given tag, starting from start and optionally including
+// drafts.
+func ListPostsByTag(tag string, start int, limit int, includeDrafts bool) ([]Post, error) {
+    return GetStore().ListPostsByTag(tag, start, limit, includeDrafts)
+}
+
+// ListPostHeadersByTag is like ListPostsByTag, without the post bodies.
+func ListPostHeadersByTag(tag string, start int, limit int, includeDrafts bool) ([]PostHeader, error) {
+    return GetStore().ListPostHeadersByTag(tag, start, limit, includeDrafts)
+}
+
+// CountPostsByTag counts the posts with the given tag, optionally including
+// drafts.
+func CountPostsByTag(tag string, includeDrafts bool) (int, error) {
+    return GetStore().CountPostsByTag(tag, includeDrafts)
+}
+
+// CountTags lists every tag with the number of posts that have it, most used
+// first.
+func CountTags(includeDrafts bool) ([]TagCount, error) {
+    return GetStore().CountTags(includeDrafts)
+}
+
+// NormalizeTags tidies up tags entered by hand. Space around tags, empty tags
+// and repeats are removed. Tags are part of URLs, so slashes become dashes,
+// and tags that are only dots, such as "..", are removed.
+func NormalizeTags(tags []string) ([]string) {
+    seen := make(map[string]bool)
+    out := []string{}
+    for _, tag := range tags {
+        tag = strings.TrimSpace(strings.Replace(tag, "/", "-", -1))
+        if IsValidTag(tag) && !seen[tag] {
+            seen[tag] = true
+            out = append(out, tag)
+        }
+    }
+    return out
+}
+
+// IsValidTag checks if a tag can be used as a path segment. The static build
+// writes each tag to a directory of its own, so "." and ".." would land
+// outside of it.
+func IsValidTag(tag string) (bool) {
+    return strings.Trim(tag, ".") != "" && !strings.Contains(tag, "/")
+}
+
+// TagUrl is the URL of the archive page for a tag.
+func TagUrl(tag string) (string) {
+    return "/tag/" + url.PathEscape(tag)
+}
+
+// TagHandler is the handler for the archive pages of a tag. They are
+// paginated the same way as the index.
+func TagHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+    tag := c.URLParams["tag"]
+    page := 1
+    if c.URLParams["page"] != "" {
+        desiredPage, err := strconv.Atoi(c.URLParams["page"])
+        if err != nil {
+            http.NotFound(w, r)
+            return
+        }
+        page = desiredPage
+    }
+
+    numPages, err := IndexPageCount(tag)
+    if err != nil {
+        panic(err)
+    }
+
+    // Unknown tags have no pages at all
+    if numPages == 0 || page < 1 || page > numPages {
+        http.NotFound(w, r)
+        return
+    }
+
+    v, err := IndexPageValues(tag, page, numPages)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+
+    err = SiteTemplates.ExecuteTemplate(w, "tag.html", v)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+    }
+}
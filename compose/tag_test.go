@@ -0,0 +1,188 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "encoding/xml"
+    "net/http"
+    "reflect"
+    "strings"
+    "testing"
+    "time"
+)
+
+// createTaggedPost saves a new post like createTestPost, with tags.
+func createTaggedPost(t *testing.T, slug string, draft bool, age time.Duration, tags ...string) (*Post) {
+    post := createTestPost(t, slug, draft, age)
+    post.Tags = tags
+    _, err := post.Save()
+    if err != nil {
+        t.Fatal("Failed to save post:", err)
+    }
+    return post
+}
+
+func TestNormalizeTags(t *testing.T) {
+    tags := NormalizeTags([]string{" go ", "", "web", "go", "a/b", "  ", "..", ".", " ... ", ".net"})
+    expected := []string{"go", "web", "a-b", ".net"}
+    if !reflect.DeepEqual(tags, expected) {
+        t.Errorf("Expected %v, got %v", expected, tags)
+    }
+    if tags := NormalizeTags(nil); tags == nil || len(tags) != 0 {
+        t.Errorf("Expected an empty slice, got %#v", tags)
+    }
+}
+
+func TestTagUrl(t *testing.T) {
+    if url := TagUrl("c sharp"); url != "/tag/c%20sharp" {
+        t.Errorf("Wrong URL %s", url)
+    }
+}
+
+func TestTagPages(t *testing.T) {
+    m := setupTestServer(t)
+    for i, slug := range []string{"one", "two", "three"} {
+        createTaggedPost(t, slug, false, time.Duration(i) * time.Hour, "go")
+    }
+    createTaggedPost(t, "other", false, 0, "web")
+    createTaggedPost(t, "draft", true, 0, "go", "secret")
+
+    // 3 published posts at 2 per page is 2 pages
+    tests := []struct {
+        path   string
+        status int
+        has    []string
+        hasNot []string
+    }{
+        {"/tag/go",   http.StatusOK,       []string{"/one", "/two", `href="/tag/go/2"`, "/tag/go/feed.xml"}, []string{"/three", "/other", "/draft"}},
+        {"/tag/go/2", http.StatusOK,       []string{"/three", `href="/tag/go"`}, []string{"/two", `href="/tag/go/3"`}},
+        {"/tag/go/3", http.StatusNotFound, nil, nil},
+        {"/tag/go/0", http.StatusNotFound, nil, nil},
+        {"/tag/web",  http.StatusOK,       []string{"/other"}, []string{"/one"}},
+        {"/tag/secret", http.StatusNotFound, nil, nil},
+        {"/tag/missing", http.StatusNotFound, nil, nil},
+    }
+
+    for _, test := range tests {
+        w := doRequest(m, "GET", test.path, nil, nil)
+        if w.Code != test.status {
+            t.Errorf("GET %s: expected status %d, got %d", test.path, test.status, w.Code)
+            continue
+        }
+        body := w.Body.String()
+        for _, s := range test.has {
+            if !strings.Contains(body, s) {
+                t.Errorf("GET %s: expected body to contain %q", test.path, s)
+            }
+        }
+        for _, s := range test.hasNot {
+            if strings.Contains(body, s) {
+                t.Errorf("GET %s: expected body not to contain %q", test.path, s)
+            }
+        }
+    }
+
+    // The index lists tags with their counts, and posts link to their tags
+    w := doRequest(m, "GET", "/", nil, nil)
+    if body := w.Body.String(); !strings.Contains(body, `href="/tag/go"`) || strings.Contains(body, "/tag/secret") {
+        t.Errorf("Wrong tag list on the index: %s", body)
+    }
+    w = doRequest(m, "GET", "/other", nil, nil)
+    if !strings.Contains(w.Body.String(), `href="/tag/web"`) {
+        t.Errorf("Post doesn't link to its tags: %s", w.Body.String())
+    }
+}
+
+func TestTagFeed(t *testing.T) {
+    m := setupTestServer(t)
+    config.SiteUrl = "http://blog.example.com"
+    createTaggedPost(t, "one", false, time.Hour, "go")
+    createTaggedPost(t, "two", false, 0, "web")
+
+    w := doRequest(m, "GET", "/tag/go/feed.xml", nil, nil)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    var rss struct {
+        Channel struct {
+            Title string `xml:"title"`
+            Items []struct {
+                Link string `xml:"link"`
+            } `xml:"item"`
+        } `xml:"channel"`
+    }
+    err := xml.Unmarshal(w.Body.Bytes(), &rss)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if rss.Channel.Title != "Test Blog: go" || !strings.Contains(w.Body.String(), "<link>http://blog.example.com/tag/go</link>") {
+        t.Errorf("Wrong channel: %s", w.Body.String())
+    }
+    if len(rss.Channel.Items) != 1 || rss.Channel.Items[0].Link != "http://blog.example.com/one" {
+        t.Errorf("Wrong items: %+v", rss.Channel.Items)
+    }
+
+    for _, path := range []string{"/tag/go/atom.xml", "/tag/go/feed.json"} {
+        w = doRequest(m, "GET", path, nil, nil)
+        if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "/one") || strings.Contains(w.Body.String(), "/two") {
+            t.Errorf("GET %s: wrong feed %d %s", path, w.Code, w.Body.String())
+        }
+    }
+}
+
+func TestApiTags(t *testing.T) {
+    m := setupTestServer(t)
+    cookie := loginTestUser(t)
+    createTaggedPost(t, "one", false, time.Hour, "go", "web")
+    createTaggedPost(t, "two", false, 0, "go")
+    draft := createTaggedPost(t, "draft", true, 0, "draft")
+
+    // Tags are tidied up when a post is saved
+    draft.Tags = []string{" go ", "go", "", "a/b"}
+    payload, _ := json.Marshal(draft)
+    w := doRequest(m, "PUT", "/api/post/" + draft.Id.Hex(), bytes.NewReader(payload), cookie)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    saved, _ := FindPostById(draft.Id)
+    if !reflect.DeepEqual(saved.Tags, []string{"go", "a-b"}) {
+        t.Errorf("Tags not normalized: %v", saved.Tags)
+    }
+
+    // Drafts are counted
+    w = doRequest(m, "GET", "/api/tags", nil, cookie)
+    var tags []TagCount
+    json.Unmarshal(w.Body.Bytes(), &tags)
+    expected := []TagCount{{"go", 3}, {"a-b", 1}, {"web", 1}}
+    if !reflect.DeepEqual(tags, expected) {
+        t.Errorf("Expected %v, got %v", expected, tags)
+    }
+
+    w = doRequest(m, "GET", "/api/posts?tag=web", nil, cookie)
+    var headers []PostHeader
+    json.Unmarshal(w.Body.Bytes(), &headers)
+    if len(headers) != 1 || headers[0].Slug != "one" {
+        t.Errorf("Wrong posts for tag: %v", headers)
+    }
+    w = doRequest(m, "GET", "/api/posts?tag=go", nil, cookie)
+    json.Unmarshal(w.Body.Bytes(), &headers)
+    if len(headers) != 3 {
+        t.Errorf("Wrong posts for tag: %v", headers)
+    }
+}
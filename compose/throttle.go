@@ -0,0 +1,326 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "github.com/zenazn/goji/web"
+    "math"
+    "net"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+    "time"
+)
+
+// LoginFailures counts the failed logins from one client IP address, or for
+// one account. Attempts are refused until RetryAt.
+type LoginFailures struct {
+    Key         string    `json:"key"`
+    Kind        string    `json:"kind"`
+    Value       string    `json:"value"`
+    Failures    int       `json:"failures"`
+    LastFailure time.Time `json:"last_failure"`
+    RetryAt     time.Time `json:"retry_at"`
+    Locked      bool      `json:"locked"`
+}
+
+// LoginThrottle slows down password guessing. After LoginFreeAttempts failed
+// logins, each attempt has to wait twice as long as the one before, starting
+// at LoginBackoffSeconds. After LoginMaxAttempts failures, the IP address or
+// account is locked out for LoginLockoutMinutes. Failures are forgotten once
+// LoginLockoutMinutes pass without another one, or when a login succeeds.
+// Nothing is saved, so restarting the server clears everything.
+type LoginThrottle struct {
+    mutex   sync.Mutex
+    records map[string]*LoginFailures
+    pruned  time.Time
+}
+
+var loginThrottle = &LoginThrottle{}
+
+// LoginThrottleMaxRecords caps how many IP addresses and accounts are kept
+// track of. Accounts come from whatever e-mail is typed in, so once there are
+// this many, the least recent failures are forgotten to make room.
+const LoginThrottleMaxRecords = 10000
+
+// loginPruneInterval is how often old failures are looked for.
+const loginPruneInterval = time.Minute
+
+// LoginThrottleKeys gets the keys a login attempt is counted under.
+func LoginThrottleKeys(r *http.Request, email string) ([]string) {
+    return []string{
+        "ip:" + ClientIp(r),
+        "account:" + strings.ToLower(strings.TrimSpace(email)),
+    }
+}
+
+// loginLockout gets how long the lockout lasts.
+func loginLockout() (time.Duration) {
+    return time.Duration(config.LoginLockoutMinutes) * time.Minute
+}
+
+// Attempt starts a login attempt under the keys. If any of them has to wait,
+// how much longer is returned and nothing is counted. Otherwise the attempt
+// is counted as a failure straight away, so guesses made at the same time all
+// count before the slow password check is done. Call Succeed if it works.
+func (t *LoginThrottle) Attempt(keys []string, now time.Time) (time.Duration) {
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+
+    if wait := t.wait(keys, now); wait > 0 {
+        return wait
+    }
+    t.fail(keys, now)
+    return 0
+}
+
+// Wait gets how much longer attempts under any of the keys have to wait.
+func (t *LoginThrottle) Wait(keys []string, now time.Time) (time.Duration) {
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+    return t.wait(keys, now)
+}
+
+// wait is Wait, for when the mutex is held.
+func (t *LoginThrottle) wait(keys []string, now time.Time) (time.Duration) {
+    var wait time.Duration
+    for _, key := range keys {
+        if record, ok := t.records[key]; ok && record.RetryAt.Sub(now) > wait {
+            wait = record.RetryAt.Sub(now)
+        }
+    }
+    return wait
+}
+
+// Fail counts a failed login under each of the keys. Nothing is counted if
+// LoginMaxAttempts is 0.
+func (t *LoginThrottle) Fail(keys []string, now time.Time) {
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+    t.fail(keys, now)
+}
+
+// fail is Fail, for when the mutex is held.
+func (t *LoginThrottle) fail(keys []string, now time.Time) {
+    if config.LoginMaxAttempts <= 0 {
+        return
+    }
+    if t.records == nil {
+        t.records = make(map[string]*LoginFailures)
+    }
+    if now.Sub(t.pruned) >= loginPruneInterval || len(t.records) >= LoginThrottleMaxRecords {
+        t.prune(now)
+    }
+
+    for _, key := range keys {
+        record, ok := t.records[key]
+        if !ok {
+            if len(t.records) >= LoginThrottleMaxRecords {
+                t.forgetOldest()
+            }
+            parts := strings.SplitN(key, ":", 2)
+            record = &LoginFailures{Key: key, Kind: parts[0], Value: parts[1]}
+            t.records[key] = record
+        }
+        record.Failures += 1
+        record.LastFailure = now
+        record.schedule()
+    }
+}
+
+// schedule works out when the next attempt can be made, from the number of
+// failures and when the last one was.
+func (record *LoginFailures) schedule() {
+    var delay time.Duration
+    record.Locked = record.Failures >= config.LoginMaxAttempts
+    if record.Locked {
+        delay = loginLockout()
+    } else if record.Failures >= config.LoginFreeAttempts {
+        backoff := math.Pow(2, float64(record.Failures - config.LoginFreeAttempts))
+        delay = time.Duration(backoff * float64(config.LoginBackoffSeconds)) * time.Second
+        if delay > loginLockout() {
+            delay = loginLockout()
+        }
+    }
+    record.RetryAt = record.LastFailure.Add(delay)
+}
+
+// Release takes back an attempt that was neither a failure nor a finished
+// login, such as the right password when a one-time code is needed too.
+func (t *LoginThrottle) Release(keys []string) {
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+
+    for _, key := range keys {
+        record, ok := t.records[key]
+        if !ok {
+            continue
+        }
+        record.Failures -= 1
+        if record.Failures <= 0 {
+            delete(t.records, key)
+        } else {
+            record.schedule()
+        }
+    }
+}
+
+// Succeed forgets the failures under each of the keys.
+func (t *LoginThrottle) Succeed(keys []string) {
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+
+    for _, key := range keys {
+        delete(t.records, key)
+    }
+}
+
+// List lists the failures that haven't been forgotten yet, the most recent
+// first.
+func (t *LoginThrottle) List(now time.Time) ([]LoginFailures) {
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+
+    t.prune(now)
+    list := []LoginFailures{}
+    for _, record := range t.records {
+        list = append(list, *record)
+    }
+    sort.Sort(failuresByRecent(list))
+    return list
+}
+
+// Clear forgets the failures under a key. All of them are forgotten if the
+// key is empty. It returns false if there was nothing to forget.
+func (t *LoginThrottle) Clear(key string) (bool) {
+    t.mutex.Lock()
+    defer t.mutex.Unlock()
+
+    if key == "" {
+        t.records = nil
+        return true
+    }
+    _, ok := t.records[key]
+    delete(t.records, key)
+    return ok
+}
+
+// failuresByRecent sorts failures, the most recent first.
+type failuresByRecent []LoginFailures
+
+func (f failuresByRecent) Len() int           { return len(f) }
+func (f failuresByRecent) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f failuresByRecent) Less(i, j int) bool { return f[i].LastFailure.After(f[j].LastFailure) }
+
+// prune forgets failures that are old enough. The mutex must be held.
+func (t *LoginThrottle) prune(now time.Time) {
+    for key, record := range t.records {
+        if now.After(record.RetryAt) && now.Sub(record.LastFailure) > loginLockout() {
+            delete(t.records, key)
+        }
+    }
+    t.pruned = now
+}
+
+// forgetOldest forgets the least recent failures, to make room for new ones.
+// The mutex must be held.
+func (t *LoginThrottle) forgetOldest() {
+    var oldest *LoginFailures
+    for _, record := range t.records {
+        if oldest == nil || record.LastFailure.Before(oldest.LastFailure) {
+            oldest = record
+        }
+    }
+    if oldest != nil {
+        delete(t.records, oldest.Key)
+    }
+}
+
+// WriteTooManyLogins refuses a login attempt that has to wait.
+func WriteTooManyLogins(w http.ResponseWriter, wait time.Duration) {
+    seconds := int(math.Ceil(wait.Seconds()))
+    w.Header().Set("Retry-After", strconv.Itoa(seconds))
+    http.Error(w, "Too many failed logins. Try again in " + strconv.Itoa(seconds) + " seconds.", http.StatusTooManyRequests)
+}
+
+// ClientIp gets the IP address of the client making a request. The
+// X-Forwarded-For header is only believed when the request comes from one of
+// the TrustedProxies, and only as far back as the proxies go.
+func ClientIp(r *http.Request) (string) {
+    ip, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        ip = r.RemoteAddr
+    }
+    if !isTrustedProxy(ip) {
+        return ip
+    }
+
+    // Each proxy adds the address it got the request from, so walk back from
+    // the end until an address isn't one of ours
+    forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+    for i := len(forwarded) - 1; i >= 0; i-- {
+        addr := strings.TrimSpace(forwarded[i])
+        if net.ParseIP(addr) == nil {
+            break
+        }
+        ip = addr
+        if !isTrustedProxy(addr) {
+            break
+        }
+    }
+    return ip
+}
+
+// isTrustedProxy checks if an IP address is in the TrustedProxies, which can
+// be addresses or CIDR ranges.
+func isTrustedProxy(addr string) (bool) {
+    ip := net.ParseIP(addr)
+    if ip == nil {
+        return false
+    }
+    for _, proxy := range config.TrustedProxies {
+        if _, network, err := net.ParseCIDR(proxy); err == nil {
+            if network.Contains(ip) {
+                return true
+            }
+        } else if other := net.ParseIP(proxy); other != nil && other.Equal(ip) {
+            return true
+        }
+    }
+    return false
+}
+
+// ApiListLockouts is a handler to list the IP addresses and accounts with
+// failed logins.
+func ApiListLockouts(c web.C, w http.ResponseWriter, r *http.Request) {
+    WriteJson(w, loginThrottle.List(time.Now()))
+}
+
+// ApiClearLockouts is a handler to forget every failed login.
+func ApiClearLockouts(c web.C, w http.ResponseWriter, r *http.Request) {
+    loginThrottle.Clear("")
+}
+
+// ApiClearLockout is a handler to forget the failed logins from an IP address
+// or for an account.
+func ApiClearLockout(c web.C, w http.ResponseWriter, r *http.Request) {
+    if c.URLParams["key"] == "" || !loginThrottle.Clear(c.URLParams["key"]) {
+        http.NotFound(w, r)
+    }
+}
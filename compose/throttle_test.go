@@ -0,0 +1,184 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/url"
+    "strconv"
+    "strings"
+    "testing"
+    "time"
+)
+
+func TestLoginThrottleBackoff(t *testing.T) {
+    setupTestServer(t)
+    keys := []string{"ip:192.0.2.1", "account:admin@example.com"}
+    now := time.Now()
+
+    // The first few failures are free
+    for i := 0; i < 3; i++ {
+        if wait := loginThrottle.Wait(keys, now); wait != 0 {
+            t.Fatalf("Failure %d: expected no wait, got %v", i, wait)
+        }
+        loginThrottle.Fail(keys, now)
+    }
+
+    // Then each one waits twice as long
+    for _, expected := range []time.Duration{1, 2, 4, 8, 16, 32, 64} {
+        if wait := loginThrottle.Wait(keys, now); wait != expected * time.Second {
+            t.Fatalf("Expected to wait %v, got %v", expected * time.Second, wait)
+        }
+        now = now.Add(expected * time.Second)
+        loginThrottle.Fail(keys, now)
+    }
+
+    // Until it's a lockout
+    if wait := loginThrottle.Wait(keys, now); wait != 15 * time.Minute {
+        t.Errorf("Expected a lockout of 15m, got %v", wait)
+    }
+    if list := loginThrottle.List(now); len(list) != 2 || !list[0].Locked || list[0].Failures != 10 {
+        t.Errorf("Expected 2 lockouts, got %+v", list)
+    }
+
+    // Which is forgotten once it's over
+    now = now.Add(16 * time.Minute)
+    if wait := loginThrottle.Wait(keys, now); wait != 0 {
+        t.Errorf("Expected the lockout to be over, got %v", wait)
+    }
+    if list := loginThrottle.List(now); len(list) != 0 {
+        t.Errorf("Expected the failures to be forgotten, got %+v", list)
+    }
+}
+
+func TestLoginThrottleAttempt(t *testing.T) {
+    setupTestServer(t)
+    keys := []string{"ip:192.0.2.1", "account:admin@example.com"}
+    now := time.Now()
+
+    // Attempts count before they fail, so ones made at once can't all get in
+    for i := 0; i < 3; i++ {
+        if wait := loginThrottle.Attempt(keys, now); wait != 0 {
+            t.Fatalf("Attempt %d: expected no wait, got %v", i, wait)
+        }
+    }
+    if wait := loginThrottle.Attempt(keys, now); wait != time.Second {
+        t.Errorf("Expected to wait 1s, got %v", wait)
+    }
+
+    // Taking an attempt back lets the next one in
+    loginThrottle.Release(keys)
+    if wait := loginThrottle.Attempt(keys, now); wait != 0 {
+        t.Errorf("Expected no wait after a release, got %v", wait)
+    }
+    loginThrottle.Succeed(keys)
+    if list := loginThrottle.List(now); len(list) != 0 {
+        t.Errorf("Expected a success to forget the failures, got %+v", list)
+    }
+}
+
+func TestLoginThrottleMaxRecords(t *testing.T) {
+    setupTestServer(t)
+    now := time.Now()
+    for i := 0; i <= LoginThrottleMaxRecords; i++ {
+        loginThrottle.Fail([]string{"account:" + strconv.Itoa(i) + "@example.com"}, now.Add(time.Duration(i) * time.Millisecond))
+    }
+    list := loginThrottle.List(now)
+    if len(list) != LoginThrottleMaxRecords {
+        t.Fatalf("Expected %d records, got %d", LoginThrottleMaxRecords, len(list))
+    }
+    if list[len(list) - 1].Value != "1@example.com" {
+        t.Errorf("Expected the least recent failure to be forgotten, got %s", list[len(list) - 1].Value)
+    }
+}
+
+func TestClientIp(t *testing.T) {
+    setupTestServer(t)
+    config.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.1"}
+
+    tests := []struct {
+        remote    string
+        forwarded string
+        expected  string
+    }{
+        {"198.51.100.7:1234", "",                               "198.51.100.7"},
+        {"198.51.100.7:1234", "203.0.113.5",                    "198.51.100.7"},
+        {"192.0.2.1:1234",    "203.0.113.5",                    "203.0.113.5"},
+        {"192.0.2.1:1234",    "1.1.1.1, 203.0.113.5, 10.1.2.3", "203.0.113.5"},
+        {"10.1.2.3:1234",     "10.4.5.6",                       "10.4.5.6"},
+        {"10.1.2.3:1234",     "garbage",                        "10.1.2.3"},
+    }
+    for _, test := range tests {
+        r, _ := http.NewRequest("GET", "/login", nil)
+        r.RemoteAddr = test.remote
+        if test.forwarded != "" {
+            r.Header.Set("X-Forwarded-For", test.forwarded)
+        }
+        if ip := ClientIp(r); ip != test.expected {
+            t.Errorf("%s via %q: expected %s, got %s", test.remote, test.forwarded, test.expected, ip)
+        }
+    }
+}
+
+func TestLoginHandlerThrottled(t *testing.T) {
+    m := setupTestServer(t)
+    Setup()
+    config.LoginMaxAttempts = 3
+
+    for i := 0; i < 3; i++ {
+        if w := postLogin(m, "admin@example.com", "wrong", false); w.Code != http.StatusUnauthorized {
+            t.Fatalf("Failure %d: expected status %d, got %d", i, http.StatusUnauthorized, w.Code)
+        }
+    }
+
+    // Even the right password has to wait
+    w := postLogin(m, "admin@example.com", "secret", false)
+    if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "900" {
+        t.Fatalf("Expected status %d with Retry-After 900, got %d %q", http.StatusTooManyRequests, w.Code, w.Header().Get("Retry-After"))
+    }
+
+    // So does the same account from elsewhere
+    form := url.Values{"email": {"Admin@Example.com"}, "password": {"secret"}}
+    r, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+    r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    r.RemoteAddr = "198.51.100.7:1234"
+    if w := doRequestWith(m, r); w.Code != http.StatusTooManyRequests {
+        t.Errorf("Other IP: expected status %d, got %d", http.StatusTooManyRequests, w.Code)
+    }
+
+    // Until an admin clears it
+    session, _ := Login("admin@example.com", "secret")
+    cookie := &http.Cookie{Name: CookieName, Value: session.Token}
+    w = doRequest(m, "GET", "/api/lockouts", nil, cookie)
+    lockouts := []LoginFailures{}
+    if err := json.Unmarshal(w.Body.Bytes(), &lockouts); err != nil || len(lockouts) != 2 {
+        t.Fatalf("Expected 2 lockouts, got %s", w.Body.String())
+    }
+    for _, lockout := range lockouts {
+        path := "/api/lockout/" + url.PathEscape(lockout.Key)
+        if w := doRequest(m, "DELETE", path, nil, cookie); w.Code != http.StatusOK {
+            t.Errorf("DELETE %s: expected status %d, got %d", path, http.StatusOK, w.Code)
+        }
+    }
+    if w := doRequest(m, "DELETE", "/api/lockout/ip:nowhere", nil, cookie); w.Code != http.StatusNotFound {
+        t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+    }
+    if w := postLogin(m, "admin@example.com", "secret", false); w.Code != http.StatusSeeOther {
+        t.Errorf("Cleared: expected status %d, got %d", http.StatusSeeOther, w.Code)
+    }
+}
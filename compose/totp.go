@@ -0,0 +1,373 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "bytes"
+    "crypto/hmac"
+    "crypto/rand"
+    "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base32"
+    "encoding/base64"
+    "encoding/hex"
+    "errors"
+    "github.com/pquerna/otp"
+    "github.com/pquerna/otp/totp"
+    "github.com/zenazn/goji/web"
+    "gopkg.in/mgo.v2/bson"
+    "image/png"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+)
+
+var ErrInvalidLoginToken = errors.New("invalid login token")
+var ErrExpiredLoginToken = errors.New("the login token has expired")
+var ErrNoTotpEnrollment = errors.New("two-factor authentication hasn't been set up")
+var ErrInvalidTotpCode = errors.New("invalid one-time code")
+
+// How long a user has to enter their one-time code after their password.
+var LoginTokenMaxAge = 5 * time.Minute
+
+// How many recovery codes a user gets. Each can be used once instead of a
+// one-time code, in case the authenticator app is lost.
+var RecoveryCodeCount = 10
+
+// One-time codes are the usual RFC 6238 ones that authenticator apps make: 6
+// digits, a new one every 30 seconds. The codes just before and after the
+// current one are accepted too, in case the clocks disagree a little.
+var totpOpts = totp.ValidateOpts{
+    Period:    30,
+    Skew:      1,
+    Digits:    otp.DigitsSix,
+    Algorithm: otp.AlgorithmSHA1,
+}
+
+// TotpEnrollment is what an authenticator app needs to make one-time codes
+// for a user: the secret, and the otpauth:// URI and QR code with it.
+type TotpEnrollment struct {
+    Secret string `json:"secret"`
+    Url    string `json:"url"`
+    QrCode string `json:"qr_code"`
+}
+
+// StartTotpEnrollment makes a new secret for the user. It isn't used until
+// the user proves their app has it by entering a code with EnableTotp.
+func (u *User) StartTotpEnrollment() (*TotpEnrollment, error) {
+    issuer := config.SiteTitle
+    if issuer == "" {
+        issuer = "Compose"
+    }
+    key, err := totp.Generate(totp.GenerateOpts{Issuer: issuer, AccountName: u.Email})
+    if err != nil {
+        return nil, err
+    }
+
+    // Send the QR code as a data URI, so it never has to be stored
+    img, err := key.Image(200, 200)
+    if err != nil {
+        return nil, err
+    }
+    var buf bytes.Buffer
+    err = png.Encode(&buf, img)
+    if err != nil {
+        return nil, err
+    }
+
+    u.TotpPending = key.Secret()
+    return &TotpEnrollment{
+        Secret: key.Secret(),
+        Url:    key.URL(),
+        QrCode: "data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()),
+    }, nil
+}
+
+// EnableTotp turns on two-factor authentication if the code was made with
+// the secret from StartTotpEnrollment. It returns a new set of recovery codes,
+// which are only stored hashed, so this is the only time they can be shown.
+func (u *User) EnableTotp(code string, now time.Time) ([]string, error) {
+    if u.TotpPending == "" {
+        return nil, ErrNoTotpEnrollment
+    }
+    step, ok := checkTotpCode(u.TotpPending, code, now)
+    if !ok {
+        return nil, ErrInvalidTotpCode
+    }
+
+    u.TotpEnabled = true
+    u.TotpSecret = u.TotpPending
+    u.TotpPending = ""
+    u.TotpLastStep = step
+    return u.NewRecoveryCodes()
+}
+
+// DisableTotp turns off two-factor authentication and forgets the secret and
+// recovery codes.
+func (u *User) DisableTotp() {
+    u.TotpEnabled = false
+    u.TotpSecret = ""
+    u.TotpPending = ""
+    u.TotpLastStep = 0
+    u.RecoveryCodes = nil
+}
+
+// NewRecoveryCodes replaces the user's recovery codes with new ones.
+func (u *User) NewRecoveryCodes() ([]string, error) {
+    codes := make([]string, RecoveryCodeCount)
+    hashes := make([]string, RecoveryCodeCount)
+    for i := range codes {
+        random := make([]byte, 10)
+        _, err := rand.Read(random)
+        if err != nil {
+            return nil, err
+        }
+        code := strings.ToLower(base32.StdEncoding.EncodeToString(random))
+        codes[i] = code[:8] + "-" + code[8:]
+        hashes[i] = HashRecoveryCode(codes[i])
+    }
+    u.RecoveryCodes = hashes
+    return codes, nil
+}
+
+// HashRecoveryCode hashes a recovery code for storing. Dashes, spaces and
+// case don't matter. The codes are random, so a plain SHA-256 hash is enough.
+func HashRecoveryCode(code string) (string) {
+    code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+    sum := sha256.Sum256([]byte(code))
+    return hex.EncodeToString(sum[:])
+}
+
+// CheckSecondFactor checks a one-time code, or a recovery code, for a user
+// with two-factor authentication on. Each code only works once: one-time
+// codes no older than the last one used are refused, and recovery codes are
+// removed. The user has to be saved afterwards.
+func (u *User) CheckSecondFactor(code string, now time.Time) (bool) {
+    if !u.TotpEnabled {
+        return false
+    }
+    code = strings.TrimSpace(code)
+
+    if len(code) == int(totpOpts.Digits) {
+        step, ok := checkTotpCode(u.TotpSecret, code, now)
+        if !ok || step <= u.TotpLastStep {
+            return false
+        }
+        u.TotpLastStep = step
+        return true
+    }
+
+    hash := HashRecoveryCode(code)
+    for i, other := range u.RecoveryCodes {
+        if subtle.ConstantTimeCompare([]byte(hash), []byte(other)) == 1 {
+            u.RecoveryCodes = append(u.RecoveryCodes[:i], u.RecoveryCodes[i+1:]...)
+            return true
+        }
+    }
+    return false
+}
+
+// checkTotpCode checks a one-time code against a secret, and gets the time
+// step it was made for.
+func checkTotpCode(secret, code string, now time.Time) (int64, bool) {
+    period := time.Duration(totpOpts.Period) * time.Second
+    for skew := -int(totpOpts.Skew); skew <= int(totpOpts.Skew); skew++ {
+        t := now.Add(time.Duration(skew) * period)
+        expected, err := totp.GenerateCodeCustom(secret, t, totpOpts)
+        if err == nil && subtle.ConstantTimeCompare([]byte(code), []byte(expected)) == 1 {
+            return t.Unix() / int64(totpOpts.Period), true
+        }
+    }
+    return 0, false
+}
+
+// LoginToken makes the token that lets a user who has entered their password
+// enter their one-time code until the given time. Like a preview token, it is
+// the user id, the expiry time and a signature of both.
+func LoginToken(id bson.ObjectId, expires time.Time) (string) {
+    e := strconv.FormatInt(expires.Unix(), 10)
+    return id.Hex() + "-" + e + "-" + tokenSignature("login", id.Hex(), e)
+}
+
+// CheckLoginToken gets the id of the user a login token is for.
+func CheckLoginToken(token string, now time.Time) (bson.ObjectId, error) {
+    parts := strings.Split(token, "-")
+    if config.SecretKey == "" || len(parts) != 3 || !bson.IsObjectIdHex(parts[0]) {
+        return "", ErrInvalidLoginToken
+    }
+    if !hmac.Equal([]byte(parts[2]), []byte(tokenSignature("login", parts[0], parts[1]))) {
+        return "", ErrInvalidLoginToken
+    }
+    expires, err := strconv.ParseInt(parts[1], 10, 64)
+    if err != nil {
+        return "", ErrInvalidLoginToken
+    }
+    if !now.Before(time.Unix(expires, 0)) {
+        return "", ErrExpiredLoginToken
+    }
+    return bson.ObjectIdHex(parts[0]), nil
+}
+
+// checkRequestPassword checks the password a logged in user entered again to
+// change their two-factor settings or credentials, and sends an error if it's
+// wrong. Wrong passwords count as failed logins.
+func checkRequestPassword(w http.ResponseWriter, r *http.Request, user *User, password string) (bool) {
+    keys := LoginThrottleKeys(r, user.Email)
+    if wait := loginThrottle.Attempt(keys, time.Now()); wait > 0 {
+        WriteTooManyLogins(w, wait)
+        return false
+    }
+    if !user.TestPassword(password) {
+        http.Error(w, "Wrong password", http.StatusForbidden)
+        return false
+    }
+    loginThrottle.Release(keys)
+    return true
+}
+
+// ApiStartTotp is a handler to start setting up two-factor authentication. It
+// needs the user's password, and sends back the new secret.
+func ApiStartTotp(c web.C, w http.ResponseWriter, r *http.Request) {
+    request := &struct{
+        Password string `json:"password"`
+    }{}
+
+    user, err := RequestUser(r)
+    if err != nil {
+        panic(err)
+    }
+    err = DecodeJsonPayload(r, request)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if !checkRequestPassword(w, r, user, request.Password) {
+        return
+    }
+    if user.TotpEnabled {
+        http.Error(w, "Two-factor authentication is already on. Turn it off first.", http.StatusConflict)
+        return
+    }
+
+    enrollment, err := user.StartTotpEnrollment()
+    if err != nil {
+        panic(err)
+    }
+    _, err = user.Save()
+    if err != nil {
+        panic(err)
+    }
+
+    WriteJson(w, enrollment)
+}
+
+// ApiEnableTotp is a handler to finish setting up two-factor authentication
+// with a code from the authenticator app. It sends back the recovery codes.
+func ApiEnableTotp(c web.C, w http.ResponseWriter, r *http.Request) {
+    request := &struct{
+        Code string `json:"code"`
+    }{}
+
+    user, err := RequestUser(r)
+    if err != nil {
+        panic(err)
+    }
+    err = DecodeJsonPayload(r, request)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+
+    codes, err := user.EnableTotp(strings.TrimSpace(request.Code), time.Now())
+    if err == ErrNoTotpEnrollment || err == ErrInvalidTotpCode {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if err != nil {
+        panic(err)
+    }
+    _, err = user.Save()
+    if err != nil {
+        panic(err)
+    }
+
+    WriteJson(w, map[string][]string{"recovery_codes": codes})
+}
+
+// ApiDisableTotp is a handler to turn off two-factor authentication. It needs
+// the user's password.
+func ApiDisableTotp(c web.C, w http.ResponseWriter, r *http.Request) {
+    request := &struct{
+        Password string `json:"password"`
+    }{}
+
+    user, err := RequestUser(r)
+    if err != nil {
+        panic(err)
+    }
+    err = DecodeJsonPayload(r, request)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if !checkRequestPassword(w, r, user, request.Password) {
+        return
+    }
+
+    user.DisableTotp()
+    _, err = user.Save()
+    if err != nil {
+        panic(err)
+    }
+}
+
+// ApiNewRecoveryCodes is a handler to replace the recovery codes, for when
+// they've been used up or lost. It needs the user's password.
+func ApiNewRecoveryCodes(c web.C, w http.ResponseWriter, r *http.Request) {
+    request := &struct{
+        Password string `json:"password"`
+    }{}
+
+    user, err := RequestUser(r)
+    if err != nil {
+        panic(err)
+    }
+    err = DecodeJsonPayload(r, request)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    if !checkRequestPassword(w, r, user, request.Password) {
+        return
+    }
+    if !user.TotpEnabled {
+        http.Error(w, ErrNoTotpEnrollment.Error(), http.StatusConflict)
+        return
+    }
+
+    codes, err := user.NewRecoveryCodes()
+    if err != nil {
+        panic(err)
+    }
+    _, err = user.Save()
+    if err != nil {
+        panic(err)
+    }
+
+    WriteJson(w, map[string][]string{"recovery_codes": codes})
+}
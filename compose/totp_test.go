@@ -0,0 +1,215 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "github.com/pquerna/otp/totp"
+    "github.com/zenazn/goji/web"
+    "net/http"
+    "net/http/httptest"
+    "net/url"
+    "strings"
+    "testing"
+    "time"
+)
+
+// enableTestTotp turns on two-factor authentication for a user, and returns
+// the secret and recovery codes.
+func enableTestTotp(t *testing.T, user *User) (string, []string) {
+    enrollment, err := user.StartTotpEnrollment()
+    if err != nil {
+        t.Fatal("Failed to start enrollment:", err)
+    }
+    code, _ := totp.GenerateCodeCustom(enrollment.Secret, time.Now(), totpOpts)
+    codes, err := user.EnableTotp(code, time.Now())
+    if err != nil {
+        t.Fatal("Failed to enable TOTP:", err)
+    }
+    user.Save()
+    return enrollment.Secret, codes
+}
+
+// postLoginCode submits the one-time code form as an XMLHttpRequest.
+func postLoginCode(m *web.Mux, token, code string) (*httptest.ResponseRecorder) {
+    form := url.Values{"login_token": {token}, "code": {code}}
+    r, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+    r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    r.Header.Set("X-Requested-With", "XMLHttpRequest")
+    return doRequestWith(m, r)
+}
+
+func TestTotpEnrollment(t *testing.T) {
+    setupTestServer(t)
+    user, _ := CreateUser()
+    user.Email = "admin@example.com"
+
+    enrollment, err := user.StartTotpEnrollment()
+    if err != nil {
+        t.Fatal("Failed to start enrollment:", err)
+    }
+    if !strings.HasPrefix(enrollment.Url, "otpauth://totp/Test%20Blog:admin@example.com?") || !strings.Contains(enrollment.Url, enrollment.Secret) {
+        t.Errorf("Unexpected provisioning URI %q", enrollment.Url)
+    }
+    if !strings.HasPrefix(enrollment.QrCode, "data:image/png;base64,") {
+        t.Errorf("Expected a PNG data URI, got %.40q", enrollment.QrCode)
+    }
+    if user.TotpEnabled || user.TotpPending != enrollment.Secret {
+        t.Errorf("Expected the secret to be pending")
+    }
+
+    // The app has to prove it has the secret
+    now := time.Now()
+    if _, err := user.EnableTotp("000000", now); err != ErrInvalidTotpCode {
+        t.Errorf("Expected a wrong code to be refused, got %v", err)
+    }
+    code, _ := totp.GenerateCodeCustom(enrollment.Secret, now, totpOpts)
+    codes, err := user.EnableTotp(code, now)
+    if err != nil || !user.TotpEnabled || user.TotpSecret != enrollment.Secret || user.TotpPending != "" {
+        t.Fatalf("Expected TOTP to be on, got %v", err)
+    }
+    if len(codes) != 10 || len(user.RecoveryCodes) != 10 || user.RecoveryCodes[0] == codes[0] {
+        t.Errorf("Expected 10 hashed recovery codes, got %v", user.RecoveryCodes)
+    }
+
+    // Each code only works once
+    if user.CheckSecondFactor(code, now) {
+        t.Errorf("Expected a used code to be refused")
+    }
+    next, _ := totp.GenerateCodeCustom(enrollment.Secret, now.Add(30 * time.Second), totpOpts)
+    if !user.CheckSecondFactor(next, now) || user.CheckSecondFactor(next, now) {
+        t.Errorf("Expected the next code to work once")
+    }
+    late, _ := totp.GenerateCodeCustom(enrollment.Secret, now.Add(5 * time.Minute), totpOpts)
+    if user.CheckSecondFactor(late, now) {
+        t.Errorf("Expected a code for another time to be refused")
+    }
+    recovery := strings.ToUpper(strings.Replace(codes[3], "-", " ", 1))
+    if !user.CheckSecondFactor(recovery, now) || user.CheckSecondFactor(codes[3], now) || len(user.RecoveryCodes) != 9 {
+        t.Errorf("Expected the recovery code to work once")
+    }
+
+    user.DisableTotp()
+    if user.TotpEnabled || user.TotpSecret != "" || user.RecoveryCodes != nil || user.CheckSecondFactor(codes[4], now) {
+        t.Errorf("Expected TOTP to be off")
+    }
+}
+
+func TestLoginWithTotp(t *testing.T) {
+    m := setupTestServer(t)
+    config.SecretKey = "test key"
+    Setup()
+    user, _ := FindUserByEmail("admin@example.com")
+    secret, codes := enableTestTotp(t, user)
+
+    if _, err := Login("admin@example.com", "secret"); err != ErrTotpRequired {
+        t.Errorf("Expected Login to need a code, got %v", err)
+    }
+
+    // The password only gets a login token
+    w := postLogin(m, "admin@example.com", "secret", true)
+    response := map[string]string{}
+    json.Unmarshal(w.Body.Bytes(), &response)
+    token := response["login_token"]
+    if w.Code != http.StatusOK || token == "" || responseCookie(w, CookieName) != nil {
+        t.Fatalf("Expected a login token and no session, got %d %s", w.Code, w.Body.String())
+    }
+
+    // Without JavaScript, the login page asks for the code
+    w = postLogin(m, "admin@example.com", "secret", false)
+    if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `name="login_token" type="hidden" id="inputLoginToken" value="`) {
+        t.Errorf("Expected the code form, got %d", w.Code)
+    }
+
+    if w := postLoginCode(m, token, "000000"); w.Code != http.StatusUnauthorized {
+        t.Errorf("Wrong code: expected status %d, got %d", http.StatusUnauthorized, w.Code)
+    }
+    if w := postLoginCode(m, "bogus", codes[0]); w.Code != http.StatusUnauthorized {
+        t.Errorf("Bad token: expected status %d, got %d", http.StatusUnauthorized, w.Code)
+    }
+    expired := LoginToken(user.Id, time.Now().Add(-time.Second))
+    if w := postLoginCode(m, expired, codes[0]); w.Code != http.StatusGone {
+        t.Errorf("Expired token: expected status %d, got %d", http.StatusGone, w.Code)
+    }
+
+    code, _ := totp.GenerateCodeCustom(secret, time.Now().Add(30 * time.Second), totpOpts)
+    w = postLoginCode(m, token, code)
+    if cookie := responseCookie(w, CookieName); w.Code != http.StatusOK || cookie == nil || !IsSessionTokenValid(cookie.Value) {
+        t.Errorf("Expected a session, got %d", w.Code)
+    }
+    if w := postLoginCode(m, token, code); w.Code != http.StatusUnauthorized {
+        t.Errorf("Used code: expected status %d, got %d", http.StatusUnauthorized, w.Code)
+    }
+
+    // A recovery code works too
+    if w := postLoginCode(m, token, codes[0]); w.Code != http.StatusOK {
+        t.Errorf("Recovery code: expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    if user, _ := FindUserById(user.Id); len(user.RecoveryCodes) != 9 {
+        t.Errorf("Expected the recovery code to be used up, %d left", len(user.RecoveryCodes))
+    }
+}
+
+func TestTotpSettingsApi(t *testing.T) {
+    m := setupTestServer(t)
+    cookie := loginTestUser(t)
+    post := func(path string, body interface{}) (*httptest.ResponseRecorder) {
+        data, _ := json.Marshal(body)
+        return doRequest(m, "POST", path, bytes.NewReader(data), cookie)
+    }
+
+    if w := post("/api/totp", map[string]string{"password": "wrong"}); w.Code != http.StatusForbidden {
+        t.Errorf("Wrong password: expected status %d, got %d", http.StatusForbidden, w.Code)
+    }
+    w := post("/api/totp", map[string]string{"password": "secret"})
+    enrollment := &TotpEnrollment{}
+    if err := json.Unmarshal(w.Body.Bytes(), enrollment); err != nil || enrollment.Secret == "" {
+        t.Fatalf("Expected an enrollment, got %d %s", w.Code, w.Body.String())
+    }
+
+    if w := post("/api/totp/enable", map[string]string{"code": "000000"}); w.Code != http.StatusBadRequest {
+        t.Errorf("Wrong code: expected status %d, got %d", http.StatusBadRequest, w.Code)
+    }
+    code, _ := totp.GenerateCodeCustom(enrollment.Secret, time.Now(), totpOpts)
+    w = post("/api/totp/enable", map[string]string{"code": code})
+    response := map[string][]string{}
+    if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || len(response["recovery_codes"]) != 10 {
+        t.Fatalf("Expected recovery codes, got %d %s", w.Code, w.Body.String())
+    }
+
+    w = doRequest(m, "GET", "/api/settings", nil, cookie)
+    if !strings.Contains(w.Body.String(), `"totp_enabled": true`) || !strings.Contains(w.Body.String(), `"recovery_codes_left": 10`) {
+        t.Errorf("Expected the settings to show TOTP is on, got %s", w.Body.String())
+    }
+    if w := post("/api/totp", map[string]string{"password": "secret"}); w.Code != http.StatusConflict {
+        t.Errorf("Already on: expected status %d, got %d", http.StatusConflict, w.Code)
+    }
+    if w := post("/api/totp/recovery", map[string]string{"password": "secret"}); w.Code != http.StatusOK {
+        t.Errorf("New recovery codes: expected status %d, got %d", http.StatusOK, w.Code)
+    }
+
+    if w := post("/api/totp/disable", map[string]string{"password": "wrong"}); w.Code != http.StatusForbidden {
+        t.Errorf("Wrong password: expected status %d, got %d", http.StatusForbidden, w.Code)
+    }
+    if w := post("/api/totp/disable", map[string]string{"password": "secret"}); w.Code != http.StatusOK {
+        t.Errorf("Disable: expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    if user, _ := FindUserByEmail("admin@example.com"); user.TotpEnabled || user.TotpSecret != "" {
+        t.Errorf("Expected TOTP to be off")
+    }
+}
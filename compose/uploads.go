@@ -18,25 +18,24 @@ package main
 import (
     "encoding/json"
     "github.com/zenazn/goji/web"
-    "gopkg.in/mgo.v2"
     "gopkg.in/mgo.v2/bson"
     "io"
     "mime"
     "net/http"
+    "net/url"
+    "path"
     "path/filepath"
     "time"
 )
 
 func DownloadHandler(w http.ResponseWriter, r *http.Request, id bson.ObjectId) {
-    file, err := GetFileById(id)
+    info, file, err := GetFileById(id)
     if err != nil {
         http.NotFound(w, r)
         return
     }
     defer file.Close()
 
-    info, _ := GetFileInfo(file)
-
     if CheckModifiedHandler(w, r, info.UploadDate) {
         // Not modified
         return
@@ -59,8 +58,6 @@ func DownloadHandler(w http.ResponseWriter, r *http.Request, id bson.ObjectId) {
 }
 
 func UploadHandler(c web.C, w http.ResponseWriter, r *http.Request) {
-    db := GetDatabaseHandle()
-    
     // Create JSON encoder for the response
     enc := json.NewEncoder(w)
     response := make(map[string]string)
@@ -76,17 +73,7 @@ func UploadHandler(c web.C, w http.ResponseWriter, r *http.Request) {
     defer file.Close()
 
     // Create file in database
-    out, err := db.GridFS("fs").Create(header.Filename)
-    if err != nil {
-        response["status"] = "error"
-        response["message"] = err.Error()
-        enc.Encode(response)
-        return
-    }
-    defer out.Close()
-
-    // Insert data into file
-    _, err = io.Copy(out, file)
+    info, err := GetStore().CreateFile(header.Filename, file)
     if err != nil {
         response["status"] = "error"
         response["message"] = err.Error()
@@ -97,7 +84,7 @@ func UploadHandler(c web.C, w http.ResponseWriter, r *http.Request) {
     // Return response object
     response["status"] = "success"
     response["message"] = "file uploaded successfully"
-    response["_id"] = bson.ObjectId(out.Id().(bson.ObjectId)).Hex()
+    response["_id"] = info.Id.Hex()
     enc.Encode(response)
 }
 
@@ -108,29 +95,18 @@ type FileInfo struct {
     Size       int64         `json:"size"          bson:"size"` 
 }
 
-func GetFileInfoById(id bson.ObjectId) (*FileInfo, error) {
-    db := GetDatabaseHandle()
-    c := db.GridFS("fs")
-    file, err := c.OpenId(id)
-    if err != nil {
-        return nil, err
-    }
-    defer file.Close()
-    return GetFileInfo(file)
+// PostFileUrl is the URL a file attached to the post with the given slug
+// is served from.
+func PostFileUrl(slug, name string) (string) {
+    return (&url.URL{Path: path.Join("/", slug, name)}).String()
 }
 
-func GetFileById(id bson.ObjectId) (*mgo.GridFile, error) {
-    db := GetDatabaseHandle()
-    c := db.GridFS("fs")
-    file, err := c.OpenId(id)
-    return file, err
+func GetFileInfoById(id bson.ObjectId) (*FileInfo, error) {
+    return GetStore().FindFileInfoById(id)
 }
 
-func GetFileInfo(file *mgo.GridFile) (*FileInfo, error) {
-    return &FileInfo{Id:         file.Id().(bson.ObjectId),
-                     Name:       file.Name(),
-                     UploadDate: file.UploadDate(),
-                     Size:       file.Size()}, nil
+func GetFileById(id bson.ObjectId) (*FileInfo, io.ReadCloser, error) {
+    return GetStore().OpenFile(id)
 }
 
 func GetMultFileInfoById(ids []bson.ObjectId) (map[bson.ObjectId]*FileInfo, error) {
@@ -147,8 +123,6 @@ func GetMultFileInfoById(ids []bson.ObjectId) (map[bson.ObjectId]*FileInfo, erro
 }
 
 func (file *FileInfo) DeleteFile() (*FileInfo, error) {
-    db := GetDatabaseHandle()
-    c := db.GridFS("fs")
-    err := c.RemoveId(file.Id)
+    err := GetStore().DeleteFile(file.Id)
     return file, err
 }
\ No newline at end of file
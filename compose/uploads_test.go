@@ -0,0 +1,106 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "bytes"
+    "encoding/json"
+    "gopkg.in/mgo.v2/bson"
+    "io/ioutil"
+    "mime/multipart"
+    "net/http"
+    "testing"
+)
+
+// newUploadRequest creates a multipart upload request for a file.
+func newUploadRequest(name string, contents []byte) (*http.Request) {
+    body := &bytes.Buffer{}
+    writer := multipart.NewWriter(body)
+    part, _ := writer.CreateFormFile("file", name)
+    part.Write(contents)
+    writer.Close()
+
+    r, _ := http.NewRequest("POST", "/upload", body)
+    r.Header.Set("Content-Type", writer.FormDataContentType())
+    return r
+}
+
+func TestUploadHandler(t *testing.T) {
+    m := setupTestServer(t)
+    cookie := loginTestUser(t)
+
+    r := newUploadRequest("notes.txt", []byte("some notes"))
+    addSessionCookie(r, cookie)
+    w := doRequestWith(m, r)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+    }
+
+    response := map[string]string{}
+    err := json.Unmarshal(w.Body.Bytes(), &response)
+    if err != nil {
+        t.Fatal("Bad response:", err)
+    }
+    if response["status"] != "success" || !bson.IsObjectIdHex(response["_id"]) {
+        t.Fatalf("Unexpected response %v", response)
+    }
+
+    info, file, err := GetFileById(bson.ObjectIdHex(response["_id"]))
+    if err != nil {
+        t.Fatal("Uploaded file not found:", err)
+    }
+    defer file.Close()
+    contents, _ := ioutil.ReadAll(file)
+    if info.Name != "notes.txt" || info.Size != 10 || string(contents) != "some notes" {
+        t.Errorf("Unexpected file %+v with contents %q", info, contents)
+    }
+
+    // File info is available through the API
+    w = doRequest(m, "GET", "/api/file/" + info.Id.Hex(), nil, cookie)
+    fetched := &FileInfo{}
+    json.Unmarshal(w.Body.Bytes(), fetched)
+    if fetched.Id != info.Id || fetched.Name != info.Name {
+        t.Errorf("Unexpected file info %+v", fetched)
+    }
+
+    w = doRequest(m, "DELETE", "/api/file/" + info.Id.Hex(), nil, cookie)
+    if w.Code != http.StatusOK {
+        t.Fatalf("Delete: expected status %d, got %d", http.StatusOK, w.Code)
+    }
+    if _, err := GetFileInfoById(info.Id); err != ErrNotFound {
+        t.Errorf("Expected file to be deleted, got %v", err)
+    }
+}
+
+func TestUploadHandlerRequiresLogin(t *testing.T) {
+    m := setupTestServer(t)
+    w := doRequestWith(m, newUploadRequest("notes.txt", []byte("some notes")))
+    if w.Code != http.StatusUnauthorized {
+        t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+    }
+}
+
+func TestUploadHandlerMissingFile(t *testing.T) {
+    m := setupTestServer(t)
+    cookie := loginTestUser(t)
+    w := doRequest(m, "POST", "/upload", nil, cookie)
+    response := map[string]string{}
+    json.Unmarshal(w.Body.Bytes(), &response)
+    if response["status"] != "error" {
+        t.Fatalf("Expected an error, got %v", response)
+    }
+}
@@ -16,21 +16,55 @@
 package main
 
 import (
+    "crypto/rand"
     "crypto/sha256"
+    "crypto/subtle"
+    "encoding/base64"
+    "errors"
     "fmt"
+    "golang.org/x/crypto/argon2"
     "gopkg.in/mgo.v2/bson"
+    "strings"
 )
 
 const (
+    // PasswordSalt was used by the old SHA-256 password hashes, which are
+    // still accepted until they're upgraded.
     PasswordSalt = "goblog"
 )
 
+// Argon2Params are the cost parameters of an argon2id password hash.
+type Argon2Params struct {
+    Time    uint32
+    Memory  uint32
+    Threads uint8
+    KeyLen  uint32
+    SaltLen int
+}
+
+// PasswordHashParams are the parameters for new password hashes. Hashes made
+// with other parameters are upgraded the next time the user logs in.
+var PasswordHashParams = Argon2Params{
+    Time:    1,
+    Memory:  64 * 1024,
+    Threads: 4,
+    KeyLen:  32,
+    SaltLen: 16,
+}
+
+// Users with TotpEnabled need a one-time code from their authenticator app, or
+// one of their recovery codes, to login. See totp.go.
 type User struct {
-    Id           bson.ObjectId `json:"_id,omitempty" bson:"_id,omitempty"`
-    FirstName    string        `json:"firstName"     bson:"firstName"`
-    LastName     string        `json:"lastName"      bson:"lastName"`
-    Email        string        `json:"email"         bson:"email"`
-    PasswordHash string        `json:"password"      bson:"password"`
+    Id            bson.ObjectId `json:"_id,omitempty" bson:"_id,omitempty"`
+    FirstName     string        `json:"firstName"     bson:"firstName"`
+    LastName      string        `json:"lastName"      bson:"lastName"`
+    Email         string        `json:"email"         bson:"email"`
+    PasswordHash  string        `json:"password"      bson:"password"`
+    TotpEnabled   bool          `json:"-"             bson:"totpEnabled,omitempty"`
+    TotpSecret    string        `json:"-"             bson:"totpSecret,omitempty"`
+    TotpPending   string        `json:"-"             bson:"totpPending,omitempty"`
+    TotpLastStep  int64         `json:"-"             bson:"totpLastStep,omitempty"`
+    RecoveryCodes []string      `json:"-"             bson:"recoveryCodes,omitempty"`
 }
 
 
@@ -43,25 +77,11 @@ func CreateUser() (*User, error) {
 }
 
 func FindUserById(id bson.ObjectId) (*User, error) {
-    db := GetDatabaseHandle()
-    c := db.C("users")
-    user := &User{}
-    err := c.FindId(id).One(user)
-    if err != nil {
-        return nil, err
-    }
-    return user, nil
+    return GetStore().FindUserById(id)
 }
 
 func FindUserByEmail(email string) (*User, error) {
-    db := GetDatabaseHandle()
-    c := db.C("users")
-    user := &User{}
-    err := c.Find(bson.M{"email": email}).One(user)
-    if err != nil {
-        return nil, err
-    }
-    return user, nil
+    return GetStore().FindUserByEmail(email)
 }
 
 func (s *User) Destroy() (error) {
@@ -70,18 +90,88 @@ func (s *User) Destroy() (error) {
 }
 
 func (u *User) Save() (*User, error) {
-    db := GetDatabaseHandle()
-    // Insert User to database
-    c := db.C("users")
-    _, err := c.UpsertId(u.Id, u)
+    err := GetStore().SaveUser(u)
     return u, err
 }
 
+// TestPassword checks a password against the user's password hash, which can
+// be an argon2id hash or one of the old SHA-256 hashes.
 func (u *User) TestPassword(password string) (bool) {
-    return u.PasswordHash == u.GenPasswordHash(password)
+    var expected, actual []byte
+    if strings.HasPrefix(u.PasswordHash, "$argon2id$") {
+        params, salt, key, err := decodeArgon2Hash(u.PasswordHash)
+        if err != nil {
+            return false
+        }
+        expected = key
+        actual = argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+    } else {
+        expected = []byte(u.PasswordHash)
+        actual = []byte(u.legacyPasswordHash(password))
+    }
+    return subtle.ConstantTimeCompare(expected, actual) == 1
+}
+
+// PasswordNeedsRehash checks if the user's password hash is an old SHA-256
+// hash, or wasn't made with the current PasswordHashParams.
+func (u *User) PasswordNeedsRehash() (bool) {
+    params, _, _, err := decodeArgon2Hash(u.PasswordHash)
+    return err != nil || params != PasswordHashParams
 }
 
+// GenPasswordHash hashes a password with argon2id and a random salt. The hash
+// is encoded along with its parameters, in the usual
+// $argon2id$v=19$m=...,t=...,p=...$salt$key format.
 func (u *User) GenPasswordHash(password string) (string) {
+    params := PasswordHashParams
+    salt := make([]byte, params.SaltLen)
+    _, err := rand.Read(salt)
+    if err != nil {
+        panic(err)
+    }
+    key := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+    return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+                       argon2.Version,
+                       params.Memory,
+                       params.Time,
+                       params.Threads,
+                       base64.RawStdEncoding.EncodeToString(salt),
+                       base64.RawStdEncoding.EncodeToString(key))
+}
+
+// legacyPasswordHash is the old SHA-256 hash of the password, salted with
+// PasswordSalt and the user id.
+func (u *User) legacyPasswordHash(password string) (string) {
     x := fmt.Sprintf("%s:%s:%s", PasswordSalt, u.Id.Hex(), password)
     return fmt.Sprintf("%x", sha256.Sum256([]byte(x)))
+}
+
+// decodeArgon2Hash gets the parameters, salt and key out of an encoded
+// argon2id hash.
+func decodeArgon2Hash(hash string) (Argon2Params, []byte, []byte, error) {
+    var params Argon2Params
+    var version int
+    parts := strings.Split(hash, "$")
+    if len(parts) != 6 || parts[0] != "" || parts[1] != "argon2id" {
+        return params, nil, nil, errors.New("not an argon2id hash")
+    }
+    _, err := fmt.Sscanf(parts[2], "v=%d", &version)
+    if err != nil || version != argon2.Version {
+        return params, nil, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+    }
+    _, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+    if err != nil {
+        return params, nil, nil, err
+    }
+    salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+    if err != nil {
+        return params, nil, nil, err
+    }
+    key, err := base64.RawStdEncoding.DecodeString(parts[5])
+    if err != nil {
+        return params, nil, nil, err
+    }
+    params.SaltLen = len(salt)
+    params.KeyLen = uint32(len(key))
+    return params, salt, key, nil
 }
\ No newline at end of file
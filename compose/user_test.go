@@ -0,0 +1,87 @@
+// Copyright (C) 2015  Matt Borgerson
+// 
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+// 
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+// 
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+
+package main
+
+import (
+    "strings"
+    "testing"
+)
+
+func TestPasswordHash(t *testing.T) {
+    user, _ := CreateUser()
+    user.PasswordHash = user.GenPasswordHash("secret")
+    if !strings.HasPrefix(user.PasswordHash, "$argon2id$v=19$m=") {
+        t.Errorf("Expected an encoded argon2id hash, got %q", user.PasswordHash)
+    }
+    if !user.TestPassword("secret") || user.TestPassword("Secret") || user.TestPassword("") {
+        t.Errorf("Password check failed for %q", user.PasswordHash)
+    }
+    if user.PasswordNeedsRehash() {
+        t.Errorf("Expected a new hash not to need rehashing")
+    }
+
+    // Each hash has its own salt
+    if other := user.GenPasswordHash("secret"); other == user.PasswordHash {
+        t.Errorf("Expected a random salt, got the same hash twice")
+    }
+
+    // The parameters are read from the hash, so changing them only means the
+    // hash should be upgraded
+    defer func(params Argon2Params) { PasswordHashParams = params }(PasswordHashParams)
+    PasswordHashParams.Time += 1
+    if !user.TestPassword("secret") || !user.PasswordNeedsRehash() {
+        t.Errorf("Expected a hash with old parameters to work and need rehashing")
+    }
+
+    for _, bad := range []string{"", "$argon2id$v=19$m=1024", "$argon2i$v=19$m=1024,t=1,p=4$c2FsdA$a2V5", "$argon2id$v=19$m=1024,t=1,p=4$!!!$a2V5"} {
+        user.PasswordHash = bad
+        if user.TestPassword("secret") || !user.PasswordNeedsRehash() {
+            t.Errorf("Expected %q to be rejected", bad)
+        }
+    }
+}
+
+func TestLegacyPasswordUpgrade(t *testing.T) {
+    setupTestServer(t)
+    user, _ := CreateUser()
+    user.Email = "old@example.com"
+    user.PasswordHash = user.legacyPasswordHash("secret")
+    user.Save()
+
+    if !user.TestPassword("secret") || user.TestPassword("wrong") || !user.PasswordNeedsRehash() {
+        t.Errorf("Expected the old hash to be accepted and need rehashing")
+    }
+
+    // A failed login leaves the hash alone, a successful one upgrades it
+    legacy := user.PasswordHash
+    if _, err := Login("old@example.com", "wrong"); err == nil {
+        t.Errorf("Expected the wrong password to be refused")
+    }
+    if user, _ := FindUserById(user.Id); user.PasswordHash != legacy {
+        t.Errorf("Expected the hash not to change")
+    }
+    if _, err := Login("old@example.com", "secret"); err != nil {
+        t.Fatal("Login failed:", err)
+    }
+    user, _ = FindUserById(user.Id)
+    if !strings.HasPrefix(user.PasswordHash, "$argon2id$") || !user.TestPassword("secret") {
+        t.Errorf("Expected the hash to be upgraded, got %q", user.PasswordHash)
+    }
+    if _, err := Login("old@example.com", "secret"); err != nil {
+        t.Errorf("Login with the upgraded hash failed: %v", err)
+    }
+}
@@ -24110,6 +24110,20 @@ angular.module('ui.ace', [])
     }]);
 }));
 
+// The server wants the CSRF token from the XSRF-TOKEN cookie sent back in the
+// X-XSRF-TOKEN header. Angular's $http does this by itself, jQuery and
+// Dropzone need to be told.
+function csrfToken() {
+  var match = document.cookie.match(/(?:^|; )XSRF-TOKEN=([^;]*)/)
+  return match ? decodeURIComponent(match[1]) : ""
+}
+
+$.ajaxSetup({
+  beforeSend: function(xhr) {
+    xhr.setRequestHeader("X-XSRF-TOKEN", csrfToken())
+  }
+});
+
 angular.module('Admin', ["ngRoute", "ui.ace", "ui.bootstrap.datetimepicker"])
 
 .directive('dropZone', function() {
@@ -24117,6 +24131,7 @@ angular.module('Admin', ["ngRoute", "ui.ace", "ui.bootstrap.datetimepicker"])
 
     element.dropzone({ 
         url: "/upload",
+        headers: {"X-XSRF-TOKEN": csrfToken()},
         init: function() {
           this.on("success", function(file, response) {
             response = JSON.parse(response)
@@ -24137,10 +24152,20 @@ angular.module('Admin', ["ngRoute", "ui.ace", "ui.bootstrap.datetimepicker"])
 // Main Controller
 //
 
-.controller('MainController', function($scope, $route, $routeParams, $location) {
+.controller('MainController', function($scope, $http, $route, $routeParams, $location, $window) {
   $scope.$route = $route;
   $scope.$location = $location;
   $scope.$routeParams = $routeParams;
+
+  $scope.logout = function() {
+    $http.post('/logout').
+    success(function(data, status, headers, config) {
+      $window.location.href = '/login';
+    }).
+    error(function(data, status, headers, config) {
+      console.log('error!');
+    });
+  }
 })
 
 //
@@ -24151,6 +24176,7 @@ angular.module('Admin', ["ngRoute", "ui.ace", "ui.bootstrap.datetimepicker"])
   $scope.name = "PostsController";
   $scope.params = $routeParams;
   $scope.posts = null;
+  $scope.pages = null;
 
   $scope.loadData = function() {
     $http.get('/api/posts').
@@ -24165,6 +24191,13 @@ angular.module('Admin', ["ngRoute", "ui.ace", "ui.bootstrap.datetimepicker"])
       error(function(data, status, headers, config) {
         console.log("Error: failed to load data!");
       });
+    $http.get('/api/pages').
+      success(function(data, status, headers, config) {
+        $scope.pages = data;
+      }).
+      error(function(data, status, headers, config) {
+        console.log("Error: failed to load data!");
+      });
   };
 
   // Initial load
@@ -24180,6 +24213,16 @@ angular.module('Admin', ["ngRoute", "ui.ace", "ui.bootstrap.datetimepicker"])
       console.log('error!');
     });
   }
+
+  $scope.createPage = function createPage() {
+    $http.post('/api/pages').
+    success(function(data, status, headers, config) {
+      $scope.loadData();
+    }).
+    error(function(data, status, headers, config) {
+      console.log('error!');
+    });
+  }
 })
 
 
@@ -24193,6 +24236,8 @@ angular.module('Admin', ["ngRoute", "ui.ace", "ui.bootstrap.datetimepicker"])
   $scope.postIsDirty = false;
   $scope.article = null;
   $scope.files = {};
+  $scope.revisions = [];
+  $scope.revisionDiff = "";
 
   // Setup Tabs
   $(document).ready(function(){ 
@@ -24209,7 +24254,13 @@ angular.module('Admin', ["ngRoute", "ui.ace", "ui.bootstrap.datetimepicker"])
 
   $scope.$watch("article.slug", function(newValue, oldValue) {
     if (oldValue === undefined) return;
+    if (newValue === $scope.savedSlug) {
+      // Changed by saving
+      $scope.savedSlug = undefined;
+      return;
+    }
     $scope.postIsDirty = true;
+    $scope.checkSlug();
   });
 
   $scope.$watch("article.date", function(newValue, oldValue) {
@@ -24227,6 +24278,16 @@ angular.module('Admin', ["ngRoute", "ui.ace", "ui.bootstrap.datetimepicker"])
     $scope.postIsDirty = true;
   });
 
+  $scope.$watch("article.menu", function(newValue, oldValue) {
+    if (oldValue === undefined) return;
+    $scope.postIsDirty = true;
+  });
+
+  $scope.$watchCollection("article.tags", function(newValue, oldValue) {
+    if (oldValue === undefined) return;
+    $scope.postIsDirty = true;
+  });
+
   // Bind leave handler to prompt for save
   $(window).bind('beforeunload', function(){
     return $scope.promptForUnsavedChanges()
@@ -24287,14 +24348,44 @@ angular.module('Admin', ["ngRoute", "ui.ace", "ui.bootstrap.datetimepicker"])
     $scope.showAlertMessage("success", msg)
   }
 
+  $scope.checkSlug = function() {
+    var params = {id: $routeParams.postId, slug: $scope.article.slug};
+    $http.get("/api/slug", {params: params}).
+    success(function(data, status, headers, config) {
+      $scope.slugCheck = data;
+    });
+  }
+
+  $scope.slugFromTitle = function() {
+    var params = {id: $routeParams.postId, title: $scope.article.title};
+    $http.get("/api/slug", {params: params}).
+    success(function(data, status, headers, config) {
+      $scope.article.slug = data.suggestion;
+    });
+  }
+
   $scope.save = function() {
     $http.put("/api/post/" + $routeParams.postId, $scope.article).
     success(function(data, status, headers, config) {
+      // The slug may have been normalized or made from the title
+      if (data.slug != $scope.article.slug) {
+        $scope.article.slug = data.slug;
+        $scope.savedSlug = data.slug;
+      }
+      $scope.article.old_slugs = data.old_slugs;
+      $scope.article.status = data.status;
+      $scope.slugCheck = null;
       $scope.postIsDirty = false;
       $scope.showSuccessMessage("Saved!");
+      $scope.loadRevisions();
     }).
     error(function(data, status, headers, config) {
-      $scope.showDangerMessage("Unable to save post!");
+      if (data.reason) {
+        // The slug can't be used, e.g. it's already taken
+        $scope.showDangerMessage(data.message);
+      } else {
+        $scope.showDangerMessage("Unable to save post!");
+      }
     });
   };
 
@@ -24342,6 +24433,51 @@ angular.module('Admin', ["ngRoute", "ui.ace", "ui.bootstrap.datetimepicker"])
     }
   }
 
+  $scope.createPreviewLink = function() {
+    $http.post("/api/post/" + $routeParams.postId + "/preview").
+    success(function(data, status, headers, config) {
+      $scope.previewLink = data;
+    }).
+    error(function(data, status, headers, config) {
+      $scope.showDangerMessage("Unable to create a preview link!");
+    });
+  }
+
+  $scope.loadRevisions = function() {
+    $http.get("/api/post/" + $routeParams.postId + "/revisions").
+    success(function(data, status, headers, config) {
+      $scope.revisions = data;
+    });
+  }
+
+  $scope.showDiff = function(revision) {
+    $http.get("/api/revision/" + revision._id + "/diff").
+    success(function(data, status, headers, config) {
+      $scope.revisionDiff = data;
+    });
+  }
+
+  $scope.restore = function(revision) {
+    var msg = $scope.promptForUnsavedChanges()
+    if (msg && !confirm(msg)) return;
+    $http.post("/api/restore/" + revision._id).
+    success(function(data, status, headers, config) {
+      data.date = new Date(data.date)
+      $scope.article = data;
+      $scope.postIsDirty = false;
+      $scope.revisionDiff = "";
+      $scope.loadRevisions();
+      $scope.showSuccessMessage("Restored!");
+    }).
+    error(function(data, status, headers, config) {
+      if (data && data.message) {
+        $scope.showDangerMessage(data.message);
+      } else {
+        $scope.showDangerMessage("Unable to restore post!");
+      }
+    });
+  }
+
   $scope.deleteFile = function(file) {
     $.ajax({
       url: "/api/file/" + file,
@@ -24367,34 +24503,129 @@ angular.module('Admin', ["ngRoute", "ui.ace", "ui.bootstrap.datetimepicker"])
   $scope.params = $routeParams;
   $scope.email = ''
   $scope.password = ''
+  $scope.currentPassword = ''
 
-  $scope.saveEmail = function() {
-    $http.post('/api/settings', {'email':$scope.email}).
+  $scope.saveSettings = function(settings) {
+    settings.current_password = $scope.currentPassword;
+    $http.post('/api/settings', settings).
     success(function(data, status, headers, config) {
-      console.log('saved!');
+      $scope.currentPassword = '';
+      $scope.settingsError = '';
     }).
     error(function(data, status, headers, config) {
-      console.log('error!');
+      if (status == 429) {
+        $scope.settingsError = "Too many wrong passwords. Try again later.";
+      } else {
+        $scope.settingsError = data;
+      }
     });
   }
 
+  $scope.saveEmail = function() {
+    $scope.saveSettings({'email':$scope.email});
+  }
+
   $scope.savePassword = function() {
-    $http.post('/api/settings', {'password':$scope.password}).
+    $scope.saveSettings({'password':$scope.password});
+  }
+
+  $scope.loadSettings = function() {
+    $http.get("/api/settings").
     success(function(data, status, headers, config) {
-      console.log('saved!');
+      $scope.email = data.email;
+      $scope.totpEnabled = data.totp_enabled;
+      $scope.recoveryCodesLeft = data.recovery_codes_left;
     }).
     error(function(data, status, headers, config) {
-      console.log('error!');
+      console.log("Error: failed to load data!");
     });
   }
 
-  $http.get("/api/settings").
+  $scope.totpFailed = function(data, status) {
+    if (status == 429) {
+      $scope.totpError = "Too many wrong passwords. Try again later.";
+    } else {
+      $scope.totpError = data;
+    }
+  }
+
+  $scope.startTotp = function() {
+    $http.post("/api/totp", {password: $scope.totpPassword}).
     success(function(data, status, headers, config) {
-      $scope.email = data.email;
+      $scope.totpPassword = "";
+      $scope.totpError = "";
+      $scope.recoveryCodes = null;
+      $scope.totpEnrollment = data;
     }).
     error(function(data, status, headers, config) {
-      console.log("Error: failed to load data!");
+      $scope.totpFailed(data, status);
+    });
+  }
+
+  $scope.enableTotp = function() {
+    $http.post("/api/totp/enable", {code: $scope.totpCode}).
+    success(function(data, status, headers, config) {
+      $scope.totpCode = "";
+      $scope.totpError = "";
+      $scope.totpEnrollment = null;
+      $scope.recoveryCodes = data.recovery_codes;
+      $scope.loadSettings();
+    }).
+    error(function(data, status, headers, config) {
+      $scope.totpFailed(data, status);
+    });
+  }
+
+  $scope.newRecoveryCodes = function() {
+    $http.post("/api/totp/recovery", {password: $scope.totpPassword}).
+    success(function(data, status, headers, config) {
+      $scope.totpPassword = "";
+      $scope.totpError = "";
+      $scope.recoveryCodes = data.recovery_codes;
+      $scope.loadSettings();
+    }).
+    error(function(data, status, headers, config) {
+      $scope.totpFailed(data, status);
+    });
+  }
+
+  $scope.disableTotp = function() {
+    if (!confirm("Are you sure you want to turn off two-factor authentication?")) return;
+    $http.post("/api/totp/disable", {password: $scope.totpPassword}).
+    success(function(data, status, headers, config) {
+      $scope.totpPassword = "";
+      $scope.totpError = "";
+      $scope.recoveryCodes = null;
+      $scope.loadSettings();
+    }).
+    error(function(data, status, headers, config) {
+      $scope.totpFailed(data, status);
+    });
+  }
+
+  $scope.loadLockouts = function() {
+    $http.get("/api/lockouts").
+    success(function(data, status, headers, config) {
+      $scope.lockouts = data;
     });
+  }
+
+  $scope.clearLockout = function(lockout) {
+    $http.delete("/api/lockout/" + encodeURIComponent(lockout.key)).
+    success(function(data, status, headers, config) {
+      $scope.loadLockouts();
+    });
+  }
+
+  $scope.clearLockouts = function() {
+    $http.delete("/api/lockouts").
+    success(function(data, status, headers, config) {
+      $scope.loadLockouts();
+    });
+  }
+
+  $scope.loadSettings();
+  $scope.loadLockouts();
 
 })
 